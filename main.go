@@ -9,8 +9,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/bruce-qin/EasyGoLib/db"
-
 	"github.com/MeloQi/service"
 	"github.com/bruce-qin/EasyDarwin/models"
 	"github.com/bruce-qin/EasyDarwin/routers"
@@ -35,6 +33,12 @@ type program struct {
 	httpVideoStreamServer *http.Server
 	rtspPort              int
 	rtspServer            *rtsp.Server
+	EnableRTMP            bool
+	rtmpPort              int
+	rtmpServer            *rtsp.RTMPServer
+	EnableWebRTC          bool
+	webrtcPort            int
+	webrtcServer          *rtsp.WebRTCServer
 }
 
 func (p *program) StopHTTP() (err error) {
@@ -138,6 +142,9 @@ func (p *program) StartRTSP() (err error) {
 	}
 	link := fmt.Sprintf("rtsp://%s%s", utils.LocalIP(), sport)
 	log.Println("rtsp server start -->", link)
+	if p.rtspServer.EnableRTSPS {
+		log.Println("rtsps server start -->", fmt.Sprintf("rtsps://%s:%d", utils.LocalIP(), p.rtspServer.RTSPSPort))
+	}
 	go func() {
 		if err := p.rtspServer.Start(); err != nil {
 			log.Println("start rtsp server error", err)
@@ -156,6 +163,55 @@ func (p *program) StopRTSP() (err error) {
 	return
 }
 
+func (p *program) StartRTMP() (err error) {
+	if p.rtmpServer == nil {
+		err = fmt.Errorf("RTMP Server Not Found")
+		return
+	}
+	link := fmt.Sprintf("rtmp://%s:%d", utils.LocalIP(), p.rtmpPort)
+	log.Println("rtmp server start -->", link)
+	go func() {
+		if err := p.rtmpServer.Start(); err != nil {
+			log.Println("start rtmp server error", err)
+		}
+		log.Println("rtmp server end")
+	}()
+	return
+}
+
+func (p *program) StopRTMP() (err error) {
+	if p.rtmpServer == nil {
+		err = fmt.Errorf("RTMP Server Not Found")
+		return
+	}
+	p.rtmpServer.Stop()
+	return
+}
+
+func (p *program) StartWebRTC() (err error) {
+	if p.webrtcServer == nil {
+		err = fmt.Errorf("WebRTC Server Not Found")
+		return
+	}
+	log.Println("webrtc server start --> udp", p.webrtcPort)
+	go func() {
+		if err := p.webrtcServer.Start(); err != nil {
+			log.Println("start webrtc server error", err)
+		}
+		log.Println("webrtc server end")
+	}()
+	return
+}
+
+func (p *program) StopWebRTC() (err error) {
+	if p.webrtcServer == nil {
+		err = fmt.Errorf("WebRTC Server Not Found")
+		return
+	}
+	p.webrtcServer.Stop()
+	return
+}
+
 func (p *program) Start(s service.Service) (err error) {
 	log.Println("********** START **********")
 	if utils.IsPortInUse(p.httpPort) {
@@ -166,6 +222,14 @@ func (p *program) Start(s service.Service) (err error) {
 		err = fmt.Errorf("RTSP port[%d] In Use", p.rtspPort)
 		return
 	}
+	if p.rtspServer.EnableRTSPS && utils.IsPortInUse(p.rtspServer.RTSPSPort) {
+		err = fmt.Errorf("RTSPS port[%d] In Use", p.rtspServer.RTSPSPort)
+		return
+	}
+	if p.EnableRTMP && utils.IsPortInUse(p.rtmpPort) {
+		err = fmt.Errorf("RTMP port[%d] In Use", p.rtmpPort)
+		return
+	}
 	err = models.Init()
 	if err != nil {
 		return
@@ -176,6 +240,12 @@ func (p *program) Start(s service.Service) (err error) {
 	}
 	p.StartRTSP()
 	p.StartHTTP()
+	if p.EnableRTMP {
+		p.StartRTMP()
+	}
+	if p.EnableWebRTC {
+		p.StartWebRTC()
+	}
 	if p.EnableHttpAudioStream {
 		err = rtsp.InitMp3Stream()
 		if err != nil {
@@ -194,10 +264,21 @@ func (p *program) Start(s service.Service) (err error) {
 		log.Println("log files -->", utils.LogDir())
 		log.SetOutput(utils.GetLogWriter())
 	}
+	agent := fmt.Sprintf("EasyDarwinGo/%s", routers.BuildVersion)
+	if routers.BuildDateTime != "" {
+		agent = fmt.Sprintf("%s(%s)", agent, routers.BuildDateTime)
+	}
 	go func() {
 		for range routers.API.RestartChan {
+			rtsp.GetServer().StreamSupervisor().Stop()
 			p.StopHTTP()
 			p.StopRTSP()
+			if p.EnableRTMP {
+				p.StopRTMP()
+			}
+			if p.EnableWebRTC {
+				p.StopWebRTC()
+			}
 			if p.EnableHttpAudioStream {
 				p.StopHttpAudioStream()
 			}
@@ -207,61 +288,42 @@ func (p *program) Start(s service.Service) (err error) {
 			utils.ReloadConf()
 			p.StartRTSP()
 			p.StartHTTP()
+			if p.EnableRTMP {
+				p.StartRTMP()
+			}
+			if p.EnableWebRTC {
+				p.StartWebRTC()
+			}
 			if p.EnableHttpAudioStream {
 				p.StartHttpAudioStream()
 			}
 			if p.EnableHttpVideoStream {
 				p.StartHttpVideoStream()
 			}
-		}
-	}()
-
-	go func() {
-		log.Printf("demon pull streams")
-		rtspServer := rtsp.GetServer()
-		for {
-			var streams []models.Stream
-			db.SQLite.Find(&streams)
-			if err := db.SQLite.Find(&streams).Error; err != nil {
-				log.Printf("find stream err:%v", err)
-				return
-			}
-			for i := len(streams) - 1; i > -1; i-- {
-				v := streams[i]
-				if rtspServer.GetPusher(v.CustomPath) != nil {
-					continue
-				}
-				agent := fmt.Sprintf("EasyDarwinGo/%s", routers.BuildVersion)
-				if routers.BuildDateTime != "" {
-					agent = fmt.Sprintf("%s(%s)", agent, routers.BuildDateTime)
-				}
-				client, err := rtsp.NewRTSPClient(rtspServer, v.URL, int64(v.HeartbeatInterval)*1000, agent)
-				if err != nil {
-					continue
-				}
-				client.CustomPath = v.CustomPath
-
-				err = client.Start(time.Duration(v.IdleTimeout) * time.Second)
-				if err != nil {
-					log.Printf("Pull stream err :%v", err)
-					continue
-				}
-				pusher := rtsp.NewClientPusher(client)
-				rtspServer.AddPusher(pusher)
-				//streams = streams[0:i]
-				//streams = append(streams[:i], streams[i+1:]...)
+			if err := rtsp.GetServer().StreamSupervisor().Start(agent); err != nil {
+				log.Printf("start pull streams err:%v", err)
 			}
-			time.Sleep(10 * time.Second)
 		}
 	}()
+
+	if err := rtsp.GetServer().StreamSupervisor().Start(agent); err != nil {
+		log.Printf("start pull streams err:%v", err)
+	}
 	return
 }
 
 func (p *program) Stop(s service.Service) (err error) {
 	defer log.Println("********** STOP **********")
 	defer utils.CloseLogWriter()
+	rtsp.GetServer().StreamSupervisor().Stop()
 	p.StopHTTP()
 	p.StopRTSP()
+	if p.EnableRTMP {
+		p.StopRTMP()
+	}
+	if p.EnableWebRTC {
+		p.StopWebRTC()
+	}
 	p.StopHttpAudioStream()
 	models.Close()
 	return
@@ -298,6 +360,16 @@ func main() {
 		httpVideoStreamPort:   rtspServer.HttpVideoStreamPort,
 		rtspPort:              rtspServer.TCPPort,
 		rtspServer:            rtspServer,
+		EnableRTMP:            rtspServer.EnableRTMP,
+		rtmpPort:              rtspServer.RTMPPort,
+		EnableWebRTC:          rtspServer.EnableWebRTC,
+		webrtcPort:            rtspServer.WebRTCPort,
+	}
+	if p.EnableRTMP {
+		p.rtmpServer = rtsp.NewRTMPServer(rtspServer)
+	}
+	if p.EnableWebRTC {
+		p.webrtcServer = rtsp.NewWebRTCServer(rtspServer)
 	}
 	s, err := service.New(p, svcConfig)
 	if err != nil {
@@ -0,0 +1,16 @@
+package models
+
+//录像文件索引，录像文件关闭时写入
+type Record struct {
+	//相对m3u8_dir_path的路径，如/live/test/20060102/20060102150405000.mp4
+	Path       string `gorm:"type:varchar(512);primary_key;unique"`
+	StreamPath string `gorm:"type:varchar(256);index"`
+	//UTC毫秒
+	StartTime int64 `gorm:"index"`
+	EndTime   int64 `gorm:"index"`
+	//毫秒
+	Duration   int64
+	Size       int64
+	VideoCodec string `gorm:"type:varchar(32)"`
+	AudioCodec string `gorm:"type:varchar(32)"`
+}
@@ -0,0 +1,7 @@
+package models
+
+//单路流的录像开关，存在时优先于全局save_stream_to_local
+type RecordSetting struct {
+	StreamPath string `gorm:"type:varchar(256);primary_key;unique"`
+	Enabled    bool
+}
@@ -3,6 +3,10 @@ package models
 type Stream struct {
 	URL               string `gorm:"type:varchar(256);primary_key;unique"`
 	CustomPath        string `gorm:"type:varchar(256)"`
+	Username          string `gorm:"type:varchar(128)"` //为空时使用URL中的用户名密码
+	Password          string `gorm:"type:varchar(128)"`
+	TransType         string `gorm:"type:varchar(8)"` //TCP/UDP，为空时使用TCP
 	IdleTimeout       int
 	HeartbeatInterval int
+	OnDemand          bool //为true时有播放请求才拉流
 }
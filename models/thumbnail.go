@@ -0,0 +1,10 @@
+package models
+
+//录像时定时截取的缩略图索引
+type Thumbnail struct {
+	//相对m3u8_dir_path的路径，如/live/test/20060102/20060102150405.jpg
+	Path       string `gorm:"type:varchar(512);primary_key;unique"`
+	StreamPath string `gorm:"type:varchar(256);index"`
+	//UTC毫秒
+	Time int64 `gorm:"index"`
+}
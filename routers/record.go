@@ -1,17 +1,18 @@
 package routers
 
 import (
-	"bytes"
+	"fmt"
 	"log"
 	"math"
+	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyDarwin/rtsp"
+	"github.com/bruce-qin/EasyGoLib/db"
 	"github.com/bruce-qin/EasyGoLib/utils"
 	"github.com/gin-gonic/gin"
 )
@@ -83,7 +84,9 @@ func (h *APIHandler) RecordFolders(c *gin.Context) {
  * @api {get} /api/v1/record/files 获取所有录像文件
  * @apiGroup record
  * @apiName RecordFiles
- * @apiParam {Number} folder 录像文件所在的文件夹
+ * @apiParam {String} folder 录像文件所在的文件夹
+ * @apiParam {Number} [beginUTCSecond] 开始时间，UTC秒，返回结束时间不早于该时间的录像
+ * @apiParam {Number} [endUTCSecond] 结束时间，UTC秒，返回开始时间不晚于该时间的录像
  * @apiParam {Number} [start] 分页开始,从零开始
  * @apiParam {Number} [limit] 分页大小
  * @apiParam {String} [sort] 排序字段
@@ -93,14 +96,23 @@ func (h *APIHandler) RecordFolders(c *gin.Context) {
  * @apiSuccess (200) {Array} rows 文件列表
  * @apiSuccess (200) {String} rows.duration	格式化好的录像时长
  * @apiSuccess (200) {Number} rows.durationMillis	录像时长，毫秒为单位
- * @apiSuccess (200) {String} rows.path 录像文件的相对路径,录像文件为m3u8格式，将其放到video标签中便可直接播放。其绝对路径为：http[s]://host:port/record/[path]。
+ * @apiSuccess (200) {String} rows.path 录像文件的相对路径,录像文件为fmp4格式，将其放到video标签中便可直接播放。其绝对路径为：http[s]://host:port/record/[path]。
+ * @apiSuccess (200) {String} rows.streamPath 推流路径
+ * @apiSuccess (200) {Number} rows.beginUTCSecond 录像开始时间，UTC秒
+ * @apiSuccess (200) {Number} rows.endUTCSecond 录像结束时间，UTC秒
+ * @apiSuccess (200) {Number} rows.size 文件大小，字节
+ * @apiSuccess (200) {String} rows.videoCodec 视频编码
+ * @apiSuccess (200) {String} rows.audioCodec 音频编码
+ * @apiSuccess (200) {Array} rows.thumbnails 录像期间截取的缩略图，需配置record_thumbnail_second
+ * @apiSuccess (200) {String} rows.thumbnails.path 缩略图的相对路径，其绝对路径为：http[s]://host:port/record/[path]
+ * @apiSuccess (200) {Number} rows.thumbnails.utcSecond 截图时间，UTC秒
  */
 func (h *APIHandler) RecordFiles(c *gin.Context) {
 	type Form struct {
 		utils.PageForm
 		Folder  string `form:"folder" binding:"required"`
-		StartAt int    `form:"beginUTCSecond"`
-		StopAt  int    `form:"endUTCSecond"`
+		StartAt int64  `form:"beginUTCSecond"`
+		StopAt  int64  `form:"endUTCSecond"`
 	}
 	var form = Form{}
 	form.Limit = math.MaxUint32
@@ -110,73 +122,53 @@ func (h *APIHandler) RecordFiles(c *gin.Context) {
 		return
 	}
 
-	files := make([]interface{}, 0)
-	mp4Path := utils.Conf().Section("rtsp").Key("m3u8_dir_path").MustString("")
-	if mp4Path != "" {
-		ffmpeg_path := utils.Conf().Section("rtsp").Key("ffmpeg_path").MustString("")
-		ffmpeg_folder, executable := filepath.Split(ffmpeg_path)
-		split := strings.Split(executable, ".")
-		suffix := ""
-		if len(split) > 1 {
-			suffix = split[1]
+	//录像索引在录像文件关闭时写入
+	folder := "/" + strings.Trim(filepath.ToSlash(form.Folder), "/")
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.TrimRight(folder, "/"))
+	query := db.SQLite.Model(models.Record{}).Where(`path LIKE ? ESCAPE '\'`, prefix+"/%")
+	if form.StartAt > 0 {
+		query = query.Where("end_time >= ?", form.StartAt*1000)
+	}
+	if form.StopAt > 0 {
+		query = query.Where("start_time <= ?", form.StopAt*1000)
+	}
+	var records []models.Record
+	if err = query.Order("start_time").Find(&records).Error; err != nil {
+		log.Printf("Query RecordFiles err:%v", err)
+	}
+	//录像期间截取的缩略图，按时间归入对应的录像
+	var thumbnails []models.Thumbnail
+	if len(records) > 0 {
+		if err = db.SQLite.Model(models.Thumbnail{}).Where(`path LIKE ? ESCAPE '\' AND time >= ? AND time <= ?`, prefix+"/%",
+			records[0].StartTime, records[len(records)-1].EndTime).Order("time").Find(&thumbnails).Error; err != nil {
+			log.Printf("Query record thumbnails err:%v", err)
 		}
-		ffprobe := ffmpeg_folder + "ffprobe" + suffix
-		folder := filepath.Join(mp4Path, form.Folder)
-		visit := func(files *[]interface{}) filepath.WalkFunc {
-			return func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if path == folder {
-					return nil
-				}
-				if info.IsDir() {
-					return nil
-				}
-				if info.Size() == 0 {
-					return nil
-				}
-				if info.Name() == ".DS_Store" {
-					return nil
-				}
-				if !strings.HasSuffix(strings.ToLower(info.Name()), ".m3u8") && !strings.HasSuffix(strings.ToLower(info.Name()), ".ts") {
-					return nil
-				}
-				cmd := exec.Command(ffprobe, "-i", path)
-				cmdOutput := &bytes.Buffer{}
-				//cmd.Stdout = cmdOutput
-				cmd.Stderr = cmdOutput
-				err = cmd.Run()
-				bytes := cmdOutput.Bytes()
-				output := string(bytes)
-				//log.Printf("%v result:%v", cmd, output)
-				var average = regexp.MustCompile(`Duration: ((\d+):(\d+):(\d+).(\d+))`)
-				result := average.FindStringSubmatch(output)
-				duration := time.Duration(0)
-				durationStr := ""
-				if len(result) > 0 {
-					durationStr = result[1]
-					h, _ := strconv.Atoi(result[2])
-					duration += time.Duration(h) * time.Hour
-					m, _ := strconv.Atoi(result[3])
-					duration += time.Duration(m) * time.Minute
-					s, _ := strconv.Atoi(result[4])
-					duration += time.Duration(s) * time.Second
-					millis, _ := strconv.Atoi(result[5])
-					duration += time.Duration(millis) * time.Millisecond
-				}
-
-				*files = append(*files, map[string]interface{}{
-					"path":           path[len(mp4Path):],
-					"durationMillis": duration / time.Millisecond,
-					"duration":       durationStr})
-				return nil
+	}
+	files := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		duration := time.Duration(record.Duration) * time.Millisecond
+		recordThumbnails := make([]interface{}, 0)
+		for _, thumbnail := range thumbnails {
+			if thumbnail.StreamPath == record.StreamPath && thumbnail.Time >= record.StartTime && thumbnail.Time <= record.EndTime {
+				recordThumbnails = append(recordThumbnails, map[string]interface{}{
+					"path":      thumbnail.Path,
+					"utcSecond": thumbnail.Time / 1000,
+				})
 			}
 		}
-		err = filepath.Walk(folder, visit(&files))
-		if err != nil {
-			log.Printf("Query RecordFolders err:%v", err)
-		}
+		files = append(files, map[string]interface{}{
+			"thumbnails":     recordThumbnails,
+			"path":           record.Path,
+			"streamPath":     record.StreamPath,
+			"beginUTCSecond": record.StartTime / 1000,
+			"endUTCSecond":   record.EndTime / 1000,
+			"size":           record.Size,
+			"videoCodec":     record.VideoCodec,
+			"audioCodec":     record.AudioCodec,
+			"durationMillis": record.Duration,
+			"duration": fmt.Sprintf("%02d:%02d:%02d.%02d", int(duration.Hours()), int(duration.Minutes())%60,
+				int(duration.Seconds())%60, duration.Milliseconds()%1000/10),
+		})
 	}
 
 	pr := utils.NewPageResult(files)
@@ -186,3 +178,118 @@ func (h *APIHandler) RecordFiles(c *gin.Context) {
 	pr.Slice(form.Start, form.Limit)
 	c.IndentedJSON(200, pr)
 }
+
+/**
+ * @api {get} /api/v1/record/start 开始录像
+ * @apiGroup record
+ * @apiName RecordStart
+ * @apiDescription 保存该路流的录像开关，流在线时立即开始录像，之后推流时也会自动录像
+ * @apiParam {String} path 推流路径
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) RecordStart(c *gin.Context) {
+	h.setRecordEnabled(c, true)
+}
+
+/**
+ * @api {get} /api/v1/record/stop 停止录像
+ * @apiGroup record
+ * @apiName RecordStop
+ * @apiDescription 保存该路流的录像开关，流在线时立即停止录像，之后推流时不再录像
+ * @apiParam {String} path 推流路径
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) RecordStop(c *gin.Context) {
+	h.setRecordEnabled(c, false)
+}
+
+func (h *APIHandler) setRecordEnabled(c *gin.Context, enabled bool) {
+	type Form struct {
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		log.Printf("record start/stop bind err:%v", err)
+		return
+	}
+	streamPath := "/" + strings.Trim(form.Path, "/")
+	if err := rtsp.GetServer().SetRecordEnabled(streamPath, enabled); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("set record[%s] enabled:%v", streamPath, enabled)
+	c.IndentedJSON(http.StatusOK, "OK")
+}
+
+/**
+ * @api {get} /api/v1/record/export 导出录像片段
+ * @apiGroup record
+ * @apiName RecordExport
+ * @apiDescription 将时间范围内的录像文件转封装(不转码)为一个fmp4文件下载，边生成边输出。视频从开始时间之前最近的关键帧开始
+ * @apiParam {String} path 推流路径
+ * @apiParam {Number} start 开始时间，UTC秒
+ * @apiParam {Number} end 结束时间，UTC秒
+ * @apiSuccess (200) {File} file mp4文件
+ */
+func (h *APIHandler) RecordExport(c *gin.Context) {
+	type Form struct {
+		Path  string `form:"path" binding:"required"`
+		Start int64  `form:"start" binding:"required"`
+		End   int64  `form:"end" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		log.Printf("record export bind err:%v", err)
+		return
+	}
+	if form.End <= form.Start {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "end must be after start")
+		return
+	}
+	streamPath := "/" + strings.Trim(form.Path, "/")
+	begin, end := time.Unix(form.Start, 0), time.Unix(form.End, 0)
+	exporter, err := rtsp.NewRecordExporter(streamPath, begin, end)
+	if err == rtsp.ErrRecordNotFound {
+		c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer exporter.Close()
+	name := strings.ReplaceAll(strings.Trim(streamPath, "/"), "/", "_")
+	c.Header("Content-Type", "video/mp4")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%s_%s.mp4"`, name, begin.Format("20060102150405"), end.Format("20060102150405")))
+	c.Status(http.StatusOK)
+	if err = exporter.Export(c.Writer, c.Writer.Flush); err != nil {
+		log.Printf("record export[%s] err:%v", streamPath, err)
+	}
+}
+
+/**
+ * @api {get} /api/v1/record/trigger 事件触发录像
+ * @apiGroup record
+ * @apiName RecordTrigger
+ * @apiDescription 开始录像并包含record_preroll_second秒的预录数据，postRoll秒内没有再次触发则停止，再次触发时顺延。
+ * 也支持POST(表单或json)，可直接作为外部告警系统的webhook地址。该路流已在持续录像时不做处理
+ * @apiParam {String} path 推流路径
+ * @apiParam {Number} [postRoll] 事件结束后继续录像的秒数，默认为record_postroll_second
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) RecordTrigger(c *gin.Context) {
+	type Form struct {
+		Path     string `form:"path" json:"path" binding:"required"`
+		PostRoll int    `form:"postRoll" json:"postRoll"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		log.Printf("record trigger bind err:%v", err)
+		return
+	}
+	streamPath := "/" + strings.Trim(form.Path, "/")
+	if err := rtsp.GetServer().TriggerRecord(streamPath, time.Duration(form.PostRoll)*time.Second); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.IndentedJSON(http.StatusOK, "OK")
+}
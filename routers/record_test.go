@@ -0,0 +1,105 @@
+package routers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+func newTestRecordDB(t *testing.T, records []models.Record, thumbnails []models.Thumbnail) {
+	old := db.SQLite
+	sqlite, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite.DB().SetMaxOpenConns(1)
+	sqlite.AutoMigrate(models.Record{}, models.Thumbnail{})
+	db.SQLite = sqlite
+	t.Cleanup(func() {
+		sqlite.Close()
+		db.SQLite = old
+	})
+	for _, record := range records {
+		if err = sqlite.Create(&record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, thumbnail := range thumbnails {
+		if err = sqlite.Create(&thumbnail).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordFiles(t *testing.T) {
+	newTestRecordDB(t, []models.Record{
+		{Path: "/live/a/20240101/1.mp4", StreamPath: "/live/a", StartTime: 100000, EndTime: 160000, Duration: 60000},
+		{Path: "/live/a/20240101/2.mp4", StreamPath: "/live/a", StartTime: 160000, EndTime: 220000, Duration: 60000},
+		{Path: "/live/a/20240101/3.mp4", StreamPath: "/live/a", StartTime: 220000, EndTime: 280000, Duration: 60000},
+		//路径前缀相同但不是同一文件夹
+		{Path: "/live/ab/20240101/1.mp4", StreamPath: "/live/ab", StartTime: 100000, EndTime: 160000, Duration: 60000},
+	}, []models.Thumbnail{
+		{Path: "/live/a/20240101/thumbnail/1.jpg", StreamPath: "/live/a", Time: 170000},
+	})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/v1/record/files", API.RecordFiles)
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"all", "folder=live/a", []string{"/live/a/20240101/1.mp4", "/live/a/20240101/2.mp4", "/live/a/20240101/3.mp4"}},
+		//与时间段有交集的录像
+		{"time range", "folder=/live/a/&beginUTCSecond=170&endUTCSecond=220", []string{"/live/a/20240101/2.mp4", "/live/a/20240101/3.mp4"}},
+		{"begin only", "folder=live/a&beginUTCSecond=221", []string{"/live/a/20240101/3.mp4"}},
+		{"like wildcard", "folder=live/a_", nil},
+		{"no match", "folder=live/a&endUTCSecond=99", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/record/files?"+test.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			var result struct {
+				Total int
+				Rows  []struct {
+					Path       string
+					Duration   string
+					Thumbnails []struct {
+						Path      string
+						UTCSecond int64
+					}
+				}
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Total != len(test.want) || len(result.Rows) != len(test.want) {
+				t.Fatalf("result = %s", w.Body.String())
+			}
+			for i, row := range result.Rows {
+				if row.Path != test.want[i] || row.Duration != "00:01:00.00" {
+					t.Fatalf("row %d = %+v", i, row)
+				}
+				if thumbnails := row.Thumbnails; (row.Path == "/live/a/20240101/2.mp4") != (len(thumbnails) == 1) {
+					t.Fatalf("row %d thumbnails = %+v", i, thumbnails)
+				}
+			}
+		})
+	}
+	//folder必填
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/record/files", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d", w.Code)
+	}
+}
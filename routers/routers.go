@@ -11,6 +11,7 @@ import (
 	"github.com/bruce-qin/EasyGoLib/db"
 
 	"github.com/MeloQi/sessions"
+	"github.com/bruce-qin/EasyDarwin/rtsp"
 	"github.com/bruce-qin/EasyGoLib/utils"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/pprof"
@@ -59,6 +60,7 @@ func init() {
 	mime.AddExtensionType(".m3u8", "application/vnd.apple.mpegurl")
 	// mime.AddExtensionType(".m3u8", "application/x-mpegurl")
 	mime.AddExtensionType(".ts", "video/mp2t")
+	mime.AddExtensionType(".mp4", "video/mp4")
 	// prevent on Windows with Dreamware installed, modified registry .css -> application/x-css
 	// see https://stackoverflow.com/questions/22839278/python-built-in-server-not-loading-css
 	mime.AddExtensionType(".css", "text/css; charset=utf-8")
@@ -112,7 +114,8 @@ func Init() (err error) {
 	Router.Use(Errors())
 	Router.Use(cors.New(cors.Config{
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
+		ExposeHeaders:    []string{"Location"},
 		AllowCredentials: true,
 		AllowAllOrigins:  true,
 		MaxAge:           12 * time.Hour,
@@ -125,6 +128,11 @@ func Init() (err error) {
 	store.Options(sessions.Options{HttpOnly: true, MaxAge: tokenTimeout, Path: "/"})
 	sessionHandle := sessions.Sessions("token", store)
 
+	{
+		//rtsp over http隧道，需在静态文件之前处理
+		Router.Use(rtsp.RTSPHTTPTunnelGinHandler{}.ProcessTunnel)
+	}
+
 	{
 		wwwDir := filepath.Join(utils.DataDir(), "www")
 		Router.Use(static.Serve("/", static.LocalFile(wwwDir, true)))
@@ -142,12 +150,33 @@ func Init() (err error) {
 
 		api.GET("/pushers", API.Pushers)
 		api.GET("/players", API.Players)
+		api.GET("/snapshot", API.Snapshot)
 
 		api.GET("/stream/start", API.StreamStart)
 		api.GET("/stream/stop", API.StreamStop)
+		api.GET("/streams", API.Streams)
 
 		api.GET("/record/folders", API.RecordFolders)
 		api.GET("/record/files", API.RecordFiles)
+		api.GET("/record/start", API.RecordStart)
+		api.GET("/record/stop", API.RecordStop)
+		api.GET("/record/export", API.RecordExport)
+		api.GET("/record/trigger", API.RecordTrigger)
+		api.POST("/record/trigger", API.RecordTrigger)
+	}
+
+	{
+		whep := rtsp.WHEPGinHandler{}
+		Router.POST(rtsp.WHEP_URL_PREFIX+"/*path", whep.ProcessOffer)
+		Router.PATCH(rtsp.WHEP_URL_PREFIX+"/*path", whep.ProcessPatch)
+		Router.DELETE(rtsp.WHEP_URL_PREFIX+"/*path", whep.ProcessDelete)
+	}
+
+	{
+		whip := rtsp.WHIPGinHandler{}
+		Router.POST(rtsp.WHIP_URL_PREFIX+"/*path", whip.ProcessOffer)
+		Router.PATCH(rtsp.WHIP_URL_PREFIX+"/*path", whip.ProcessPatch)
+		Router.DELETE(rtsp.WHIP_URL_PREFIX+"/*path", whip.ProcessDelete)
 	}
 
 	{
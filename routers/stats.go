@@ -2,6 +2,9 @@ package routers
 
 import (
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/bruce-qin/EasyDarwin/rtsp"
@@ -41,6 +44,11 @@ import (
  * @apiSuccess (200) {Number} rows.outBytes 出口流量
  * @apiSuccess (200) {String} rows.startAt 开始时间
  * @apiSuccess (200) {Number} rows.onlines 在线人数
+ * @apiSuccess (200) {Boolean} rows.recording 是否正在录像
+ * @apiSuccess (200) {String} rows.snapshotURL 截图地址
+ * @apiSuccess (200) {Boolean} rows.reconnecting 拉流是否正在断线重连
+ * @apiSuccess (200) {Number} rows.reconnectCount 拉流重连次数
+ * @apiSuccess (200) {String} rows.lastError 拉流最近一次错误
  */
 func (h *APIHandler) Pushers(c *gin.Context) {
 	form := utils.NewPageForm()
@@ -58,16 +66,22 @@ func (h *APIHandler) Pushers(c *gin.Context) {
 		if form.Q != "" && !strings.Contains(strings.ToLower(rtsp), strings.ToLower(form.Q)) {
 			continue
 		}
+		reconnecting, reconnectCount, lastError := pusher.ReconnectInfo()
 		pushers = append(pushers, map[string]interface{}{
-			"id":        pusher.ID(),
-			"url":       rtsp,
-			"path":      pusher.Path(),
-			"source":    pusher.Source(),
-			"transType": pusher.TransType(),
-			"inBytes":   pusher.InBytes(),
-			"outBytes":  pusher.OutBytes(),
-			"startAt":   utils.DateTime(pusher.StartAt()),
-			"onlines":   len(pusher.GetPlayers()),
+			"id":             pusher.ID(),
+			"url":            rtsp,
+			"path":           pusher.Path(),
+			"source":         pusher.Source(),
+			"transType":      pusher.TransType(),
+			"inBytes":        pusher.InBytes(),
+			"outBytes":       pusher.OutBytes(),
+			"startAt":        utils.DateTime(pusher.StartAt()),
+			"onlines":        pusher.OnlineSize(),
+			"recording":      pusher.Recording(),
+			"snapshotURL":    "/api/v1/snapshot?path=" + url.QueryEscape(pusher.Path()),
+			"reconnecting":   reconnecting,
+			"reconnectCount": reconnectCount,
+			"lastError":      lastError,
 		})
 	}
 	pr := utils.NewPageResult(pushers)
@@ -95,6 +109,12 @@ func (h *APIHandler) Pushers(c *gin.Context) {
  * @apiSuccess (200) {Number} rows.inBytes 入口流量
  * @apiSuccess (200) {Number} rows.outBytes 出口流量
  * @apiSuccess (200) {String} rows.startAt 开始时间
+ * @apiSuccess (200) {Number} [rows.jitter] rtsp拉流端RR上报的抖动(毫秒)
+ * @apiSuccess (200) {Number} [rows.packetsLost] rtsp拉流端RR上报的累计丢包数
+ * @apiSuccess (200) {Number} [rows.lossRate] rtsp拉流端RR上报的丢包率(百分比)
+ * @apiSuccess (200) {Number} [rows.rtt] rtsp拉流端往返时延(毫秒)
+ * @apiSuccess (200) {Number} [rows.nacks] udp拉流端NACK请求重传的包数
+ * @apiSuccess (200) {Number} [rows.retransmits] udp拉流端实际重传的包数
  */
 func (h *APIHandler) Players(c *gin.Context) {
 	form := utils.NewPageForm()
@@ -116,15 +136,41 @@ func (h *APIHandler) Players(c *gin.Context) {
 		if port == 554 {
 			rtsp = fmt.Sprintf("rtsp://%s%s", hostname, player.Path)
 		}
+		stats := player.RTCPStats()
+		nacks, retransmits := player.RetransmitStats()
 		_players = append(_players, map[string]interface{}{
-			"id":        player.ID,
-			"path":      rtsp,
-			"transType": player.TransType.String(),
-			"inBytes":   player.InBytes,
-			"outBytes":  player.OutBytes,
-			"startAt":   utils.DateTime(player.StartAt),
+			"id":          player.ID,
+			"path":        rtsp,
+			"transType":   player.TransType.String(),
+			"inBytes":     player.InBytes,
+			"outBytes":    player.OutBytes,
+			"startAt":     utils.DateTime(player.StartAt),
+			"jitter":      stats.Jitter.Milliseconds(),
+			"packetsLost": stats.PacketsLost,
+			"lossRate":    stats.LossRate,
+			"rtt":         stats.RTT.Milliseconds(),
+			"nacks":       nacks,
+			"retransmits": retransmits,
 		})
 	}
+	//http-flv等其他协议拉流
+	for _, pusher := range rtsp.Instance.GetPushers() {
+		port := pusher.Server().TCPPort
+		for _, player := range pusher.GetMediaPlayers() {
+			rtsp := fmt.Sprintf("rtsp://%s:%d%s", hostname, port, player.Path())
+			if port == 554 {
+				rtsp = fmt.Sprintf("rtsp://%s%s", hostname, player.Path())
+			}
+			_players = append(_players, map[string]interface{}{
+				"id":        player.ID(),
+				"path":      rtsp,
+				"transType": player.TransType(),
+				"inBytes":   player.InBytes(),
+				"outBytes":  player.OutBytes(),
+				"startAt":   utils.DateTime(player.StartAt()),
+			})
+		}
+	}
 	pr := utils.NewPageResult(_players)
 	if form.Sort != "" {
 		pr.Sort(form.Sort, form.Order)
@@ -132,3 +178,35 @@ func (h *APIHandler) Players(c *gin.Context) {
 	pr.Slice(form.Start, form.Limit)
 	c.IndentedJSON(200, pr)
 }
+
+/**
+ * @api {get} /api/v1/snapshot 获取推流截图
+ * @apiGroup stats
+ * @apiName Snapshot
+ * @apiDescription 将推流gop缓存中最新的关键帧解码为jpeg返回，结果缓存snapshot_cache_second秒。需开启gop_cache_enable，默认使用ffmpeg解码
+ * @apiParam {String} path 推流路径
+ * @apiSuccess (200) {File} image jpeg图片
+ */
+func (h *APIHandler) Snapshot(c *gin.Context) {
+	type Form struct {
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	streamPath := "/" + strings.Trim(form.Path, "/")
+	jpeg, err := rtsp.GetServer().Snapshot(streamPath)
+	switch err {
+	case nil:
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "image/jpeg", jpeg)
+	case rtsp.ErrPusherNotFound, rtsp.ErrKeyFrameNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+	case rtsp.ErrSnapshotNotSupport:
+		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("snapshot[%s] err:%v", streamPath, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/bruce-qin/EasyDarwin/models"
-	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/bruce-qin/EasyGoLib/utils"
 
 	"github.com/bruce-qin/EasyDarwin/rtsp"
 	"github.com/gin-gonic/gin"
@@ -24,18 +23,24 @@ import (
  * @apiName StreamStart
  * @apiParam {String} url RTSP源地址
  * @apiParam {String} [customPath] 转推时的推送PATH
+ * @apiParam {String} [username] RTSP源用户名，为空时使用url中的用户名密码
+ * @apiParam {String} [password] RTSP源密码
  * @apiParam {String=TCP,UDP} [transType=TCP] 拉流传输模式
  * @apiParam {Number} [idleTimeout] 拉流时的超时时间
  * @apiParam {Number} [heartbeatInterval] 拉流时的心跳间隔，毫秒为单位。如果心跳间隔不为0，那拉流时会向源地址以该间隔发送OPTION请求用来心跳保活
+ * @apiParam {Boolean} [onDemand=false] 是否按需拉流。为true时不立即拉流，有播放请求时才拉流，最后一个播放者离开pull_on_demand_linger_second秒后停止
  * @apiSuccess (200) {String} ID	拉流的ID。后续可以通过该ID来停止拉流
  */
 func (h *APIHandler) StreamStart(c *gin.Context) {
 	type Form struct {
 		URL               string `form:"url" binding:"required"`
 		CustomPath        string `form:"customPath"`
+		Username          string `form:"username"`
+		Password          string `form:"password"`
 		TransType         string `form:"transType"`
 		IdleTimeout       int    `form:"idleTimeout"`
 		HeartbeatInterval int    `form:"heartbeatInterval"`
+		OnDemand          bool   `form:"onDemand"`
 	}
 	var form Form
 	err := c.Bind(&form)
@@ -43,54 +48,24 @@ func (h *APIHandler) StreamStart(c *gin.Context) {
 		log.Printf("Pull to push err:%v", err)
 		return
 	}
-	agent := fmt.Sprintf("EasyDarwinGo/%s", BuildVersion)
-	if BuildDateTime != "" {
-		agent = fmt.Sprintf("%s(%s)", agent, BuildDateTime)
-	}
-	client, err := rtsp.NewRTSPClient(rtsp.GetServer(), form.URL, int64(form.HeartbeatInterval)*1000, agent)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
-		return
-	}
-	if form.CustomPath != "" && !strings.HasPrefix(form.CustomPath, "/") {
-		form.CustomPath = "/" + form.CustomPath
-	}
-	client.CustomPath = form.CustomPath
-	switch strings.ToLower(form.TransType) {
-	case "udp":
-		client.TransType = rtsp.TRANS_TYPE_UDP
-	case "tcp":
-		fallthrough
-	default:
-		client.TransType = rtsp.TRANS_TYPE_TCP
-	}
-
-	pusher := rtsp.NewClientPusher(client)
-	if rtsp.GetServer().GetPusher(pusher.Path()) != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Path %s already exists", client.Path))
-		return
-	}
-	err = client.Start(time.Duration(form.IdleTimeout) * time.Second)
-	if err != nil {
-		log.Printf("Pull stream err :%v", err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Pull stream err: %v", err))
-		return
-	}
-	log.Printf("Pull to push %v success ", form)
-	rtsp.GetServer().AddPusher(pusher)
-	// save to db.
-	var stream = models.Stream{
+	stream := models.Stream{
 		URL:               form.URL,
 		CustomPath:        form.CustomPath,
+		Username:          form.Username,
+		Password:          form.Password,
+		TransType:         form.TransType,
 		IdleTimeout:       form.IdleTimeout,
 		HeartbeatInterval: form.HeartbeatInterval,
+		OnDemand:          form.OnDemand,
 	}
-	if db.SQLite.Where(&models.Stream{URL: form.URL}).First(&models.Stream{}).RecordNotFound() {
-		db.SQLite.Create(&stream)
-	} else {
-		db.SQLite.Save(&stream)
+	info, err := rtsp.GetServer().StreamSupervisor().Add(stream)
+	if err != nil {
+		log.Printf("Pull stream err :%v", err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Pull stream err: %v", err))
+		return
 	}
-	c.IndentedJSON(200, pusher.ID())
+	log.Printf("Pull to push %s success ", info.URL)
+	c.IndentedJSON(200, info.ID)
 }
 
 /**
@@ -110,19 +85,67 @@ func (h *APIHandler) StreamStop(c *gin.Context) {
 		log.Printf("stop pull to push err:%v", err)
 		return
 	}
+	if info, err := rtsp.GetServer().StreamSupervisor().Remove(form.ID); err != rtsp.ErrStreamNotFound {
+		if err != nil {
+			log.Printf("delete stream[%s] err:%v", info.URL, err)
+		}
+		c.IndentedJSON(200, "OK")
+		log.Printf("Stop %s success ", info.URL)
+		return
+	}
 	pushers := rtsp.GetServer().GetPushers()
 	for _, v := range pushers {
 		if v.ID() == form.ID {
 			v.Stop()
 			c.IndentedJSON(200, "OK")
 			log.Printf("Stop %v success ", v)
-			if v.RTSPClient != nil {
-				var stream models.Stream
-				stream.URL = v.RTSPClient.URL
-				db.SQLite.Delete(stream)
-			}
 			return
 		}
 	}
 	c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Pusher[%s] not found", form.ID))
 }
+
+/**
+ * @api {get} /api/v1/streams 获取拉转推列表
+ * @apiGroup stream
+ * @apiName Streams
+ * @apiParam {Number} [start] 分页开始,从零开始
+ * @apiParam {Number} [limit] 分页大小
+ * @apiParam {String} [sort] 排序字段
+ * @apiParam {String=ascending,descending} [order] 排序顺序
+ * @apiParam {String} [q] 查询参数
+ * @apiSuccess (200) {Number} total 总数
+ * @apiSuccess (200) {Array} rows 拉流列表
+ * @apiSuccess (200) {String} rows.id 拉流的ID，可用于停止拉流
+ * @apiSuccess (200) {String} rows.url RTSP源地址，其中的密码已隐藏
+ * @apiSuccess (200) {String} rows.username RTSP源用户名
+ * @apiSuccess (200) {String} rows.customPath 转推时的推送PATH
+ * @apiSuccess (200) {String} rows.path 推流PATH
+ * @apiSuccess (200) {String} rows.transType 拉流传输模式
+ * @apiSuccess (200) {Number} rows.idleTimeout 拉流时的超时时间
+ * @apiSuccess (200) {Number} rows.heartbeatInterval 拉流时的心跳间隔
+ * @apiSuccess (200) {Boolean} rows.onDemand 是否按需拉流
+ * @apiSuccess (200) {String=connecting,live,backoff,failed,idle} rows.state 拉流状态，idle表示按需拉流等待播放
+ * @apiSuccess (200) {Number} rows.reconnectCount 重连次数
+ * @apiSuccess (200) {String} rows.lastError 最近一次错误
+ * @apiSuccess (200) {Number} rows.onlines 在线人数
+ */
+func (h *APIHandler) Streams(c *gin.Context) {
+	form := utils.NewPageForm()
+	if err := c.Bind(form); err != nil {
+		return
+	}
+	streams := make([]interface{}, 0)
+	for _, info := range rtsp.GetServer().StreamSupervisor().Streams() {
+		if form.Q != "" && !strings.Contains(strings.ToLower(info.URL+info.Path), strings.ToLower(form.Q)) {
+			continue
+		}
+		streams = append(streams, info)
+	}
+	pr := utils.NewPageResult(streams)
+	if form.Sort != "" {
+		pr.Sort(form.Sort, form.Order)
+	}
+	pr.Slice(form.Start, form.Limit)
+	c.IndentedJSON(200, pr)
+}
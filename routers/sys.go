@@ -106,6 +106,13 @@ func (h *APIHandler) ModifyPassword(c *gin.Context) {
  * @apiSuccess (200) {String} RunningTime 运行时间
  * @apiSuccess (200) {String} StartUpTime 启动时间
  * @apiSuccess (200) {String} Server 软件信息
+ * @apiSuccess (200) {Object} recordRetention 录像清理信息，未开启时为null
+ * @apiSuccess (200) {Object[]} recordRetention.policies 按路径前缀的保留策略(prefix, maxAgeDays, maxSizeMB)
+ * @apiSuccess (200) {Number} recordRetention.highWaterPercent 磁盘高水位百分比
+ * @apiSuccess (200) {Number} recordRetention.diskUsedPercent 录像目录所在磁盘使用率
+ * @apiSuccess (200) {Number} recordRetention.deletedFiles 已删除录像文件数
+ * @apiSuccess (200) {Number} recordRetention.reclaimedBytes 已回收字节数
+ * @apiSuccess (200) {String} recordRetention.lastRunTime 最近一次清理时间
  */
 func (h *APIHandler) GetServerInfo(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, gin.H{
@@ -118,6 +125,7 @@ func (h *APIHandler) GetServerInfo(c *gin.Context) {
 		"cpuData":          cpuData,
 		"pusherData":       pusherData,
 		"playerData":       playerData,
+		"recordRetention":  rtsp.Instance.GetRecordJanitorInfo(),
 	})
 }
 
@@ -0,0 +1,314 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	FLV_TAG_AUDIO  = 8
+	FLV_TAG_VIDEO  = 9
+	FLV_TAG_SCRIPT = 18
+
+	FLV_CODEC_AVC  = 7
+	FLV_CODEC_HEVC = 12
+
+	FLV_SOUND_PCMA = 7
+	FLV_SOUND_PCMU = 8
+	FLV_SOUND_AAC  = 10
+)
+
+type FLVTag struct {
+	Type      byte
+	Timestamp uint32
+	Data      []byte
+}
+
+//将音视频帧封装为flv tag，http-flv与rtmp拉流共用
+type FLVMuxer struct {
+	w           io.Writer
+	videoCodec  string
+	audioCodec  string
+	audioConfig []byte
+
+	vps []byte
+	sps []byte
+	pps []byte
+
+	started           bool
+	baseTime          time.Duration
+	videoHeaderSent   bool
+	audioHeaderSent   bool
+	videoHeaderDirty  bool
+	previousTagLength uint32
+}
+
+func NewFLVMuxer(w io.Writer, depacketizer *RTPDepacketizer) *FLVMuxer {
+	muxer := &FLVMuxer{
+		w:   w,
+		vps: depacketizer.VPS,
+		sps: depacketizer.SPS,
+		pps: depacketizer.PPS,
+	}
+	if depacketizer.HasVideo() {
+		muxer.videoCodec = depacketizer.VCodec
+	}
+	switch depacketizer.ACodec {
+	case "aac":
+		if len(depacketizer.AudioConfig) >= 2 {
+			muxer.audioCodec = depacketizer.ACodec
+			muxer.audioConfig = depacketizer.AudioConfig
+		}
+	case "pcma", "pcmu":
+		muxer.audioCodec = depacketizer.ACodec
+	}
+	return muxer
+}
+
+func (muxer *FLVMuxer) HasVideo() bool {
+	return muxer.videoCodec != ""
+}
+
+func (muxer *FLVMuxer) HasAudio() bool {
+	return muxer.audioCodec != ""
+}
+
+//flv文件头
+func (muxer *FLVMuxer) WriteHeader() (err error) {
+	flags := byte(0)
+	if muxer.HasAudio() {
+		flags |= 0x04
+	}
+	if muxer.HasVideo() {
+		flags |= 0x01
+	}
+	_, err = muxer.w.Write([]byte{'F', 'L', 'V', 0x01, flags, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00})
+	return
+}
+
+func (muxer *FLVMuxer) WriteTag(tag *FLVTag) (err error) {
+	header := make([]byte, 11, 11+len(tag.Data)+4)
+	header[0] = tag.Type
+	header[1] = byte(len(tag.Data) >> 16)
+	header[2] = byte(len(tag.Data) >> 8)
+	header[3] = byte(len(tag.Data))
+	header[4] = byte(tag.Timestamp >> 16)
+	header[5] = byte(tag.Timestamp >> 8)
+	header[6] = byte(tag.Timestamp)
+	header[7] = byte(tag.Timestamp >> 24)
+	buf := append(header, tag.Data...)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(11+len(tag.Data)))
+	_, err = muxer.w.Write(buf)
+	return
+}
+
+func (muxer *FLVMuxer) WriteFrame(frame *AVFrame) (err error) {
+	for _, tag := range muxer.Tags(frame) {
+		if err = muxer.WriteTag(tag); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//将帧转换为flv tag，有视频时从第一个关键帧开始输出
+func (muxer *FLVMuxer) Tags(frame *AVFrame) (tags []*FLVTag) {
+	switch frame.Type {
+	case RTP_TYPE_VIDEO:
+		if !muxer.HasVideo() {
+			return
+		}
+		if !muxer.started && !frame.KeyFrame {
+			return
+		}
+	case RTP_TYPE_AUDIO:
+		if !muxer.HasAudio() {
+			return
+		}
+		if !muxer.started && muxer.HasVideo() {
+			return
+		}
+	default:
+		return
+	}
+	if !muxer.started {
+		muxer.started = true
+		muxer.baseTime = frame.Timestamp
+	}
+	timestamp := uint32(0)
+	if frame.Timestamp > muxer.baseTime {
+		timestamp = uint32((frame.Timestamp - muxer.baseTime) / time.Millisecond)
+	}
+	if frame.Type == RTP_TYPE_VIDEO {
+		return muxer.videoTags(frame, timestamp)
+	}
+	return muxer.audioTags(frame, timestamp)
+}
+
+func (muxer *FLVMuxer) videoTags(frame *AVFrame, timestamp uint32) (tags []*FLVTag) {
+	codecID := byte(FLV_CODEC_AVC)
+	if muxer.videoCodec == "h265" {
+		codecID = FLV_CODEC_HEVC
+	}
+	body := bytes.Buffer{}
+	for _, nalu := range frame.NALUs {
+		if len(nalu) == 0 {
+			continue
+		}
+		//参数集放在sequence header中
+		if muxer.updateParameterSet(nalu) {
+			continue
+		}
+		_ = binary.Write(&body, binary.BigEndian, uint32(len(nalu)))
+		body.Write(nalu)
+	}
+	if frame.KeyFrame && (!muxer.videoHeaderSent || muxer.videoHeaderDirty) {
+		if config := muxer.videoDecoderConfig(); config != nil {
+			data := append([]byte{0x10 | codecID, 0x00, 0x00, 0x00, 0x00}, config...)
+			tags = append(tags, &FLVTag{Type: FLV_TAG_VIDEO, Timestamp: timestamp, Data: data})
+			muxer.videoHeaderSent = true
+			muxer.videoHeaderDirty = false
+		}
+	}
+	if !muxer.videoHeaderSent || body.Len() == 0 {
+		return
+	}
+	frameType := byte(0x20)
+	if frame.KeyFrame {
+		frameType = 0x10
+	}
+	data := append([]byte{frameType | codecID, 0x01, 0x00, 0x00, 0x00}, body.Bytes()...)
+	tags = append(tags, &FLVTag{Type: FLV_TAG_VIDEO, Timestamp: timestamp, Data: data})
+	return
+}
+
+//记录参数集，变化时需要重新发送sequence header
+func (muxer *FLVMuxer) updateParameterSet(nalu []byte) bool {
+	var target *[]byte
+	if muxer.videoCodec == "h264" {
+		switch nalu[0] & 0x1f {
+		case 7:
+			target = &muxer.sps
+		case 8:
+			target = &muxer.pps
+		case 9:
+			return true
+		}
+	} else {
+		switch (nalu[0] >> 1) & 0x3f {
+		case 32:
+			target = &muxer.vps
+		case 33:
+			target = &muxer.sps
+		case 34:
+			target = &muxer.pps
+		case 35:
+			return true
+		}
+	}
+	if target == nil {
+		return false
+	}
+	if !bytes.Equal(*target, nalu) {
+		*target = nalu
+		muxer.videoHeaderDirty = true
+	}
+	return true
+}
+
+func (muxer *FLVMuxer) videoDecoderConfig() []byte {
+	if len(muxer.sps) < 4 || len(muxer.pps) == 0 {
+		return nil
+	}
+	if muxer.videoCodec == "h264" {
+		return AVCDecoderConfigurationRecord(muxer.sps, muxer.pps)
+	}
+	if len(muxer.vps) == 0 {
+		return nil
+	}
+	return HEVCDecoderConfigurationRecord(muxer.vps, muxer.sps, muxer.pps)
+}
+
+func (muxer *FLVMuxer) audioTags(frame *AVFrame, timestamp uint32) (tags []*FLVTag) {
+	switch muxer.audioCodec {
+	case "aac":
+		if !muxer.audioHeaderSent {
+			data := append([]byte{FLV_SOUND_AAC<<4 | 0x0f, 0x00}, muxer.audioConfig...)
+			tags = append(tags, &FLVTag{Type: FLV_TAG_AUDIO, Timestamp: timestamp, Data: data})
+			muxer.audioHeaderSent = true
+		}
+		data := append([]byte{FLV_SOUND_AAC<<4 | 0x0f, 0x01}, frame.Payload...)
+		tags = append(tags, &FLVTag{Type: FLV_TAG_AUDIO, Timestamp: timestamp, Data: data})
+	case "pcma":
+		data := append([]byte{FLV_SOUND_PCMA<<4 | 0x02}, frame.Payload...)
+		tags = append(tags, &FLVTag{Type: FLV_TAG_AUDIO, Timestamp: timestamp, Data: data})
+	case "pcmu":
+		data := append([]byte{FLV_SOUND_PCMU<<4 | 0x02}, frame.Payload...)
+		tags = append(tags, &FLVTag{Type: FLV_TAG_AUDIO, Timestamp: timestamp, Data: data})
+	}
+	return
+}
+
+//ISO/IEC 14496-15 avcC
+func AVCDecoderConfigurationRecord(sps []byte, pps []byte) []byte {
+	buf := bytes.Buffer{}
+	buf.Write([]byte{0x01, sps[1], sps[2], sps[3], 0xff, 0xe1})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(sps)))
+	buf.Write(sps)
+	buf.WriteByte(0x01)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(pps)))
+	buf.Write(pps)
+	return buf.Bytes()
+}
+
+//ISO/IEC 14496-15 hvcC
+func HEVCDecoderConfigurationRecord(vps []byte, sps []byte, pps []byte) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(0x01)
+	//sps: nal头2字节，1字节id与子层信息，之后12字节为general_profile_tier_level
+	rbsp := removeEmulationPrevention(sps)
+	ptl := make([]byte, 12)
+	if len(rbsp) >= 15 {
+		copy(ptl, rbsp[3:15])
+	}
+	buf.Write(ptl)
+	buf.Write([]byte{
+		0xf0, 0x00, // min_spatial_segmentation_idc
+		0xfc,       // parallelismType
+		0xfd,       // chromaFormat 4:2:0
+		0xf8,       // bitDepthLumaMinus8
+		0xf8,       // bitDepthChromaMinus8
+		0x00, 0x00, // avgFrameRate
+		0x0f, // numTemporalLayers=1, temporalIdNested=1, lengthSizeMinusOne=3
+		0x03, // numOfArrays
+	})
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		buf.WriteByte(0x80 | (nalu[0]>>1)&0x3f)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(1))
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(nalu)))
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+//去除nalu中的防竞争字节 00 00 03
+func removeEmulationPrevention(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
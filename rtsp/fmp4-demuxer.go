@@ -0,0 +1,572 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	//moov、moof及单个sample的最大长度，防止损坏的文件导致分配过大的内存
+	FMP4_MAX_BOX_SIZE    = 16 * 1024 * 1024
+	FMP4_MAX_SAMPLE_SIZE = 16 * 1024 * 1024
+	//单个分片中的最大sample数
+	FMP4_MAX_FRAGMENT_SAMPLES = 1 << 16
+)
+
+//fmp4文件中的音视频轨道
+type fmp4TrackInfo struct {
+	id        uint32
+	rtpType   RTPType
+	codec     string
+	timescale uint32
+	//nalu长度字段字节数
+	lengthSize    int
+	vps           []byte
+	sps           []byte
+	pps           []byte
+	audioConfig   []byte
+	audioRate     int
+	audioChannels int
+
+	//trex中的默认值
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+}
+
+type fmp4SampleRef struct {
+	track  *fmp4TrackInfo
+	dts    uint64
+	key    bool
+	offset int64
+	size   uint32
+}
+
+//读取FMP4Muxer生成的fragmented mp4录像文件，录像回放使用
+type FMP4Demuxer struct {
+	r      io.ReadSeeker
+	Video  *fmp4TrackInfo
+	Audio  *fmp4TrackInfo
+	tracks map[uint32]*fmp4TrackInfo
+	//moov之后第一个分片及下一个分片的位置
+	firstFragment int64
+	offset        int64
+}
+
+type mp4BoxData struct {
+	boxType string
+	payload []byte
+}
+
+func NewFMP4Demuxer(r io.ReadSeeker) (demuxer *FMP4Demuxer, err error) {
+	demuxer = &FMP4Demuxer{r: r, tracks: make(map[uint32]*fmp4TrackInfo)}
+	for {
+		var (
+			boxType string
+			size    int64
+			header  int64
+		)
+		if boxType, size, header, err = demuxer.readBoxHeader(demuxer.offset); err != nil {
+			return nil, err
+		}
+		if boxType != "moov" {
+			demuxer.offset += size
+			continue
+		}
+		if size-header > FMP4_MAX_BOX_SIZE {
+			return nil, fmt.Errorf("mp4 moov size %d too large", size)
+		}
+		moov := make([]byte, size-header)
+		if _, err = io.ReadFull(r, moov); err != nil {
+			return nil, err
+		}
+		demuxer.offset += size
+		demuxer.firstFragment = demuxer.offset
+		if err = demuxer.parseMoov(moov); err != nil {
+			return nil, err
+		}
+		return demuxer, nil
+	}
+}
+
+func (demuxer *FMP4Demuxer) readBoxHeader(offset int64) (boxType string, size int64, header int64, err error) {
+	if _, err = demuxer.r.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err = io.ReadFull(demuxer.r, buf[:8]); err != nil {
+		return
+	}
+	size, boxType, header = int64(binary.BigEndian.Uint32(buf)), string(buf[4:8]), 8
+	switch size {
+	case 0:
+		//直到文件结束
+		var end int64
+		if end, err = demuxer.r.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+		size = end - offset
+		_, err = demuxer.r.Seek(offset+header, io.SeekStart)
+	case 1:
+		if _, err = io.ReadFull(demuxer.r, buf[8:16]); err != nil {
+			return
+		}
+		size, header = int64(binary.BigEndian.Uint64(buf[8:])), 16
+	}
+	if size < header {
+		err = fmt.Errorf("invalid mp4 box[%s] size %d", boxType, size)
+	}
+	return
+}
+
+//拆分容器box的子box
+func mp4Children(data []byte) (boxes []mp4BoxData) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return
+		}
+		boxes = append(boxes, mp4BoxData{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	return
+}
+
+func mp4Child(data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		found := false
+		for _, box := range mp4Children(data) {
+			if box.boxType == boxType {
+				data = box.payload
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+func (demuxer *FMP4Demuxer) parseMoov(moov []byte) error {
+	for _, box := range mp4Children(moov) {
+		switch box.boxType {
+		case "trak":
+			track := parseFMP4Trak(box.payload)
+			if track == nil {
+				continue
+			}
+			demuxer.tracks[track.id] = track
+			if track.rtpType == RTP_TYPE_VIDEO && demuxer.Video == nil {
+				demuxer.Video = track
+			} else if track.rtpType == RTP_TYPE_AUDIO && demuxer.Audio == nil {
+				demuxer.Audio = track
+			}
+		case "mvex":
+			for _, trex := range mp4Children(box.payload) {
+				if trex.boxType != "trex" || len(trex.payload) < 24 {
+					continue
+				}
+				if track, ok := demuxer.tracks[binary.BigEndian.Uint32(trex.payload[4:])]; ok {
+					track.defaultDuration = binary.BigEndian.Uint32(trex.payload[12:])
+					track.defaultSize = binary.BigEndian.Uint32(trex.payload[16:])
+					track.defaultFlags = binary.BigEndian.Uint32(trex.payload[20:])
+				}
+			}
+		}
+	}
+	if demuxer.Video == nil && demuxer.Audio == nil {
+		return fmt.Errorf("no supported track in mp4")
+	}
+	return nil
+}
+
+//只解析录像中使用的编码
+func parseFMP4Trak(trak []byte) *fmp4TrackInfo {
+	tkhd := mp4Child(trak, "tkhd")
+	mdhd := mp4Child(trak, "mdia", "mdhd")
+	stsd := mp4Child(trak, "mdia", "minf", "stbl", "stsd")
+	if len(tkhd) < 16 || len(mdhd) < 24 || len(stsd) < 8 {
+		return nil
+	}
+	track := &fmp4TrackInfo{}
+	if tkhd[0] == 1 {
+		if len(tkhd) < 24 {
+			return nil
+		}
+		track.id = binary.BigEndian.Uint32(tkhd[20:])
+	} else {
+		track.id = binary.BigEndian.Uint32(tkhd[12:])
+	}
+	if mdhd[0] == 1 {
+		track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	} else {
+		track.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	entries := mp4Children(stsd[8:])
+	if len(entries) == 0 || track.timescale == 0 {
+		return nil
+	}
+	entry := entries[0]
+	switch entry.boxType {
+	case "avc1", "avc3", "hvc1", "hev1":
+		//VisualSampleEntry固定78字节
+		if len(entry.payload) < 78 {
+			return nil
+		}
+		track.rtpType = RTP_TYPE_VIDEO
+		if entry.boxType[0] == 'a' {
+			track.codec = "h264"
+			config := mp4Child(entry.payload[78:], "avcC")
+			if len(config) < 7 {
+				return nil
+			}
+			track.lengthSize = int(config[4]&0x03) + 1
+			//sps个数的高3位为保留位，之后为pps个数
+			data := config[5:]
+			for pass := 0; pass < 2 && len(data) > 0; pass++ {
+				count := int(data[0])
+				if pass == 0 {
+					count &= 0x1f
+				}
+				data = data[1:]
+				for i := 0; i < count && len(data) >= 2; i++ {
+					length := int(binary.BigEndian.Uint16(data))
+					if len(data) < 2+length {
+						return nil
+					}
+					nalu := data[2 : 2+length]
+					if len(nalu) > 0 && nalu[0]&0x1f == 7 {
+						track.sps = nalu
+					} else if len(nalu) > 0 && nalu[0]&0x1f == 8 {
+						track.pps = nalu
+					}
+					data = data[2+length:]
+				}
+			}
+		} else {
+			track.codec = "h265"
+			config := mp4Child(entry.payload[78:], "hvcC")
+			if len(config) < 23 {
+				return nil
+			}
+			track.lengthSize = int(config[21]&0x03) + 1
+			data := config[23:]
+			for arrays := int(config[22]); arrays > 0 && len(data) >= 3; arrays-- {
+				nalType := data[0] & 0x3f
+				count := int(binary.BigEndian.Uint16(data[1:]))
+				data = data[3:]
+				for i := 0; i < count && len(data) >= 2; i++ {
+					length := int(binary.BigEndian.Uint16(data))
+					if len(data) < 2+length {
+						return nil
+					}
+					switch nalType {
+					case 32:
+						track.vps = data[2 : 2+length]
+					case 33:
+						track.sps = data[2 : 2+length]
+					case 34:
+						track.pps = data[2 : 2+length]
+					}
+					data = data[2+length:]
+				}
+			}
+		}
+	case "mp4a", "Opus", "alaw", "ulaw":
+		//AudioSampleEntry固定28字节
+		if len(entry.payload) < 28 {
+			return nil
+		}
+		track.rtpType = RTP_TYPE_AUDIO
+		track.audioChannels = int(binary.BigEndian.Uint16(entry.payload[16:]))
+		track.audioRate = int(binary.BigEndian.Uint32(entry.payload[24:]) >> 16)
+		switch entry.boxType {
+		case "mp4a":
+			track.codec = "aac"
+			if track.audioConfig = parseESDSConfig(mp4Child(entry.payload[28:], "esds")); track.audioConfig == nil {
+				return nil
+			}
+		case "Opus":
+			track.codec = "opus"
+		case "alaw":
+			track.codec = "pcma"
+		case "ulaw":
+			track.codec = "pcmu"
+		}
+	default:
+		return nil
+	}
+	return track
+}
+
+//esds中的DecoderSpecificInfo
+func parseESDSConfig(esds []byte) []byte {
+	if len(esds) < 4 {
+		return nil
+	}
+	data := esds[4:]
+	readDescriptor := func() (tag byte, payload []byte) {
+		if len(data) < 2 {
+			return 0, nil
+		}
+		tag = data[0]
+		length, i := 0, 1
+		for ; i < 5 && i < len(data); i++ {
+			length = length<<7 | int(data[i]&0x7f)
+			if data[i]&0x80 == 0 {
+				break
+			}
+		}
+		if 1+i+length > len(data) {
+			return 0, nil
+		}
+		payload = data[1+i : 1+i+length]
+		data = data[1+i+length:]
+		return
+	}
+	tag, es := readDescriptor()
+	if tag != 0x03 || len(es) < 3 {
+		return nil
+	}
+	flags := es[2]
+	data = es[3:]
+	if flags&0x80 != 0 && len(data) >= 2 {
+		data = data[2:]
+	}
+	if flags&0x40 != 0 && len(data) >= 1 {
+		if 1+int(data[0]) > len(data) {
+			return nil
+		}
+		data = data[1+int(data[0]):]
+	}
+	if flags&0x20 != 0 && len(data) >= 2 {
+		data = data[2:]
+	}
+	tag, decoderConfig := readDescriptor()
+	if tag != 0x04 || len(decoderConfig) < 13 {
+		return nil
+	}
+	data = decoderConfig[13:]
+	if tag, config := readDescriptor(); tag == 0x05 {
+		return config
+	}
+	return nil
+}
+
+//读取offset处的moof，返回其中的sample及下一个box的位置
+func (demuxer *FMP4Demuxer) readMoof(offset int64) (samples []*fmp4SampleRef, next int64, err error) {
+	for {
+		var (
+			boxType string
+			size    int64
+			header  int64
+		)
+		if boxType, size, header, err = demuxer.readBoxHeader(offset); err != nil {
+			return
+		}
+		if boxType != "moof" {
+			offset += size
+			continue
+		}
+		if size-header > FMP4_MAX_BOX_SIZE {
+			err = fmt.Errorf("mp4 moof size %d too large", size)
+			return
+		}
+		moof := make([]byte, size-header)
+		if _, err = io.ReadFull(demuxer.r, moof); err != nil {
+			return
+		}
+		next = offset + size
+		for _, traf := range mp4Children(moof) {
+			if traf.boxType == "traf" {
+				samples = demuxer.parseTraf(traf.payload, offset, samples)
+			}
+		}
+		return
+	}
+}
+
+//解析traf中的sample并追加到samples
+func (demuxer *FMP4Demuxer) parseTraf(traf []byte, moofOffset int64, samples []*fmp4SampleRef) []*fmp4SampleRef {
+	tfhd := mp4Child(traf, "tfhd")
+	if len(tfhd) < 8 {
+		return samples
+	}
+	track, ok := demuxer.tracks[binary.BigEndian.Uint32(tfhd[4:])]
+	if !ok {
+		return samples
+	}
+	flags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+	base := moofOffset
+	duration, size, sampleFlags := track.defaultDuration, track.defaultSize, track.defaultFlags
+	data := tfhd[8:]
+	read := func(n int) []byte {
+		if len(data) < n {
+			return make([]byte, n)
+		}
+		v := data[:n]
+		data = data[n:]
+		return v
+	}
+	if flags&0x01 != 0 {
+		base = int64(binary.BigEndian.Uint64(read(8)))
+	}
+	if flags&0x02 != 0 {
+		read(4)
+	}
+	if flags&0x08 != 0 {
+		duration = binary.BigEndian.Uint32(read(4))
+	}
+	if flags&0x10 != 0 {
+		size = binary.BigEndian.Uint32(read(4))
+	}
+	if flags&0x20 != 0 {
+		sampleFlags = binary.BigEndian.Uint32(read(4))
+	}
+	var dts uint64
+	if tfdt := mp4Child(traf, "tfdt"); len(tfdt) >= 8 {
+		if tfdt[0] == 1 && len(tfdt) >= 12 {
+			dts = binary.BigEndian.Uint64(tfdt[4:])
+		} else {
+			dts = uint64(binary.BigEndian.Uint32(tfdt[4:]))
+		}
+	}
+	offset := base
+	for _, trun := range mp4Children(traf) {
+		if trun.boxType != "trun" || len(trun.payload) < 8 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(trun.payload) & 0xffffff
+		count := binary.BigEndian.Uint32(trun.payload[4:])
+		data = trun.payload[8:]
+		if flags&0x01 != 0 {
+			offset = base + int64(int32(binary.BigEndian.Uint32(read(4))))
+		}
+		firstFlags := sampleFlags
+		if flags&0x04 != 0 {
+			firstFlags = binary.BigEndian.Uint32(read(4))
+		}
+		for i := uint32(0); i < count && len(data) > 0 && len(samples) < FMP4_MAX_FRAGMENT_SAMPLES; i++ {
+			sample := &fmp4SampleRef{track: track, dts: dts, offset: offset}
+			sampleDuration, sampleSize, flagsValue := duration, size, sampleFlags
+			if i == 0 {
+				flagsValue = firstFlags
+			}
+			if flags&0x100 != 0 {
+				sampleDuration = binary.BigEndian.Uint32(read(4))
+			}
+			if flags&0x200 != 0 {
+				sampleSize = binary.BigEndian.Uint32(read(4))
+			}
+			if flags&0x400 != 0 {
+				flagsValue = binary.BigEndian.Uint32(read(4))
+			}
+			if flags&0x800 != 0 {
+				read(4)
+			}
+			sample.size = sampleSize
+			//sample_is_non_sync_sample
+			sample.key = track.rtpType == RTP_TYPE_AUDIO || flagsValue&0x00010000 == 0
+			samples = append(samples, sample)
+			dts += uint64(sampleDuration)
+			offset += int64(sampleSize)
+		}
+	}
+	return samples
+}
+
+func (track *fmp4TrackInfo) duration(dts uint64) time.Duration {
+	return time.Duration(dts * uint64(time.Second) / uint64(track.timescale))
+}
+
+//定位到不晚于pos的最后一个可独立解码的分片，返回该分片的开始时间
+func (demuxer *FMP4Demuxer) Seek(pos time.Duration) (start time.Duration, err error) {
+	offset := demuxer.firstFragment
+	target := demuxer.firstFragment
+	for {
+		samples, next, e := demuxer.readMoof(offset)
+		if e != nil || len(samples) == 0 {
+			break
+		}
+		var first *fmp4SampleRef
+		for _, sample := range samples {
+			if demuxer.Video == nil || sample.track == demuxer.Video {
+				first = sample
+				break
+			}
+		}
+		if first != nil {
+			t := first.track.duration(first.dts)
+			if t > pos {
+				break
+			}
+			if first.key {
+				target, start = offset, t
+			}
+		}
+		offset = next
+	}
+	demuxer.offset = target
+	return
+}
+
+//读取下一个分片中的音视频帧，按时间排序
+func (demuxer *FMP4Demuxer) ReadFragment() (frames []*AVFrame, err error) {
+	samples, next, err := demuxer.readMoof(demuxer.offset)
+	if err != nil {
+		return nil, err
+	}
+	demuxer.offset = next
+	for _, sample := range samples {
+		if sample.size > FMP4_MAX_SAMPLE_SIZE {
+			return nil, fmt.Errorf("mp4 sample size %d too large", sample.size)
+		}
+		data := make([]byte, sample.size)
+		if _, err = demuxer.r.Seek(sample.offset, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(demuxer.r, data); err != nil {
+			return
+		}
+		frame := &AVFrame{
+			Type:      sample.track.rtpType,
+			Codec:     sample.track.codec,
+			Timestamp: sample.track.duration(sample.dts),
+			KeyFrame:  sample.key,
+		}
+		if frame.Type == RTP_TYPE_VIDEO {
+			frame.NALUs = splitLengthPrefixed(data, sample.track.lengthSize)
+		} else {
+			frame.Payload = data
+		}
+		frames = append(frames, frame)
+	}
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].Timestamp < frames[j].Timestamp
+	})
+	return
+}
+
+//长度前缀格式转为nalu列表
+func splitLengthPrefixed(data []byte, lengthSize int) (nalus [][]byte) {
+	for len(data) > lengthSize {
+		length := 0
+		for i := 0; i < lengthSize; i++ {
+			length = length<<8 | int(data[i])
+		}
+		data = data[lengthSize:]
+		if length > len(data) {
+			return
+		}
+		if length > 0 {
+			nalus = append(nalus, data[:length])
+		}
+		data = data[length:]
+	}
+	return
+}
@@ -0,0 +1,194 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	fmp4TestSPS = []byte{0x67, 0x42, 0x00, 0x1f, 0x95, 0xa8, 0x14, 0x01, 0x6e, 0x40}
+	fmp4TestPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+//h264+aac，每秒一个关键帧分片
+func newTestFMP4File(t testing.TB, seconds int) (data []byte, frames []*AVFrame) {
+	buf := &bytes.Buffer{}
+	muxer := NewFMP4Muxer(buf, &RTPDepacketizer{
+		VCodec:        "h264",
+		SPS:           fmp4TestSPS,
+		PPS:           fmp4TestPPS,
+		ACodec:        "aac",
+		AudioConfig:   []byte{0x12, 0x10},
+		AudioRate:     44100,
+		AudioChannels: 2,
+	})
+	if err := muxer.WriteInit(); err != nil {
+		t.Fatal(err)
+	}
+	for second := 0; second < seconds; second++ {
+		for i := 0; i < 25; i++ {
+			video := &AVFrame{
+				Type:      RTP_TYPE_VIDEO,
+				Codec:     "h264",
+				Timestamp: time.Duration(second)*time.Second + time.Duration(i)*40*time.Millisecond,
+				KeyFrame:  i == 0,
+				NALUs:     [][]byte{{0x41, byte(second), byte(i)}},
+			}
+			if video.KeyFrame {
+				video.NALUs = [][]byte{fmp4TestSPS, fmp4TestPPS, {0x65, byte(second), byte(i)}}
+			}
+			audio := &AVFrame{Type: RTP_TYPE_AUDIO, Codec: "aac", Timestamp: video.Timestamp, KeyFrame: true, Payload: []byte{0x21, byte(second), byte(i)}}
+			frames = append(frames, video, audio)
+			muxer.WriteFrame(video)
+			//与录像一致，关键帧写入后flush，下一个分片从关键帧开始
+			if video.KeyFrame {
+				muxer.Flush()
+			}
+			muxer.WriteFrame(audio)
+		}
+	}
+	if err := muxer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), frames
+}
+
+func TestFMP4MuxDemux(t *testing.T) {
+	data, frames := newTestFMP4File(t, 3)
+	demuxer, err := NewFMP4Demuxer(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video := demuxer.Video; video == nil || video.codec != "h264" || !bytes.Equal(video.sps, fmp4TestSPS) || !bytes.Equal(video.pps, fmp4TestPPS) {
+		t.Fatalf("video track = %+v", demuxer.Video)
+	}
+	if audio := demuxer.Audio; audio == nil || audio.codec != "aac" || !bytes.Equal(audio.audioConfig, []byte{0x12, 0x10}) || audio.audioRate != 44100 || audio.audioChannels != 2 {
+		t.Fatalf("audio track = %+v", demuxer.Audio)
+	}
+	var got []*AVFrame
+	for {
+		fragment, err := demuxer.ReadFragment()
+		if err != nil {
+			break
+		}
+		got = append(got, fragment...)
+	}
+	if len(got) != len(frames) {
+		t.Fatalf("frames = %d, want %d", len(got), len(frames))
+	}
+	for i, frame := range got {
+		want := frames[i]
+		//音频时长按采样率取整
+		if diff := frame.Timestamp - want.Timestamp; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Fatalf("frame %d timestamp = %v, want %v", i, frame.Timestamp, want.Timestamp)
+		}
+		if frame.Type != want.Type || frame.KeyFrame != want.KeyFrame || !reflect.DeepEqual(frame.NALUs, want.NALUs) || !bytes.Equal(frame.Payload, want.Payload) {
+			t.Fatalf("frame %d = %+v, want %+v", i, frame, want)
+		}
+	}
+	//定位到不晚于目标时间的关键帧分片
+	tests := []struct {
+		pos   time.Duration
+		start time.Duration
+	}{
+		{0, 0},
+		{1500 * time.Millisecond, time.Second},
+		{2 * time.Second, 2 * time.Second},
+		{time.Hour, 2 * time.Second},
+	}
+	for _, test := range tests {
+		start, err := demuxer.Seek(test.pos)
+		if err != nil || start != test.start {
+			t.Fatalf("seek %v = %v %v, want %v", test.pos, start, err, test.start)
+		}
+		fragment, err := demuxer.ReadFragment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		//分片中可能包含上一个关键帧之前的音频
+		for _, frame := range fragment {
+			if frame.Type != RTP_TYPE_VIDEO {
+				continue
+			}
+			if !frame.KeyFrame || frame.Timestamp != test.start {
+				t.Fatalf("seek %v first video frame = %+v", test.pos, frame)
+			}
+			break
+		}
+	}
+}
+
+func TestFMP4DemuxerMalformed(t *testing.T) {
+	data, _ := newTestFMP4File(t, 1)
+	//ftyp之后为moov
+	moovOffset := int(binary.BigEndian.Uint32(data))
+	moovSize := int(binary.BigEndian.Uint32(data[moovOffset:]))
+	largeMoov := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(largeMoov[moovOffset:], 1)
+	largeMoov = append(largeMoov[:moovOffset+8], append([]byte{0, 0, 0, 0x10, 0, 0, 0, 0}, largeMoov[moovOffset+8:]...)...)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated moov", data[:moovOffset+moovSize-1]},
+		{"box size smaller than header", append(append([]byte{}, data[:moovOffset]...), 0, 0, 0, 4, 'm', 'o', 'o', 'v')},
+		{"moov too large", largeMoov},
+		{"without track", append(append([]byte{}, data[:moovOffset]...), 0, 0, 0, 8, 'm', 'o', 'o', 'v')},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewFMP4Demuxer(bytes.NewReader(test.data)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParseFMP4TrakMalformed(t *testing.T) {
+	stsd := mp4FullBox("stsd", 0, 0, mp4Uint32(1), mp4Box("avc1", make([]byte, 78)))
+	mdia := mp4Box("mdia", mp4FullBox("mdhd", 0, 0, make([]byte, 8), mp4Uint32(90000), make([]byte, 8)), mp4Box("minf", mp4Box("stbl", stsd)))
+	tests := []struct {
+		name string
+		trak []byte
+	}{
+		//version 1的tkhd至少24字节
+		{"short tkhd version 1", mp4Box("trak", mp4FullBox("tkhd", 1, 0, make([]byte, 16)), mdia)},
+		{"avc1 without avcC", mp4Box("trak", mp4FullBox("tkhd", 0, 0, make([]byte, 8), mp4Uint32(1), make([]byte, 4)), mdia)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if track := parseFMP4Trak(mp4Children(test.trak)[0].payload); track != nil {
+				t.Fatalf("track = %+v", track)
+			}
+		})
+	}
+	//esds中URL长度超出范围
+	esds := []byte{0, 0, 0, 0, 0x03, 5, 0, 1, 0x40, 10, 'a'}
+	if config := parseESDSConfig(esds); config != nil {
+		t.Fatalf("config = %x", config)
+	}
+	if config := parseESDSConfig(mp4ESDS([]byte{0x12, 0x10})[8:]); !bytes.Equal(config, []byte{0x12, 0x10}) {
+		t.Fatalf("config = %x", config)
+	}
+}
+
+func FuzzFMP4Demuxer(f *testing.F) {
+	data, _ := newTestFMP4File(f, 2)
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		demuxer, err := NewFMP4Demuxer(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		demuxer.Seek(time.Second)
+		for i := 0; i < 8; i++ {
+			if _, err = demuxer.ReadFragment(); err != nil {
+				return
+			}
+		}
+	})
+}
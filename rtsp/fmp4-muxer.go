@@ -0,0 +1,517 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	FMP4_VIDEO_TRACK_ID  = 1
+	FMP4_AUDIO_TRACK_ID  = 2
+	FMP4_VIDEO_TIMESCALE = 90000
+
+	//trun中sample_flags，关键帧不依赖其他帧，非关键帧为non-sync sample
+	fmp4SampleFlagsKey    = 0x02000000
+	fmp4SampleFlagsNonKey = 0x01010000
+)
+
+type fmp4Sample struct {
+	//解码时间，单位为轨道timescale
+	dts      uint64
+	duration uint32
+	key      bool
+	data     []byte
+}
+
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+	samples   []*fmp4Sample
+	//等待下一帧确定时长的sample
+	pending      *fmp4Sample
+	lastDuration uint32
+}
+
+//时长确定后的sample进入待输出队列
+func (track *fmp4Track) push(sample *fmp4Sample) {
+	if track.pending != nil {
+		//b帧或时间戳抖动时保证解码时间递增
+		if sample.dts <= track.pending.dts {
+			sample.dts = track.pending.dts + 1
+		}
+		track.pending.duration = uint32(sample.dts - track.pending.dts)
+		track.lastDuration = track.pending.duration
+		track.samples = append(track.samples, track.pending)
+	}
+	track.pending = sample
+}
+
+//结束时最后一帧沿用上一帧时长
+func (track *fmp4Track) flushPending() {
+	if track.pending == nil {
+		return
+	}
+	track.pending.duration = track.lastDuration
+	if track.pending.duration == 0 {
+		track.pending.duration = track.timescale / 25
+	}
+	track.samples = append(track.samples, track.pending)
+	track.pending = nil
+}
+
+//将音视频帧封装为fragmented mp4，录像使用
+type FMP4Muxer struct {
+	w             io.Writer
+	videoCodec    string
+	audioCodec    string
+	audioConfig   []byte
+	audioRate     int
+	audioChannels int
+
+	vps []byte
+	sps []byte
+	pps []byte
+
+	started  bool
+	baseTime time.Duration
+	sequence uint32
+	video    *fmp4Track
+	audio    *fmp4Track
+}
+
+func NewFMP4Muxer(w io.Writer, depacketizer *RTPDepacketizer) *FMP4Muxer {
+	muxer := &FMP4Muxer{
+		w:             w,
+		vps:           depacketizer.VPS,
+		sps:           depacketizer.SPS,
+		pps:           depacketizer.PPS,
+		audioRate:     depacketizer.AudioRate,
+		audioChannels: depacketizer.AudioChannels,
+	}
+	if depacketizer.HasVideo() && len(muxer.sps) >= 4 && len(muxer.pps) > 0 && (depacketizer.VCodec == "h264" || len(muxer.vps) > 0) {
+		muxer.videoCodec = depacketizer.VCodec
+		muxer.video = &fmp4Track{id: FMP4_VIDEO_TRACK_ID, timescale: FMP4_VIDEO_TIMESCALE}
+	}
+	switch depacketizer.ACodec {
+	case "aac":
+		if len(depacketizer.AudioConfig) >= 2 {
+			muxer.audioCodec = depacketizer.ACodec
+			muxer.audioConfig = depacketizer.AudioConfig
+		}
+	case "pcma", "pcmu", "opus":
+		muxer.audioCodec = depacketizer.ACodec
+	}
+	if muxer.audioCodec != "" {
+		if muxer.audioRate <= 0 {
+			muxer.audioRate = 8000
+		}
+		if muxer.audioChannels <= 0 {
+			muxer.audioChannels = 1
+		}
+		muxer.audio = &fmp4Track{id: FMP4_AUDIO_TRACK_ID, timescale: uint32(muxer.audioRate)}
+	}
+	return muxer
+}
+
+func (muxer *FMP4Muxer) HasVideo() bool {
+	return muxer.video != nil
+}
+
+func (muxer *FMP4Muxer) HasAudio() bool {
+	return muxer.audio != nil
+}
+
+//写入ftyp及moov
+func (muxer *FMP4Muxer) WriteInit() (err error) {
+	ftyp := mp4Box("ftyp", []byte("iso5"), mp4Uint32(512), []byte("iso5iso6mp41"))
+	var traks [][]byte
+	var trexs [][]byte
+	if muxer.video != nil {
+		traks = append(traks, muxer.videoTrak())
+		trexs = append(trexs, mp4Trex(muxer.video.id))
+	}
+	if muxer.audio != nil {
+		traks = append(traks, muxer.audioTrak())
+		trexs = append(trexs, mp4Trex(muxer.audio.id))
+	}
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		make([]byte, 8), // creation_time, modification_time
+		mp4Uint32(1000), // timescale
+		mp4Uint32(0),    // duration
+		mp4Uint32(0x00010000), []byte{0x01, 0x00}, make([]byte, 10),
+		mp4Matrix(),
+		make([]byte, 24), // pre_defined
+		mp4Uint32(FMP4_AUDIO_TRACK_ID+1))
+	moov := mp4Box("moov", append([][]byte{mvhd}, append(traks, mp4Box("mvex", trexs...))...)...)
+	_, err = muxer.w.Write(append(ftyp, moov...))
+	return
+}
+
+func (muxer *FMP4Muxer) videoTrak() []byte {
+	width, height := 0, 0
+	var config []byte
+	sampleEntry := "avc1"
+	if muxer.videoCodec == "h264" {
+		width, height = h264SPSResolution(muxer.sps)
+		config = mp4Box("avcC", AVCDecoderConfigurationRecord(muxer.sps, muxer.pps))
+	} else {
+		sampleEntry = "hvc1"
+		config = mp4Box("hvcC", HEVCDecoderConfigurationRecord(muxer.vps, muxer.sps, muxer.pps))
+	}
+	compressor := make([]byte, 32)
+	entry := mp4Box(sampleEntry,
+		make([]byte, 6), []byte{0x00, 0x01}, // reserved, data_reference_index
+		make([]byte, 16), // pre_defined, reserved
+		mp4Uint16(uint16(width)), mp4Uint16(uint16(height)),
+		mp4Uint32(0x00480000), mp4Uint32(0x00480000), // resolution 72dpi
+		mp4Uint32(0), mp4Uint16(1), // reserved, frame_count
+		compressor,
+		[]byte{0x00, 0x18, 0xff, 0xff}, // depth, pre_defined
+		config)
+	return muxer.trak(muxer.video, "vide", uint32(width), uint32(height),
+		mp4FullBox("vmhd", 0, 1, make([]byte, 8)), entry)
+}
+
+func (muxer *FMP4Muxer) audioTrak() []byte {
+	var entry []byte
+	header := func(entryType string, rate int, children ...[]byte) []byte {
+		return mp4Box(entryType, append([][]byte{
+			make([]byte, 6), []byte{0x00, 0x01}, // reserved, data_reference_index
+			make([]byte, 8), // reserved
+			mp4Uint16(uint16(muxer.audioChannels)), mp4Uint16(16),
+			make([]byte, 4), // pre_defined, reserved
+			mp4Uint32(uint32(rate) << 16),
+		}, children...)...)
+	}
+	switch muxer.audioCodec {
+	case "aac":
+		entry = header("mp4a", muxer.audioRate, mp4ESDS(muxer.audioConfig))
+	case "opus":
+		//opus固定48000Hz
+		dops := []byte{0x00, byte(muxer.audioChannels), 0x01, 0x38}
+		dops = append(dops, mp4Uint32(48000)...)
+		dops = append(dops, 0x00, 0x00, 0x00)
+		entry = header("Opus", 48000, mp4Box("dOps", dops))
+	case "pcma":
+		entry = header("alaw", muxer.audioRate)
+	case "pcmu":
+		entry = header("ulaw", muxer.audioRate)
+	}
+	return muxer.trak(muxer.audio, "soun", 0, 0,
+		mp4FullBox("smhd", 0, 0, make([]byte, 4)), entry)
+}
+
+func (muxer *FMP4Muxer) trak(track *fmp4Track, handler string, width uint32, height uint32, mediaHeader []byte, sampleEntry []byte) []byte {
+	volume := []byte{0x00, 0x00}
+	if handler == "soun" {
+		volume = []byte{0x01, 0x00}
+	}
+	tkhd := mp4FullBox("tkhd", 0, 0x03,
+		make([]byte, 8), // creation_time, modification_time
+		mp4Uint32(track.id),
+		make([]byte, 4), // reserved
+		mp4Uint32(0),    // duration
+		make([]byte, 8), // reserved
+		make([]byte, 4), // layer, alternate_group
+		volume, make([]byte, 2),
+		mp4Matrix(),
+		mp4Uint32(width<<16), mp4Uint32(height<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		make([]byte, 8),
+		mp4Uint32(track.timescale),
+		mp4Uint32(0),
+		[]byte{0x55, 0xc4, 0x00, 0x00}) // language und
+	name := "SoundHandler"
+	if handler == "vide" {
+		name = "VideoHandler"
+	}
+	hdlr := mp4FullBox("hdlr", 0, 0, make([]byte, 4), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)))
+	minf := mp4Box("minf", mediaHeader, dinf, stbl)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf))
+}
+
+//写入音视频帧，时间戳早于首帧的数据丢弃
+func (muxer *FMP4Muxer) WriteFrame(frame *AVFrame) error {
+	var (
+		track *fmp4Track
+		data  []byte
+	)
+	switch frame.Type {
+	case RTP_TYPE_VIDEO:
+		if muxer.video == nil {
+			return nil
+		}
+		track = muxer.video
+		for _, nalu := range frame.NALUs {
+			data = append(data, mp4Uint32(uint32(len(nalu)))...)
+			data = append(data, nalu...)
+		}
+	case RTP_TYPE_AUDIO:
+		if muxer.audio == nil {
+			return nil
+		}
+		track = muxer.audio
+		data = frame.Payload
+	default:
+		return nil
+	}
+	if !muxer.started {
+		muxer.started = true
+		muxer.baseTime = frame.Timestamp
+	}
+	if frame.Timestamp < muxer.baseTime || len(data) == 0 {
+		return nil
+	}
+	track.push(&fmp4Sample{
+		dts:  uint64(frame.Timestamp-muxer.baseTime) * uint64(track.timescale) / uint64(time.Second),
+		key:  frame.Type == RTP_TYPE_AUDIO || frame.KeyFrame,
+		data: data,
+	})
+	return nil
+}
+
+//将已确定时长的sample写为一个moof+mdat分片
+func (muxer *FMP4Muxer) Flush() (err error) {
+	var tracks []*fmp4Track
+	for _, track := range []*fmp4Track{muxer.video, muxer.audio} {
+		if track != nil && len(track.samples) > 0 {
+			tracks = append(tracks, track)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	muxer.sequence++
+	//先按data_offset为0计算moof长度，再回填
+	build := func(offsets []uint32) []byte {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, mp4Uint32(muxer.sequence))}
+		for i, track := range tracks {
+			entries := bytes.Buffer{}
+			for _, sample := range track.samples {
+				flags := uint32(fmp4SampleFlagsNonKey)
+				if sample.key {
+					flags = fmp4SampleFlagsKey
+				}
+				entries.Write(mp4Uint32(sample.duration))
+				entries.Write(mp4Uint32(uint32(len(sample.data))))
+				entries.Write(mp4Uint32(flags))
+			}
+			trafs = append(trafs, mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, mp4Uint32(track.id)),
+				mp4FullBox("tfdt", 1, 0, mp4Uint64(track.samples[0].dts)),
+				mp4FullBox("trun", 0, 0x000701, mp4Uint32(uint32(len(track.samples))), mp4Uint32(offsets[i]), entries.Bytes())))
+		}
+		return mp4Box("moof", trafs...)
+	}
+	offsets := make([]uint32, len(tracks))
+	moofSize := uint32(len(build(offsets)))
+	mdat := bytes.Buffer{}
+	for i, track := range tracks {
+		offsets[i] = moofSize + 8 + uint32(mdat.Len())
+		for _, sample := range track.samples {
+			mdat.Write(sample.data)
+		}
+	}
+	fragment := append(build(offsets), mp4Box("mdat", mdat.Bytes())...)
+	for _, track := range tracks {
+		track.samples = nil
+	}
+	_, err = muxer.w.Write(fragment)
+	return
+}
+
+//输出缓存中的全部数据
+func (muxer *FMP4Muxer) Close() error {
+	for _, track := range []*fmp4Track{muxer.video, muxer.audio} {
+		if track != nil {
+			track.flushPending()
+		}
+	}
+	return muxer.Flush()
+}
+
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	box := make([]byte, 4, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	box = append(box, boxType...)
+	for _, payload := range payloads {
+		box = append(box, payload...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+func mp4Uint16(v uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, v)
+	return buf
+}
+
+func mp4Uint32(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return buf
+}
+
+func mp4Uint64(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+
+func mp4Matrix() []byte {
+	matrix := bytes.Buffer{}
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix.Write(mp4Uint32(v))
+	}
+	return matrix.Bytes()
+}
+
+func mp4Trex(trackID uint32) []byte {
+	return mp4FullBox("trex", 0, 0, mp4Uint32(trackID), mp4Uint32(1), mp4Uint32(0), mp4Uint32(0), mp4Uint32(0))
+}
+
+//ISO/IEC 14496-1 ES_Descriptor，aac AudioSpecificConfig
+func mp4ESDS(config []byte) []byte {
+	descriptor := func(tag byte, payload ...[]byte) []byte {
+		body := bytes.Join(payload, nil)
+		return append([]byte{tag, 0x80, 0x80, 0x80, byte(len(body))}, body...)
+	}
+	decoderConfig := descriptor(0x04,
+		[]byte{0x40, 0x15, 0x00, 0x00, 0x00}, // mpeg4 audio, audio stream, bufferSizeDB
+		mp4Uint32(0), mp4Uint32(0),           // maxBitrate, avgBitrate
+		descriptor(0x05, config))
+	es := descriptor(0x03, []byte{0x00, FMP4_AUDIO_TRACK_ID, 0x00}, decoderConfig, descriptor(0x06, []byte{0x02}))
+	return mp4FullBox("esds", 0, 0, es)
+}
+
+//h264 sps中的图像宽高，解析失败返回0
+func h264SPSResolution(sps []byte) (width int, height int) {
+	rbsp := removeEmulationPrevention(sps)
+	pos := 8
+	read := func(n int) int {
+		v := readBits(rbsp, pos, n)
+		pos += n
+		return v
+	}
+	ue := func() int {
+		zeros := 0
+		for {
+			b := read(1)
+			if b < 0 || zeros > 31 {
+				return -1
+			}
+			if b == 1 {
+				break
+			}
+			zeros++
+		}
+		if zeros == 0 {
+			return 0
+		}
+		return 1<<uint(zeros) - 1 + read(zeros)
+	}
+	se := func() int {
+		v := ue()
+		if v%2 == 1 {
+			return (v + 1) / 2
+		}
+		return -v / 2
+	}
+	profile := read(8)
+	read(16) // constraint flags, level
+	ue()     // seq_parameter_set_id
+	chromaFormat := 1
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = ue(); chromaFormat == 3 {
+			read(1)
+		}
+		ue()    // bit_depth_luma_minus8
+		ue()    // bit_depth_chroma_minus8
+		read(1) // qpprime_y_zero_transform_bypass_flag
+		if read(1) == 1 {
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if read(1) != 1 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	ue() // log2_max_frame_num_minus4
+	switch ue() {
+	case 0:
+		ue()
+	case 1:
+		read(1)
+		se()
+		se()
+		for n := ue(); n > 0; n-- {
+			se()
+		}
+	}
+	ue()    // max_num_ref_frames
+	read(1) // gaps_in_frame_num_value_allowed_flag
+	mbWidth, mbHeight := ue()+1, ue()+1
+	frameMbsOnly := read(1)
+	if frameMbsOnly == 0 {
+		read(1)
+	}
+	read(1) // direct_8x8_inference_flag
+	width, height = mbWidth*16, (2-frameMbsOnly)*mbHeight*16
+	if read(1) == 1 {
+		left, right, top, bottom := ue(), ue(), ue(), ue()
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, cropY*2
+		case 2:
+			cropX = 2
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+	if pos > len(rbsp)*8 || width <= 0 || height <= 0 {
+		return 0, 0
+	}
+	return
+}
+
+func (sample *fmp4Sample) String() string {
+	return fmt.Sprintf("sample[dts:%d][duration:%d][key:%v][size:%d]", sample.dts, sample.duration, sample.key, len(sample.data))
+}
@@ -0,0 +1,334 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//EXT-X-TARGETDURATION在切片时长基础上预留的关键帧间隔
+	HLS_TARGET_DURATION_SLACK = 4 * time.Second
+)
+
+//内存中的hls切片
+type hlsSegment struct {
+	seq       int
+	start     time.Duration
+	duration  time.Duration
+	createAt  time.Time
+	data      bytes.Buffer
+	parts     []*hlsPart
+	completed bool
+}
+
+//LL-HLS 部分切片，为所属切片数据中的一段
+type hlsPart struct {
+	index       int
+	start       time.Duration
+	duration    time.Duration
+	offset      int
+	length      int
+	independent bool
+	completed   bool
+}
+
+//将推流rtp直接封装为内存中的hls(LL-HLS)切片
+type HLSMuxer struct {
+	SessionLogger
+	streamPath      string
+	segmentDuration time.Duration
+	targetDuration  time.Duration //启动时确定，之后不再变化
+	segmentCount    int
+	lowLatency      bool
+	partDuration    time.Duration
+
+	depacketizer *RTPDepacketizer
+	tsMuxer      *TSMuxer
+
+	lock     sync.RWMutex
+	notify   chan struct{}
+	segments []*hlsSegment
+	current  *hlsSegment
+	nextSeq  int
+	lastTime time.Duration
+	closed   bool
+}
+
+func NewHLSMuxer(pusher *Pusher) *HLSMuxer {
+	server := pusher.Server()
+	muxer := &HLSMuxer{
+		SessionLogger:   SessionLogger{pusher.Logger()},
+		streamPath:      pusher.Path(),
+		segmentDuration: server.hlsSegmentDuration,
+		targetDuration:  time.Duration(math.Ceil((server.hlsSegmentDuration+HLS_TARGET_DURATION_SLACK).Seconds())) * time.Second,
+		segmentCount:    server.hlsSegmentCount,
+		lowLatency:      server.llHlsEnable,
+		partDuration:    server.llHlsPartDuration,
+		notify:          make(chan struct{}),
+	}
+	if muxer.segmentCount < 3 {
+		muxer.segmentCount = 3
+	}
+	muxer.depacketizer = NewRTPDepacketizer(pusher.SDPRaw(), muxer.writeFrame)
+	muxer.depacketizer.Timeline = pusher.timeline
+	muxer.tsMuxer = NewTSMuxer(nil, muxer.depacketizer.VCodec, muxer.depacketizer.ACodec, muxer.depacketizer.AudioConfig)
+	return muxer
+}
+
+func (muxer *HLSMuxer) WriteRTP(pack *RTPPack) {
+	muxer.depacketizer.WriteRTP(pack)
+}
+
+func (muxer *HLSMuxer) Close() {
+	muxer.lock.Lock()
+	defer muxer.lock.Unlock()
+	if muxer.closed {
+		return
+	}
+	muxer.closed = true
+	close(muxer.notify)
+}
+
+func (muxer *HLSMuxer) writeFrame(frame *AVFrame) {
+	hasVideo := muxer.tsMuxer.videoCodec != ""
+	if frame.Type == RTP_TYPE_VIDEO && !hasVideo || frame.Type == RTP_TYPE_AUDIO && muxer.tsMuxer.audioCodec == "" {
+		return
+	}
+	muxer.lock.Lock()
+	defer muxer.lock.Unlock()
+	if muxer.closed {
+		return
+	}
+	//有视频时切片必须从关键帧开始
+	cut := false
+	if muxer.current == nil {
+		if hasVideo && !(frame.Type == RTP_TYPE_VIDEO && frame.KeyFrame) {
+			return
+		}
+		cut = true
+	} else if elapsed := frame.Timestamp - muxer.current.start; elapsed >= muxer.targetDuration {
+		//关键帧间隔过长时强制切片，保证切片时长不超过EXT-X-TARGETDURATION
+		cut = true
+	} else if elapsed >= muxer.segmentDuration {
+		cut = !hasVideo || frame.Type == RTP_TYPE_VIDEO && frame.KeyFrame
+	}
+	changed := false
+	if cut {
+		muxer.startSegment(frame.Timestamp)
+		changed = true
+	} else if muxer.lowLatency {
+		part := muxer.current.parts[len(muxer.current.parts)-1]
+		if frame.Timestamp-part.start >= muxer.partDuration && (frame.Type == RTP_TYPE_VIDEO || !hasVideo) {
+			muxer.startPart(frame.Timestamp, frame.KeyFrame)
+			changed = true
+		}
+	}
+	if err := muxer.tsMuxer.WriteFrame(frame); err != nil {
+		muxer.logger.Printf("hls mux frame error:%v", err)
+	}
+	if frame.Timestamp > muxer.lastTime {
+		muxer.lastTime = frame.Timestamp
+	}
+	if changed {
+		muxer.broadcast()
+	}
+}
+
+func (muxer *HLSMuxer) startSegment(start time.Duration) {
+	if muxer.current != nil {
+		muxer.finishPart(start)
+		muxer.current.duration = start - muxer.current.start
+		muxer.current.completed = true
+		muxer.segments = append(muxer.segments, muxer.current)
+		if len(muxer.segments) > muxer.segmentCount {
+			muxer.segments = muxer.segments[len(muxer.segments)-muxer.segmentCount:]
+		}
+	}
+	muxer.current = &hlsSegment{
+		seq:      muxer.nextSeq,
+		start:    start,
+		createAt: time.Now(),
+	}
+	muxer.nextSeq++
+	muxer.tsMuxer.SetWriter(&muxer.current.data)
+	muxer.current.parts = append(muxer.current.parts, &hlsPart{start: start, independent: true})
+	if err := muxer.tsMuxer.WriteTables(); err != nil {
+		muxer.logger.Printf("hls write ts tables error:%v", err)
+	}
+}
+
+func (muxer *HLSMuxer) startPart(start time.Duration, independent bool) {
+	muxer.finishPart(start)
+	segment := muxer.current
+	segment.parts = append(segment.parts, &hlsPart{
+		index:       len(segment.parts),
+		start:       start,
+		offset:      segment.data.Len(),
+		independent: independent,
+	})
+	//每个部分切片都带有PAT、PMT，可单独请求播放
+	if err := muxer.tsMuxer.WriteTables(); err != nil {
+		muxer.logger.Printf("hls write ts tables error:%v", err)
+	}
+}
+
+func (muxer *HLSMuxer) finishPart(end time.Duration) {
+	if muxer.current == nil || len(muxer.current.parts) == 0 {
+		return
+	}
+	part := muxer.current.parts[len(muxer.current.parts)-1]
+	part.duration = end - part.start
+	part.length = muxer.current.data.Len() - part.offset
+	part.completed = true
+}
+
+func (muxer *HLSMuxer) broadcast() {
+	close(muxer.notify)
+	muxer.notify = make(chan struct{})
+}
+
+//等待切片变化，超时或关闭返回false
+func (muxer *HLSMuxer) wait(timeout time.Duration, ready func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		muxer.lock.RLock()
+		ok := ready()
+		closed := muxer.closed
+		notify := muxer.notify
+		muxer.lock.RUnlock()
+		if ok {
+			return true
+		}
+		if closed {
+			return false
+		}
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return false
+		}
+		select {
+		case <-notify:
+		case <-time.After(remain):
+			return false
+		}
+	}
+}
+
+func (muxer *HLSMuxer) findSegment(seq int) *hlsSegment {
+	if muxer.current != nil && muxer.current.seq == seq {
+		return muxer.current
+	}
+	for _, segment := range muxer.segments {
+		if segment.seq == seq {
+			return segment
+		}
+	}
+	return nil
+}
+
+//阻塞直到指定切片(部分切片)生成, LL-HLS 的 _HLS_msn/_HLS_part 阻塞刷新
+func (muxer *HLSMuxer) WaitFor(msn int, part int) bool {
+	timeout := 3 * muxer.segmentDuration
+	return muxer.wait(timeout, func() bool {
+		segment := muxer.findSegment(msn)
+		if segment == nil {
+			return muxer.current != nil && muxer.current.seq > msn
+		}
+		if segment.completed {
+			return true
+		}
+		if part < 0 {
+			return false
+		}
+		return part < len(segment.parts) && segment.parts[part].completed
+	})
+}
+
+//等待第一个切片完成，刚开始推流时播放列表为空
+func (muxer *HLSMuxer) WaitReady(timeout time.Duration) bool {
+	return muxer.wait(timeout, func() bool {
+		return len(muxer.segments) > 0
+	})
+}
+
+func (muxer *HLSMuxer) Segment(seq int) ([]byte, bool) {
+	muxer.lock.RLock()
+	defer muxer.lock.RUnlock()
+	segment := muxer.findSegment(seq)
+	if segment == nil || !segment.completed {
+		return nil, false
+	}
+	return segment.data.Bytes(), true
+}
+
+func (muxer *HLSMuxer) Part(seq int, index int) ([]byte, bool) {
+	if !muxer.WaitFor(seq, index) {
+		return nil, false
+	}
+	muxer.lock.RLock()
+	defer muxer.lock.RUnlock()
+	segment := muxer.findSegment(seq)
+	if segment == nil || index >= len(segment.parts) || !segment.parts[index].completed {
+		return nil, false
+	}
+	part := segment.parts[index]
+	data := segment.data.Bytes()
+	return data[part.offset : part.offset+part.length], true
+}
+
+func formatHlsDuration(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
+
+func (muxer *HLSMuxer) Playlist() string {
+	muxer.lock.RLock()
+	defer muxer.lock.RUnlock()
+	name := path.Base(muxer.streamPath)
+	builder := strings.Builder{}
+	builder.WriteString("#EXTM3U\n")
+	if muxer.lowLatency {
+		builder.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		builder.WriteString("#EXT-X-VERSION:3\n")
+	}
+	builder.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(muxer.targetDuration.Seconds())))
+	if len(muxer.segments) > 0 {
+		builder.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", muxer.segments[0].seq))
+	}
+	if muxer.lowLatency {
+		builder.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s\n", formatHlsDuration(3*muxer.partDuration)))
+		builder.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%s\n", formatHlsDuration(muxer.partDuration)))
+	}
+	for i, segment := range muxer.segments {
+		builder.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.createAt.UTC().Format("2006-01-02T15:04:05.000Z")))
+		//只保留最近几个切片的部分切片信息
+		if muxer.lowLatency && i >= len(muxer.segments)-2 {
+			muxer.writeParts(&builder, name, segment)
+		}
+		builder.WriteString(fmt.Sprintf("#EXTINF:%s,\n", formatHlsDuration(segment.duration)))
+		builder.WriteString(fmt.Sprintf("%s/%d.ts\n", name, segment.seq))
+	}
+	if muxer.lowLatency && muxer.current != nil {
+		muxer.writeParts(&builder, name, muxer.current)
+		builder.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s/%d.%d.ts\"\n", name, muxer.current.seq, len(muxer.current.parts)-1))
+	}
+	return builder.String()
+}
+
+func (muxer *HLSMuxer) writeParts(builder *strings.Builder, name string, segment *hlsSegment) {
+	for _, part := range segment.parts {
+		if !part.completed {
+			continue
+		}
+		independent := ""
+		if part.independent {
+			independent = ",INDEPENDENT=YES"
+		}
+		builder.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%s,URI=\"%s/%d.%d.ts\"%s\n", formatHlsDuration(part.duration), name, segment.seq, part.index, independent))
+	}
+}
@@ -1,9 +1,7 @@
 package rtsp
 
 import (
-	"crypto/md5"
 	"fmt"
-	"github.com/ReneKroon/ttlcache"
 	"github.com/bruce-qin/EasyGoLib/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -12,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -19,11 +18,8 @@ import (
 
 const GIN_HTTP_STREAM_INFO_STORAGE_KEY = "httpStreamInfo"
 
-const cookieName string = "x-token"
-
 var (
-	tokenNonceCache *ttlcache.Cache
-	spaceRegex      = regexp.MustCompile("[ ]+")
+	spaceRegex = regexp.MustCompile("[ ]+")
 )
 
 type MediaStreamGinHandler struct {
@@ -34,7 +30,6 @@ type HttpPlayStreamInfo struct {
 	id         string
 	rtspPath   string
 	fullPath   string
-	nonce      string
 	authCookie string
 	overed     bool
 	mediaData  chan *[]byte
@@ -53,13 +48,6 @@ type MediaUdpDataListener struct {
 	pusher        *Pusher
 }
 
-func init() {
-	server := GetServer()
-	if (server.EnableAudioHttpStream || server.EnableVideoHttpStream) && (server.remoteHttpAuthorizationEnable || server.localAuthorizationEnable) {
-		tokenNonceCache = ttlcache.NewCache()
-	}
-}
-
 func (info *HttpPlayStreamInfo) ToRtspWebHookInfo(actionType WebHookActionType) (webHook *WebHookInfo) {
 	return &WebHookInfo{
 		ID:          info.id,
@@ -213,69 +201,68 @@ func generateHttpStreamInfo(c *gin.Context) *HttpPlayStreamInfo {
 		id := shortid.MustGenerate()
 		info := &HttpPlayStreamInfo{
 			id:        id,
-			rtspPath:  c.Request.URL.Path,
+			rtspPath:  mediaStreamPath(c.Request.URL.Path),
 			fullPath:  c.Request.RequestURI,
 			overed:    false,
 			mediaData: make(chan *[]byte, 128),
 			clientAdd: strings.Split(c.Request.RemoteAddr, ":")[0],
 		}
-		server := GetServer()
-		if server.localAuthorizationEnable || server.remoteHttpAuthorizationEnable {
-			var nonce, token string
-			if token, _ = c.Cookie(cookieName); token != "" {
-				if cacheNonce, exist := tokenNonceCache.Get(token); exist {
-					nonce = cacheNonce.(string)
-				}
-			} else {
-				token = fmt.Sprintf("%x", md5.Sum([]byte(shortid.MustGenerate())))
-				c.SetCookie(cookieName, token, 60, "/", "", true, true)
-			}
-			if nonce == "" {
-				nonce = fmt.Sprintf("%x", md5.Sum([]byte(shortid.MustGenerate())))
-			}
-			tokenNonceCache.SetWithTTL(token, nonce, time.Duration(60)*time.Second)
-			info.nonce = nonce
-		}
 		c.Set(GIN_HTTP_STREAM_INFO_STORAGE_KEY, info)
 		return info
 	}
 }
 
-func (handler MediaStreamGinHandler) BeforeProcessMediaStream(c *gin.Context) {
-	streamInfo := generateHttpStreamInfo(c)
+//http拉流地址对应的推流路径
+// /live/test.m3u8 -> /live/test , /live/test/3.ts -> /live/test , /flv/live/test.flv -> /live/test , /whep/live/test -> /live/test
+func mediaStreamPath(urlPath string) string {
+	if strings.HasPrefix(urlPath, WHEP_URL_PREFIX+"/") {
+		return strings.TrimPrefix(urlPath, WHEP_URL_PREFIX)
+	}
+	if strings.HasPrefix(urlPath, WHIP_URL_PREFIX+"/") {
+		return strings.TrimPrefix(urlPath, WHIP_URL_PREFIX)
+	}
+	switch strings.ToLower(path.Ext(urlPath)) {
+	case ".flv":
+		return strings.TrimPrefix(strings.TrimSuffix(urlPath, path.Ext(urlPath)), FLV_URL_PREFIX)
+	case ".m3u8":
+		return strings.TrimSuffix(urlPath, path.Ext(urlPath))
+	case ".ts":
+		return path.Dir(urlPath)
+	}
+	return urlPath
+}
+
+//http拉流身份认证，与rtsp拉流使用相同的本地/远程认证，失败时返回401
+func checkHttpStreamAuthorization(c *gin.Context, streamInfo *HttpPlayStreamInfo, sessionType SessionType) bool {
 	server := GetServer()
 	logger := server.logger
-	//身份认证
-	if server.localAuthorizationEnable || server.remoteHttpAuthorizationEnable {
-		authLine := c.GetHeader("Authorization")
-		authFailed := true
-		if authLine != "" {
-			info, err := DecodeAuthorizationInfo(authLine, streamInfo.nonce, c.Request.Method, SESSEION_TYPE_PLAYER)
-			if err != nil {
-				logger.Printf("%v", err)
-			} else if server.localAuthorizationEnable {
-				if err = info.CheckAuthLocal(); err != nil {
-					logger.Printf("%v", err)
-				} else {
-					authFailed = false
-				}
-			} else if server.remoteHttpAuthorizationEnable {
-				if err = info.CheckAuthHttpRemote(); err != nil {
-					logger.Printf("%v", err)
-				} else {
-					authFailed = false
-				}
-			}
-		}
-		if authFailed {
-			if server.authorizationType == "Basic" {
-				c.Header("WWW-Authenticate", `Basic realm="EasyDarwin"`)
-			} else {
-				c.Header("WWW-Authenticate", fmt.Sprintf(`Digest realm="EasyDarwin", nonce="%s", algorithm="MD5"`, streamInfo.nonce))
-			}
-			_ = c.AbortWithError(401, fmt.Errorf("Unauthorized"))
+	if !server.localAuthorizationEnable && !server.remoteHttpAuthorizationEnable {
+		return true
+	}
+	authLine := c.GetHeader("Authorization")
+	stale := false
+	if authLine != "" {
+		var err error
+		if stale, err = server.CheckAuthorization(authLine, c.Request.Method, c.Request.RequestURI, sessionType); err != nil {
+			logger.Printf("%v", err)
+		} else {
+			return true
 		}
 	}
+	for _, value := range server.AuthenticateHeaders(stale) {
+		c.Writer.Header().Add("WWW-Authenticate", value)
+	}
+	_ = c.AbortWithError(401, fmt.Errorf("Unauthorized"))
+	return false
+}
+
+func (handler MediaStreamGinHandler) BeforeProcessMediaStream(c *gin.Context) {
+	streamInfo := generateHttpStreamInfo(c)
+	server := GetServer()
+	//身份认证失败时已返回401
+	if !checkHttpStreamAuthorization(c, streamInfo, SESSEION_TYPE_PLAYER) {
+		return
+	}
 	//拉流通知
 	webHookInfo := streamInfo.ToRtspWebHookInfo(ON_PLAY)
 	if webHookInfo.ExecuteWebHookNotify() {
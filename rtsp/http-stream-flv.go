@@ -0,0 +1,97 @@
+package rtsp
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const FLV_URL_PREFIX = "/flv"
+
+//http-flv拉流端
+type FlvPlayer struct {
+	*mediaPlayerBase
+	writer       gin.ResponseWriter
+	depacketizer *RTPDepacketizer
+	muxer        *FLVMuxer
+	err          error
+}
+
+func NewFlvPlayer(id string, clientAddr string, pusher *Pusher, writer gin.ResponseWriter) *FlvPlayer {
+	player := &FlvPlayer{
+		mediaPlayerBase: newMediaPlayerBase(id, "HTTP-FLV", clientAddr, pusher),
+		writer:          writer,
+	}
+	player.depacketizer = NewRTPDepacketizer(pusher.SDPRaw(), player.writeFrame)
+	player.depacketizer.Timeline = pusher.timeline
+	player.muxer = NewFLVMuxer(player, player.depacketizer)
+	return player
+}
+
+func (player *FlvPlayer) Write(p []byte) (n int, err error) {
+	n, err = player.writer.Write(p)
+	player.outBytes += n
+	return
+}
+
+func (player *FlvPlayer) writeFrame(frame *AVFrame) {
+	if player.err != nil {
+		return
+	}
+	player.err = player.muxer.WriteFrame(frame)
+}
+
+func (player *FlvPlayer) handleRTP(pack *RTPPack) error {
+	player.depacketizer.WriteRTP(pack)
+	if player.err != nil {
+		return player.err
+	}
+	player.writer.Flush()
+	return nil
+}
+
+//http-flv输出
+// /flv/{path}.flv
+func (handler VideoStreamGinHandler) ProcessFlvStream(c *gin.Context) {
+	urlPath := c.Request.URL.Path
+	if !strings.HasPrefix(urlPath, FLV_URL_PREFIX+"/") || strings.ToLower(path.Ext(urlPath)) != ".flv" {
+		return
+	}
+	defer c.Abort()
+	streamInfo := generateHttpStreamInfo(c)
+	server := GetServer()
+	defer streamInfo.ToRtspWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+	pusher := server.GetPusher(streamInfo.rtspPath)
+	if pusher == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	player := NewFlvPlayer(streamInfo.id, streamInfo.clientAdd, pusher, c.Writer)
+	if !player.muxer.HasVideo() && !player.muxer.HasAudio() {
+		server.logger.Printf("%v unsupported codec for flv, sdp:%s", player, pusher.SDPRaw())
+		c.Status(http.StatusUnsupportedMediaType)
+		return
+	}
+	c.Header("Content-Type", "video/x-flv")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	if err := player.muxer.WriteHeader(); err != nil {
+		return
+	}
+	c.Writer.Flush()
+	defer pusher.RemoveMediaPlayer(player)
+	defer player.Stop()
+	//客户端断开时停止
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			player.Stop()
+		case <-done:
+		}
+	}()
+	pusher.AddMediaPlayer(player)
+	player.run(player.handleRTP)
+}
@@ -0,0 +1,158 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//单个nalu的h264 rtp包
+func newTestH264Pack(seq uint16, timestamp uint32, nalu []byte) *RTPPack {
+	packet := []byte{0x80, 0x80 | 96, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	return &RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(append(packet, nalu...))}
+}
+
+//记录收到的webhook动作，全部返回允许
+type testWebHookServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	actions []WebHookActionType
+}
+
+func newTestWebHookServer(t *testing.T) *testWebHookServer {
+	hook := &testWebHookServer{}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info WebHookInfo
+		json.NewDecoder(r.Body).Decode(&info)
+		hook.lock.Lock()
+		hook.actions = append(hook.actions, info.ActionType)
+		hook.lock.Unlock()
+		w.Write([]byte("0"))
+	}))
+	server := GetServer()
+	onPlay, onStop := server.onPlay, server.onStop
+	server.onPlay, server.onStop = []string{hook.URL}, []string{hook.URL}
+	t.Cleanup(func() {
+		server.onPlay, server.onStop = onPlay, onStop
+		hook.Close()
+	})
+	return hook
+}
+
+func (hook *testWebHookServer) Actions() []WebHookActionType {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	return append([]WebHookActionType{}, hook.actions...)
+}
+
+//与hls端口上的注册方式相同
+func newTestVideoStreamRouter() *gin.Engine {
+	router := gin.New()
+	handler := VideoStreamGinHandler{MediaStreamGinHandler: &MediaStreamGinHandler{}}
+	router.Use(handler.BeforeProcessMediaStream, handler.ProcessFlvStream)
+	return router
+}
+
+func readTestFLVTag(t *testing.T, r io.Reader) (tagType byte, data []byte) {
+	header := make([]byte, 11)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	data = make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3])+4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.BigEndian.Uint32(data[len(data)-4:]); size != uint32(len(data)-4+11) {
+		t.Fatalf("previous tag size = %d", size)
+	}
+	return header[0], data[:len(data)-4]
+}
+
+func TestFlvStream(t *testing.T) {
+	server := startTestServer(t)
+	pusher := newTestPusher(t, server, "/live/flv")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	hook := newTestWebHookServer(t)
+	//流不存在时不等待
+	hold := server.streamNotExistHoldMillisecond
+	server.streamNotExistHoldMillisecond = 0
+	defer func() {
+		server.streamNotExistHoldMillisecond = hold
+	}()
+	httpServer := httptest.NewServer(newTestVideoStreamRouter())
+	defer httpServer.Close()
+	if response, err := http.Get(httpServer.URL + "/flv/live/none.flv"); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("response = %v err = %v", response, err)
+	}
+	//播放前的关键帧在gop缓存中，播放从关键帧开始
+	pusher.QueueRTP(newTestH264Pack(1, 0, []byte{0x65, 0x88, 0x80}))
+	pusher.QueueRTP(newTestH264Pack(2, 3600, []byte{0x41, 0x9a}))
+	for i := 0; i < 100 && len(pusher.queue) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	response, err := http.Get(httpServer.URL + "/flv/live/flv.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "video/x-flv" {
+		t.Fatalf("status = %d header = %v", response.StatusCode, response.Header)
+	}
+	header := make([]byte, 13)
+	if _, err = io.ReadFull(response.Body, header); err != nil {
+		t.Fatal(err)
+	}
+	if string(header[:3]) != "FLV" || header[4] != 0x05 {
+		t.Fatalf("flv header = %x", header)
+	}
+	pusher.QueueRTP(newTestH264Pack(3, 7200, []byte{0x41, 0x9b}))
+	tests := []struct {
+		tagType byte
+		prefix  []byte
+	}{
+		//avc sequence header
+		{9, []byte{0x17, 0}},
+		{9, []byte{0x17, 1}},
+		{9, []byte{0x27, 1}},
+	}
+	for i, test := range tests {
+		tagType, data := readTestFLVTag(t, response.Body)
+		if tagType != test.tagType || !bytes.HasPrefix(data, test.prefix) {
+			t.Fatalf("tag %d = %d %x", i, tagType, data)
+		}
+	}
+	players := pusher.GetMediaPlayers()
+	if len(players) != 1 {
+		t.Fatalf("players = %v", players)
+	}
+	for _, player := range players {
+		if player.TransType() != "HTTP-FLV" {
+			t.Fatalf("player = %v", player)
+		}
+	}
+	response.Body.Close()
+	for i := 0; i < 100 && len(pusher.GetMediaPlayers()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if players = pusher.GetMediaPlayers(); len(players) != 0 {
+		t.Fatalf("players = %v", players)
+	}
+	for i := 0; i < 100 && len(hook.Actions()) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	//不存在的流同样通知on_play及on_stop
+	if actions := hook.Actions(); len(actions) != 4 || actions[0] != ON_PLAY || actions[1] != ON_STOP || actions[2] != ON_PLAY || actions[3] != ON_STOP {
+		t.Fatalf("actions = %v", actions)
+	}
+}
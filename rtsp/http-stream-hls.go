@@ -5,6 +5,10 @@ import (
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -48,10 +52,75 @@ func InitHlsStream() (err error) {
 	}))
 	//id := shortid.MustGenerate()
 	HlsStreamRouter.Use(hlsStreamGinHandler.BeforeProcessMediaStream)
-	HlsStreamRouter.Use(static.Serve("/", static.LocalFile(GetServer().NginxRtmpHlsMapDir, false)))
+	HlsStreamRouter.Use(hlsStreamGinHandler.ProcessFlvStream)
+	if GetServer().hlsEnable {
+		HlsStreamRouter.Use(hlsStreamGinHandler.ProcessHlsStream)
+	} else {
+		HlsStreamRouter.Use(static.Serve("/", static.LocalFile(GetServer().NginxRtmpHlsMapDir, false)))
+	}
 	return nil
 }
 
+//内存hls输出
+// 播放列表: /{path}.m3u8 , 切片: /{path}/{seq}.ts , LL-HLS部分切片: /{path}/{seq}.{part}.ts
+func (handler VideoStreamGinHandler) ProcessHlsStream(c *gin.Context) {
+	streamInfo := generateHttpStreamInfo(c)
+	server := GetServer()
+	pusher := server.GetPusher(streamInfo.rtspPath)
+	if pusher == nil || pusher.HLSMuxer() == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	muxer := pusher.HLSMuxer()
+	urlPath := c.Request.URL.Path
+	switch strings.ToLower(path.Ext(urlPath)) {
+	case ".m3u8":
+		if msn, err := strconv.Atoi(c.Query("_HLS_msn")); err == nil {
+			part, err := strconv.Atoi(c.Query("_HLS_part"))
+			if err != nil {
+				part = -1
+			}
+			if !muxer.WaitFor(msn, part) {
+				c.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+		} else if !muxer.WaitReady(3 * server.hlsSegmentDuration) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(muxer.Playlist()))
+	case ".ts":
+		name := strings.Split(strings.TrimSuffix(path.Base(urlPath), path.Ext(urlPath)), ".")
+		seq, err := strconv.Atoi(name[0])
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		var (
+			data []byte
+			ok   bool
+		)
+		if len(name) > 1 {
+			index, err := strconv.Atoi(name[1])
+			if err != nil {
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+			data, ok = muxer.Part(seq, index)
+		} else {
+			data, ok = muxer.Segment(seq)
+		}
+		if !ok {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Data(http.StatusOK, "video/mp2t", data)
+	default:
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
 //func NewMp4UdpDataListener(pusher *Pusher) (listener *VideoUdpDataListener) {
 //    return &VideoUdpDataListener{
 //        MediaUdpDataListener: newMediaStreamLocalListener(pusher),
@@ -0,0 +1,133 @@
+package rtsp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//非rtsp协议的拉流端，如http-flv、rtmp、webrtc，由Pusher.BroadcastRTP分发rtp包
+type MediaPlayer interface {
+	ID() string
+	Path() string
+	TransType() string
+	ClientAddr() string
+	InBytes() int
+	OutBytes() int
+	StartAt() time.Time
+	QueueRTP(pack *RTPPack)
+	Stop()
+}
+
+//MediaPlayer通用实现，rtp包缓存在队列中，由具体协议在自己的协程中取出发送
+type mediaPlayerBase struct {
+	SessionLogger
+	id         string
+	path       string
+	transType  string
+	clientAddr string
+	startAt    time.Time
+	inBytes    int
+	outBytes   int
+	pusher     *Pusher
+
+	queue       chan *RTPPack
+	queueLock   sync.Mutex
+	stoped      bool
+	dropped     int
+	StopHandles []func()
+}
+
+func newMediaPlayerBase(id string, transType string, clientAddr string, pusher *Pusher) *mediaPlayerBase {
+	return &mediaPlayerBase{
+		SessionLogger: SessionLogger{pusher.Logger()},
+		id:            id,
+		path:          pusher.Path(),
+		transType:     transType,
+		clientAddr:    clientAddr,
+		startAt:       time.Now(),
+		pusher:        pusher,
+		queue:         make(chan *RTPPack, MAX_GOP_CACHE_LEN*4),
+		StopHandles:   make([]func(), 0),
+	}
+}
+
+func (player *mediaPlayerBase) String() string {
+	return fmt.Sprintf("player[%s][%s][%s][%s]", player.transType, player.path, player.id, player.clientAddr)
+}
+
+func (player *mediaPlayerBase) ID() string {
+	return player.id
+}
+
+func (player *mediaPlayerBase) Path() string {
+	return player.path
+}
+
+func (player *mediaPlayerBase) TransType() string {
+	return player.transType
+}
+
+func (player *mediaPlayerBase) ClientAddr() string {
+	return player.clientAddr
+}
+
+func (player *mediaPlayerBase) InBytes() int {
+	return player.inBytes
+}
+
+func (player *mediaPlayerBase) OutBytes() int {
+	return player.outBytes
+}
+
+func (player *mediaPlayerBase) StartAt() time.Time {
+	return player.startAt
+}
+
+func (player *mediaPlayerBase) Stoped() bool {
+	return player.stoped
+}
+
+//队列满时丢弃，避免慢速客户端阻塞推流分发
+func (player *mediaPlayerBase) QueueRTP(pack *RTPPack) {
+	if pack == nil {
+		return
+	}
+	player.queueLock.Lock()
+	defer player.queueLock.Unlock()
+	if player.stoped {
+		return
+	}
+	select {
+	case player.queue <- pack:
+	default:
+		player.dropped++
+		if player.dropped%100 == 1 {
+			player.logger.Printf("%v queue full, dropped %d packets", player, player.dropped)
+		}
+	}
+}
+
+func (player *mediaPlayerBase) Stop() {
+	player.queueLock.Lock()
+	if player.stoped {
+		player.queueLock.Unlock()
+		return
+	}
+	player.stoped = true
+	close(player.queue)
+	player.queueLock.Unlock()
+	for _, h := range player.StopHandles {
+		h()
+	}
+}
+
+//循环取出rtp包交给handle处理，直到停止或handle返回错误
+func (player *mediaPlayerBase) run(handle func(pack *RTPPack) error) {
+	for pack := range player.queue {
+		if err := handle(pack); err != nil {
+			player.logger.Printf("%v send error:%v", player, err)
+			break
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/bruce-qin/EasyGoLib/utils"
+)
+
+const (
+	//录像写入队列长度，磁盘阻塞时丢弃多余的包
+	MP4_RECORD_QUEUE_LEN = 4096
+	//无关键帧时最长的分片时长
+	MP4_FRAGMENT_DURATION = 2 * time.Second
+	//同名录像文件追加序号的最大次数
+	MP4_RECORD_NAME_RETRY = 100
+)
+
+//在进程内将推流rtp录制为fragmented mp4文件，按切片时长在关键帧处切换文件
+//文件路径：{m3u8_dir_path}/{path}/{yyyyMMdd}/{yyyyMMddHHmmssSSS}[_n].mp4
+type MP4Recorder struct {
+	SessionLogger
+	streamPath      string
+	dir             string
+	segmentDuration time.Duration
+
+	depacketizer *RTPDepacketizer
+	thumbnailer  *recordThumbnailer
+	queue        chan *RTPPack
+	lock         sync.RWMutex
+	closed       bool
+	dropped      int
+	unsupported  bool
+
+	file      *os.File
+	muxer     *FMP4Muxer
+	record    *models.Record
+	fileStart time.Duration
+	fileEnd   time.Duration
+	lastFlush time.Duration
+	params    [][]byte
+}
+
+func NewMP4Recorder(pusher *Pusher) *MP4Recorder {
+	server := pusher.Server()
+	recorder := &MP4Recorder{
+		SessionLogger:   SessionLogger{pusher.Logger()},
+		streamPath:      pusher.Path(),
+		dir:             server.m3u8DirPath,
+		segmentDuration: server.recordSegmentDuration,
+		queue:           make(chan *RTPPack, MP4_RECORD_QUEUE_LEN),
+	}
+	recorder.depacketizer = NewRTPDepacketizer(pusher.SDPRaw(), recorder.writeFrame)
+	recorder.depacketizer.Timeline = pusher.timeline
+	if server.recordThumbnailInterval > 0 {
+		recorder.thumbnailer = newRecordThumbnailer(pusher)
+		recorder.thumbnailer.Start()
+	}
+	go recorder.run()
+	return recorder
+}
+
+//不阻塞推流，队列满时丢包
+func (recorder *MP4Recorder) WriteRTP(pack *RTPPack) {
+	recorder.lock.RLock()
+	defer recorder.lock.RUnlock()
+	if recorder.closed {
+		return
+	}
+	select {
+	case recorder.queue <- pack:
+	default:
+		if recorder.dropped++; recorder.dropped%1000 == 1 {
+			recorder.logger.Printf("record queue full, %d packets dropped", recorder.dropped)
+		}
+	}
+}
+
+//写入预录缓存，队列满时等待，不丢包
+func (recorder *MP4Recorder) WritePrerollRTP(pack *RTPPack) {
+	recorder.lock.RLock()
+	defer recorder.lock.RUnlock()
+	if recorder.closed {
+		return
+	}
+	recorder.queue <- pack
+}
+
+func (recorder *MP4Recorder) Close() {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.closed {
+		return
+	}
+	recorder.closed = true
+	close(recorder.queue)
+	if recorder.thumbnailer != nil {
+		recorder.thumbnailer.Stop()
+	}
+}
+
+func (recorder *MP4Recorder) run() {
+	for pack := range recorder.queue {
+		recorder.depacketizer.WriteRTP(pack)
+	}
+	recorder.closeFile()
+}
+
+func (recorder *MP4Recorder) writeFrame(frame *AVFrame) {
+	if recorder.unsupported {
+		return
+	}
+	vCodec := recorder.depacketizer.VCodec
+	hasVideo := vCodec == "h264" || vCodec == "h265"
+	isKey := frame.Type == RTP_TYPE_VIDEO && frame.KeyFrame
+	if recorder.file == nil {
+		//有视频时文件必须从关键帧开始
+		if hasVideo && !isKey {
+			return
+		}
+		if !recorder.openFile(frame.Timestamp) {
+			return
+		}
+	} else if !hasVideo || isKey {
+		if frame.Timestamp-recorder.fileStart >= recorder.segmentDuration || isKey && recorder.paramsChanged() {
+			recorder.closeFile()
+			if !recorder.openFile(frame.Timestamp) {
+				return
+			}
+		}
+	}
+	recorder.muxer.WriteFrame(frame)
+	if frame.Timestamp > recorder.fileEnd {
+		recorder.fileEnd = frame.Timestamp
+	}
+	//当前帧等待下一帧确定时长，flush后分片从该帧开始
+	if isKey || (frame.Type == RTP_TYPE_VIDEO || !hasVideo) && frame.Timestamp-recorder.lastFlush >= MP4_FRAGMENT_DURATION {
+		recorder.flush(frame.Timestamp)
+	}
+}
+
+//sps/pps变化后需要新的moov
+func (recorder *MP4Recorder) paramsChanged() bool {
+	params := recorder.depacketizer.ParameterSets()
+	if len(params) != len(recorder.params) {
+		return true
+	}
+	for i := range params {
+		if !bytes.Equal(params[i], recorder.params[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (recorder *MP4Recorder) openFile(start time.Duration) bool {
+	now := time.Now()
+	//预录的帧早于当前时间，按推流时间线换算文件开始时间
+	if timeline := recorder.depacketizer.Timeline; timeline != nil {
+		now = timeline.startAt.Add(start)
+	}
+	dir, err := recordStreamDir(recorder.dir, recorder.streamPath, now.Format("20060102"))
+	if err != nil {
+		recorder.unsupported = true
+		recorder.logger.Printf("record err:%v", err)
+		return false
+	}
+	if err = utils.EnsureDir(dir); err != nil {
+		recorder.logger.Printf("EnsureDir:[%s] err:%v.", dir, err)
+		return false
+	}
+	file, err := createRecordFile(dir, now)
+	if err != nil {
+		recorder.logger.Printf("create record file in [%s] err:%v", dir, err)
+		return false
+	}
+	filePath := file.Name()
+	recordPath := path.Join("/", recorder.streamPath, now.Format("20060102"), path.Base(filePath))
+	muxer := NewFMP4Muxer(file, recorder.depacketizer)
+	if !muxer.HasVideo() && !muxer.HasAudio() {
+		file.Close()
+		os.Remove(filePath)
+		recorder.unsupported = true
+		recorder.logger.Printf("record unsupported codec video[%s] audio[%s]", recorder.depacketizer.VCodec, recorder.depacketizer.ACodec)
+		return false
+	}
+	if err = muxer.WriteInit(); err != nil {
+		file.Close()
+		recorder.logger.Printf("write record file[%s] err:%v", filePath, err)
+		return false
+	}
+	recorder.file = file
+	recorder.muxer = muxer
+	recorder.record = &models.Record{
+		Path:       recordPath,
+		StreamPath: recorder.streamPath,
+		StartTime:  now.UnixNano() / int64(time.Millisecond),
+		VideoCodec: muxer.videoCodec,
+		AudioCodec: muxer.audioCodec,
+	}
+	recorder.fileStart = start
+	recorder.fileEnd = start
+	recorder.lastFlush = start
+	recorder.params = recorder.depacketizer.ParameterSets()
+	recorder.logger.Printf("start record file[%s]", filePath)
+	return true
+}
+
+//推流路径由客户端指定，不能包含..及windows路径分隔符，保证拼接后仍在录像目录下
+func recordStreamDir(recordDir string, streamPath string, date string) (string, error) {
+	for _, name := range strings.Split(streamPath, "/") {
+		if name == ".." || strings.Contains(name, "\\") {
+			return "", fmt.Errorf("invalid record stream path:%s", streamPath)
+		}
+	}
+	return path.Join(recordDir, streamPath, date), nil
+}
+
+//文件名精确到毫秒，同名文件已存在时追加序号，不覆盖已有录像
+func createRecordFile(dir string, start time.Time) (file *os.File, err error) {
+	name := fmt.Sprintf("%s%03d", start.Format("20060102150405"), start.Nanosecond()/int(time.Millisecond))
+	for i := 0; i < MP4_RECORD_NAME_RETRY; i++ {
+		fileName := name + ".mp4"
+		if i > 0 {
+			fileName = fmt.Sprintf("%s_%d.mp4", name, i)
+		}
+		file, err = os.OpenFile(path.Join(dir, fileName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !os.IsExist(err) {
+			return
+		}
+	}
+	return
+}
+
+func (recorder *MP4Recorder) flush(now time.Duration) {
+	recorder.lastFlush = now
+	if err := recorder.muxer.Flush(); err != nil {
+		recorder.logger.Printf("write record file[%s] err:%v", recorder.file.Name(), err)
+		recorder.closeFile()
+	}
+}
+
+func (recorder *MP4Recorder) closeFile() {
+	if recorder.file == nil {
+		return
+	}
+	if err := recorder.muxer.Close(); err != nil {
+		recorder.logger.Printf("write record file[%s] err:%v", recorder.file.Name(), err)
+	}
+	record := recorder.record
+	if info, err := recorder.file.Stat(); err == nil {
+		record.Size = info.Size()
+	}
+	recorder.file.Close()
+	recorder.logger.Printf("end record file[%s]", recorder.file.Name())
+	record.Duration = int64((recorder.fileEnd - recorder.fileStart) / time.Millisecond)
+	record.EndTime = record.StartTime + record.Duration
+	if err := db.SQLite.Save(record).Error; err != nil {
+		recorder.logger.Printf("save record index[%s] err:%v", record.Path, err)
+	}
+	recorder.file = nil
+	recorder.muxer = nil
+	recorder.record = nil
+}
@@ -0,0 +1,134 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/jinzhu/gorm"
+)
+
+func TestCreateRecordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 678*int(time.Millisecond), time.Local)
+	names := []string{"20240102030405678.mp4", "20240102030405678_1.mp4", "20240102030405678_2.mp4"}
+	for i, name := range names {
+		file, err := createRecordFile(dir, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Base(file.Name()) != name {
+			t.Fatalf("file %d = %s, want %s", i, path.Base(file.Name()), name)
+		}
+		file.WriteString("record")
+		file.Close()
+	}
+	//已有的录像不被截断
+	for _, name := range names {
+		if data, _ := ioutil.ReadFile(path.Join(dir, name)); string(data) != "record" {
+			t.Fatalf("%s = %q", name, data)
+		}
+	}
+	//同一秒内的不同毫秒使用不同的文件名
+	file, err := createRecordFile(dir, start.Add(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if path.Base(file.Name()) != "20240102030405679.mp4" {
+		t.Fatalf("file = %s", file.Name())
+	}
+}
+
+func TestRecordStreamDir(t *testing.T) {
+	tests := []struct {
+		streamPath string
+		want       string
+	}{
+		{"/live/test", "/data/record/live/test/20240102"},
+		{"live//test/", "/data/record/live/test/20240102"},
+		{"/live/./test", "/data/record/live/test/20240102"},
+		{"/live/..test", "/data/record/live/..test/20240102"},
+		{"/../../etc", ""},
+		{"/live/../../etc", ""},
+		{"/live/..", ""},
+		{"/live/..\\..\\etc", ""},
+	}
+	for _, test := range tests {
+		dir, err := recordStreamDir("/data/record", test.streamPath, "20240102")
+		if test.want == "" {
+			if err == nil {
+				t.Fatalf("%s dir = %s, want error", test.streamPath, dir)
+			}
+			continue
+		}
+		if err != nil || dir != test.want {
+			t.Fatalf("%s dir = %s err = %v, want %s", test.streamPath, dir, err, test.want)
+		}
+	}
+}
+
+//内存数据库，测试结束后恢复
+func newTestRecordDB(t *testing.T) {
+	old := db.SQLite
+	sqlite, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//每个连接是独立的内存数据库
+	sqlite.DB().SetMaxOpenConns(1)
+	sqlite.AutoMigrate(models.Record{}, models.Thumbnail{})
+	db.SQLite = sqlite
+	t.Cleanup(func() {
+		sqlite.Close()
+		db.SQLite = old
+	})
+}
+
+//录像文件关闭时写入索引
+func TestMP4RecorderIndex(t *testing.T) {
+	newTestRecordDB(t)
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder := NewMP4Recorder(newTestPusher(t, GetServer(), "/live/index"))
+	recorder.dir = dir
+	before := time.Now()
+	recorder.WriteRTP(newTestH264Pack(1, 0, []byte{0x65, 0x88, 0x80}))
+	recorder.WriteRTP(newTestH264Pack(2, 45000, []byte{0x41, 0x9a}))
+	recorder.WriteRTP(newTestH264Pack(3, 90000, []byte{0x41, 0x9b}))
+	recorder.Close()
+	var records []models.Record
+	for i := 0; i < 100 && len(records) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		db.SQLite.Find(&records)
+	}
+	if len(records) != 1 {
+		t.Fatalf("records = %v", records)
+	}
+	record := records[0]
+	if record.StreamPath != "/live/index" || !strings.HasPrefix(record.Path, "/live/index/"+before.Format("20060102")+"/") || record.VideoCodec == "" {
+		t.Fatalf("record = %+v", record)
+	}
+	if record.Duration != 1000 || record.EndTime-record.StartTime != record.Duration || record.StartTime < before.UnixNano()/int64(time.Millisecond)-1000 {
+		t.Fatalf("record = %+v", record)
+	}
+	info, err := os.Stat(path.Join(dir, record.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != record.Size {
+		t.Fatalf("size = %d, index size = %d", info.Size(), record.Size)
+	}
+}
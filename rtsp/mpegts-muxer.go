@@ -0,0 +1,272 @@
+package rtsp
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	TS_PACKET_SIZE = 188
+	TS_PMT_PID     = 0x1000
+	TS_VIDEO_PID   = 0x100
+	TS_AUDIO_PID   = 0x101
+
+	TS_STREAM_TYPE_AAC  = 0x0f
+	TS_STREAM_TYPE_H264 = 0x1b
+	TS_STREAM_TYPE_H265 = 0x24
+
+	//pts相对pcr的偏移，避免播放器解码缓冲区下溢
+	tsPTSOffset = 90000
+)
+
+var crc32MPEGTable = func() (table [256]uint32) {
+	for i := 0; i < 256; i++ {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32MPEGTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+//mpeg-ts封装，写入h264/h265/aac帧
+type TSMuxer struct {
+	w           io.Writer
+	videoCodec  string
+	audioCodec  string
+	audioConfig []byte
+	continuity  map[uint16]byte
+	packet      [TS_PACKET_SIZE]byte
+}
+
+func NewTSMuxer(w io.Writer, videoCodec string, audioCodec string, audioConfig []byte) *TSMuxer {
+	muxer := &TSMuxer{
+		w:           w,
+		audioConfig: audioConfig,
+		continuity:  make(map[uint16]byte),
+	}
+	if videoCodec == "h264" || videoCodec == "h265" {
+		muxer.videoCodec = videoCodec
+	}
+	//ts中只封装aac音频
+	if audioCodec == "aac" && len(audioConfig) >= 2 {
+		muxer.audioCodec = audioCodec
+	}
+	return muxer
+}
+
+func (muxer *TSMuxer) SetWriter(w io.Writer) {
+	muxer.w = w
+}
+
+func (muxer *TSMuxer) pcrPID() uint16 {
+	if muxer.videoCodec != "" {
+		return TS_VIDEO_PID
+	}
+	return TS_AUDIO_PID
+}
+
+//写入PAT、PMT表，每个切片开头都需要写入
+func (muxer *TSMuxer) WriteTables() (err error) {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1, 0x00, 0x00,
+		0x00, 0x01, // program_number
+		0xe0 | TS_PMT_PID>>8, TS_PMT_PID & 0xff,
+	}
+	if err = muxer.writeSection(0, pat); err != nil {
+		return
+	}
+	pcrPID := muxer.pcrPID()
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_length 之后计算
+		0x00, 0x01, // program_number
+		0xc1, 0x00, 0x00,
+		0xe0 | byte(pcrPID>>8), byte(pcrPID),
+		0xf0, 0x00, // program_info_length
+	}
+	if muxer.videoCodec != "" {
+		streamType := byte(TS_STREAM_TYPE_H264)
+		if muxer.videoCodec == "h265" {
+			streamType = TS_STREAM_TYPE_H265
+		}
+		pmt = append(pmt, streamType, 0xe0|TS_VIDEO_PID>>8, TS_VIDEO_PID&0xff, 0xf0, 0x00)
+	}
+	if muxer.audioCodec != "" {
+		pmt = append(pmt, TS_STREAM_TYPE_AAC, 0xe0|TS_AUDIO_PID>>8, TS_AUDIO_PID&0xff, 0xf0, 0x00)
+	}
+	sectionLength := len(pmt) - 3 + 4
+	pmt[1] = 0xb0 | byte(sectionLength>>8)
+	pmt[2] = byte(sectionLength)
+	return muxer.writeSection(TS_PMT_PID, pmt)
+}
+
+func (muxer *TSMuxer) writeSection(pid uint16, section []byte) (err error) {
+	crc := crc32MPEG(section)
+	pkt := muxer.packet[:]
+	for i := range pkt {
+		pkt[i] = 0xff
+	}
+	pkt[0] = 0x47
+	pkt[1] = 0x40 | byte(pid>>8)&0x1f
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | muxer.nextContinuity(pid)
+	pkt[4] = 0x00 // pointer_field
+	n := copy(pkt[5:], section)
+	pkt[5+n] = byte(crc >> 24)
+	pkt[6+n] = byte(crc >> 16)
+	pkt[7+n] = byte(crc >> 8)
+	pkt[8+n] = byte(crc)
+	_, err = muxer.w.Write(pkt)
+	return
+}
+
+func (muxer *TSMuxer) nextContinuity(pid uint16) byte {
+	cc := muxer.continuity[pid]
+	muxer.continuity[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+func (muxer *TSMuxer) WriteFrame(frame *AVFrame) (err error) {
+	pts := int64(frame.Timestamp*90000/time.Second) + tsPTSOffset
+	switch frame.Type {
+	case RTP_TYPE_VIDEO:
+		if muxer.videoCodec == "" {
+			return
+		}
+		var payload []byte
+		if muxer.videoCodec == "h264" {
+			payload = append(payload, 0x00, 0x00, 0x00, 0x01, 0x09, 0xf0)
+		} else {
+			payload = append(payload, 0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50)
+		}
+		for _, nalu := range frame.NALUs {
+			payload = append(payload, 0x00, 0x00, 0x00, 0x01)
+			payload = append(payload, nalu...)
+		}
+		return muxer.writePES(TS_VIDEO_PID, 0xe0, pts, payload, frame.KeyFrame)
+	case RTP_TYPE_AUDIO:
+		if muxer.audioCodec == "" {
+			return
+		}
+		payload := append(ADTSHeader(muxer.audioConfig, len(frame.Payload)), frame.Payload...)
+		return muxer.writePES(TS_AUDIO_PID, 0xc0, pts, payload, muxer.videoCodec == "")
+	}
+	return
+}
+
+//根据AudioSpecificConfig生成adts头
+func ADTSHeader(config []byte, payloadLen int) []byte {
+	objectType := config[0] >> 3
+	frequencyIndex := (config[0]&0x07)<<1 | config[1]>>7
+	channels := (config[1] >> 3) & 0x0f
+	frameLen := payloadLen + 7
+	return []byte{
+		0xff,
+		0xf1,
+		(objectType-1)<<6 | frequencyIndex<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(frameLen>>11)&0x03,
+		byte(frameLen >> 3),
+		byte(frameLen&0x07)<<5 | 0x1f,
+		0xfc,
+	}
+}
+
+func encodePTS(flag byte, pts int64) []byte {
+	return []byte{
+		flag<<4 | byte(pts>>29)&0x0e | 1,
+		byte(pts >> 22),
+		byte(pts>>14)&0xfe | 1,
+		byte(pts >> 7),
+		byte(pts<<1)&0xfe | 1,
+	}
+}
+
+func (muxer *TSMuxer) writePES(pid uint16, streamID byte, pts int64, payload []byte, randomAccess bool) (err error) {
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05}
+	header = append(header, encodePTS(0x02, pts)...)
+	if pesLen := len(header) - 6 + len(payload); streamID != 0xe0 && pesLen <= 0xffff {
+		header[4] = byte(pesLen >> 8)
+		header[5] = byte(pesLen)
+	}
+	data := append(header, payload...)
+	withPCR := pid == muxer.pcrPID()
+	first := true
+	for len(data) > 0 {
+		pkt := muxer.packet[:]
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		var adaptation []byte
+		if first && (withPCR || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = append(adaptation, flags)
+			if withPCR {
+				adaptation[0] |= 0x10
+				pcr := pts - tsPTSOffset
+				if pcr < 0 {
+					pcr = 0
+				}
+				adaptation = append(adaptation, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr&1)<<7|0x7e, 0x00)
+			}
+		}
+		space := TS_PACKET_SIZE - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		if len(data) < space {
+			stuffing := space - len(data)
+			if adaptation == nil {
+				//需要新增adaptation field用于填充，长度字节本身占一字节
+				stuffing--
+				if stuffing > 0 {
+					adaptation = append(adaptation, 0x00)
+					stuffing--
+				} else {
+					adaptation = []byte{}
+				}
+			}
+			for i := 0; i < stuffing; i++ {
+				adaptation = append(adaptation, 0xff)
+			}
+		}
+		off := 4
+		if adaptation != nil {
+			pkt[3] = 0x30 | muxer.nextContinuity(pid)
+			pkt[4] = byte(len(adaptation))
+			copy(pkt[5:], adaptation)
+			off = 5 + len(adaptation)
+		} else {
+			pkt[3] = 0x10 | muxer.nextContinuity(pid)
+		}
+		n := copy(pkt[off:], data)
+		data = data[n:]
+		if _, err = muxer.w.Write(pkt); err != nil {
+			return
+		}
+		first = false
+	}
+	return
+}
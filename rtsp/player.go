@@ -2,10 +2,14 @@ package rtsp
 
 import (
 	//"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Player struct {
+	//收到NACK请求的包数及实际重传的包数，atomic操作需8字节对齐，放在最前
+	nackCount       uint64
+	retransmitCount uint64
 	*Session
 	Pusher *Pusher
 	//cond                 *sync.Cond
@@ -13,6 +17,7 @@ type Player struct {
 	queueLimit           int
 	dropPacketWhenPaused bool
 	paused               bool
+	rtcp                 *rtcpReporter
 }
 
 func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
@@ -25,7 +30,10 @@ func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
 		queueLimit:           server.playerQueueLimit,
 		dropPacketWhenPaused: server.dropPacketWhenPaused,
 		paused:               false,
+		rtcp:                 newRTCPReporter(pusher),
 	}
+	//拉流端发来的RR
+	session.RTPHandles = append(session.RTPHandles, player.rtcp.HandleReceiverReport, player.handleNACK)
 	session.StopHandles = append(session.StopHandles, func() {
 		pusher.RemovePlayer(player)
 		close(player.queue)
@@ -69,6 +77,7 @@ func (player *Player) QueueRTP(pack *RTPPack) *Player {
 func (player *Player) Start() {
 	logger := player.logger
 	timer := time.Unix(0, 0)
+	go player.startRTCPReport()
 	for !player.Stoped {
 		var pack *RTPPack
 		pack, ok := <-player.queue
@@ -93,6 +102,8 @@ func (player *Player) Start() {
 		}
 		if err := player.SendRTP(pack); err != nil {
 			logger.Println(err)
+		} else {
+			player.rtcp.OnSend(pack)
 		}
 		elapsed := time.Now().Sub(timer)
 		if player.debugLogEnable && elapsed >= 30*time.Second {
@@ -102,6 +113,50 @@ func (player *Player) Start() {
 	}
 }
 
+//周期性发送服务端生成的SR
+func (player *Player) startRTCPReport() {
+	ticker := time.NewTicker(RTCP_REPORT_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		if player.Stoped {
+			return
+		}
+		for _, pack := range player.rtcp.SenderReports() {
+			if player.hasRTCPChannel(pack.Type) {
+				player.QueueRTP(pack)
+			}
+		}
+	}
+}
+
+//udp拉流端的NACK，从推流端缓存中重发丢失的视频包
+func (player *Player) handleNACK(pack *RTPPack) {
+	buffer := player.Pusher.retransmitBuffer
+	if pack.Type != RTP_TYPE_VIDEOCONTROL || player.TransType != TRANS_TYPE_UDP || buffer == nil {
+		return
+	}
+	for _, packet := range parseRTCP(pack.Buffer.Bytes()) {
+		ssrc, seqs := parseGenericNACK(packet)
+		for _, seq := range seqs {
+			atomic.AddUint64(&player.nackCount, 1)
+			if lost := buffer.Get(ssrc, seq); lost != nil {
+				player.QueueRTP(lost)
+				atomic.AddUint64(&player.retransmitCount, 1)
+			}
+		}
+	}
+}
+
+//收到NACK请求的包数及重传的包数
+func (player *Player) RetransmitStats() (nacks uint64, retransmits uint64) {
+	return atomic.LoadUint64(&player.nackCount), atomic.LoadUint64(&player.retransmitCount)
+}
+
+//拉流端RR统计的抖动、丢包及rtt
+func (player *Player) RTCPStats() RTCPStats {
+	return player.rtcp.Stats()
+}
+
 func (player *Player) Pause(paused bool) {
 	if paused {
 		player.logger.Printf("Player %s, Pause\n", player.String())
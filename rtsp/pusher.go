@@ -14,6 +14,10 @@ type Pusher struct {
 	*RTSPClient
 	//不为null则表示是组播推流
 	*MulticastClient
+	//不为null则表示是rtmp推流
+	*RTMPSession
+	//不为null则表示是webrtc推流
+	*WebRTCSession
 	players        map[string]*Player //SessionID <-> Player
 	playersLock    sync.RWMutex
 	gopCacheEnable bool
@@ -26,6 +30,21 @@ type Pusher struct {
 	queue                      chan *RTPPack
 	udpHttpAudioStreamListener *AudioUdpDataListener
 	//udpHttpVideoStreamListener *VideoUdpDataListener
+	//服务内部的rtp消费者，如hls切片、录像等，不计入播放人数
+	rtpSinks     map[string]func(*RTPPack)
+	rtpSinksLock sync.RWMutex
+	hlsMuxer     *HLSMuxer
+	recorder     *MP4Recorder
+	recorderLock sync.Mutex
+	//事件录像的预录缓存及停止时间，eventRecordUntil为零表示持续录像
+	preroll          *rtpPrerollBuffer
+	eventRecordUntil time.Time
+	timeline         *RTPTimeline
+	//udp拉流端NACK重传缓存
+	retransmitBuffer *rtpRetransmitBuffer
+	//非rtsp协议的拉流端
+	mediaPlayers     map[string]MediaPlayer
+	mediaPlayersLock sync.RWMutex
 }
 
 func (pusher *Pusher) String() string {
@@ -35,6 +54,12 @@ func (pusher *Pusher) String() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.multiInfo.String()
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.String()
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.String()
+	}
 	return pusher.RTSPClient.String()
 }
 
@@ -45,6 +70,12 @@ func (pusher *Pusher) Server() *Server {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.Server
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.Server
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.Server
+	}
 	return pusher.RTSPClient.Server
 }
 
@@ -55,6 +86,12 @@ func (pusher *Pusher) SDPRaw() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.multiInfo.SDPRaw
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.SDPRaw
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.SDPRaw
+	}
 	return pusher.RTSPClient.SDPRaw
 }
 
@@ -65,6 +102,12 @@ func (pusher *Pusher) Stoped() bool {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.Stopped
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.Stoped
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.Stoped
+	}
 	return pusher.RTSPClient.Stoped
 }
 
@@ -75,6 +118,12 @@ func (pusher *Pusher) Path() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.multiInfo.Path
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.Path
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.Path
+	}
 	if pusher.RTSPClient.CustomPath != "" {
 		return pusher.RTSPClient.CustomPath
 	}
@@ -88,6 +137,12 @@ func (pusher *Pusher) ID() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.multiInfo.SourceSessionId
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.ID
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.ID
+	}
 	return pusher.RTSPClient.ID
 }
 
@@ -98,6 +153,12 @@ func (pusher *Pusher) Logger() *log.Logger {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.logger
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.logger
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.logger
+	}
 	return pusher.RTSPClient.logger
 }
 
@@ -108,6 +169,12 @@ func (pusher *Pusher) VCodec() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.VCodec
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.VCodec
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.VCodec
+	}
 	return pusher.RTSPClient.VCodec
 }
 
@@ -118,6 +185,12 @@ func (pusher *Pusher) ACodec() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.ACodec
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.ACodec
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.ACodec
+	}
 	return pusher.RTSPClient.ACodec
 }
 
@@ -128,6 +201,12 @@ func (pusher *Pusher) AControl() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.AControl
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.AControl
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.AControl
+	}
 	return pusher.RTSPClient.AControl
 }
 
@@ -138,6 +217,12 @@ func (pusher *Pusher) VControl() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.VControl
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.VControl
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.VControl
+	}
 	return pusher.RTSPClient.VControl
 }
 
@@ -148,6 +233,12 @@ func (pusher *Pusher) URL() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.multiInfo.SourceUrl
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.URL
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.URL
+	}
 	return pusher.RTSPClient.URL
 }
 
@@ -160,6 +251,14 @@ func (pusher *Pusher) AddOutputBytes(size int) {
 		pusher.MulticastClient.OutBytes += size
 		return
 	}
+	if pusher.RTMPSession != nil {
+		pusher.RTMPSession.OutBytes += size
+		return
+	}
+	if pusher.WebRTCSession != nil {
+		pusher.WebRTCSession.OutBytes += size
+		return
+	}
 	pusher.RTSPClient.OutBytes += size
 }
 
@@ -170,6 +269,12 @@ func (pusher *Pusher) InBytes() int {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.InBytes
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.InBytes
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.InBytes
+	}
 	return pusher.RTSPClient.InBytes
 }
 
@@ -180,6 +285,12 @@ func (pusher *Pusher) OutBytes() int {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.OutBytes
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.OutBytes
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.OutBytes
+	}
 	return pusher.RTSPClient.OutBytes
 }
 
@@ -190,6 +301,12 @@ func (pusher *Pusher) TransType() string {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.TransType.String()
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.TransType.String()
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.TransType.String()
+	}
 	return pusher.RTSPClient.TransType.String()
 }
 
@@ -200,17 +317,30 @@ func (pusher *Pusher) StartAt() time.Time {
 	if pusher.MulticastClient != nil {
 		return pusher.MulticastClient.StartAt
 	}
+	if pusher.RTMPSession != nil {
+		return pusher.RTMPSession.StartAt
+	}
+	if pusher.WebRTCSession != nil {
+		return pusher.WebRTCSession.StartAt
+	}
 	return pusher.RTSPClient.StartAt
 }
 
+//推流来源地址，隐藏其中的密码
 func (pusher *Pusher) Source() string {
 	if pusher.Session != nil {
-		return pusher.Session.URL
+		return redactURL(pusher.Session.URL)
 	}
 	if pusher.MulticastClient != nil {
-		return pusher.MulticastClient.multiInfo.SourceUrl
+		return redactURL(pusher.MulticastClient.multiInfo.SourceUrl)
 	}
-	return pusher.RTSPClient.URL
+	if pusher.RTMPSession != nil {
+		return redactURL(pusher.RTMPSession.URL)
+	}
+	if pusher.WebRTCSession != nil {
+		return redactURL(pusher.WebRTCSession.URL)
+	}
+	return redactURL(pusher.RTSPClient.URL)
 }
 
 /**
@@ -225,7 +355,9 @@ func NewClientPusher(client *RTSPClient) (pusher *Pusher) {
 		gopCache:       make([]*RTPPack, 0),
 
 		//cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		queue:        make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		rtpSinks:     make(map[string]func(*RTPPack)),
+		mediaPlayers: make(map[string]MediaPlayer),
 	}
 	client.RTPHandles = append(client.RTPHandles, func(pack *RTPPack) {
 		pusher.QueueRTP(pack)
@@ -235,6 +367,9 @@ func NewClientPusher(client *RTSPClient) (pusher *Pusher) {
 		pusher.Server().RemovePusher(pusher)
 		//pusher.cond.Broadcast()
 	})
+	client.RebindHandles = append(client.RebindHandles, func(next *RTSPClient) {
+		pusher.RebindClient(next)
+	})
 	//
 	server := client.Server
 	if server.enableMulticast {
@@ -301,7 +436,9 @@ func NewMulticastPusher(multiInfo *MulticastCommunicateInfo) (pusher *Pusher) {
 		gopCache:       make([]*RTPPack, 0),
 
 		//cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		queue:        make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		rtpSinks:     make(map[string]func(*RTPPack)),
+		mediaPlayers: make(map[string]MediaPlayer),
 	}
 	multicastClient, _ := StartMulticastListen(pusher, multiInfo)
 	pusher.MulticastClient = multicastClient
@@ -315,6 +452,50 @@ func NewMulticastPusher(multiInfo *MulticastCommunicateInfo) (pusher *Pusher) {
 	return pusher
 }
 
+//rtmp推流
+func NewRTMPPusher(session *RTMPSession) (pusher *Pusher) {
+	pusher = &Pusher{
+		RTMPSession:    session,
+		players:        make(map[string]*Player),
+		gopCacheEnable: GetServer().gopCacheEnable,
+		gopCache:       make([]*RTPPack, 0),
+
+		queue:        make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		rtpSinks:     make(map[string]func(*RTPPack)),
+		mediaPlayers: make(map[string]MediaPlayer),
+	}
+	session.RTPHandles = append(session.RTPHandles, func(pack *RTPPack) {
+		pusher.QueueRTP(pack)
+	})
+	session.StopHandles = append(session.StopHandles, func() {
+		pusher.ClearPlayer()
+		pusher.Server().RemovePusher(pusher)
+	})
+	return
+}
+
+//webrtc推流
+func NewWebRTCPusher(session *WebRTCSession) (pusher *Pusher) {
+	pusher = &Pusher{
+		WebRTCSession:  session,
+		players:        make(map[string]*Player),
+		gopCacheEnable: GetServer().gopCacheEnable,
+		gopCache:       make([]*RTPPack, 0),
+
+		queue:        make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		rtpSinks:     make(map[string]func(*RTPPack)),
+		mediaPlayers: make(map[string]MediaPlayer),
+	}
+	session.RTPHandles = append(session.RTPHandles, func(pack *RTPPack) {
+		pusher.QueueRTP(pack)
+	})
+	session.StopHandles = append(session.StopHandles, func() {
+		pusher.ClearPlayer()
+		pusher.Server().RemovePusher(pusher)
+	})
+	return
+}
+
 //rtsp推流
 func NewPusher(session *Session) (pusher *Pusher) {
 	pusher = &Pusher{
@@ -325,7 +506,9 @@ func NewPusher(session *Session) (pusher *Pusher) {
 		gopCache:       make([]*RTPPack, 0),
 
 		//cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		queue:        make(chan *RTPPack, MAX_GOP_CACHE_LEN),
+		rtpSinks:     make(map[string]func(*RTPPack)),
+		mediaPlayers: make(map[string]MediaPlayer),
 	}
 	pusher.bindSession(session)
 	return
@@ -439,6 +622,14 @@ func (pusher *Pusher) RebindSession(session *Session) bool {
 		pusher.Logger().Printf("call RebindSession[%s] to a Client-Pusher. got false", session.ID)
 		return false
 	}
+	if pusher.RTMPSession != nil {
+		pusher.Logger().Printf("call RebindSession[%s] to a RTMP-Pusher. got false", session.ID)
+		return false
+	}
+	if pusher.WebRTCSession != nil {
+		pusher.Logger().Printf("call RebindSession[%s] to a WebRTC-Pusher. got false", session.ID)
+		return false
+	}
 	sess := pusher.Session
 	pusher.bindSession(session)
 	session.Pusher = pusher
@@ -453,18 +644,31 @@ func (pusher *Pusher) RebindSession(session *Session) bool {
 }
 
 func (pusher *Pusher) RebindClient(client *RTSPClient) bool {
-	if pusher.Session != nil {
+	if pusher.Session != nil || pusher.RTMPSession != nil || pusher.WebRTCSession != nil {
 		pusher.Logger().Printf("call RebindClient[%s] to a Session-Pusher. got false", client.ID)
 		return false
 	}
 	sess := pusher.RTSPClient
 	pusher.RTSPClient = client
+	//重连后rtp时间戳重新开始
+	if pusher.timeline != nil {
+		pusher.timeline.Rebase()
+	}
 	if sess != nil {
 		sess.Stop()
 	}
 	return true
 }
 
+//拉流断线重连状态，非拉流的pusher返回零值
+func (pusher *Pusher) ReconnectInfo() (reconnecting bool, count int, lastError string) {
+	if pusher.Session != nil || pusher.MulticastClient != nil || pusher.RTMPSession != nil || pusher.WebRTCSession != nil {
+		return
+	}
+	client := pusher.RTSPClient
+	return client.Reconnecting, client.ReconnectCount, client.LastError
+}
+
 func (pusher *Pusher) QueueRTP(pack *RTPPack) *Pusher {
 	//pusher.cond.L.Lock()
 	pusher.queue <- pack
@@ -494,6 +698,9 @@ func (pusher *Pusher) Start() {
 			}
 			continue
 		}
+		if pusher.timeline != nil {
+			pusher.timeline.Update(pack)
+		}
 
 		if pusher.gopCacheEnable && pack.Type == RTP_TYPE_VIDEO {
 			//pusher.gopCacheLock.Lock()
@@ -506,8 +713,138 @@ func (pusher *Pusher) Start() {
 			pusher.gopCache = append(pusher.gopCache, pack)
 			//pusher.gopCacheLock.Unlock()
 		}
+		if pusher.preroll != nil {
+			keyFrame := false
+			if pack.Type == RTP_TYPE_VIDEO {
+				if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil {
+					keyFrame = pusher.shouldSequenceStart(rtp)
+				}
+			}
+			pusher.preroll.Push(pack, keyFrame)
+		}
+		if pusher.retransmitBuffer != nil && pack.Type == RTP_TYPE_VIDEO {
+			pusher.retransmitBuffer.Push(pack)
+		}
 		pusher.BroadcastRTP(pack)
+		for _, sink := range pusher.GetRTPSinks() {
+			sink(pack)
+		}
+	}
+}
+
+func (pusher *Pusher) AddRTPSink(name string, sink func(*RTPPack)) *Pusher {
+	pusher.rtpSinksLock.Lock()
+	pusher.rtpSinks[name] = sink
+	pusher.rtpSinksLock.Unlock()
+	return pusher
+}
+
+func (pusher *Pusher) RemoveRTPSink(name string) *Pusher {
+	pusher.rtpSinksLock.Lock()
+	delete(pusher.rtpSinks, name)
+	pusher.rtpSinksLock.Unlock()
+	return pusher
+}
+
+func (pusher *Pusher) GetRTPSinks() (sinks []func(*RTPPack)) {
+	pusher.rtpSinksLock.RLock()
+	for _, sink := range pusher.rtpSinks {
+		sinks = append(sinks, sink)
 	}
+	pusher.rtpSinksLock.RUnlock()
+	return
+}
+
+//开始持续录像，已在持续录像或已从server移除时返回false
+func (pusher *Pusher) StartRecord() bool {
+	pusher.recorderLock.Lock()
+	defer pusher.recorderLock.Unlock()
+	if pusher.recorder != nil {
+		//事件录像转为持续录像
+		if !pusher.eventRecordUntil.IsZero() {
+			pusher.eventRecordUntil = time.Time{}
+			return true
+		}
+		return false
+	}
+	if pusher.Server().GetPusher(pusher.Path()) != pusher {
+		return false
+	}
+	pusher.recorder = NewMP4Recorder(pusher)
+	pusher.AddRTPSink("record", pusher.recorder.WriteRTP)
+	return true
+}
+
+//事件录像，包含预录缓存中的数据，postRoll内没有再次触发则停止。已在持续录像时不做处理
+func (pusher *Pusher) TriggerRecord(postRoll time.Duration) bool {
+	pusher.recorderLock.Lock()
+	defer pusher.recorderLock.Unlock()
+	until := time.Now().Add(postRoll)
+	if pusher.recorder != nil {
+		if !pusher.eventRecordUntil.IsZero() && until.After(pusher.eventRecordUntil) {
+			pusher.eventRecordUntil = until
+		}
+		return true
+	}
+	if pusher.Server().GetPusher(pusher.Path()) != pusher {
+		return false
+	}
+	pusher.recorder = NewMP4Recorder(pusher)
+	if pusher.preroll != nil {
+		pusher.preroll.Attach(pusher.recorder.WritePrerollRTP, pusher.recorder.WriteRTP)
+	} else {
+		pusher.AddRTPSink("record", pusher.recorder.WriteRTP)
+	}
+	pusher.eventRecordUntil = until
+	pusher.Logger().Printf("event record start, post roll[%v]", postRoll)
+	time.AfterFunc(postRoll, pusher.checkEventRecord)
+	return true
+}
+
+//到达停止时间后停止事件录像，期间再次触发则顺延
+func (pusher *Pusher) checkEventRecord() {
+	pusher.recorderLock.Lock()
+	defer pusher.recorderLock.Unlock()
+	if pusher.recorder == nil || pusher.eventRecordUntil.IsZero() {
+		return
+	}
+	if wait := time.Until(pusher.eventRecordUntil); wait > 0 {
+		time.AfterFunc(wait, pusher.checkEventRecord)
+		return
+	}
+	pusher.Logger().Printf("event record stop")
+	pusher.stopRecord()
+}
+
+//停止录像，当前文件关闭后写入录像索引
+func (pusher *Pusher) StopRecord() bool {
+	pusher.recorderLock.Lock()
+	defer pusher.recorderLock.Unlock()
+	if pusher.recorder == nil {
+		return false
+	}
+	pusher.stopRecord()
+	return true
+}
+
+func (pusher *Pusher) stopRecord() {
+	pusher.RemoveRTPSink("record")
+	if pusher.preroll != nil {
+		pusher.preroll.Detach()
+	}
+	pusher.recorder.Close()
+	pusher.recorder = nil
+	pusher.eventRecordUntil = time.Time{}
+}
+
+func (pusher *Pusher) Recording() bool {
+	pusher.recorderLock.Lock()
+	defer pusher.recorderLock.Unlock()
+	return pusher.recorder != nil
+}
+
+func (pusher *Pusher) HLSMuxer() *HLSMuxer {
+	return pusher.hlsMuxer
 }
 
 func (pusher *Pusher) Stop() {
@@ -528,6 +865,14 @@ func (pusher *Pusher) Stop() {
 		pusher.MulticastClient.Stop()
 		return
 	}
+	if pusher.RTMPSession != nil {
+		pusher.RTMPSession.Stop()
+		return
+	}
+	if pusher.WebRTCSession != nil {
+		pusher.WebRTCSession.Stop()
+		return
+	}
 	if pusher.udpHttpAudioStreamListener != nil {
 		pusher.udpHttpAudioStreamListener.Stop()
 	}
@@ -538,13 +883,70 @@ func (pusher *Pusher) Stop() {
 }
 
 func (pusher *Pusher) BroadcastRTP(pack *RTPPack) *Pusher {
-	for _, player := range pusher.GetPlayers() {
+	//推流端rtcp由服务端消费，rtsp拉流端使用服务端为其单独生成的SR
+	if pack.Type != RTP_TYPE_AUDIOCONTROL && pack.Type != RTP_TYPE_VIDEOCONTROL {
+		for _, player := range pusher.GetPlayers() {
+			player.QueueRTP(pack)
+			pusher.AddOutputBytes(pack.Buffer.Len())
+		}
+	}
+	for _, player := range pusher.GetMediaPlayers() {
 		player.QueueRTP(pack)
 		pusher.AddOutputBytes(pack.Buffer.Len())
 	}
 	return pusher
 }
 
+func (pusher *Pusher) GetMediaPlayers() (players map[string]MediaPlayer) {
+	players = make(map[string]MediaPlayer)
+	pusher.mediaPlayersLock.RLock()
+	for k, v := range pusher.mediaPlayers {
+		players[k] = v
+	}
+	pusher.mediaPlayersLock.RUnlock()
+	return
+}
+
+func (pusher *Pusher) AddMediaPlayer(player MediaPlayer) *Pusher {
+	logger := pusher.Logger()
+	pusher.mediaPlayersLock.Lock()
+	if _, ok := pusher.mediaPlayers[player.ID()]; !ok {
+		pusher.mediaPlayers[player.ID()] = player
+		logger.Printf("%v start, now media player size[%d]", player, len(pusher.mediaPlayers))
+	}
+	pusher.mediaPlayersLock.Unlock()
+	if pusher.gopCacheEnable {
+		packs := pusher.gopCache[:]
+		for _, pack := range packs {
+			player.QueueRTP(pack)
+			pusher.AddOutputBytes(pack.Buffer.Len())
+		}
+	}
+	return pusher
+}
+
+func (pusher *Pusher) RemoveMediaPlayer(player MediaPlayer) *Pusher {
+	logger := pusher.Logger()
+	pusher.mediaPlayersLock.Lock()
+	if _, ok := pusher.mediaPlayers[player.ID()]; ok {
+		delete(pusher.mediaPlayers, player.ID())
+		logger.Printf("%v end, now media player size[%d]\n", player, len(pusher.mediaPlayers))
+	}
+	pusher.mediaPlayersLock.Unlock()
+	return pusher
+}
+
+//rtsp播放者与其他协议播放者总数
+func (pusher *Pusher) OnlineSize() int {
+	pusher.playersLock.RLock()
+	size := len(pusher.players)
+	pusher.playersLock.RUnlock()
+	pusher.mediaPlayersLock.RLock()
+	size += len(pusher.mediaPlayers)
+	pusher.mediaPlayersLock.RUnlock()
+	return size
+}
+
 func (pusher *Pusher) GetPlayers() (players map[string]*Player) {
 	players = make(map[string]*Player)
 	pusher.playersLock.RLock()
@@ -606,10 +1008,17 @@ func (pusher *Pusher) ClearPlayer() {
 	//}
 	pusher.players = make(map[string]*Player)
 	pusher.playersLock.Unlock()
+	pusher.mediaPlayersLock.Lock()
+	mediaPlayers := pusher.mediaPlayers
+	pusher.mediaPlayers = make(map[string]MediaPlayer)
+	pusher.mediaPlayersLock.Unlock()
 	go func() { // do not block
 		for _, v := range players {
 			v.Stop()
 		}
+		for _, v := range mediaPlayers {
+			v.Stop()
+		}
 	}()
 }
 
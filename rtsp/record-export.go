@@ -0,0 +1,204 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+)
+
+//查询与时间范围有交集的录像，按开始时间排序
+func findRecords(streamPath string, begin time.Time, end time.Time) (records []models.Record, err error) {
+	err = db.SQLite.Where("stream_path = ? AND end_time >= ? AND start_time <= ?", streamPath, toMillis(begin), toMillis(end)).
+		Order("start_time").Find(&records).Error
+	if err == nil && len(records) == 0 {
+		err = ErrRecordNotFound
+	}
+	return
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//将时间范围内的录像文件转封装(不转码)为一个fmp4，边读边写
+type RecordExporter struct {
+	streamPath string
+	dir        string
+	begin      time.Time
+	end        time.Time
+	records    []models.Record
+
+	//创建时打开并校验的第一个录像文件，出错时可以在写响应头之前返回
+	muxer     *FMP4Muxer
+	first     *FMP4Demuxer
+	firstFile *os.File
+	next      int
+	origin    time.Time
+}
+
+func NewRecordExporter(streamPath string, begin time.Time, end time.Time) (exporter *RecordExporter, err error) {
+	if !end.After(begin) {
+		return nil, errInvalidRange
+	}
+	exporter = &RecordExporter{
+		streamPath: streamPath,
+		dir:        GetServer().m3u8DirPath,
+		begin:      begin,
+		end:        end,
+	}
+	if exporter.records, err = findRecords(streamPath, begin, end); err != nil {
+		return nil, err
+	}
+	if err = exporter.openFirst(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (exporter *RecordExporter) openRecord(record models.Record) (file *os.File, demuxer *FMP4Demuxer, err error) {
+	filePath := path.Join(exporter.dir, record.Path)
+	if file, err = os.Open(filePath); err != nil {
+		log.Printf("export open record file[%s] err:%v", filePath, err)
+		return
+	}
+	if demuxer, err = NewFMP4Demuxer(file); err != nil {
+		file.Close()
+		log.Printf("export open record file[%s] err:%v", filePath, err)
+	}
+	return
+}
+
+//跳过无法打开的文件，第一个可以打开的文件决定导出的轨道
+func (exporter *RecordExporter) openFirst() error {
+	for i, record := range exporter.records {
+		file, demuxer, err := exporter.openRecord(record)
+		if err != nil {
+			continue
+		}
+		//写入目标在Export时设置
+		muxer := NewFMP4Muxer(nil, demuxerTracks(demuxer))
+		if !muxer.HasVideo() && !muxer.HasAudio() {
+			file.Close()
+			return fmt.Errorf("record file[%s] has no supported track", record.Path)
+		}
+		//从开始时间之前最近的关键帧开始
+		recordStart := time.Unix(0, record.StartTime*int64(time.Millisecond))
+		offset := exporter.begin.Sub(recordStart)
+		if offset < 0 {
+			offset = 0
+		}
+		start, _ := demuxer.Seek(offset)
+		exporter.muxer, exporter.first, exporter.firstFile = muxer, demuxer, file
+		exporter.next = i
+		exporter.origin = recordStart.Add(start)
+		return nil
+	}
+	return ErrRecordNotFound
+}
+
+//未调用Export时释放已打开的文件
+func (exporter *RecordExporter) Close() {
+	if exporter.firstFile != nil {
+		exporter.firstFile.Close()
+		exporter.firstFile = nil
+	}
+}
+
+//编码参数不同的录像无法写入同一个moov
+func sameTracks(a *FMP4Demuxer, b *FMP4Demuxer) bool {
+	same := func(x *fmp4TrackInfo, y *fmp4TrackInfo) bool {
+		if x == nil || y == nil {
+			return x == y
+		}
+		return x.codec == y.codec && bytes.Equal(x.vps, y.vps) && bytes.Equal(x.sps, y.sps) && bytes.Equal(x.pps, y.pps) &&
+			bytes.Equal(x.audioConfig, y.audioConfig) && x.audioRate == y.audioRate && x.audioChannels == y.audioChannels
+	}
+	return same(a.Video, b.Video) && same(a.Audio, b.Audio)
+}
+
+//用录像文件的轨道信息构造muxer参数
+func demuxerTracks(demuxer *FMP4Demuxer) *RTPDepacketizer {
+	tracks := &RTPDepacketizer{}
+	if video := demuxer.Video; video != nil {
+		tracks.VCodec = video.codec
+		tracks.VPS, tracks.SPS, tracks.PPS = video.vps, video.sps, video.pps
+	}
+	if audio := demuxer.Audio; audio != nil {
+		tracks.ACodec = audio.codec
+		tracks.AudioConfig = audio.audioConfig
+		tracks.AudioRate = audio.audioRate
+		tracks.AudioChannels = audio.audioChannels
+	}
+	return tracks
+}
+
+//flush在每个分片写完后调用，用于及时发送给下载端
+func (exporter *RecordExporter) Export(w io.Writer, flush func()) (err error) {
+	defer exporter.Close()
+	muxer := exporter.muxer
+	muxer.w = w
+	if err = muxer.WriteInit(); err != nil {
+		return
+	}
+	for i := exporter.next; i < len(exporter.records); i++ {
+		record := exporter.records[i]
+		file, demuxer := exporter.firstFile, exporter.first
+		if i != exporter.next {
+			var e error
+			if file, demuxer, e = exporter.openRecord(record); e != nil {
+				continue
+			}
+			if !sameTracks(exporter.first, demuxer) {
+				file.Close()
+				log.Printf("export skip record file[%s], codec parameters changed", record.Path)
+				continue
+			}
+		}
+		recordStart := time.Unix(0, record.StartTime*int64(time.Millisecond))
+		done, e := exporter.copyFrames(muxer, demuxer, recordStart, exporter.origin, flush)
+		file.Close()
+		if i == exporter.next {
+			exporter.firstFile = nil
+		}
+		if e != nil {
+			return e
+		}
+		if done {
+			break
+		}
+	}
+	err = muxer.Close()
+	flush()
+	return
+}
+
+func (exporter *RecordExporter) copyFrames(muxer *FMP4Muxer, demuxer *FMP4Demuxer, recordStart time.Time, origin time.Time, flush func()) (done bool, err error) {
+	for {
+		frames, e := demuxer.ReadFragment()
+		if e != nil {
+			return false, nil
+		}
+		for _, frame := range frames {
+			t := recordStart.Add(frame.Timestamp)
+			if t.After(exporter.end) {
+				return true, nil
+			}
+			if t.Before(origin) {
+				continue
+			}
+			frame.Timestamp = t.Sub(origin)
+			muxer.WriteFrame(frame)
+		}
+		if err = muxer.Flush(); err != nil {
+			return
+		}
+		flush()
+	}
+}
@@ -0,0 +1,116 @@
+package rtsp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+)
+
+//录像目录及索引，files为空的项只写索引不写文件
+func newTestExportRecords(t *testing.T, files map[string][]byte, records ...models.Record) {
+	newTestRecordDB(t)
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := GetServer()
+	old := server.m3u8DirPath
+	server.m3u8DirPath = dir
+	t.Cleanup(func() {
+		server.m3u8DirPath = old
+		os.RemoveAll(dir)
+	})
+	for _, record := range records {
+		if data, ok := files[record.Path]; ok {
+			os.MkdirAll(path.Dir(path.Join(dir, record.Path)), 0755)
+			if err = ioutil.WriteFile(path.Join(dir, record.Path), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = db.SQLite.Create(&record).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewRecordExporterErrors(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := models.Record{Path: "/live/test/20240102/a.mp4", StreamPath: "/live/test", StartTime: toMillis(start), EndTime: toMillis(start.Add(3 * time.Second))}
+	tests := []struct {
+		name    string
+		files   map[string][]byte
+		wantErr string
+	}{
+		{"no record", nil, ErrRecordNotFound.Error()},
+		{"file missing", map[string][]byte{}, ErrRecordNotFound.Error()},
+		{"file corrupted", map[string][]byte{record.Path: []byte("not mp4")}, ErrRecordNotFound.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.files == nil {
+				newTestExportRecords(t, nil)
+			} else {
+				newTestExportRecords(t, test.files, record)
+			}
+			exporter, err := NewRecordExporter("/live/test", start, start.Add(time.Second))
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("exporter = %v err = %v", exporter, err)
+			}
+		})
+	}
+	if _, err := NewRecordExporter("/live/test", start, start); err != errInvalidRange {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestRecordExport(t *testing.T) {
+	data, _ := newTestFMP4File(t, 3)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := start.Add(3 * time.Second)
+	newTestExportRecords(t, map[string][]byte{"/live/test/b.mp4": data, "/live/test/c.mp4": data},
+		//索引中有但文件已删除的录像被跳过
+		models.Record{Path: "/live/test/a.mp4", StreamPath: "/live/test", StartTime: toMillis(start.Add(-time.Second)), EndTime: toMillis(start)},
+		models.Record{Path: "/live/test/b.mp4", StreamPath: "/live/test", StartTime: toMillis(start), EndTime: toMillis(second)},
+		models.Record{Path: "/live/test/c.mp4", StreamPath: "/live/test", StartTime: toMillis(second), EndTime: toMillis(second.Add(3 * time.Second))},
+	)
+	exporter, err := NewRecordExporter("/live/test", start.Add(1500*time.Millisecond), second.Add(1500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	flushes := 0
+	if err = exporter.Export(buf, func() { flushes++ }); err != nil {
+		t.Fatal(err)
+	}
+	demuxer, err := NewFMP4Demuxer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if demuxer.Video == nil || demuxer.Audio == nil {
+		t.Fatal("tracks not exported")
+	}
+	var frames []*AVFrame
+	for {
+		fragment, err := demuxer.ReadFragment()
+		if err != nil {
+			break
+		}
+		frames = append(frames, fragment...)
+	}
+	//从1秒处的关键帧到第二个文件的1.5秒
+	if len(frames) == 0 || !frames[0].KeyFrame || frames[0].Timestamp != 0 {
+		t.Fatalf("first frame = %+v", frames)
+	}
+	if last := frames[len(frames)-1].Timestamp; last < 3*time.Second || last > 3500*time.Millisecond {
+		t.Fatalf("last frame timestamp = %v", last)
+	}
+	if flushes == 0 || exporter.firstFile != nil {
+		t.Fatalf("flushes = %d first file = %v", flushes, exporter.firstFile)
+	}
+}
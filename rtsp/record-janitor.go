@@ -0,0 +1,281 @@
+package rtsp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/bruce-qin/EasyGoLib/utils"
+	"github.com/shirou/gopsutil/disk"
+)
+
+//未建立索引的录像文件超过该时间未修改才参与清理，避免删除正在写入的录像
+const RECORD_UNINDEXED_GRACE = time.Hour
+
+//按推流路径前缀配置的录像保留策略，0表示不限制
+type RecordRetentionPolicy struct {
+	Prefix     string `json:"prefix"`
+	MaxAgeDays int    `json:"maxAgeDays"`
+	MaxSizeMB  int64  `json:"maxSizeMB"`
+}
+
+//录像清理状态，在GetServerInfo中返回
+type RecordJanitorInfo struct {
+	Policies         []RecordRetentionPolicy `json:"policies"`
+	HighWaterPercent float64                 `json:"highWaterPercent"`
+	DiskUsedPercent  float64                 `json:"diskUsedPercent"`
+	DeletedFiles     int64                   `json:"deletedFiles"`
+	ReclaimedBytes   int64                   `json:"reclaimedBytes"`
+	LastRunTime      string                  `json:"lastRunTime"`
+}
+
+//读取[record_retention]配置，key为路径前缀，value为：保留天数,最大占用MB
+func loadRecordRetentionPolicies(logger SessionLogger) (policies []RecordRetentionPolicy) {
+	for _, key := range utils.Conf().Section("record_retention").Keys() {
+		fields := strings.Split(key.Value(), ",")
+		policy := RecordRetentionPolicy{Prefix: "/" + strings.Trim(key.Name(), "/")}
+		var err error
+		if policy.MaxAgeDays, err = strconv.Atoi(strings.TrimSpace(fields[0])); err == nil && len(fields) > 1 {
+			policy.MaxSizeMB, err = strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+		}
+		if err != nil {
+			logger.logger.Printf("invalidate record retention[%s=%s]: %v", key.Name(), key.Value(), err)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	//最长前缀优先匹配
+	sort.Slice(policies, func(i, j int) bool {
+		return len(policies[i].Prefix) > len(policies[j].Prefix)
+	})
+	return
+}
+
+func (policy *RecordRetentionPolicy) match(streamPath string) bool {
+	return policy.Prefix == "/" || streamPath == policy.Prefix || strings.HasPrefix(streamPath, policy.Prefix+"/")
+}
+
+//后台定期删除过期及超出配额的录像，磁盘使用率超过高水位时从最旧的录像开始删除
+type RecordJanitor struct {
+	SessionLogger
+	dir              string
+	interval         time.Duration
+	policies         []RecordRetentionPolicy
+	highWaterPercent float64
+	stop             chan struct{}
+
+	lock            sync.RWMutex
+	deletedFiles    int64
+	reclaimedBytes  int64
+	diskUsedPercent float64
+	lastRun         time.Time
+}
+
+func NewRecordJanitor(server *Server) *RecordJanitor {
+	interval := server.recordJanitorInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &RecordJanitor{
+		SessionLogger:    server.SessionLogger,
+		dir:              server.m3u8DirPath,
+		interval:         interval,
+		policies:         server.recordRetention,
+		highWaterPercent: server.recordHighWaterPercent,
+		stop:             make(chan struct{}),
+	}
+}
+
+func (janitor *RecordJanitor) Start() {
+	janitor.logger.Printf("record janitor start, dir[%s] policies%+v high water[%.1f%%]", janitor.dir, janitor.policies, janitor.highWaterPercent)
+	go func() {
+		ticker := time.NewTicker(janitor.interval)
+		defer ticker.Stop()
+		for {
+			janitor.clean()
+			select {
+			case <-janitor.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (janitor *RecordJanitor) Stop() {
+	close(janitor.stop)
+}
+
+func (janitor *RecordJanitor) Info() RecordJanitorInfo {
+	janitor.lock.RLock()
+	defer janitor.lock.RUnlock()
+	info := RecordJanitorInfo{
+		Policies:         janitor.policies,
+		HighWaterPercent: janitor.highWaterPercent,
+		DiskUsedPercent:  janitor.diskUsedPercent,
+		DeletedFiles:     janitor.deletedFiles,
+		ReclaimedBytes:   janitor.reclaimedBytes,
+	}
+	if !janitor.lastRun.IsZero() {
+		info.LastRunTime = janitor.lastRun.Format(utils.DateTimeLayout)
+	}
+	return info
+}
+
+func (janitor *RecordJanitor) clean() {
+	var records []models.Record
+	if err := db.SQLite.Select("path, stream_path, start_time, end_time, size").Order("start_time").Find(&records).Error; err != nil {
+		janitor.logger.Printf("query records err:%v", err)
+		return
+	}
+	//进程崩溃或写索引失败时遗留的录像文件
+	if unindexed := janitor.unindexedRecords(records); len(unindexed) > 0 {
+		records = append(records, unindexed...)
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].StartTime < records[j].StartTime
+		})
+	}
+	//按策略分组，组内按时间从旧到新
+	groups := make([][]models.Record, len(janitor.policies))
+	for _, record := range records {
+		for i := range janitor.policies {
+			if janitor.policies[i].match(record.StreamPath) {
+				groups[i] = append(groups[i], record)
+				break
+			}
+		}
+	}
+	deleted := make(map[string]bool)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, policy := range janitor.policies {
+		var total int64
+		for _, record := range groups[i] {
+			total += record.Size
+		}
+		for _, record := range groups[i] {
+			expired := policy.MaxAgeDays > 0 && now-record.EndTime > int64(policy.MaxAgeDays)*24*int64(time.Hour/time.Millisecond)
+			oversize := policy.MaxSizeMB > 0 && total > policy.MaxSizeMB<<20
+			if !expired && !oversize {
+				break
+			}
+			if janitor.remove(record) {
+				deleted[record.Path] = true
+				total -= record.Size
+			}
+		}
+	}
+	if janitor.highWaterPercent > 0 {
+		for _, record := range records {
+			if deleted[record.Path] {
+				continue
+			}
+			usage, err := disk.Usage(janitor.dir)
+			if err != nil {
+				janitor.logger.Printf("disk usage[%s] err:%v", janitor.dir, err)
+				break
+			}
+			janitor.setDiskUsed(usage.UsedPercent)
+			if usage.UsedPercent < janitor.highWaterPercent {
+				break
+			}
+			janitor.remove(record)
+		}
+		if usage, err := disk.Usage(janitor.dir); err == nil {
+			janitor.setDiskUsed(usage.UsedPercent)
+		}
+	}
+	janitor.lock.Lock()
+	janitor.lastRun = time.Now()
+	janitor.lock.Unlock()
+}
+
+//遍历录像目录，找出索引中没有的录像文件，以修改时间作为录像时间
+func (janitor *RecordJanitor) unindexedRecords(records []models.Record) (unindexed []models.Record) {
+	indexed := make(map[string]bool, len(records))
+	for _, record := range records {
+		indexed[record.Path] = true
+	}
+	deadline := time.Now().Add(-RECORD_UNINDEXED_GRACE)
+	filepath.Walk(janitor.dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(filePath) != ".mp4" || info.ModTime().After(deadline) {
+			return nil
+		}
+		rel, err := filepath.Rel(janitor.dir, filePath)
+		if err != nil {
+			return nil
+		}
+		//{path}/{yyyyMMdd}/{name}.mp4
+		recordPath := path.Join("/", filepath.ToSlash(rel))
+		streamPath := path.Dir(path.Dir(recordPath))
+		if indexed[recordPath] || streamPath == "/" {
+			return nil
+		}
+		modTime := info.ModTime().UnixNano() / int64(time.Millisecond)
+		unindexed = append(unindexed, models.Record{
+			Path:       recordPath,
+			StreamPath: streamPath,
+			StartTime:  modTime,
+			EndTime:    modTime,
+			Size:       info.Size(),
+		})
+		return nil
+	})
+	return
+}
+
+func (janitor *RecordJanitor) setDiskUsed(percent float64) {
+	janitor.lock.Lock()
+	janitor.diskUsedPercent = percent
+	janitor.lock.Unlock()
+}
+
+func (janitor *RecordJanitor) remove(record models.Record) bool {
+	filePath := path.Join(janitor.dir, record.Path)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		janitor.logger.Printf("remove record file[%s] err:%v", filePath, err)
+		return false
+	}
+	if err := db.SQLite.Delete(&models.Record{Path: record.Path}).Error; err != nil {
+		janitor.logger.Printf("delete record index[%s] err:%v", record.Path, err)
+	}
+	janitor.removeThumbnails(record)
+	//日期目录为空时一并删除
+	os.Remove(path.Dir(filePath))
+	janitor.logger.Printf("remove record file[%s], size[%d]", filePath, record.Size)
+	janitor.lock.Lock()
+	janitor.deletedFiles++
+	janitor.reclaimedBytes += record.Size
+	janitor.lock.Unlock()
+	return true
+}
+
+//同一路流的录像总是从旧到新删除，删除不晚于该录像结束时间的缩略图
+func (janitor *RecordJanitor) removeThumbnails(record models.Record) {
+	var thumbnails []models.Thumbnail
+	if err := db.SQLite.Where("stream_path = ? AND time <= ?", record.StreamPath, record.EndTime).Find(&thumbnails).Error; err != nil {
+		janitor.logger.Printf("query thumbnails[%s] err:%v", record.StreamPath, err)
+		return
+	}
+	for _, thumbnail := range thumbnails {
+		filePath := path.Join(janitor.dir, thumbnail.Path)
+		var size int64
+		if info, err := os.Stat(filePath); err == nil {
+			size = info.Size()
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			janitor.logger.Printf("remove thumbnail[%s] err:%v", filePath, err)
+			continue
+		}
+		janitor.lock.Lock()
+		janitor.reclaimedBytes += size
+		janitor.lock.Unlock()
+		db.SQLite.Delete(&models.Thumbnail{Path: thumbnail.Path})
+	}
+}
@@ -0,0 +1,68 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+)
+
+func TestRecordJanitorUnindexedFiles(t *testing.T) {
+	newTestRecordDB(t)
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		path    string
+		modTime time.Time
+		indexed bool
+		removed bool
+	}{
+		{"/live/a/20240101/20240101000000000.mp4", old, true, true},
+		{"/live/a/20240101/20240101010000000.mp4", old, false, true},
+		{"/live/a/20240101/20240101020000000.mp4", time.Now(), false, false},
+		{"/live/a/20240101/20240101030000000.mp4", time.Now().Add(-2 * RECORD_UNINDEXED_GRACE), false, false},
+		{"/live/a/20240101/segment.ts", old, false, false},
+		{"/other/b/20240101/20240101000000000.mp4", old, false, false},
+	}
+	for _, file := range files {
+		filePath := path.Join(dir, file.path)
+		os.MkdirAll(path.Dir(filePath), 0755)
+		if err := ioutil.WriteFile(filePath, []byte("record"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filePath, file.modTime, file.modTime)
+		if file.indexed {
+			millis := file.modTime.UnixNano() / int64(time.Millisecond)
+			db.SQLite.Create(&models.Record{Path: file.path, StreamPath: "/live/a", StartTime: millis, EndTime: millis, Size: 6})
+		}
+	}
+	janitor := &RecordJanitor{
+		SessionLogger: SessionLogger{logger: log.New(ioutil.Discard, "", 0)},
+		dir:           dir,
+		policies:      []RecordRetentionPolicy{{Prefix: "/live", MaxAgeDays: 1}},
+	}
+	janitor.clean()
+	for _, file := range files {
+		_, err := os.Stat(path.Join(dir, file.path))
+		if removed := os.IsNotExist(err); removed != file.removed {
+			t.Fatalf("%s removed = %v, want %v", file.path, removed, file.removed)
+		}
+	}
+	if info := janitor.Info(); info.DeletedFiles != 2 || info.ReclaimedBytes != 12 {
+		t.Fatalf("info = %+v", info)
+	}
+	count := 0
+	db.SQLite.Model(models.Record{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("record index count = %d", count)
+	}
+}
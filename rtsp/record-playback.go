@@ -0,0 +1,526 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+)
+
+const (
+	//录像回放地址：rtsp://host/playback/{path}?start=..&end=..
+	PLAYBACK_PATH_PREFIX        = "/playback"
+	PLAYBACK_VIDEO_PAYLOAD_TYPE = 96
+	PLAYBACK_AUDIO_PAYLOAD_TYPE = 97
+	//超过该倍速时只发送视频关键帧
+	PLAYBACK_KEYFRAME_SCALE = 4
+	//录像文件间隔超过该时长时直接跳过
+	PLAYBACK_MAX_GAP = time.Second
+	//rfc2326 3.7 clock格式
+	PLAYBACK_CLOCK_LAYOUT = "20060102T150405Z"
+)
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	errInvalidRange   = errors.New("invalid range")
+	errInvalidScale   = errors.New("invalid scale")
+)
+
+//打开的单个录像文件
+type playbackCursor struct {
+	index       int
+	file        *os.File
+	demuxer     *FMP4Demuxer
+	recordStart time.Time
+}
+
+func (cursor *playbackCursor) close() {
+	cursor.file.Close()
+}
+
+//PLAY后待开始的回放
+type playbackRun struct {
+	cursor *playbackCursor
+	start  time.Time
+	stopAt time.Time
+	scale  float64
+}
+
+//按时间范围回放录像文件，按时间戳节奏发送rtp，支持Range定位、Scale倍速及暂停
+type recordPlayback struct {
+	SessionLogger
+	session    *Session
+	streamPath string
+	dir        string
+	records    []models.Record
+	begin      time.Time
+	end        time.Time
+	baseURL    string
+
+	SDPRaw   string
+	VControl string
+	AControl string
+	VCodec   string
+	ACodec   string
+
+	video       *fmp4TrackInfo
+	audio       *fmp4TrackInfo
+	vPacketizer *RTPPacketizer
+	aPacketizer *RTPPacketizer
+	vTimestamp  uint32
+	aTimestamp  uint32
+	rtcp        *rtcpReporter
+
+	lock     sync.Mutex
+	position time.Time
+	scale    float64
+	prepared *playbackRun
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+//回放地址前缀下的路径保留给录像回放，不允许推流
+func isPlaybackPath(streamPath string) bool {
+	return streamPath == PLAYBACK_PATH_PREFIX || strings.HasPrefix(streamPath, PLAYBACK_PATH_PREFIX+"/")
+}
+
+//回放时间，支持UTC秒及clock格式
+func parsePlaybackTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.ParseInLocation(PLAYBACK_CLOCK_LAYOUT, value, time.UTC)
+}
+
+//npt时间，支持秒及hh:mm:ss[.frac]
+func parseNPT(value string) (time.Duration, error) {
+	var seconds float64
+	for _, field := range strings.Split(value, ":") {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + v
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func newRecordPlayback(session *Session, rawURL string) (playback *recordPlayback, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	streamPath := strings.TrimPrefix(u.Path, PLAYBACK_PATH_PREFIX)
+	if streamPath == "" || streamPath == "/" {
+		return nil, ErrRecordNotFound
+	}
+	query := u.Query()
+	begin, err := parsePlaybackTime(query.Get("start"))
+	if err != nil {
+		return nil, errInvalidRange
+	}
+	end := time.Now()
+	if value := query.Get("end"); value != "" {
+		if end, err = parsePlaybackTime(value); err != nil {
+			return nil, errInvalidRange
+		}
+	}
+	if !end.After(begin) {
+		return nil, errInvalidRange
+	}
+	playback = &recordPlayback{
+		SessionLogger: session.SessionLogger,
+		session:       session,
+		streamPath:    streamPath,
+		dir:           session.Server.m3u8DirPath,
+		begin:         begin,
+		end:           end,
+		position:      begin,
+		scale:         1,
+	}
+	if playback.records, err = findRecords(streamPath, begin, end); err != nil {
+		return nil, err
+	}
+	cursor, _, err := playback.openAt(begin)
+	if err != nil {
+		return nil, err
+	}
+	cursor.close()
+	playback.video = cursor.demuxer.Video
+	playback.audio = cursor.demuxer.Audio
+	//拉流端SETUP使用绝对地址，避免与url参数拼接
+	u.RawQuery = ""
+	playback.baseURL = u.String()
+	playback.SDPRaw = playback.sdp()
+	playback.rtcp = &rtcpReporter{
+		audio: rtcpStream{rtpType: RTP_TYPE_AUDIO},
+		video: rtcpStream{rtpType: RTP_TYPE_VIDEO, clockRate: FMP4_VIDEO_TIMESCALE},
+	}
+	if playback.audio != nil {
+		playback.rtcp.audio.clockRate = playback.audioRate()
+	}
+	playback.vTimestamp = rand.Uint32()
+	playback.aTimestamp = rand.Uint32()
+	return
+}
+
+func (playback *recordPlayback) audioRate() int {
+	if playback.audio.codec == "opus" {
+		return 48000
+	}
+	return playback.audio.audioRate
+}
+
+func (playback *recordPlayback) sdp() string {
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=EasyDarwin Playback",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=tool:EasyDarwin",
+		"a=range:clock=" + playback.begin.UTC().Format(PLAYBACK_CLOCK_LAYOUT) + "-" + playback.end.UTC().Format(PLAYBACK_CLOCK_LAYOUT),
+	}
+	if track := playback.video; track != nil {
+		playback.VCodec = track.codec
+		playback.VControl = playback.baseURL + "/streamid=0"
+		lines = append(lines, fmt.Sprintf("m=video 0 RTP/AVP %d", PLAYBACK_VIDEO_PAYLOAD_TYPE))
+		if track.codec == "h264" {
+			lines = append(lines,
+				fmt.Sprintf("a=rtpmap:%d H264/90000", PLAYBACK_VIDEO_PAYLOAD_TYPE),
+				fmt.Sprintf("a=fmtp:%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s", PLAYBACK_VIDEO_PAYLOAD_TYPE,
+					hex.EncodeToString(track.sps[1:4]), base64.StdEncoding.EncodeToString(track.sps), base64.StdEncoding.EncodeToString(track.pps)))
+		} else {
+			lines = append(lines,
+				fmt.Sprintf("a=rtpmap:%d H265/90000", PLAYBACK_VIDEO_PAYLOAD_TYPE),
+				fmt.Sprintf("a=fmtp:%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s", PLAYBACK_VIDEO_PAYLOAD_TYPE,
+					base64.StdEncoding.EncodeToString(track.vps), base64.StdEncoding.EncodeToString(track.sps), base64.StdEncoding.EncodeToString(track.pps)))
+		}
+		lines = append(lines, "a=control:"+playback.VControl)
+		playback.vPacketizer = NewRTPPacketizer(RTP_TYPE_VIDEO, PLAYBACK_VIDEO_PAYLOAD_TYPE)
+	}
+	if track := playback.audio; track != nil {
+		playback.ACodec = track.codec
+		playback.AControl = playback.baseURL + "/streamid=1"
+		payloadType := byte(PLAYBACK_AUDIO_PAYLOAD_TYPE)
+		switch track.codec {
+		case "aac":
+			lines = append(lines,
+				fmt.Sprintf("m=audio 0 RTP/AVP %d", payloadType),
+				fmt.Sprintf("a=rtpmap:%d MPEG4-GENERIC/%d/%d", payloadType, track.audioRate, track.audioChannels),
+				fmt.Sprintf("a=fmtp:%d streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s", payloadType, hex.EncodeToString(track.audioConfig)))
+		case "opus":
+			lines = append(lines,
+				fmt.Sprintf("m=audio 0 RTP/AVP %d", payloadType),
+				fmt.Sprintf("a=rtpmap:%d opus/48000/2", payloadType))
+		case "pcma", "pcmu":
+			payloadType = 8
+			if track.codec == "pcmu" {
+				payloadType = 0
+			}
+			lines = append(lines,
+				fmt.Sprintf("m=audio 0 RTP/AVP %d", payloadType),
+				fmt.Sprintf("a=rtpmap:%d %s/%d", payloadType, strings.ToUpper(track.codec), track.audioRate))
+		}
+		lines = append(lines, "a=control:"+playback.AControl)
+		playback.aPacketizer = NewRTPPacketizer(RTP_TYPE_AUDIO, payloadType)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func (playback *recordPlayback) openRecord(index int) (cursor *playbackCursor, err error) {
+	record := playback.records[index]
+	file, err := os.Open(path.Join(playback.dir, record.Path))
+	if err != nil {
+		return
+	}
+	demuxer, err := NewFMP4Demuxer(file)
+	if err != nil {
+		file.Close()
+		return
+	}
+	return &playbackCursor{
+		index:       index,
+		file:        file,
+		demuxer:     demuxer,
+		recordStart: time.Unix(0, record.StartTime*int64(time.Millisecond)),
+	}, nil
+}
+
+//打开包含pos的录像文件并定位到pos之前最近的关键帧，返回实际开始时间
+func (playback *recordPlayback) openAt(pos time.Time) (cursor *playbackCursor, start time.Time, err error) {
+	for i, record := range playback.records {
+		if record.EndTime < toMillis(pos) && i < len(playback.records)-1 {
+			continue
+		}
+		if cursor, err = playback.openRecord(i); err != nil {
+			playback.logger.Printf("open record file[%s] err:%v", record.Path, err)
+			continue
+		}
+		offset := pos.Sub(cursor.recordStart)
+		if offset < 0 {
+			offset = 0
+		}
+		if offset, err = cursor.demuxer.Seek(offset); err != nil {
+			cursor.close()
+			continue
+		}
+		return cursor, cursor.recordStart.Add(offset), nil
+	}
+	return nil, start, ErrRecordNotFound
+}
+
+//Range: clock=20061017T101010Z-[20061017T111010Z] 或 npt=10.5-[20]，npt相对回放开始时间
+func (playback *recordPlayback) parseRange(value string) (start time.Time, stopAt time.Time, npt bool, err error) {
+	start, stopAt = playback.position, playback.end
+	value = strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+	var from, to string
+	switch {
+	case strings.HasPrefix(value, "npt="):
+		npt = true
+		value = value[len("npt="):]
+	case strings.HasPrefix(value, "clock="):
+		value = value[len("clock="):]
+	default:
+		err = errInvalidRange
+		return
+	}
+	if index := strings.Index(value, "-"); index >= 0 {
+		from, to = value[:index], value[index+1:]
+	} else {
+		from = value
+	}
+	parse := func(v string) (time.Time, error) {
+		if !npt {
+			return time.ParseInLocation(PLAYBACK_CLOCK_LAYOUT, v, time.UTC)
+		}
+		offset, e := parseNPT(v)
+		return playback.begin.Add(offset), e
+	}
+	if from != "" && from != "now" {
+		if start, err = parse(from); err != nil {
+			err = errInvalidRange
+			return
+		}
+	}
+	if to != "" {
+		if stopAt, err = parse(to); err != nil {
+			err = errInvalidRange
+			return
+		}
+	}
+	if start.Before(playback.begin) {
+		start = playback.begin
+	}
+	if stopAt.After(playback.end) {
+		stopAt = playback.end
+	}
+	if !start.Before(stopAt) {
+		err = errInvalidRange
+	}
+	return
+}
+
+//处理PLAY请求，定位后返回Range及RTP-Info，rtp在响应发送后由Start开始发送
+func (playback *recordPlayback) Play(rangeHeader string, scaleHeader string) (rangeValue string, rtpInfo string, scaleValue string, err error) {
+	playback.Pause()
+	if playback.prepared != nil {
+		playback.prepared.cursor.close()
+		playback.prepared = nil
+	}
+	scale := playback.scale
+	if scaleHeader != "" {
+		if scale, err = strconv.ParseFloat(strings.TrimSpace(scaleHeader), 64); err != nil || scale <= 0 {
+			return "", "", "", errInvalidScale
+		}
+	}
+	start, stopAt, npt := playback.position, playback.end, false
+	if rangeHeader != "" {
+		if start, stopAt, npt, err = playback.parseRange(rangeHeader); err != nil {
+			return
+		}
+	}
+	cursor, start, err := playback.openAt(start)
+	if err != nil {
+		return
+	}
+	playback.scale = scale
+	playback.prepared = &playbackRun{cursor: cursor, start: start, stopAt: stopAt, scale: scale}
+	if npt {
+		rangeValue = fmt.Sprintf("npt=%.3f-%.3f", start.Sub(playback.begin).Seconds(), stopAt.Sub(playback.begin).Seconds())
+	} else {
+		rangeValue = "clock=" + start.UTC().Format(PLAYBACK_CLOCK_LAYOUT) + "-" + stopAt.UTC().Format(PLAYBACK_CLOCK_LAYOUT)
+	}
+	var infos []string
+	if playback.vPacketizer != nil {
+		infos = append(infos, fmt.Sprintf("url=%s;seq=%d;rtptime=%d", playback.VControl, playback.vPacketizer.seq, playback.rtpTimestamp(RTP_TYPE_VIDEO, start)))
+	}
+	if playback.aPacketizer != nil {
+		infos = append(infos, fmt.Sprintf("url=%s;seq=%d;rtptime=%d", playback.AControl, playback.aPacketizer.seq, playback.rtpTimestamp(RTP_TYPE_AUDIO, start)))
+	}
+	return rangeValue, strings.Join(infos, ","), strconv.FormatFloat(scale, 'f', -1, 64), nil
+}
+
+//开始发送PLAY定位好的数据
+func (playback *recordPlayback) Start() {
+	playback.lock.Lock()
+	defer playback.lock.Unlock()
+	run := playback.prepared
+	if run == nil || playback.stop != nil {
+		return
+	}
+	playback.prepared = nil
+	playback.stop = make(chan struct{})
+	playback.done = make(chan struct{})
+	go playback.run(run, playback.stop, playback.done)
+}
+
+func (playback *recordPlayback) Pause() {
+	if done := playback.stopLoop(); done != nil {
+		<-done
+	}
+}
+
+//会话结束时调用，发送协程可能阻塞在连接上，不等待其退出
+func (playback *recordPlayback) Close() {
+	playback.stopLoop()
+	if playback.prepared != nil {
+		playback.prepared.cursor.close()
+		playback.prepared = nil
+	}
+}
+
+func (playback *recordPlayback) stopLoop() (done chan struct{}) {
+	playback.lock.Lock()
+	defer playback.lock.Unlock()
+	if playback.stop != nil {
+		close(playback.stop)
+		done = playback.done
+	}
+	playback.stop, playback.done = nil, nil
+	return
+}
+
+//录像时间对应的rtp时间戳，与回放开始时间成线性关系
+func (playback *recordPlayback) rtpTimestamp(rtpType RTPType, t time.Time) uint32 {
+	offset := int64(t.Sub(playback.begin))
+	if rtpType == RTP_TYPE_VIDEO {
+		return playback.vTimestamp + uint32(offset*FMP4_VIDEO_TIMESCALE/int64(time.Second))
+	}
+	return playback.aTimestamp + uint32(offset*int64(playback.audioRate())/int64(time.Second))
+}
+
+func (playback *recordPlayback) run(run *playbackRun, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	cursor := run.cursor
+	defer func() {
+		cursor.close()
+	}()
+	wallStart, posStart := time.Now(), run.start
+	lastReport := time.Now()
+	for {
+		frames, err := cursor.demuxer.ReadFragment()
+		if err != nil {
+			//当前文件结束，打开下一个录像文件
+			next := cursor
+			for i := cursor.index + 1; i < len(playback.records) && next == cursor; i++ {
+				if c, e := playback.openRecord(i); e == nil {
+					next = c
+				} else {
+					playback.logger.Printf("open record file[%s] err:%v", playback.records[i].Path, e)
+				}
+			}
+			if next == cursor {
+				playback.logger.Printf("playback[%s] reach the end", playback.streamPath)
+				return
+			}
+			cursor.close()
+			cursor = next
+			if gap := cursor.recordStart.Sub(playback.currentPosition()); gap > PLAYBACK_MAX_GAP {
+				wallStart, posStart = time.Now(), cursor.recordStart
+			}
+			continue
+		}
+		for _, frame := range frames {
+			t := cursor.recordStart.Add(frame.Timestamp)
+			if t.After(run.stopAt) {
+				playback.logger.Printf("playback[%s] reach the end", playback.streamPath)
+				return
+			}
+			//倍速播放时不发送音频，高倍速只发送关键帧
+			if run.scale != 1 && frame.Type == RTP_TYPE_AUDIO || run.scale >= PLAYBACK_KEYFRAME_SCALE && !frame.KeyFrame {
+				continue
+			}
+			wait := time.Until(wallStart.Add(time.Duration(float64(t.Sub(posStart)) / run.scale)))
+			if wait < 0 {
+				wait = 0
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+			if err := playback.send(frame, t); err != nil {
+				playback.logger.Printf("playback[%s] send error:%v", playback.streamPath, err)
+				return
+			}
+			if time.Since(lastReport) >= RTCP_REPORT_INTERVAL {
+				lastReport = time.Now()
+				for _, pack := range playback.rtcp.SenderReports() {
+					if playback.session.hasRTCPChannel(pack.Type) {
+						playback.session.SendRTP(pack)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (playback *recordPlayback) currentPosition() time.Time {
+	playback.lock.Lock()
+	defer playback.lock.Unlock()
+	return playback.position
+}
+
+func (playback *recordPlayback) send(frame *AVFrame, t time.Time) error {
+	var packs []*RTPPack
+	switch {
+	case frame.Type == RTP_TYPE_VIDEO && playback.vPacketizer != nil:
+		ts := playback.rtpTimestamp(RTP_TYPE_VIDEO, t)
+		if frame.Codec == "h265" {
+			packs = playback.vPacketizer.PacketizeH265(frame.NALUs, ts)
+		} else {
+			packs = playback.vPacketizer.PacketizeH264(frame.NALUs, ts)
+		}
+	case frame.Type == RTP_TYPE_AUDIO && playback.aPacketizer != nil:
+		ts := playback.rtpTimestamp(RTP_TYPE_AUDIO, t)
+		if frame.Codec == "aac" {
+			packs = playback.aPacketizer.PacketizeAAC(frame.Payload, ts)
+		} else {
+			packs = playback.aPacketizer.PacketizeRaw(frame.Payload, ts)
+		}
+	}
+	for _, pack := range packs {
+		if playback.session.Stoped {
+			return fmt.Errorf("session stoped")
+		}
+		if err := playback.session.SendRTP(pack); err != nil {
+			return err
+		}
+		playback.rtcp.OnSend(pack)
+	}
+	playback.lock.Lock()
+	playback.position = t
+	playback.lock.Unlock()
+	return nil
+}
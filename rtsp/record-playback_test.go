@@ -0,0 +1,129 @@
+package rtsp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsPlaybackPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		playback bool
+	}{
+		{"/playback", true},
+		{"/playback/live/test", true},
+		{"/playbacks", false},
+		{"/live/playback", false},
+		{"/", false},
+	}
+	for _, test := range tests {
+		if isPlaybackPath(test.path) != test.playback {
+			t.Fatalf("%s playback = %v", test.path, !test.playback)
+		}
+	}
+}
+
+func TestAddPusherRejectPlaybackPath(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	server := GetServer()
+	pusher := &Pusher{RTMPSession: &RTMPSession{Path: "/playback/live/test", Conn: conn}}
+	if server.AddPusher(pusher) {
+		t.Fatal("pusher under playback path added")
+	}
+	if server.GetPusher(pusher.Path()) != nil {
+		t.Fatal("pusher saved")
+	}
+}
+
+func TestParsePlaybackTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"1700000000", time.Unix(1700000000, 0), false},
+		{"20231114T221320Z", time.Unix(1700000000, 0), false},
+		{"20231114T221320", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, test := range tests {
+		got, err := parsePlaybackTime(test.value)
+		if (err != nil) != test.wantErr || err == nil && !got.Equal(test.want) {
+			t.Fatalf("%q = %v %v, want %v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParseNPT(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"12.5", 12500 * time.Millisecond, false},
+		{"1:02:03.5", time.Hour + 2*time.Minute + 3500*time.Millisecond, false},
+		{"1:x", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseNPT(test.value)
+		if (err != nil) != test.wantErr || err == nil && got != test.want {
+			t.Fatalf("%q = %v %v, want %v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestRecordPlaybackParseRange(t *testing.T) {
+	begin := time.Unix(1700000000, 0)
+	playback := &recordPlayback{begin: begin, end: begin.Add(time.Hour), position: begin.Add(time.Minute)}
+	tests := []struct {
+		value   string
+		start   time.Time
+		stopAt  time.Time
+		npt     bool
+		wantErr bool
+	}{
+		{value: "npt=10-20", start: begin.Add(10 * time.Second), stopAt: begin.Add(20 * time.Second), npt: true},
+		{value: "npt=10-", start: begin.Add(10 * time.Second), stopAt: begin.Add(time.Hour), npt: true},
+		{value: "npt=now-", start: begin.Add(time.Minute), stopAt: begin.Add(time.Hour), npt: true},
+		{value: "npt=0-7200", start: begin, stopAt: begin.Add(time.Hour), npt: true},
+		{value: "clock=20231114T222320Z-", start: begin.Add(10 * time.Minute), stopAt: begin.Add(time.Hour)},
+		{value: "clock=20231114T212320Z-20231114T222320Z", start: begin, stopAt: begin.Add(10 * time.Minute)},
+		{value: "npt=10-20;time=20231114T222320Z", start: begin.Add(10 * time.Second), stopAt: begin.Add(20 * time.Second), npt: true},
+		{value: "npt=20-10", wantErr: true},
+		{value: "npt=3600-", wantErr: true},
+		{value: "npt=a-", wantErr: true},
+		{value: "smpte=0:00:10-", wantErr: true},
+		{value: "clock=2023-", wantErr: true},
+	}
+	for _, test := range tests {
+		start, stopAt, npt, err := playback.parseRange(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Fatalf("%q expected error", test.value)
+			}
+			continue
+		}
+		if err != nil || !start.Equal(test.start) || !stopAt.Equal(test.stopAt) || npt != test.npt {
+			t.Fatalf("%q = %v %v %v %v", test.value, start, stopAt, npt, err)
+		}
+	}
+}
+
+func FuzzRecordPlaybackParseRange(f *testing.F) {
+	f.Add("npt=10-20")
+	f.Add("clock=20231114T222320Z-")
+	f.Add("npt=1:02:03.5-now")
+	begin := time.Unix(1700000000, 0)
+	f.Fuzz(func(t *testing.T, value string) {
+		playback := &recordPlayback{begin: begin, end: begin.Add(time.Hour), position: begin}
+		start, stopAt, _, err := playback.parseRange(value)
+		if err == nil && (start.Before(playback.begin) || stopAt.After(playback.end) || !start.Before(stopAt)) {
+			t.Fatalf("%q = %v-%v out of playback range", value, start, stopAt)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package rtsp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//预录缓存最多保留的包数，避免高码率时占用过多内存
+	RECORD_PREROLL_MAX_PACKETS = 32768
+	//纯音频时按该间隔划分缓存
+	RECORD_PREROLL_AUDIO_GROUP = time.Second
+)
+
+type prerollPack struct {
+	pack *RTPPack
+	at   time.Time
+}
+
+//事件录像的预录缓存，与gop缓存类似，但保留最近N秒的音视频包，且总是从关键帧开始
+type rtpPrerollBuffer struct {
+	lock     sync.Mutex
+	duration time.Duration
+	//每组从关键帧开始
+	gops     [][]prerollPack
+	count    int
+	hasVideo bool
+	//不为nil时新包直接转发给录像
+	sink func(*RTPPack)
+}
+
+func newRTPPrerollBuffer(duration time.Duration) *rtpPrerollBuffer {
+	return &rtpPrerollBuffer{
+		duration: duration,
+	}
+}
+
+func (buffer *rtpPrerollBuffer) Push(pack *RTPPack, keyFrame bool) {
+	if pack.Type != RTP_TYPE_VIDEO && pack.Type != RTP_TYPE_AUDIO {
+		return
+	}
+	now := time.Now()
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.sink != nil {
+		buffer.sink(pack)
+	}
+	if pack.Type == RTP_TYPE_VIDEO {
+		buffer.hasVideo = true
+	} else if !buffer.hasVideo {
+		keyFrame = len(buffer.gops) == 0 || now.Sub(buffer.gops[len(buffer.gops)-1][0].at) >= RECORD_PREROLL_AUDIO_GROUP
+	}
+	if keyFrame {
+		buffer.gops = append(buffer.gops, nil)
+	} else if len(buffer.gops) == 0 {
+		//等待第一个关键帧
+		return
+	}
+	last := len(buffer.gops) - 1
+	buffer.gops[last] = append(buffer.gops[last], prerollPack{pack: pack, at: now})
+	buffer.count++
+	//第二组开始时间早于预录时长时，第一组已不需要
+	cutoff := now.Add(-buffer.duration)
+	for len(buffer.gops) > 1 && (!buffer.gops[1][0].at.After(cutoff) || buffer.count > RECORD_PREROLL_MAX_PACKETS) {
+		buffer.count -= len(buffer.gops[0])
+		buffer.gops[0] = nil
+		buffer.gops = buffer.gops[1:]
+	}
+}
+
+//先用replay写入缓存中的包，再用sink转发新包，两者之间不会丢包或重复
+func (buffer *rtpPrerollBuffer) Attach(replay func(*RTPPack), sink func(*RTPPack)) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	for _, gop := range buffer.gops {
+		for _, item := range gop {
+			replay(item.pack)
+		}
+	}
+	buffer.sink = sink
+}
+
+func (buffer *rtpPrerollBuffer) Detach() {
+	buffer.lock.Lock()
+	buffer.sink = nil
+	buffer.lock.Unlock()
+}
@@ -0,0 +1,113 @@
+package rtsp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+)
+
+func TestRTPPrerollBuffer(t *testing.T) {
+	buffer := newRTPPrerollBuffer(100 * time.Millisecond)
+	packs := make([]*RTPPack, 6)
+	for i := range packs {
+		packs[i] = newTestH264Pack(uint16(i), uint32(i), []byte{0x41})
+	}
+	//第一个关键帧之前的包不缓存
+	buffer.Push(packs[0], false)
+	buffer.Push(packs[1], true)
+	buffer.Push(packs[2], false)
+	time.Sleep(150 * time.Millisecond)
+	//第二组晚于预录时长的开始时间，仍需保留第一组
+	buffer.Push(packs[3], true)
+	time.Sleep(150 * time.Millisecond)
+	buffer.Push(packs[4], true)
+	var replayed, sunk []*RTPPack
+	buffer.Attach(func(pack *RTPPack) {
+		replayed = append(replayed, pack)
+	}, func(pack *RTPPack) {
+		sunk = append(sunk, pack)
+	})
+	if len(replayed) != 2 || replayed[0] != packs[3] || replayed[1] != packs[4] {
+		t.Fatalf("replayed = %v", replayed)
+	}
+	buffer.Push(packs[5], false)
+	buffer.Detach()
+	buffer.Push(packs[5], false)
+	if len(sunk) != 1 || sunk[0] != packs[5] {
+		t.Fatalf("sunk = %v", sunk)
+	}
+	//rtcp不缓存
+	buffer.Push(&RTPPack{Type: RTP_TYPE_VIDEOCONTROL}, true)
+	if last := buffer.gops[len(buffer.gops)-1]; last[len(last)-1].pack != packs[5] {
+		t.Fatalf("last pack = %v", last[len(last)-1].pack)
+	}
+}
+
+func TestRTPPrerollBufferMaxPackets(t *testing.T) {
+	buffer := newRTPPrerollBuffer(time.Hour)
+	buffer.Push(newTestH264Pack(0, 0, []byte{0x65}), true)
+	for i := 1; i <= RECORD_PREROLL_MAX_PACKETS; i++ {
+		buffer.Push(newTestH264Pack(uint16(i), 0, []byte{0x41}), false)
+	}
+	buffer.Push(newTestH264Pack(0, 0, []byte{0x65}), true)
+	if len(buffer.gops) != 1 || buffer.count != 1 {
+		t.Fatalf("gops = %d count = %d", len(buffer.gops), buffer.count)
+	}
+}
+
+//事件录像包含触发前的预录数据，post roll内再次触发则顺延
+func TestTriggerRecord(t *testing.T) {
+	server := startTestServer(t)
+	newTestRecordDB(t)
+	db.SQLite.AutoMigrate(models.RecordSetting{})
+	prerollDuration := server.recordPrerollDuration
+	server.recordPrerollDuration = 10 * time.Second
+	defer func() {
+		server.recordPrerollDuration = prerollDuration
+	}()
+	if err := server.TriggerRecord("/live/none", time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+	pusher := newTestPusher(t, server, "/live/event")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	pusher.QueueRTP(newTestH264Pack(1, 0, []byte{0x65, 0x88, 0x80}))
+	pusher.QueueRTP(newTestH264Pack(2, 45000, []byte{0x41, 0x9a}))
+	for i := 0; i < 100 && len(pusher.queue) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if pusher.Recording() {
+		t.Fatal("recording before trigger")
+	}
+	if err := server.TriggerRecord("/live/event", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := server.TriggerRecord("/live/event", 400*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	pusher.QueueRTP(newTestH264Pack(3, 90000, []byte{0x41, 0x9b}))
+	time.Sleep(200 * time.Millisecond)
+	if !pusher.Recording() {
+		t.Fatal("event record not extended")
+	}
+	for i := 0; i < 100 && pusher.Recording(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pusher.Recording() {
+		t.Fatal("event record not stopped")
+	}
+	var records []models.Record
+	for i := 0; i < 100 && len(records) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		db.SQLite.Where("stream_path = ?", "/live/event").Find(&records)
+	}
+	//从预录的关键帧开始
+	if len(records) != 1 || records[0].Duration != 1000 {
+		t.Fatalf("records = %+v", records)
+	}
+}
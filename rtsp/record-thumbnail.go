@@ -0,0 +1,86 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/bruce-qin/EasyGoLib/utils"
+)
+
+//录像期间定时从推流最新关键帧截图，保存在录像文件旁
+//文件路径：{m3u8_dir_path}/{path}/{yyyyMMdd}/{yyyyMMddHHmmss}.jpg
+type recordThumbnailer struct {
+	SessionLogger
+	server     *Server
+	streamPath string
+	dir        string
+	interval   time.Duration
+	stop       chan struct{}
+	lastErr    string
+}
+
+func newRecordThumbnailer(pusher *Pusher) *recordThumbnailer {
+	server := pusher.Server()
+	return &recordThumbnailer{
+		SessionLogger: SessionLogger{pusher.Logger()},
+		server:        server,
+		streamPath:    pusher.Path(),
+		dir:           server.m3u8DirPath,
+		interval:      server.recordThumbnailInterval,
+		stop:          make(chan struct{}),
+	}
+}
+
+func (thumbnailer *recordThumbnailer) Start() {
+	go func() {
+		ticker := time.NewTicker(thumbnailer.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-thumbnailer.stop:
+				return
+			case <-ticker.C:
+				thumbnailer.capture()
+			}
+		}
+	}()
+}
+
+func (thumbnailer *recordThumbnailer) Stop() {
+	close(thumbnailer.stop)
+}
+
+func (thumbnailer *recordThumbnailer) capture() {
+	jpeg, err := thumbnailer.server.Snapshot(thumbnailer.streamPath)
+	if err != nil {
+		//同样的错误只打印一次
+		if err.Error() != thumbnailer.lastErr {
+			thumbnailer.lastErr = err.Error()
+			thumbnailer.logger.Printf("record thumbnail err:%v", err)
+		}
+		return
+	}
+	thumbnailer.lastErr = ""
+	now := time.Now()
+	thumbnailPath := path.Join("/", thumbnailer.streamPath, now.Format("20060102"), now.Format("20060102150405")+".jpg")
+	filePath := path.Join(thumbnailer.dir, thumbnailPath)
+	if err = utils.EnsureDir(path.Dir(filePath)); err != nil {
+		thumbnailer.logger.Printf("EnsureDir:[%s] err:%v.", path.Dir(filePath), err)
+		return
+	}
+	if err = ioutil.WriteFile(filePath, jpeg, 0644); err != nil {
+		thumbnailer.logger.Printf("write thumbnail[%s] err:%v", filePath, err)
+		return
+	}
+	thumbnail := &models.Thumbnail{
+		Path:       thumbnailPath,
+		StreamPath: thumbnailer.streamPath,
+		Time:       toMillis(now),
+	}
+	if err = db.SQLite.Save(thumbnail).Error; err != nil {
+		thumbnailer.logger.Printf("save thumbnail index[%s] err:%v", thumbnailPath, err)
+	}
+}
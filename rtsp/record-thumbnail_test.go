@@ -0,0 +1,117 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+)
+
+//录像期间定时截图，停止录像后不再截图
+func TestRecordThumbnail(t *testing.T) {
+	server := startTestServer(t)
+	newTestRecordDB(t)
+	db.SQLite.AutoMigrate(models.RecordSetting{})
+	decoder := &testSnapshotDecoder{}
+	snapshotDecoder, cacheDuration, interval := server.snapshotDecoder, server.snapshotCacheDuration, server.recordThumbnailInterval
+	server.SetSnapshotDecoder(decoder)
+	server.snapshotCacheDuration = 0
+	server.recordThumbnailInterval = 20 * time.Millisecond
+	defer func() {
+		server.snapshotDecoder, server.snapshotCacheDuration, server.recordThumbnailInterval = snapshotDecoder, cacheDuration, interval
+	}()
+	pusher := newTestPusher(t, server, "/live/thumbnail")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	if !pusher.StartRecord() {
+		t.Fatal("start record failed")
+	}
+	//没有关键帧时不截图
+	time.Sleep(50 * time.Millisecond)
+	if decoder.Decodes() != 0 {
+		t.Fatalf("decodes = %d", decoder.Decodes())
+	}
+	pusher.QueueRTP(newTestH264Pack(1, 0, []byte{0x65, 0x88, 0x80}))
+	pusher.QueueRTP(newTestH264Pack(2, 3600, []byte{0x41, 0x9a}))
+	var thumbnails []models.Thumbnail
+	for i := 0; i < 100 && len(thumbnails) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		db.SQLite.Find(&thumbnails)
+	}
+	if len(thumbnails) == 0 {
+		t.Fatal("thumbnail not captured")
+	}
+	thumbnail := thumbnails[0]
+	if thumbnail.StreamPath != "/live/thumbnail" || path.Ext(thumbnail.Path) != ".jpg" || time.Since(time.Unix(0, thumbnail.Time*int64(time.Millisecond))) > time.Second {
+		t.Fatalf("thumbnail = %+v", thumbnail)
+	}
+	if data, err := ioutil.ReadFile(path.Join(server.m3u8DirPath, thumbnail.Path)); err != nil || string(data) != "h264jpeg" {
+		t.Fatalf("thumbnail file = %s err = %v", data, err)
+	}
+	pusher.StopRecord()
+	time.Sleep(50 * time.Millisecond)
+	decodes := decoder.Decodes()
+	time.Sleep(50 * time.Millisecond)
+	if decoder.Decodes() != decodes {
+		t.Fatal("thumbnail captured after record stopped")
+	}
+}
+
+//删除录像时一并删除该录像结束前的缩略图
+func TestRecordJanitorRemoveThumbnails(t *testing.T) {
+	newTestRecordDB(t)
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	record := models.Record{Path: "/live/a/20240101/20240101000000000.mp4", StreamPath: "/live/a", StartTime: 1000, EndTime: 2000, Size: 6}
+	thumbnails := []struct {
+		thumbnail models.Thumbnail
+		removed   bool
+	}{
+		{models.Thumbnail{Path: "/live/a/20240101/20240101000001.jpg", StreamPath: "/live/a", Time: 1500}, true},
+		{models.Thumbnail{Path: "/live/a/20240101/20240101000002.jpg", StreamPath: "/live/a", Time: 2000}, true},
+		{models.Thumbnail{Path: "/live/a/20240101/20240101000003.jpg", StreamPath: "/live/a", Time: 2500}, false},
+		{models.Thumbnail{Path: "/live/b/20240101/20240101000001.jpg", StreamPath: "/live/b", Time: 1500}, false},
+	}
+	files := []string{record.Path}
+	for _, item := range thumbnails {
+		files = append(files, item.thumbnail.Path)
+		db.SQLite.Create(&item.thumbnail)
+	}
+	for _, file := range files {
+		os.MkdirAll(path.Dir(path.Join(dir, file)), 0755)
+		if err = ioutil.WriteFile(path.Join(dir, file), []byte("record"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.SQLite.Create(&record)
+	janitor := &RecordJanitor{
+		SessionLogger: SessionLogger{logger: log.New(ioutil.Discard, "", 0)},
+		dir:           dir,
+	}
+	if !janitor.remove(record) {
+		t.Fatal("remove failed")
+	}
+	for _, item := range thumbnails {
+		_, err := os.Stat(path.Join(dir, item.thumbnail.Path))
+		if removed := os.IsNotExist(err); removed != item.removed {
+			t.Fatalf("%s removed = %v, want %v", item.thumbnail.Path, removed, item.removed)
+		}
+		count := 0
+		db.SQLite.Model(models.Thumbnail{}).Where("path = ?", item.thumbnail.Path).Count(&count)
+		if (count == 0) != item.removed {
+			t.Fatalf("%s index count = %d", item.thumbnail.Path, count)
+		}
+	}
+	if info := janitor.Info(); info.ReclaimedBytes != 18 {
+		t.Fatalf("info = %+v", info)
+	}
+}
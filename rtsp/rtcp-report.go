@@ -0,0 +1,314 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	RTCP_TYPE_SR    = 200
+	RTCP_TYPE_RR    = 201
+	RTCP_TYPE_SDES  = 202
+	RTCP_TYPE_BYE   = 203
+	RTCP_TYPE_RTPFB = 205
+	RTCP_TYPE_PSFB  = 206
+
+	RTCP_SENDER_INFO_LENGTH  = 20
+	RTCP_REPORT_BLOCK_LENGTH = 24
+	//rfc3550 6.2 最小报告间隔
+	RTCP_REPORT_INTERVAL = 5 * time.Second
+	RTCP_CNAME           = "EasyDarwin"
+)
+
+//rtcp复合包中的单个包，Payload为SSRC之后的内容
+type rtcpPacket struct {
+	Type    uint8
+	Count   uint8
+	SSRC    uint32
+	Payload []byte
+}
+
+type rtcpSenderInfo struct {
+	NTPTime      uint64
+	RTPTimestamp uint32
+	PacketCount  uint32
+	OctetCount   uint32
+}
+
+type rtcpReportBlock struct {
+	SSRC         uint32
+	FractionLost uint8
+	PacketsLost  int32
+	HighestSeq   uint32
+	Jitter       uint32
+	LSR          uint32
+	DLSR         uint32
+}
+
+//拆分rtcp复合包
+func parseRTCP(data []byte) (packets []*rtcpPacket) {
+	for len(data) >= RTCP_FIXED_HEADER_LEN {
+		if data[0]>>6 != 2 {
+			return
+		}
+		length := (int(binary.BigEndian.Uint16(data[2:])) + 1) * 4
+		//length为0时只有4字节，不足以包含ssrc
+		if length < RTCP_FIXED_HEADER_LEN || length > len(data) {
+			return
+		}
+		packets = append(packets, &rtcpPacket{
+			Type:    data[1],
+			Count:   data[0] & 0x1f,
+			SSRC:    binary.BigEndian.Uint32(data[4:]),
+			Payload: data[RTCP_FIXED_HEADER_LEN:length],
+		})
+		data = data[length:]
+	}
+	return
+}
+
+//解析SR的发送者信息及SR/RR中的报告块
+func (packet *rtcpPacket) reports() (info *rtcpSenderInfo, blocks []rtcpReportBlock) {
+	data := packet.Payload
+	if packet.Type == RTCP_TYPE_SR {
+		if len(data) < RTCP_SENDER_INFO_LENGTH {
+			return
+		}
+		info = &rtcpSenderInfo{
+			NTPTime:      binary.BigEndian.Uint64(data),
+			RTPTimestamp: binary.BigEndian.Uint32(data[8:]),
+			PacketCount:  binary.BigEndian.Uint32(data[12:]),
+			OctetCount:   binary.BigEndian.Uint32(data[16:]),
+		}
+		data = data[RTCP_SENDER_INFO_LENGTH:]
+	} else if packet.Type != RTCP_TYPE_RR {
+		return
+	}
+	for i := 0; i < int(packet.Count) && len(data) >= RTCP_REPORT_BLOCK_LENGTH; i++ {
+		blocks = append(blocks, rtcpReportBlock{
+			SSRC:         binary.BigEndian.Uint32(data),
+			FractionLost: data[4],
+			//24位有符号数
+			PacketsLost: int32(binary.BigEndian.Uint32(data[4:])<<8) >> 8,
+			HighestSeq:  binary.BigEndian.Uint32(data[8:]),
+			Jitter:      binary.BigEndian.Uint32(data[12:]),
+			LSR:         binary.BigEndian.Uint32(data[16:]),
+			DLSR:        binary.BigEndian.Uint32(data[20:]),
+		})
+		data = data[RTCP_REPORT_BLOCK_LENGTH:]
+	}
+	return
+}
+
+//不带报告块的SR及CNAME组成的复合包
+func newSenderReport(ssrc uint32, info *rtcpSenderInfo) []byte {
+	packet := make([]byte, RTCP_FIXED_HEADER_LEN+RTCP_SENDER_INFO_LENGTH, 64)
+	packet[0], packet[1] = 0x80, RTCP_TYPE_SR
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)/4-1))
+	binary.BigEndian.PutUint32(packet[4:], ssrc)
+	binary.BigEndian.PutUint64(packet[8:], info.NTPTime)
+	binary.BigEndian.PutUint32(packet[16:], info.RTPTimestamp)
+	binary.BigEndian.PutUint32(packet[20:], info.PacketCount)
+	binary.BigEndian.PutUint32(packet[24:], info.OctetCount)
+
+	sdes := []byte{0x81, RTCP_TYPE_SDES, 0, 0, byte(ssrc >> 24), byte(ssrc >> 16), byte(ssrc >> 8), byte(ssrc), 1, byte(len(RTCP_CNAME))}
+	sdes = append(sdes, RTCP_CNAME...)
+	//item列表以0结束并补齐4字节
+	sdes = append(sdes, 0)
+	for len(sdes)%4 != 0 {
+		sdes = append(sdes, 0)
+	}
+	binary.BigEndian.PutUint16(sdes[2:], uint16(len(sdes)/4-1))
+	return append(packet, sdes...)
+}
+
+func fromNTPTimestamp(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - 2208988800
+	nanos := int64((ntp & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+//拉流端单个媒体的发送统计及收到的接收报告
+type rtcpStream struct {
+	rtpType   RTPType
+	clockRate int
+	started   bool
+	ssrc      uint32
+	lastRTP   uint32
+	lastSend  time.Time
+	packets   uint32
+	octets    uint32
+	//最近一次SR的ntp中间32位及发送时间，用于计算rtt
+	lastSR     uint32
+	lastSRSend time.Time
+
+	fractionLost uint8
+	packetsLost  int32
+	jitter       uint32
+	rtt          time.Duration
+}
+
+//拉流端rtcp统计，音视频中取较差的值
+type RTCPStats struct {
+	Jitter      time.Duration
+	PacketsLost int
+	//百分比
+	LossRate float64
+	RTT      time.Duration
+}
+
+//为单个拉流端生成SR并消费其RR
+type rtcpReporter struct {
+	lock     sync.Mutex
+	timeline *RTPTimeline
+	audio    rtcpStream
+	video    rtcpStream
+}
+
+func newRTCPReporter(pusher *Pusher) *rtcpReporter {
+	reporter := &rtcpReporter{
+		timeline: pusher.timeline,
+		audio:    rtcpStream{rtpType: RTP_TYPE_AUDIO},
+		video:    rtcpStream{rtpType: RTP_TYPE_VIDEO},
+	}
+	sdpMap := ParseSDP(pusher.SDPRaw())
+	if info, ok := sdpMap["audio"]; ok {
+		reporter.audio.clockRate = info.TimeScale
+	}
+	if info, ok := sdpMap["video"]; ok {
+		reporter.video.clockRate = info.TimeScale
+	}
+	return reporter
+}
+
+func (reporter *rtcpReporter) stream(rtpType RTPType) *rtcpStream {
+	switch rtpType {
+	case RTP_TYPE_AUDIO, RTP_TYPE_AUDIOCONTROL:
+		return &reporter.audio
+	case RTP_TYPE_VIDEO, RTP_TYPE_VIDEOCONTROL:
+		return &reporter.video
+	}
+	return nil
+}
+
+//记录已发送给拉流端的rtp包
+func (reporter *rtcpReporter) OnSend(pack *RTPPack) {
+	if pack.Type != RTP_TYPE_AUDIO && pack.Type != RTP_TYPE_VIDEO {
+		return
+	}
+	data := pack.Buffer.Bytes()
+	if len(data) < RTP_FIXED_HEADER_LENGTH {
+		return
+	}
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	stream := reporter.stream(pack.Type)
+	if ssrc := binary.BigEndian.Uint32(data[8:]); !stream.started || stream.ssrc != ssrc {
+		//推流端重连后ssrc变化，重新统计
+		*stream = rtcpStream{rtpType: stream.rtpType, clockRate: stream.clockRate, started: true, ssrc: ssrc}
+	}
+	stream.lastRTP = binary.BigEndian.Uint32(data[4:])
+	stream.lastSend = time.Now()
+	stream.packets++
+	stream.octets += uint32(len(data) - RTP_FIXED_HEADER_LENGTH)
+}
+
+//生成各媒体的SR，rtp时间戳由最近发送的包按时钟频率外推到当前时刻
+func (reporter *rtcpReporter) SenderReports() (packs []*RTPPack) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	now := time.Now()
+	for _, stream := range []*rtcpStream{&reporter.video, &reporter.audio} {
+		if !stream.started {
+			continue
+		}
+		clockRate := stream.clockRate
+		if clockRate <= 0 {
+			clockRate = 90000
+		}
+		rtpTime := stream.lastRTP + uint32(int64(now.Sub(stream.lastSend))*int64(clockRate)/int64(time.Second))
+		//使用推流统一的时间线，保证各拉流端的音视频同步关系与推流端一致
+		ntpTime := now
+		if reporter.timeline != nil {
+			ntpTime = reporter.timeline.NTPTime(stream.rtpType, rtpTime)
+		}
+		ntp := toNTPTimestamp(ntpTime)
+		stream.lastSR = uint32(ntp >> 16)
+		stream.lastSRSend = now
+		packType := RTP_TYPE_VIDEOCONTROL
+		if stream.rtpType == RTP_TYPE_AUDIO {
+			packType = RTP_TYPE_AUDIOCONTROL
+		}
+		packs = append(packs, &RTPPack{
+			Type: packType,
+			Buffer: bytes.NewBuffer(newSenderReport(stream.ssrc, &rtcpSenderInfo{
+				NTPTime:      ntp,
+				RTPTimestamp: rtpTime,
+				PacketCount:  stream.packets,
+				OctetCount:   stream.octets,
+			})),
+		})
+	}
+	return
+}
+
+//消费拉流端的RR
+func (reporter *rtcpReporter) HandleReceiverReport(pack *RTPPack) {
+	if pack.Type != RTP_TYPE_AUDIOCONTROL && pack.Type != RTP_TYPE_VIDEOCONTROL {
+		return
+	}
+	now := time.Now()
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	for _, packet := range parseRTCP(pack.Buffer.Bytes()) {
+		_, blocks := packet.reports()
+		for _, block := range blocks {
+			stream := reporter.stream(pack.Type)
+			//部分客户端音视频rtcp共用一个通道
+			if stream.ssrc != block.SSRC {
+				if stream = reporter.stream(RTP_TYPE_AUDIO); stream.ssrc != block.SSRC {
+					if stream = reporter.stream(RTP_TYPE_VIDEO); stream.ssrc != block.SSRC {
+						continue
+					}
+				}
+			}
+			stream.fractionLost = block.FractionLost
+			stream.packetsLost = block.PacketsLost
+			stream.jitter = block.Jitter
+			if block.LSR != 0 && block.LSR == stream.lastSR {
+				//DLSR单位为1/65536秒
+				delay := time.Duration(int64(block.DLSR) * int64(time.Second) >> 16)
+				if rtt := now.Sub(stream.lastSRSend) - delay; rtt >= 0 {
+					stream.rtt = rtt
+				}
+			}
+		}
+	}
+}
+
+func (reporter *rtcpReporter) Stats() (stats RTCPStats) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	for _, stream := range []*rtcpStream{&reporter.video, &reporter.audio} {
+		if !stream.started {
+			continue
+		}
+		clockRate := stream.clockRate
+		if clockRate <= 0 {
+			clockRate = 90000
+		}
+		if jitter := time.Duration(int64(stream.jitter) * int64(time.Second) / int64(clockRate)); jitter > stats.Jitter {
+			stats.Jitter = jitter
+		}
+		stats.PacketsLost += int(stream.packetsLost)
+		if lossRate := float64(stream.fractionLost) * 100 / 256; lossRate > stats.LossRate {
+			stats.LossRate = lossRate
+		}
+		if stream.rtt > stats.RTT {
+			stats.RTT = stream.rtt
+		}
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package rtsp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseRTCP(t *testing.T) {
+	sr := newSenderReport(0x1234, &rtcpSenderInfo{NTPTime: 1 << 32, RTPTimestamp: 90000, PacketCount: 10, OctetCount: 1000})
+	rr := []byte{0x81, RTCP_TYPE_RR, 0, 7, 0, 0, 0, 1,
+		0, 0, 0x12, 0x34, 0x40, 0xff, 0xff, 0xfe, 0, 0, 0, 100, 0, 0, 0, 90, 0, 0, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name  string
+		data  []byte
+		types []uint8
+	}{
+		{"sender report and sdes", sr, []uint8{RTCP_TYPE_SR, RTCP_TYPE_SDES}},
+		{"receiver report", rr, []uint8{RTCP_TYPE_RR}},
+		{"zero length", []byte{0x80, RTCP_TYPE_RR, 0, 0, 0, 0, 0, 1}, nil},
+		{"zero length after valid packet", append(append([]byte{}, rr...), 0x80, RTCP_TYPE_RR, 0, 0, 0, 0, 0, 1), []uint8{RTCP_TYPE_RR}},
+		{"length out of range", []byte{0x80, RTCP_TYPE_RR, 0, 2, 0, 0, 0, 1}, nil},
+		{"bad version", []byte{0x40, RTCP_TYPE_RR, 0, 1, 0, 0, 0, 1}, nil},
+		{"shorter than header", []byte{0x80, RTCP_TYPE_RR, 0, 1}, nil},
+		{"trailing bytes", append(append([]byte{}, rr...), 0x80, 0xc9), []uint8{RTCP_TYPE_RR}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := parseRTCP(test.data)
+			if len(packets) != len(test.types) {
+				t.Fatalf("packets = %d, want %d", len(packets), len(test.types))
+			}
+			for i, packet := range packets {
+				if packet.Type != test.types[i] {
+					t.Fatalf("packet %d type = %d, want %d", i, packet.Type, test.types[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRTCPReports(t *testing.T) {
+	info := &rtcpSenderInfo{NTPTime: 0x0123456789abcdef, RTPTimestamp: 90000, PacketCount: 10, OctetCount: 1000}
+	packets := parseRTCP(newSenderReport(0x1234, info))
+	got, blocks := packets[0].reports()
+	if got == nil || *got != *info || len(blocks) != 0 {
+		t.Fatalf("sender info = %+v, blocks = %d", got, len(blocks))
+	}
+	//count大于实际报告块数
+	rr := []byte{0x83, RTCP_TYPE_RR, 0, 7, 0, 0, 0, 1,
+		0, 0, 0x12, 0x34, 0x40, 0xff, 0xff, 0xfe, 0, 0, 0, 100, 0, 0, 0, 90, 0, 0, 0, 0, 0, 0, 0, 0}
+	_, blocks = parseRTCP(rr)[0].reports()
+	if len(blocks) != 1 || blocks[0].SSRC != 0x1234 || blocks[0].FractionLost != 0x40 || blocks[0].PacketsLost != -2 || blocks[0].Jitter != 90 {
+		t.Fatalf("blocks = %+v", blocks)
+	}
+	//SR长度不足发送者信息
+	if info, _ := parseRTCP([]byte{0x80, RTCP_TYPE_SR, 0, 1, 0, 0, 0, 1})[0].reports(); info != nil {
+		t.Fatal("truncated sender info parsed")
+	}
+}
+
+func TestRTCPReporterMalformedReport(t *testing.T) {
+	reporter := &rtcpReporter{audio: rtcpStream{rtpType: RTP_TYPE_AUDIO}, video: rtcpStream{rtpType: RTP_TYPE_VIDEO}}
+	reporter.OnSend(&RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(testRTPPacket(0x1234, 1))})
+	reporter.SenderReports()
+	for _, data := range [][]byte{
+		{0x80, RTCP_TYPE_RR, 0, 0, 0, 0, 0, 1},
+		{0x81, RTCP_TYPE_RR, 0, 1, 0, 0, 0, 1},
+		{0x81, RTCP_TYPE_RR, 0, 7, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0x40, 0, 0, 5, 0, 0, 0, 100, 0, 0, 0, 90, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		reporter.HandleReceiverReport(&RTPPack{Type: RTP_TYPE_VIDEOCONTROL, Buffer: bytes.NewBuffer(data)})
+	}
+	if stats := reporter.Stats(); stats.PacketsLost != 5 || stats.Jitter != time.Second/1000 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func FuzzParseRTCP(f *testing.F) {
+	f.Add(newSenderReport(0x1234, &rtcpSenderInfo{NTPTime: 1 << 32}))
+	f.Add([]byte{0x81, RTCP_TYPE_RR, 0, 7, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0x40, 0xff, 0xff, 0xfe, 0, 0, 0, 100, 0, 0, 0, 90, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0x80, RTCP_TYPE_RR, 0, 0, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, packet := range parseRTCP(data) {
+			packet.reports()
+			parseGenericNACK(packet)
+		}
+		timeline := &RTPTimeline{}
+		timeline.updateSenderReport(&RTPPack{Type: RTP_TYPE_VIDEOCONTROL, Buffer: bytes.NewBuffer(data)})
+		reporter := &rtcpReporter{audio: rtcpStream{rtpType: RTP_TYPE_AUDIO}, video: rtcpStream{rtpType: RTP_TYPE_VIDEO}}
+		reporter.HandleReceiverReport(&RTPPack{Type: RTP_TYPE_AUDIOCONTROL, Buffer: bytes.NewBuffer(data)})
+	})
+}
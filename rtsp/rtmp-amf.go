@@ -0,0 +1,221 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	AMF0_NUMBER       = 0x00
+	AMF0_BOOLEAN      = 0x01
+	AMF0_STRING       = 0x02
+	AMF0_OBJECT       = 0x03
+	AMF0_NULL         = 0x05
+	AMF0_UNDEFINED    = 0x06
+	AMF0_ECMA_ARRAY   = 0x08
+	AMF0_OBJECT_END   = 0x09
+	AMF0_STRICT_ARRAY = 0x0a
+	AMF0_DATE         = 0x0b
+	AMF0_LONG_STRING  = 0x0c
+
+	//对象及数组的最大嵌套层数
+	AMF0_MAX_DEPTH = 32
+)
+
+type AMFObject map[string]interface{}
+
+func (obj AMFObject) String(key string) string {
+	if v, ok := obj[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (obj AMFObject) Number(key string) float64 {
+	if v, ok := obj[key].(float64); ok {
+		return v
+	}
+	return 0
+}
+
+//解析amf0数据中的全部值
+func AMF0Decode(data []byte) (values []interface{}, err error) {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var v interface{}
+		if v, err = amf0ReadValue(r, 0); err != nil {
+			return
+		}
+		values = append(values, v)
+	}
+	return
+}
+
+func amf0ReadString(r *bytes.Reader, long bool) (string, error) {
+	var length uint32
+	if long {
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return "", err
+		}
+	} else {
+		var l uint16
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return "", err
+		}
+		length = uint32(l)
+	}
+	if int(length) > r.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func amf0ReadObject(r *bytes.Reader, depth int) (AMFObject, error) {
+	obj := make(AMFObject)
+	for {
+		key, err := amf0ReadString(r, false)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if marker == AMF0_OBJECT_END {
+				return obj, nil
+			}
+			_ = r.UnreadByte()
+		}
+		value, err := amf0ReadValue(r, depth)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = value
+	}
+}
+
+func amf0ReadValue(r *bytes.Reader, depth int) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case AMF0_OBJECT, AMF0_ECMA_ARRAY, AMF0_STRICT_ARRAY:
+		if depth++; depth > AMF0_MAX_DEPTH {
+			return nil, fmt.Errorf("amf0 nesting too deep")
+		}
+	}
+	switch marker {
+	case AMF0_NUMBER:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case AMF0_BOOLEAN:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case AMF0_STRING:
+		return amf0ReadString(r, false)
+	case AMF0_LONG_STRING:
+		return amf0ReadString(r, true)
+	case AMF0_OBJECT:
+		return amf0ReadObject(r, depth)
+	case AMF0_ECMA_ARRAY:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		return amf0ReadObject(r, depth)
+	case AMF0_STRICT_ARRAY:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, 0)
+		for i := uint32(0); i < count; i++ {
+			v, err := amf0ReadValue(r, depth)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		return array, nil
+	case AMF0_DATE:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		var zone int16
+		err := binary.Read(r, binary.BigEndian, &zone)
+		return math.Float64frombits(bits), err
+	case AMF0_NULL, AMF0_UNDEFINED:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported amf0 marker:%d", marker)
+}
+
+//将值编码为amf0数据
+func AMF0Encode(values ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	for _, v := range values {
+		amf0WriteValue(buf, v)
+	}
+	return buf.Bytes()
+}
+
+func amf0WriteString(buf *bytes.Buffer, s string) {
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func amf0WriteValue(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteByte(AMF0_NULL)
+	case float64:
+		buf.WriteByte(AMF0_NUMBER)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(value))
+	case int:
+		amf0WriteValue(buf, float64(value))
+	case uint32:
+		amf0WriteValue(buf, float64(value))
+	case bool:
+		buf.WriteByte(AMF0_BOOLEAN)
+		if value {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		if len(value) > 0xffff {
+			buf.WriteByte(AMF0_LONG_STRING)
+			_ = binary.Write(buf, binary.BigEndian, uint32(len(value)))
+			buf.WriteString(value)
+		} else {
+			buf.WriteByte(AMF0_STRING)
+			amf0WriteString(buf, value)
+		}
+	case AMFObject:
+		buf.WriteByte(AMF0_OBJECT)
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			amf0WriteString(buf, key)
+			amf0WriteValue(buf, value[key])
+		}
+		buf.Write([]byte{0x00, 0x00, AMF0_OBJECT_END})
+	default:
+		buf.WriteByte(AMF0_UNDEFINED)
+	}
+}
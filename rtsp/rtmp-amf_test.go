@@ -0,0 +1,85 @@
+package rtsp
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAMF0EncodeDecode(t *testing.T) {
+	values := []interface{}{
+		"connect",
+		float64(1),
+		AMFObject{"app": "live", "tcUrl": "rtmp://127.0.0.1/live", "fpad": false, "audioCodecs": float64(3575)},
+		nil,
+		strings.Repeat("a", 0x10000),
+	}
+	decoded, err := AMF0Decode(AMF0Encode(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Fatalf("decoded = %v", decoded)
+	}
+}
+
+func TestAMF0DecodeError(t *testing.T) {
+	nested := func(depth int, marker byte) []byte {
+		buf := &bytes.Buffer{}
+		for i := 0; i < depth; i++ {
+			buf.WriteByte(marker)
+			if marker == AMF0_STRICT_ARRAY {
+				buf.Write([]byte{0, 0, 0, 1})
+			} else {
+				buf.Write([]byte{0, 1, 'a'})
+			}
+		}
+		buf.WriteByte(AMF0_NULL)
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"strict array too deep", nested(AMF0_MAX_DEPTH+1, AMF0_STRICT_ARRAY), true},
+		{"object too deep", nested(3200000, AMF0_OBJECT), true},
+		{"truncated number", []byte{AMF0_NUMBER, 0, 0}, true},
+		{"string longer than data", []byte{AMF0_STRING, 0, 10, 'a'}, true},
+		{"long string longer than data", []byte{AMF0_LONG_STRING, 0xff, 0xff, 0xff, 0xff}, true},
+		{"unsupported marker", []byte{0x11}, true},
+		{"object without end", []byte{AMF0_OBJECT, 0, 1, 'a', AMF0_NULL}, true},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := AMF0Decode(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+	//未超过最大层数的数组可以正常解析
+	array := bytes.Repeat([]byte{AMF0_STRICT_ARRAY, 0, 0, 0, 1}, AMF0_MAX_DEPTH)
+	if _, err := AMF0Decode(append(array, AMF0_NULL)); err != nil {
+		t.Fatalf("depth %d error = %v", AMF0_MAX_DEPTH, err)
+	}
+}
+
+func FuzzAMF0Decode(f *testing.F) {
+	f.Add(AMF0Encode("connect", float64(1), AMFObject{"app": "live"}))
+	f.Add(AMF0Encode("@setDataFrame", "onMetaData", AMFObject{"width": float64(1920), "videocodecid": float64(7)}))
+	f.Add([]byte{AMF0_ECMA_ARRAY, 0, 0, 0, 1, 0, 1, 'a', AMF0_BOOLEAN, 1, 0, 0, AMF0_OBJECT_END})
+	f.Add([]byte{AMF0_STRICT_ARRAY, 0, 0, 0, 2, AMF0_DATE, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, AMF0_UNDEFINED})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		values, err := AMF0Decode(data)
+		if err != nil {
+			return
+		}
+		//能解析的数据重新编码后应得到相同的值
+		if _, err = AMF0Decode(AMF0Encode(values...)); err != nil {
+			t.Fatalf("decode encoded values error:%v", err)
+		}
+	})
+}
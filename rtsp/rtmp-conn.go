@@ -0,0 +1,379 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RTMP_MSG_SET_CHUNK_SIZE     = 1
+	RTMP_MSG_ABORT              = 2
+	RTMP_MSG_ACK                = 3
+	RTMP_MSG_USER_CONTROL       = 4
+	RTMP_MSG_WINDOW_ACK_SIZE    = 5
+	RTMP_MSG_SET_PEER_BANDWIDTH = 6
+	RTMP_MSG_AUDIO              = 8
+	RTMP_MSG_VIDEO              = 9
+	RTMP_MSG_AMF3_DATA          = 15
+	RTMP_MSG_AMF3_COMMAND       = 17
+	RTMP_MSG_AMF0_DATA          = 18
+	RTMP_MSG_AMF0_COMMAND       = 20
+
+	RTMP_USER_STREAM_BEGIN  = 0
+	RTMP_USER_PING_REQUEST  = 6
+	RTMP_USER_PING_RESPONSE = 7
+
+	//发送消息使用的chunk stream id
+	RTMP_CSID_CONTROL = 2
+	RTMP_CSID_COMMAND = 3
+	RTMP_CSID_AUDIO   = 4
+	RTMP_CSID_VIDEO   = 6
+	RTMP_CSID_DATA    = 5
+
+	RTMP_HANDSHAKE_SIZE     = 1536
+	RTMP_DEFAULT_CHUNK_SIZE = 128
+	RTMP_OUT_CHUNK_SIZE     = 4096
+	RTMP_WINDOW_ACK_SIZE    = 2500000
+
+	//接收消息的最大长度及同时接收的chunk stream个数，防止恶意客户端占用大量内存
+	RTMP_MAX_MESSAGE_SIZE  = 4 * 1024 * 1024
+	RTMP_MAX_CHUNK_STREAMS = 64
+)
+
+type RTMPMessage struct {
+	TypeID    byte
+	StreamID  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+//接收中的chunk stream状态
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    byte
+	streamID  uint32
+	extended  bool
+	payload   []byte
+}
+
+//rtmp握手及chunk收发
+type rtmpConn struct {
+	conn         net.Conn
+	timeout      time.Duration
+	r            *bufio.Reader
+	w            *bufio.Writer
+	wLock        sync.Mutex
+	inChunkSize  uint32
+	outChunkSize uint32
+	chunkStreams map[uint32]*rtmpChunkStream
+	ackWindow    uint32
+	inBytes      uint32
+	lastAck      uint32
+	outBytes     int
+}
+
+func newRTMPConn(conn net.Conn, bufferSize int, timeout time.Duration) *rtmpConn {
+	c := &rtmpConn{
+		conn:         conn,
+		timeout:      timeout,
+		inChunkSize:  RTMP_DEFAULT_CHUNK_SIZE,
+		outChunkSize: RTMP_DEFAULT_CHUNK_SIZE,
+		chunkStreams: make(map[uint32]*rtmpChunkStream),
+	}
+	c.r = bufio.NewReaderSize(c, bufferSize)
+	c.w = bufio.NewWriterSize(conn, bufferSize)
+	return c
+}
+
+//统计读取的字节数，用于回复Acknowledgement
+func (c *rtmpConn) Read(p []byte) (n int, err error) {
+	if c.timeout > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	n, err = c.conn.Read(p)
+	c.inBytes += uint32(n)
+	return
+}
+
+//简单握手，不校验digest
+func (c *rtmpConn) Handshake() (err error) {
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+	if _, err = io.ReadFull(c.r, c0c1); err != nil {
+		return
+	}
+	if c0c1[0] != 0x03 {
+		return fmt.Errorf("unsupported rtmp version:%d", c0c1[0])
+	}
+	s0s1s2 := make([]byte, 1+2*RTMP_HANDSHAKE_SIZE)
+	s0s1s2[0] = 0x03
+	binary.BigEndian.PutUint32(s0s1s2[1:], uint32(time.Now().Unix()))
+	if _, err = rand.Read(s0s1s2[9 : 1+RTMP_HANDSHAKE_SIZE]); err != nil {
+		return
+	}
+	copy(s0s1s2[1+RTMP_HANDSHAKE_SIZE:], c0c1[1:])
+	c.wLock.Lock()
+	_, err = c.w.Write(s0s1s2)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.wLock.Unlock()
+	if err != nil {
+		return
+	}
+	c2 := make([]byte, RTMP_HANDSHAKE_SIZE)
+	_, err = io.ReadFull(c.r, c2)
+	return
+}
+
+func (c *rtmpConn) readUint(size int) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c.r, buf[4-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+//读取一个完整的消息，协议控制消息在此处理
+func (c *rtmpConn) ReadMessage() (*RTMPMessage, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if c.ackWindow > 0 && c.inBytes-c.lastAck >= c.ackWindow {
+			c.lastAck = c.inBytes
+			ack := make([]byte, 4)
+			binary.BigEndian.PutUint32(ack, c.inBytes)
+			if err = c.WriteMessage(RTMP_CSID_CONTROL, &RTMPMessage{TypeID: RTMP_MSG_ACK, Payload: ack}); err != nil {
+				return nil, err
+			}
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.TypeID {
+		case RTMP_MSG_SET_CHUNK_SIZE:
+			if len(msg.Payload) >= 4 {
+				size := binary.BigEndian.Uint32(msg.Payload) & 0x7fffffff
+				if size == 0 {
+					return nil, fmt.Errorf("rtmp invalid chunk size:%d", size)
+				}
+				c.inChunkSize = size
+			}
+		case RTMP_MSG_ABORT:
+			if len(msg.Payload) >= 4 {
+				if cs := c.chunkStreams[binary.BigEndian.Uint32(msg.Payload)]; cs != nil {
+					cs.payload = nil
+				}
+			}
+		case RTMP_MSG_WINDOW_ACK_SIZE:
+			if len(msg.Payload) >= 4 {
+				c.ackWindow = binary.BigEndian.Uint32(msg.Payload)
+			}
+		case RTMP_MSG_ACK, RTMP_MSG_SET_PEER_BANDWIDTH:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+//读取一个chunk，消息未接收完整时返回nil
+func (c *rtmpConn) readChunk() (msg *RTMPMessage, err error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return
+	}
+	format := b >> 6
+	csid := uint32(b & 0x3f)
+	switch csid {
+	case 0:
+		var v byte
+		if v, err = c.r.ReadByte(); err != nil {
+			return
+		}
+		csid = 64 + uint32(v)
+	case 1:
+		var v uint32
+		if v, err = c.readUint(2); err != nil {
+			return
+		}
+		csid = 64 + (v&0xff)<<8 + v>>8
+	}
+	cs := c.chunkStreams[csid]
+	if cs == nil {
+		if format != 0 {
+			return nil, fmt.Errorf("rtmp chunk stream[%d] start without type 0 header", csid)
+		}
+		if len(c.chunkStreams) >= RTMP_MAX_CHUNK_STREAMS {
+			return nil, fmt.Errorf("rtmp too many chunk streams:%d", len(c.chunkStreams))
+		}
+		cs = &rtmpChunkStream{}
+		c.chunkStreams[csid] = cs
+	}
+	var timestamp uint32
+	if format <= 2 {
+		if timestamp, err = c.readUint(3); err != nil {
+			return
+		}
+	}
+	if format <= 1 {
+		var length uint32
+		if length, err = c.readUint(3); err != nil {
+			return
+		}
+		//消息未接收完整时不允许修改消息长度
+		if len(cs.payload) > 0 && length != cs.length {
+			return nil, fmt.Errorf("rtmp chunk stream[%d] message length changed from %d to %d", csid, cs.length, length)
+		}
+		if length > RTMP_MAX_MESSAGE_SIZE {
+			return nil, fmt.Errorf("rtmp chunk stream[%d] message too large:%d", csid, length)
+		}
+		cs.length = length
+		if cs.typeID, err = c.r.ReadByte(); err != nil {
+			return
+		}
+	}
+	if format == 0 {
+		var v uint32
+		if v, err = c.readUint(4); err != nil {
+			return
+		}
+		cs.streamID = binary.LittleEndian.Uint32([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	}
+	if format <= 2 {
+		cs.extended = timestamp == 0xffffff
+	}
+	if cs.extended {
+		if timestamp, err = c.readUint(4); err != nil {
+			return
+		}
+	}
+	//type 3 chunk开始新消息时沿用上一个消息的时间增量
+	newMessage := len(cs.payload) == 0
+	switch format {
+	case 0:
+		cs.timestamp = timestamp
+		cs.delta = 0
+	case 1, 2:
+		cs.delta = timestamp
+		cs.timestamp += timestamp
+	case 3:
+		if newMessage {
+			cs.timestamp += cs.delta
+		}
+	}
+	size := cs.length - uint32(len(cs.payload))
+	if size > c.inChunkSize {
+		size = c.inChunkSize
+	}
+	//按实际收到的数据增长，不按消息头中的长度预先分配
+	start := len(cs.payload)
+	cs.payload = append(cs.payload, make([]byte, size)...)
+	if _, err = io.ReadFull(c.r, cs.payload[start:]); err != nil {
+		return
+	}
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+	msg = &RTMPMessage{
+		TypeID:    cs.typeID,
+		StreamID:  cs.streamID,
+		Timestamp: cs.timestamp,
+		Payload:   cs.payload,
+	}
+	cs.payload = nil
+	return
+}
+
+//以type 0 chunk开始发送消息，超出chunk大小部分使用type 3 chunk
+func (c *rtmpConn) WriteMessage(csid uint32, msg *RTMPMessage) (err error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	if c.timeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	extended := msg.Timestamp >= 0xffffff
+	header := make([]byte, 0, 16)
+	header = append(header, byte(csid&0x3f))
+	timestamp := msg.Timestamp
+	if extended {
+		timestamp = 0xffffff
+	}
+	length := len(msg.Payload)
+	header = append(header, byte(timestamp>>16), byte(timestamp>>8), byte(timestamp))
+	header = append(header, byte(length>>16), byte(length>>8), byte(length), msg.TypeID)
+	header = append(header, byte(msg.StreamID), byte(msg.StreamID>>8), byte(msg.StreamID>>16), byte(msg.StreamID>>24))
+	if extended {
+		header = append(header, byte(msg.Timestamp>>24), byte(msg.Timestamp>>16), byte(msg.Timestamp>>8), byte(msg.Timestamp))
+	}
+	if _, err = c.w.Write(header); err != nil {
+		return
+	}
+	c.outBytes += len(header)
+	payload := msg.Payload
+	for first := true; first || len(payload) > 0; first = false {
+		if !first {
+			continuation := []byte{0xc0 | byte(csid&0x3f)}
+			if extended {
+				continuation = append(continuation, byte(msg.Timestamp>>24), byte(msg.Timestamp>>16), byte(msg.Timestamp>>8), byte(msg.Timestamp))
+			}
+			if _, err = c.w.Write(continuation); err != nil {
+				return
+			}
+			c.outBytes += len(continuation)
+		}
+		size := len(payload)
+		if size > int(c.outChunkSize) {
+			size = int(c.outChunkSize)
+		}
+		if _, err = c.w.Write(payload[:size]); err != nil {
+			return
+		}
+		c.outBytes += size
+		payload = payload[size:]
+	}
+	return c.w.Flush()
+}
+
+func (c *rtmpConn) WriteCommand(csid uint32, streamID uint32, values ...interface{}) error {
+	return c.WriteMessage(csid, &RTMPMessage{TypeID: RTMP_MSG_AMF0_COMMAND, StreamID: streamID, Payload: AMF0Encode(values...)})
+}
+
+//连接成功后的窗口大小、带宽、chunk大小设置
+func (c *rtmpConn) WriteServerControls() (err error) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, RTMP_WINDOW_ACK_SIZE)
+	if err = c.WriteMessage(RTMP_CSID_CONTROL, &RTMPMessage{TypeID: RTMP_MSG_WINDOW_ACK_SIZE, Payload: buf}); err != nil {
+		return
+	}
+	bandwidth := append(append([]byte{}, buf...), 0x02)
+	if err = c.WriteMessage(RTMP_CSID_CONTROL, &RTMPMessage{TypeID: RTMP_MSG_SET_PEER_BANDWIDTH, Payload: bandwidth}); err != nil {
+		return
+	}
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, RTMP_OUT_CHUNK_SIZE)
+	if err = c.WriteMessage(RTMP_CSID_CONTROL, &RTMPMessage{TypeID: RTMP_MSG_SET_CHUNK_SIZE, Payload: chunkSize}); err != nil {
+		return
+	}
+	c.outChunkSize = RTMP_OUT_CHUNK_SIZE
+	return
+}
+
+func (c *rtmpConn) WriteUserControl(event uint16, value uint32) error {
+	buf := make([]byte, 6)
+	binary.BigEndian.PutUint16(buf, event)
+	binary.BigEndian.PutUint32(buf[2:], value)
+	return c.WriteMessage(RTMP_CSID_CONTROL, &RTMPMessage{TypeID: RTMP_MSG_USER_CONTROL, Payload: buf})
+}
+
+func (c *rtmpConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,151 @@
+package rtsp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+//只用于读写的net.Conn
+type rtmpTestConn struct {
+	net.Conn
+	r   *bytes.Reader
+	out bytes.Buffer
+}
+
+func (conn *rtmpTestConn) Read(p []byte) (int, error) {
+	return conn.r.Read(p)
+}
+
+func (conn *rtmpTestConn) Write(p []byte) (int, error) {
+	return conn.out.Write(p)
+}
+
+func newRTMPTestConn(data []byte) *rtmpConn {
+	return newRTMPConn(&rtmpTestConn{r: bytes.NewReader(data)}, 4096, 0)
+}
+
+func rtmpChunkHeader0(csid byte, length int, typeID byte) []byte {
+	return []byte{csid, 0, 0, 0, byte(length >> 16), byte(length >> 8), byte(length), typeID, 1, 0, 0, 0}
+}
+
+func rtmpChunkHeader1(csid byte, length int, typeID byte) []byte {
+	return []byte{0x40 | csid, 0, 0, 0, byte(length >> 16), byte(length >> 8), byte(length), typeID}
+}
+
+func rtmpJoin(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestRTMPReadMessage(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xab}, 200)
+	tests := []struct {
+		name    string
+		data    []byte
+		length  int
+		wantErr string
+	}{
+		{
+			name:   "single chunk",
+			data:   rtmpJoin(rtmpChunkHeader0(4, 10, RTMP_MSG_AUDIO), payload[:10]),
+			length: 10,
+		},
+		{
+			name:   "type 3 continuation",
+			data:   rtmpJoin(rtmpChunkHeader0(4, 200, RTMP_MSG_VIDEO), payload[:128], []byte{0xc4}, payload[128:]),
+			length: 200,
+		},
+		{
+			name:   "set chunk size",
+			data:   rtmpJoin(rtmpChunkHeader0(2, 4, RTMP_MSG_SET_CHUNK_SIZE), []byte{0, 0, 1, 0}, rtmpChunkHeader0(4, 200, RTMP_MSG_VIDEO), payload),
+			length: 200,
+		},
+		{
+			name:    "length changed in message",
+			data:    rtmpJoin(rtmpChunkHeader0(4, 130, RTMP_MSG_VIDEO), payload[:128], rtmpChunkHeader1(4, 10, RTMP_MSG_VIDEO), payload[:10]),
+			wantErr: "length changed",
+		},
+		{
+			name:    "message too large",
+			data:    rtmpChunkHeader0(4, RTMP_MAX_MESSAGE_SIZE+1, RTMP_MSG_VIDEO),
+			wantErr: "too large",
+		},
+		{
+			name:    "zero chunk size",
+			data:    rtmpJoin(rtmpChunkHeader0(2, 4, RTMP_MSG_SET_CHUNK_SIZE), []byte{0, 0, 0, 0}),
+			wantErr: "invalid chunk size",
+		},
+		{
+			name:    "start without type 0",
+			data:    rtmpJoin(rtmpChunkHeader1(4, 10, RTMP_MSG_AUDIO), payload[:10]),
+			wantErr: "without type 0",
+		},
+		{
+			name:    "truncated",
+			data:    rtmpJoin(rtmpChunkHeader0(4, 10, RTMP_MSG_AUDIO), payload[:5]),
+			wantErr: "EOF",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := newRTMPTestConn(test.data).ReadMessage()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Payload) != test.length {
+				t.Fatalf("payload length = %d, want %d", len(msg.Payload), test.length)
+			}
+		})
+	}
+}
+
+func TestRTMPTooManyChunkStreams(t *testing.T) {
+	var data []byte
+	for i := 0; i <= RTMP_MAX_CHUNK_STREAMS; i++ {
+		//每个chunk stream只发送消息的第一个chunk
+		data = append(data, 0x00, byte(i))
+		data = append(data, rtmpChunkHeader0(0, 200, RTMP_MSG_VIDEO)[1:]...)
+		data = append(data, make([]byte, 128)...)
+	}
+	_, err := newRTMPTestConn(data).ReadMessage()
+	if err == nil || !strings.Contains(err.Error(), "too many chunk streams") {
+		t.Fatalf("error = %v", err)
+	}
+}
+
+func TestRTMPWriteReadMessage(t *testing.T) {
+	payload := bytes.Repeat([]byte{1, 2, 3}, 3000)
+	writer := newRTMPTestConn(nil)
+	if err := writer.WriteMessage(RTMP_CSID_VIDEO, &RTMPMessage{TypeID: RTMP_MSG_VIDEO, StreamID: 1, Timestamp: 0x1000000, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := newRTMPTestConn(writer.conn.(*rtmpTestConn).out.Bytes()).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Payload, payload) || msg.Timestamp != 0x1000000 || msg.StreamID != 1 {
+		t.Fatalf("message = %d %d %d", len(msg.Payload), msg.Timestamp, msg.StreamID)
+	}
+}
+
+func FuzzRTMPReadMessage(f *testing.F) {
+	payload := bytes.Repeat([]byte{0xab}, 200)
+	f.Add(rtmpJoin(rtmpChunkHeader0(4, 200, RTMP_MSG_VIDEO), payload[:128], []byte{0xc4}, payload[128:]))
+	f.Add(rtmpJoin(rtmpChunkHeader0(4, 130, RTMP_MSG_VIDEO), payload[:128], rtmpChunkHeader1(4, 10, RTMP_MSG_VIDEO), payload[:10]))
+	f.Add(rtmpJoin(rtmpChunkHeader0(2, 4, RTMP_MSG_SET_CHUNK_SIZE), []byte{0, 0, 0, 1}, rtmpChunkHeader0(4, 3, RTMP_MSG_AUDIO), payload[:3]))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newRTMPTestConn(data)
+		for i := 0; i < 64; i++ {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package rtsp
+
+//rtmp拉流端，由Pusher.BroadcastRTP分发rtp包，还原为flv tag发送
+type RTMPPlayer struct {
+	*mediaPlayerBase
+	session      *RTMPSession
+	streamID     uint32
+	depacketizer *RTPDepacketizer
+	muxer        *FLVMuxer
+	err          error
+}
+
+func NewRTMPPlayer(session *RTMPSession, pusher *Pusher, streamID uint32) *RTMPPlayer {
+	player := &RTMPPlayer{
+		mediaPlayerBase: newMediaPlayerBase(session.ID, TRANS_TYPE_RTMP.String(), session.Conn.RemoteAddr().String(), pusher),
+		session:         session,
+		streamID:        streamID,
+	}
+	player.depacketizer = NewRTPDepacketizer(pusher.SDPRaw(), player.writeFrame)
+	player.depacketizer.Timeline = pusher.timeline
+	player.muxer = NewFLVMuxer(nil, player.depacketizer)
+	player.StopHandles = append(player.StopHandles, func() {
+		go session.Stop()
+	})
+	session.StopHandles = append(session.StopHandles, func() {
+		player.Stop()
+		pusher.RemoveMediaPlayer(player)
+	})
+	return player
+}
+
+func (player *RTMPPlayer) writeFrame(frame *AVFrame) {
+	if player.err != nil {
+		return
+	}
+	for _, tag := range player.muxer.Tags(frame) {
+		csid := uint32(RTMP_CSID_VIDEO)
+		if tag.Type == FLV_TAG_AUDIO {
+			csid = RTMP_CSID_AUDIO
+		}
+		msg := &RTMPMessage{TypeID: tag.Type, StreamID: player.streamID, Timestamp: tag.Timestamp, Payload: tag.Data}
+		if player.err = player.session.conn.WriteMessage(csid, msg); player.err != nil {
+			return
+		}
+		player.outBytes += len(tag.Data)
+		player.session.OutBytes += len(tag.Data)
+	}
+}
+
+func (player *RTMPPlayer) handleRTP(pack *RTPPack) error {
+	player.depacketizer.WriteRTP(pack)
+	return player.err
+}
+
+//发送播放开始状态及onMetaData
+func (player *RTMPPlayer) writeStart() (err error) {
+	conn := player.session.conn
+	if err = conn.WriteUserControl(RTMP_USER_STREAM_BEGIN, player.streamID); err != nil {
+		return
+	}
+	if err = player.session.onStatus(player.streamID, "status", "NetStream.Play.Reset", "Playing and resetting stream"); err != nil {
+		return
+	}
+	if err = player.session.onStatus(player.streamID, "status", "NetStream.Play.Start", "Started playing stream"); err != nil {
+		return
+	}
+	if err = conn.WriteMessage(RTMP_CSID_DATA, &RTMPMessage{TypeID: RTMP_MSG_AMF0_DATA, StreamID: player.streamID, Payload: AMF0Encode("|RtmpSampleAccess", true, true)}); err != nil {
+		return
+	}
+	metadata := AMFObject{"server": "EasyDarwin"}
+	switch player.muxer.videoCodec {
+	case "h264":
+		metadata["videocodecid"] = FLV_CODEC_AVC
+	case "h265":
+		metadata["videocodecid"] = FLV_CODEC_HEVC
+	}
+	switch player.muxer.audioCodec {
+	case "aac":
+		metadata["audiocodecid"] = FLV_SOUND_AAC
+	case "pcma":
+		metadata["audiocodecid"] = FLV_SOUND_PCMA
+	case "pcmu":
+		metadata["audiocodecid"] = FLV_SOUND_PCMU
+	}
+	return conn.WriteMessage(RTMP_CSID_DATA, &RTMPMessage{TypeID: RTMP_MSG_AMF0_DATA, StreamID: player.streamID, Payload: AMF0Encode("onMetaData", metadata)})
+}
+
+func (player *RTMPPlayer) Start() {
+	if err := player.writeStart(); err != nil {
+		player.logger.Printf("%v write play start error:%v", player, err)
+		player.Stop()
+		return
+	}
+	player.pusher.AddMediaPlayer(player)
+	player.run(player.handleRTP)
+	player.Stop()
+}
@@ -0,0 +1,145 @@
+package rtsp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//连接到rtmp会话的客户端，完成握手
+func newTestRTMPClient(t *testing.T, server *Server) *rtmpConn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			NewRTMPSession(server, conn).Start()
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+	c0c1[0] = 0x03
+	rand.Read(c0c1[9:])
+	if _, err = conn.Write(c0c1); err != nil {
+		t.Fatal(err)
+	}
+	s0s1s2 := make([]byte, 1+2*RTMP_HANDSHAKE_SIZE)
+	if _, err = io.ReadFull(conn, s0s1s2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(s0s1s2[1 : 1+RTMP_HANDSHAKE_SIZE]); err != nil {
+		t.Fatal(err)
+	}
+	return newRTMPConn(conn, 4096, 0)
+}
+
+//读取下一个命令或数据消息，返回名称及参数
+func readTestRTMPCommand(t *testing.T, client *rtmpConn) (msg *RTMPMessage, values []interface{}) {
+	for {
+		msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID != RTMP_MSG_AMF0_COMMAND && msg.TypeID != RTMP_MSG_AMF0_DATA {
+			continue
+		}
+		if values, err = AMF0Decode(msg.Payload); err != nil {
+			t.Fatal(err)
+		}
+		return msg, values
+	}
+}
+
+func TestRTMPPlay(t *testing.T) {
+	server := startTestServer(t)
+	pusher := newTestPusher(t, server, "/live/rtmpplay")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	pusher.QueueRTP(newTestH264Pack(1, 0, []byte{0x65, 0x88, 0x80}))
+	client := newTestRTMPClient(t, server)
+	client.WriteCommand(RTMP_CSID_COMMAND, 0, "connect", 1, AMFObject{"app": "live", "tcUrl": "rtmp://127.0.0.1/live"})
+	if _, values := readTestRTMPCommand(t, client); values[0] != "_result" {
+		t.Fatalf("connect result = %v", values)
+	}
+	client.WriteCommand(RTMP_CSID_COMMAND, 0, "createStream", 2, nil)
+	_, values := readTestRTMPCommand(t, client)
+	if values[0] != "_result" || len(values) < 4 {
+		t.Fatalf("createStream result = %v", values)
+	}
+	streamID := uint32(values[3].(float64))
+	client.WriteCommand(RTMP_CSID_COMMAND, streamID, "play", 3, nil, "rtmpplay")
+	for _, code := range []string{"NetStream.Play.Reset", "NetStream.Play.Start"} {
+		_, values = readTestRTMPCommand(t, client)
+		if values[0] != "onStatus" || values[3].(AMFObject).String("code") != code {
+			t.Fatalf("status = %v, want %s", values, code)
+		}
+	}
+	if _, values = readTestRTMPCommand(t, client); values[0] != "|RtmpSampleAccess" {
+		t.Fatalf("data = %v", values)
+	}
+	_, values = readTestRTMPCommand(t, client)
+	if values[0] != "onMetaData" || values[1].(AMFObject).Number("videocodecid") != FLV_CODEC_AVC || values[1].(AMFObject).Number("audiocodecid") != FLV_SOUND_PCMA {
+		t.Fatalf("metadata = %v", values)
+	}
+	//gop缓存中的关键帧在下一帧到达时输出
+	pusher.QueueRTP(newTestH264Pack(2, 3600, []byte{0x41, 0x9a}))
+	for i, prefix := range [][]byte{{0x17, 0}, {0x17, 1}} {
+		msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.TypeID != RTMP_MSG_VIDEO || msg.StreamID != streamID || len(msg.Payload) < 2 || msg.Payload[0] != prefix[0] || msg.Payload[1] != prefix[1] {
+			t.Fatalf("message %d = %d %x", i, msg.TypeID, msg.Payload)
+		}
+	}
+	players := pusher.GetMediaPlayers()
+	if len(players) != 1 {
+		t.Fatalf("players = %v", players)
+	}
+	for _, player := range players {
+		if player.TransType() != "RTMP" {
+			t.Fatalf("player = %v", player)
+		}
+	}
+	//断开后从pusher中移除
+	client.Close()
+	for i := 0; i < 100 && len(pusher.GetMediaPlayers()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if players = pusher.GetMediaPlayers(); len(players) != 0 {
+		t.Fatalf("players = %v", players)
+	}
+}
+
+func TestRTMPPlayStreamNotFound(t *testing.T) {
+	server := startTestServer(t)
+	hold := server.streamNotExistHoldMillisecond
+	server.streamNotExistHoldMillisecond = 0
+	defer func() {
+		server.streamNotExistHoldMillisecond = hold
+	}()
+	client := newTestRTMPClient(t, server)
+	client.WriteCommand(RTMP_CSID_COMMAND, 0, "connect", 1, AMFObject{"app": "live"})
+	readTestRTMPCommand(t, client)
+	client.WriteCommand(RTMP_CSID_COMMAND, 1, "play", 2, nil, "none")
+	_, values := readTestRTMPCommand(t, client)
+	if values[0] != "onStatus" || values[3].(AMFObject).String("code") != "NetStream.Play.StreamNotFound" {
+		t.Fatalf("status = %v", values)
+	}
+	//会话随后关闭
+	if _, err := client.ReadMessage(); err == nil {
+		t.Fatal("expected connection closed")
+	}
+}
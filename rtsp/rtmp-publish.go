@@ -0,0 +1,433 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+const (
+	RTMP_VIDEO_PAYLOAD_TYPE = 96
+	RTMP_AUDIO_PAYLOAD_TYPE = 97
+
+	//等待音视频sequence header的最大帧数
+	rtmpMaxWaitFrames = 200
+)
+
+//rtmp推流，将flv tag转换为rtp包
+type rtmpPublisher struct {
+	session  *RTMPSession
+	metadata AMFObject
+
+	videoCodec    string
+	vps           []byte
+	sps           []byte
+	pps           []byte
+	nalLengthSize int
+
+	audioCodec    string
+	audioConfig   []byte
+	audioRate     int
+	audioChannels int
+
+	sawVideo    bool
+	sawAudio    bool
+	waitFrames  int
+	vPacketizer *RTPPacketizer
+	aPacketizer *RTPPacketizer
+}
+
+func newRTMPPublisher(session *RTMPSession) *rtmpPublisher {
+	return &rtmpPublisher{
+		session:       session,
+		nalLengthSize: 4,
+	}
+}
+
+//@setDataFrame onMetaData
+func (publisher *rtmpPublisher) handleData(payload []byte) {
+	values, err := AMF0Decode(payload)
+	if err != nil {
+		return
+	}
+	for _, v := range values {
+		if obj, ok := v.(AMFObject); ok {
+			publisher.metadata = obj
+		}
+	}
+}
+
+func (publisher *rtmpPublisher) handleMedia(msg *RTMPMessage) error {
+	if len(msg.Payload) < 2 {
+		return nil
+	}
+	if msg.TypeID == RTMP_MSG_VIDEO {
+		return publisher.handleVideo(msg.Timestamp, msg.Payload)
+	}
+	return publisher.handleAudio(msg.Timestamp, msg.Payload)
+}
+
+func (publisher *rtmpPublisher) handleVideo(timestamp uint32, payload []byte) error {
+	publisher.sawVideo = true
+	var (
+		keyFrame   bool
+		codec      string
+		packetType byte
+		cts        int32
+		data       []byte
+	)
+	if payload[0]&0x80 != 0 {
+		//enhanced rtmp: ExVideoTagHeader
+		if len(payload) < 5 {
+			return nil
+		}
+		keyFrame = (payload[0]>>4)&0x07 == 1
+		packetType = payload[0] & 0x0f
+		if string(payload[1:5]) != "hvc1" {
+			return nil
+		}
+		codec = "h265"
+		data = payload[5:]
+		switch packetType {
+		case 0:
+		case 1:
+			if len(data) < 3 {
+				return nil
+			}
+			cts = int32(data[0])<<16 | int32(data[1])<<8 | int32(data[2])
+			data = data[3:]
+		case 3:
+			packetType = 1
+		default:
+			return nil
+		}
+	} else {
+		if len(payload) < 5 {
+			return nil
+		}
+		keyFrame = payload[0]>>4 == 1
+		switch payload[0] & 0x0f {
+		case FLV_CODEC_AVC:
+			codec = "h264"
+		case FLV_CODEC_HEVC:
+			codec = "h265"
+		default:
+			return nil
+		}
+		packetType = payload[1]
+		cts = int32(payload[2])<<16 | int32(payload[3])<<8 | int32(payload[4])
+		data = payload[5:]
+	}
+	//composition time为有符号24位
+	if cts&0x800000 != 0 {
+		cts -= 0x1000000
+	}
+	if packetType == 0 {
+		return publisher.parseVideoConfig(codec, data)
+	}
+	if packetType != 1 || codec != publisher.videoCodec {
+		return nil
+	}
+	var nalus [][]byte
+	for len(data) >= publisher.nalLengthSize {
+		size := 0
+		for i := 0; i < publisher.nalLengthSize; i++ {
+			size = size<<8 | int(data[i])
+		}
+		data = data[publisher.nalLengthSize:]
+		if size > len(data) {
+			break
+		}
+		//跳过空的nalu
+		if size > 0 {
+			nalus = append(nalus, data[:size])
+		}
+		data = data[size:]
+	}
+	if len(nalus) == 0 {
+		return nil
+	}
+	if !publisher.ready() {
+		return nil
+	}
+	if publisher.vPacketizer == nil {
+		return nil
+	}
+	//关键帧前补充参数集
+	if keyFrame && !publisher.hasParameterSets(nalus) {
+		var params [][]byte
+		if codec == "h265" {
+			params = append(params, publisher.vps)
+		}
+		nalus = append(append(params, publisher.sps, publisher.pps), nalus...)
+	}
+	ts := uint32(int64(timestamp)+int64(cts)) * 90
+	var packs []*RTPPack
+	if codec == "h264" {
+		packs = publisher.vPacketizer.PacketizeH264(nalus, ts)
+	} else {
+		packs = publisher.vPacketizer.PacketizeH265(nalus, ts)
+	}
+	publisher.emit(packs)
+	return nil
+}
+
+func (publisher *rtmpPublisher) hasParameterSets(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		if publisher.videoCodec == "h264" && nalu[0]&0x1f == 7 {
+			return true
+		}
+		if publisher.videoCodec == "h265" && (nalu[0]>>1)&0x3f == 32 {
+			return true
+		}
+	}
+	return false
+}
+
+//解析avcC、hvcC
+func (publisher *rtmpPublisher) parseVideoConfig(codec string, data []byte) error {
+	var vps, sps, pps []byte
+	if codec == "h264" {
+		if len(data) < 7 {
+			return fmt.Errorf("invalid avc decoder configuration record")
+		}
+		publisher.nalLengthSize = int(data[4]&0x03) + 1
+		off := 5
+		//sps个数(低5位)、sps列表、pps个数、pps列表
+		for i := 0; i < 2 && off < len(data); i++ {
+			count := int(data[off])
+			if i == 0 {
+				count &= 0x1f
+			}
+			off++
+			for j := 0; j < count && off+2 <= len(data); j++ {
+				size := int(data[off])<<8 | int(data[off+1])
+				off += 2
+				if size == 0 || off+size > len(data) {
+					break
+				}
+				nalu := data[off : off+size]
+				off += size
+				if i == 0 && sps == nil {
+					sps = nalu
+				} else if i == 1 && pps == nil {
+					pps = nalu
+				}
+			}
+		}
+	} else {
+		if len(data) < 23 {
+			return fmt.Errorf("invalid hevc decoder configuration record")
+		}
+		publisher.nalLengthSize = int(data[21]&0x03) + 1
+		arrays := int(data[22])
+		off := 23
+		for i := 0; i < arrays && off+3 <= len(data); i++ {
+			nalType := data[off] & 0x3f
+			count := int(data[off+1])<<8 | int(data[off+2])
+			off += 3
+			for j := 0; j < count && off+2 <= len(data); j++ {
+				size := int(data[off])<<8 | int(data[off+1])
+				off += 2
+				if size == 0 || off+size > len(data) {
+					break
+				}
+				nalu := data[off : off+size]
+				off += size
+				switch nalType {
+				case 32:
+					vps = nalu
+				case 33:
+					sps = nalu
+				case 34:
+					pps = nalu
+				}
+			}
+		}
+		if vps == nil {
+			return fmt.Errorf("hevc decoder configuration record without vps")
+		}
+	}
+	if sps == nil || pps == nil {
+		return fmt.Errorf("video decoder configuration record without sps/pps")
+	}
+	//sps[1:4]用于sdp的profile-level-id
+	if codec == "h264" && len(sps) < 4 {
+		return fmt.Errorf("invalid avc sps length:%d", len(sps))
+	}
+	if publisher.videoCodec != "" && publisher.videoCodec != codec {
+		publisher.session.logger.Printf("%v video codec changed from %s to %s, ignore", publisher.session, publisher.videoCodec, codec)
+		return nil
+	}
+	publisher.videoCodec = codec
+	publisher.vps = append([]byte{}, vps...)
+	publisher.sps = append([]byte{}, sps...)
+	publisher.pps = append([]byte{}, pps...)
+	return nil
+}
+
+func (publisher *rtmpPublisher) handleAudio(timestamp uint32, payload []byte) error {
+	publisher.sawAudio = true
+	soundFormat := payload[0] >> 4
+	var codec string
+	switch soundFormat {
+	case FLV_SOUND_AAC:
+		codec = "aac"
+		if payload[1] == 0 {
+			config := payload[2:]
+			if len(config) < 2 {
+				return fmt.Errorf("invalid aac audio specific config")
+			}
+			if publisher.audioCodec == "" {
+				publisher.audioCodec = codec
+				publisher.audioConfig = append([]byte{}, config...)
+				publisher.audioRate = 44100
+				if index := int((config[0]&0x07)<<1 | config[1]>>7); index < len(aacSampleRates) {
+					publisher.audioRate = aacSampleRates[index]
+				}
+				publisher.audioChannels = int((config[1] >> 3) & 0x0f)
+			}
+			return nil
+		}
+		payload = payload[2:]
+	case FLV_SOUND_PCMA:
+		codec = "pcma"
+		payload = payload[1:]
+	case FLV_SOUND_PCMU:
+		codec = "pcmu"
+		payload = payload[1:]
+	default:
+		return nil
+	}
+	if publisher.audioCodec == "" && codec != "aac" {
+		publisher.audioCodec = codec
+		publisher.audioRate = 8000
+		publisher.audioChannels = 1
+	}
+	if codec != publisher.audioCodec || len(payload) == 0 {
+		return nil
+	}
+	if !publisher.ready() || publisher.aPacketizer == nil {
+		return nil
+	}
+	ts := uint32(int64(timestamp) * int64(publisher.audioRate) / 1000)
+	if codec == "aac" {
+		publisher.emit(publisher.aPacketizer.PacketizeAAC(payload, ts))
+	} else {
+		publisher.emit(publisher.aPacketizer.PacketizeRaw(payload, ts))
+	}
+	return nil
+}
+
+func (publisher *rtmpPublisher) emit(packs []*RTPPack) {
+	for _, pack := range packs {
+		for _, h := range publisher.session.RTPHandles {
+			h(pack)
+		}
+	}
+}
+
+//收到音视频sequence header后生成sdp并注册pusher
+func (publisher *rtmpPublisher) ready() bool {
+	session := publisher.session
+	if session.Pusher != nil {
+		return true
+	}
+	expectVideo := publisher.sawVideo
+	expectAudio := publisher.sawAudio
+	if publisher.metadata != nil {
+		if _, ok := publisher.metadata["videocodecid"]; ok {
+			expectVideo = true
+		}
+		if _, ok := publisher.metadata["audiocodecid"]; ok {
+			expectAudio = true
+		}
+	}
+	publisher.waitFrames++
+	if publisher.waitFrames < rtmpMaxWaitFrames && (expectVideo && publisher.videoCodec == "" || expectAudio && publisher.audioCodec == "") {
+		return false
+	}
+	if publisher.videoCodec == "" && publisher.audioCodec == "" {
+		return false
+	}
+	session.SDPRaw = publisher.sdp()
+	if publisher.videoCodec != "" {
+		session.VCodec = publisher.videoCodec
+		session.VControl = "streamid=0"
+		publisher.vPacketizer = NewRTPPacketizer(RTP_TYPE_VIDEO, RTMP_VIDEO_PAYLOAD_TYPE)
+	}
+	if publisher.audioCodec != "" {
+		session.ACodec = publisher.audioCodec
+		session.AControl = "streamid=1"
+		publisher.aPacketizer = NewRTPPacketizer(RTP_TYPE_AUDIO, publisher.audioPayloadType())
+	}
+	session.logger.Printf("%v video codec[%s] audio codec[%s]", session, session.VCodec, session.ACodec)
+	session.Pusher = NewRTMPPusher(session)
+	if !session.Server.AddPusher(session.Pusher) {
+		session.logger.Printf("reject pusher.")
+		_ = session.onStatus(session.streamID, "error", "NetStream.Publish.BadName", "Stream already publishing")
+		session.Pusher = nil
+		go session.Stop()
+		return false
+	}
+	return true
+}
+
+func (publisher *rtmpPublisher) audioPayloadType() byte {
+	switch publisher.audioCodec {
+	case "pcmu":
+		return 0
+	case "pcma":
+		return 8
+	}
+	return RTMP_AUDIO_PAYLOAD_TYPE
+}
+
+//根据sequence header生成sdp
+func (publisher *rtmpPublisher) sdp() string {
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=EasyDarwin RTMP",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=tool:EasyDarwin",
+	}
+	switch publisher.videoCodec {
+	case "h264":
+		lines = append(lines,
+			fmt.Sprintf("m=video 0 RTP/AVP %d", RTMP_VIDEO_PAYLOAD_TYPE),
+			fmt.Sprintf("a=rtpmap:%d H264/90000", RTMP_VIDEO_PAYLOAD_TYPE),
+			fmt.Sprintf("a=fmtp:%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s", RTMP_VIDEO_PAYLOAD_TYPE,
+				hex.EncodeToString(publisher.sps[1:4]), base64.StdEncoding.EncodeToString(publisher.sps), base64.StdEncoding.EncodeToString(publisher.pps)),
+			"a=control:streamid=0")
+	case "h265":
+		lines = append(lines,
+			fmt.Sprintf("m=video 0 RTP/AVP %d", RTMP_VIDEO_PAYLOAD_TYPE),
+			fmt.Sprintf("a=rtpmap:%d H265/90000", RTMP_VIDEO_PAYLOAD_TYPE),
+			fmt.Sprintf("a=fmtp:%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s", RTMP_VIDEO_PAYLOAD_TYPE,
+				base64.StdEncoding.EncodeToString(publisher.vps), base64.StdEncoding.EncodeToString(publisher.sps), base64.StdEncoding.EncodeToString(publisher.pps)),
+			"a=control:streamid=0")
+	}
+	payloadType := publisher.audioPayloadType()
+	switch publisher.audioCodec {
+	case "aac":
+		lines = append(lines,
+			fmt.Sprintf("m=audio 0 RTP/AVP %d", payloadType),
+			fmt.Sprintf("a=rtpmap:%d MPEG4-GENERIC/%d/%d", payloadType, publisher.audioRate, publisher.audioChannels),
+			fmt.Sprintf("a=fmtp:%d streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s", payloadType, hex.EncodeToString(publisher.audioConfig)),
+			"a=control:streamid=1")
+	case "pcma", "pcmu":
+		lines = append(lines,
+			fmt.Sprintf("m=audio 0 RTP/AVP %d", payloadType),
+			fmt.Sprintf("a=rtpmap:%d %s/8000", payloadType, strings.ToUpper(publisher.audioCodec)),
+			"a=control:streamid=1")
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
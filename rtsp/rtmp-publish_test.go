@@ -0,0 +1,101 @@
+package rtsp
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+//已注册pusher的推流，收到的rtp包保存在packs中
+func newRTMPTestPublisher(packs *[]*RTPPack) *rtmpPublisher {
+	session := &RTMPSession{Pusher: &Pusher{}}
+	session.logger = log.New(ioutil.Discard, "", 0)
+	session.RTPHandles = append(session.RTPHandles, func(pack *RTPPack) {
+		*packs = append(*packs, pack)
+	})
+	publisher := newRTMPPublisher(session)
+	publisher.vPacketizer = NewRTPPacketizer(RTP_TYPE_VIDEO, RTMP_VIDEO_PAYLOAD_TYPE)
+	publisher.aPacketizer = NewRTPPacketizer(RTP_TYPE_AUDIO, RTMP_AUDIO_PAYLOAD_TYPE)
+	return publisher
+}
+
+//avcC: version、profile、compatibility、level、lengthSizeMinusOne、sps、pps
+func rtmpAVCConfig(sps []byte, pps []byte) []byte {
+	data := []byte{1, 0x64, 0, 0x1f, 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	data = append(data, sps...)
+	data = append(data, 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(data, pps...)
+}
+
+func TestRTMPParseVideoConfig(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac}
+	pps := []byte{0x68, 0xee, 0x3c, 0x80}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"valid", rtmpAVCConfig(sps, pps), false},
+		{"sps one byte", rtmpAVCConfig(sps[:1], pps), true},
+		{"sps three bytes", rtmpAVCConfig(sps[:3], pps), true},
+		{"without pps", rtmpAVCConfig(sps, nil), true},
+		{"truncated", rtmpAVCConfig(sps, pps)[:6], true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var packs []*RTPPack
+			publisher := newRTMPTestPublisher(&packs)
+			err := publisher.parseVideoConfig("h264", test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && !strings.Contains(publisher.sdp(), "profile-level-id=64001f") {
+				t.Fatalf("sdp = %s", publisher.sdp())
+			}
+		})
+	}
+}
+
+func TestRTMPHandleVideoEmptyNALU(t *testing.T) {
+	var packs []*RTPPack
+	publisher := newRTMPTestPublisher(&packs)
+	config := append([]byte{0x17, 0, 0, 0, 0}, rtmpAVCConfig([]byte{0x67, 0x64, 0x00, 0x1f}, []byte{0x68, 0xee})...)
+	if err := publisher.handleMedia(&RTMPMessage{TypeID: RTMP_MSG_VIDEO, Payload: config}); err != nil {
+		t.Fatal(err)
+	}
+	//关键帧中包含长度为0的nalu
+	frame := []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88, 0, 0, 0, 0}
+	if err := publisher.handleMedia(&RTMPMessage{TypeID: RTMP_MSG_VIDEO, Payload: frame}); err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) == 0 {
+		t.Fatal("no rtp packet for key frame")
+	}
+}
+
+func FuzzRTMPPublishMedia(f *testing.F) {
+	config := append([]byte{0x17, 0, 0, 0, 0}, rtmpAVCConfig([]byte{0x67, 0x64, 0x00, 0x1f}, []byte{0x68, 0xee})...)
+	f.Add(byte(RTMP_MSG_VIDEO), config)
+	f.Add(byte(RTMP_MSG_VIDEO), []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88})
+	f.Add(byte(RTMP_MSG_VIDEO), []byte{0x1c, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xf3, 1, 0x20, 0, 1, 0, 0})
+	f.Add(byte(RTMP_MSG_VIDEO), []byte{0x90, 'h', 'v', 'c', '1', 0, 0, 0})
+	f.Add(byte(RTMP_MSG_AUDIO), []byte{0xaf, 0, 0x12, 0x10})
+	f.Add(byte(RTMP_MSG_AUDIO), []byte{0xaf, 1, 0x21, 0x00})
+	f.Add(byte(RTMP_MSG_AUDIO), []byte{0x72, 0xd5, 0xd5})
+	f.Fuzz(func(t *testing.T, typeID byte, payload []byte) {
+		var packs []*RTPPack
+		publisher := newRTMPTestPublisher(&packs)
+		if typeID&1 == 0 {
+			typeID = RTMP_MSG_AUDIO
+		} else {
+			typeID = RTMP_MSG_VIDEO
+		}
+		//先发送一个合法的配置，使后续数据进入打包流程
+		_ = publisher.handleMedia(&RTMPMessage{TypeID: RTMP_MSG_VIDEO, Payload: config})
+		_ = publisher.handleMedia(&RTMPMessage{TypeID: typeID, Payload: payload})
+		if publisher.videoCodec != "" {
+			publisher.sdp()
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package rtsp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+//rtmp推拉流服务，推流注册到rtsp服务的pusher中
+type RTMPServer struct {
+	SessionLogger
+	Server      *Server
+	TCPListener *net.TCPListener
+	TCPPort     int
+	Stoped      bool
+}
+
+func NewRTMPServer(server *Server) *RTMPServer {
+	return &RTMPServer{
+		SessionLogger: SessionLogger{log.New(os.Stdout, "[RTMPServer]", log.LstdFlags|log.Lshortfile)},
+		Server:        server,
+		TCPPort:       server.RTMPPort,
+		Stoped:        true,
+	}
+}
+
+func (rtmpServer *RTMPServer) Start() (err error) {
+	var (
+		logger   = rtmpServer.logger
+		addr     *net.TCPAddr
+		listener *net.TCPListener
+	)
+	if addr, err = net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", rtmpServer.TCPPort)); err != nil {
+		return
+	}
+	if listener, err = net.ListenTCP("tcp", addr); err != nil {
+		return
+	}
+	rtmpServer.Stoped = false
+	rtmpServer.TCPListener = listener
+	logger.Println("rtmp server start on", rtmpServer.TCPPort)
+	networkBuffer := rtmpServer.Server.networkBuffer
+	for !rtmpServer.Stoped {
+		var conn net.Conn
+		if conn, err = listener.Accept(); err != nil {
+			if rtmpServer.Stoped {
+				return nil
+			}
+			logger.Println(err)
+			continue
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err = tcpConn.SetReadBuffer(networkBuffer); err != nil {
+				logger.Printf("rtmp server conn set read buffer error, %v", err)
+			}
+			if err = tcpConn.SetWriteBuffer(networkBuffer); err != nil {
+				logger.Printf("rtmp server conn set write buffer error, %v", err)
+			}
+		}
+		session := NewRTMPSession(rtmpServer.Server, conn)
+		go session.Start()
+	}
+	return
+}
+
+func (rtmpServer *RTMPServer) Stop() {
+	rtmpServer.logger.Println("rtmp server stop on", rtmpServer.TCPPort)
+	rtmpServer.Stoped = true
+	if rtmpServer.TCPListener != nil {
+		rtmpServer.TCPListener.Close()
+		rtmpServer.TCPListener = nil
+	}
+}
@@ -0,0 +1,312 @@
+package rtsp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce-qin/EasyGoLib/utils"
+	"github.com/teris-io/shortid"
+)
+
+//rtmp连接，推流时作为pusher的数据源
+type RTMPSession struct {
+	SessionLogger
+	ID        string
+	Server    *Server
+	Conn      net.Conn
+	conn      *rtmpConn
+	Type      SessionType
+	TransType TransType
+	App       string
+	TcURL     string
+	Path      string
+	URL       string
+	SDPRaw    string
+
+	AControl string
+	VControl string
+	ACodec   string
+	VCodec   string
+
+	// stats info
+	InBytes  int
+	OutBytes int
+	StartAt  time.Time
+
+	Stoped    bool
+	stopLock  sync.Mutex
+	streamID  uint32
+	publisher *rtmpPublisher
+
+	Pusher      *Pusher
+	RTPHandles  []func(*RTPPack)
+	StopHandles []func()
+}
+
+func (session *RTMPSession) String() string {
+	return fmt.Sprintf("rtmp session[%v][%s][%s][%s]", session.Type, session.Path, session.ID, session.Conn.RemoteAddr().String())
+}
+
+func NewRTMPSession(server *Server, conn net.Conn) *RTMPSession {
+	session := &RTMPSession{
+		ID:          shortid.MustGenerate(),
+		Server:      server,
+		Conn:        conn,
+		conn:        newRTMPConn(conn, server.networkBuffer, time.Duration(server.rtspTimeoutMillisecond)*time.Millisecond),
+		TransType:   TRANS_TYPE_RTMP,
+		StartAt:     time.Now(),
+		RTPHandles:  make([]func(*RTPPack), 0),
+		StopHandles: make([]func(), 0),
+	}
+	session.logger = log.New(os.Stdout, fmt.Sprintf("[%s]", session.ID), log.LstdFlags|log.Lshortfile)
+	if !utils.Debug {
+		session.logger.SetOutput(utils.GetLogWriter())
+	}
+	return session
+}
+
+func (session *RTMPSession) ToWebHookInfo(actionType WebHookActionType) *WebHookInfo {
+	return NewWebHookInfo(actionType, session.ID, session.Type, session.TransType, session.URL, session.Path, session.SDPRaw, session.Conn.RemoteAddr().String())
+}
+
+func (session *RTMPSession) Start() {
+	defer session.Stop()
+	logger := session.logger
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Printf("%v session panic:%v", session, err)
+		}
+	}()
+	if err := session.conn.Handshake(); err != nil {
+		logger.Printf("rtmp handshake error:%v", err)
+		return
+	}
+	for !session.Stoped {
+		msg, err := session.conn.ReadMessage()
+		if err != nil {
+			if !session.Stoped {
+				logger.Printf("%v read message error:%v", session, err)
+			}
+			return
+		}
+		switch msg.TypeID {
+		case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND:
+			payload := msg.Payload
+			if msg.TypeID == RTMP_MSG_AMF3_COMMAND && len(payload) > 0 {
+				payload = payload[1:]
+			}
+			if err = session.handleCommand(msg, payload); err != nil {
+				logger.Printf("%v handle command error:%v", session, err)
+				return
+			}
+		case RTMP_MSG_AMF0_DATA, RTMP_MSG_AMF3_DATA:
+			if session.publisher != nil {
+				payload := msg.Payload
+				if msg.TypeID == RTMP_MSG_AMF3_DATA && len(payload) > 0 {
+					payload = payload[1:]
+				}
+				session.publisher.handleData(payload)
+			}
+		case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+			if session.publisher != nil {
+				session.InBytes += len(msg.Payload)
+				if err = session.publisher.handleMedia(msg); err != nil {
+					logger.Printf("%v publish error:%v", session, err)
+					return
+				}
+			}
+		case RTMP_MSG_USER_CONTROL:
+			if len(msg.Payload) >= 6 && msg.Payload[1] == RTMP_USER_PING_REQUEST {
+				timestamp := uint32(msg.Payload[2])<<24 | uint32(msg.Payload[3])<<16 | uint32(msg.Payload[4])<<8 | uint32(msg.Payload[5])
+				_ = session.conn.WriteUserControl(RTMP_USER_PING_RESPONSE, timestamp)
+			}
+		}
+	}
+}
+
+func (session *RTMPSession) handleCommand(msg *RTMPMessage, payload []byte) (err error) {
+	values, err := AMF0Decode(payload)
+	if err != nil || len(values) < 2 {
+		return fmt.Errorf("invalid amf command:%v", err)
+	}
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+	if session.Server.debugLogEnable {
+		session.logger.Printf("%v command:%s %v", session, name, values[2:])
+	}
+	switch name {
+	case "connect":
+		var obj AMFObject
+		if len(values) > 2 {
+			obj, _ = values[2].(AMFObject)
+		}
+		session.App = strings.Trim(obj.String("app"), "/")
+		session.TcURL = obj.String("tcUrl")
+		if err = session.conn.WriteServerControls(); err != nil {
+			return
+		}
+		return session.conn.WriteCommand(RTMP_CSID_COMMAND, 0, "_result", transactionID,
+			AMFObject{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+			AMFObject{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": obj.Number("objectEncoding")})
+	case "createStream":
+		session.streamID = 1
+		return session.conn.WriteCommand(RTMP_CSID_COMMAND, 0, "_result", transactionID, nil, session.streamID)
+	case "releaseStream", "FCPublish", "FCUnpublish", "getStreamLength":
+		return session.conn.WriteCommand(RTMP_CSID_COMMAND, 0, "_result", transactionID, nil)
+	case "publish":
+		if len(values) < 4 {
+			return fmt.Errorf("publish without stream name")
+		}
+		streamName, _ := values[3].(string)
+		return session.handlePublish(msg.StreamID, streamName)
+	case "play":
+		if len(values) < 4 {
+			return fmt.Errorf("play without stream name")
+		}
+		streamName, _ := values[3].(string)
+		return session.handlePlay(msg.StreamID, streamName)
+	case "deleteStream", "closeStream":
+		session.Stop()
+	}
+	return
+}
+
+func (session *RTMPSession) onStatus(streamID uint32, level string, code string, description string) error {
+	return session.conn.WriteCommand(RTMP_CSID_DATA, streamID, "onStatus", 0, nil,
+		AMFObject{"level": level, "code": code, "description": description})
+}
+
+//推流地址 rtmp://host/{app}/{stream}?query 对应路径 /{app}/{stream}
+func (session *RTMPSession) streamPath(streamName string) (string, url.Values) {
+	query := url.Values{}
+	if index := strings.Index(streamName, "?"); index >= 0 {
+		query, _ = url.ParseQuery(streamName[index+1:])
+		streamName = streamName[:index]
+	}
+	if index := strings.Index(session.App, "?"); index >= 0 {
+		appQuery, _ := url.ParseQuery(session.App[index+1:])
+		for k, v := range appQuery {
+			query[k] = v
+		}
+		session.App = session.App[:index]
+	}
+	streamPath := "/" + strings.Trim(streamName, "/")
+	if session.App != "" {
+		streamPath = "/" + session.App + streamPath
+	}
+	return streamPath, query
+}
+
+//rtmp没有标准的认证方式，通过地址参数username、password认证
+func (session *RTMPSession) checkAuthorization(query url.Values, method string, sessionType SessionType) error {
+	server := session.Server
+	if !server.localAuthorizationEnable && !server.remoteHttpAuthorizationEnable {
+		return nil
+	}
+	info := &AuthorizationInfo{
+		AuthType:      BASIC,
+		Username:      query.Get("username"),
+		Password:      query.Get("password"),
+		Uri:           session.URL,
+		RequestMethod: method,
+		SessionType:   sessionType.String(),
+	}
+	if server.localAuthorizationEnable {
+		return info.CheckAuthLocal()
+	}
+	return info.CheckAuthHttpRemote()
+}
+
+func (session *RTMPSession) handlePublish(streamID uint32, streamName string) (err error) {
+	logger := session.logger
+	session.Type = SESSION_TYPE_PUSHER
+	streamPath, query := session.streamPath(streamName)
+	session.Path = streamPath
+	session.URL = strings.TrimRight(session.TcURL, "/") + "/" + strings.Trim(streamName, "/")
+	if err = session.checkAuthorization(query, "publish", SESSION_TYPE_PUSHER); err != nil {
+		logger.Printf("%v", err)
+		_ = session.onStatus(streamID, "error", "NetStream.Publish.Unauthorized", "Unauthorized")
+		return err
+	}
+	if !session.ToWebHookInfo(ON_PUBLISH).ExecuteWebHookNotify() {
+		_ = session.onStatus(streamID, "error", "NetStream.Publish.Rejected", "Server not allowed you push stream")
+		return fmt.Errorf("server not allowed push stream:%s", session.Path)
+	}
+	if session.Server.GetPusher(session.Path) != nil {
+		_ = session.onStatus(streamID, "error", "NetStream.Publish.BadName", "Stream already publishing")
+		return fmt.Errorf("stream already publishing:%s", session.Path)
+	}
+	session.publisher = newRTMPPublisher(session)
+	logger.Printf("%v start publish", session)
+	return session.onStatus(streamID, "status", "NetStream.Publish.Start", "Start publishing")
+}
+
+func (session *RTMPSession) handlePlay(streamID uint32, streamName string) (err error) {
+	logger := session.logger
+	server := session.Server
+	session.Type = SESSEION_TYPE_PLAYER
+	streamPath, query := session.streamPath(streamName)
+	session.Path = streamPath
+	session.URL = strings.TrimRight(session.TcURL, "/") + "/" + strings.Trim(streamName, "/")
+	if err = session.checkAuthorization(query, "play", SESSEION_TYPE_PLAYER); err != nil {
+		logger.Printf("%v", err)
+		_ = session.onStatus(streamID, "error", "NetStream.Play.Failed", "Unauthorized")
+		return err
+	}
+	if !session.ToWebHookInfo(ON_PLAY).ExecuteWebHookNotify() {
+		_ = session.onStatus(streamID, "error", "NetStream.Play.Failed", "Server not allowed you pull stream")
+		return fmt.Errorf("server not allowed pull stream:%s", session.Path)
+	}
+	pusher := server.GetPusher(session.Path)
+	if pusher == nil && server.streamNotExistHoldMillisecond != 0 {
+		end := time.Now().Add(server.streamNotExistHoldMillisecond)
+		for pusher == nil && time.Now().Before(end) {
+			time.Sleep(time.Duration(200) * time.Millisecond)
+			pusher = server.GetPusher(session.Path)
+		}
+	}
+	if pusher == nil {
+		_ = session.onStatus(streamID, "error", "NetStream.Play.StreamNotFound", "Stream not found")
+		return fmt.Errorf("not found stream:%s", session.Path)
+	}
+	session.Pusher = pusher
+	session.ACodec = pusher.ACodec()
+	session.VCodec = pusher.VCodec()
+	session.SDPRaw = pusher.SDPRaw()
+	session.logger = log.New(os.Stdout, fmt.Sprintf("[rtmp player:%s, pusher:%s, path: %s]", session.ID, pusher.ID(), session.Path), log.LstdFlags|log.Lshortfile)
+	if !utils.Debug {
+		session.logger.SetOutput(utils.GetLogWriter())
+	}
+	//播放时不设置读超时，客户端可能长时间不发送数据
+	session.conn.timeout = 0
+	player := NewRTMPPlayer(session, pusher, streamID)
+	go player.Start()
+	return
+}
+
+func (session *RTMPSession) Stop() {
+	session.stopLock.Lock()
+	if session.Stoped {
+		session.stopLock.Unlock()
+		return
+	}
+	session.Stoped = true
+	session.stopLock.Unlock()
+	if session.Type != 0 {
+		if session.Type == SESSEION_TYPE_PLAYER {
+			go session.ToWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+		} else {
+			go session.ToWebHookInfo(ON_TEARDOWN).ExecuteWebHookNotify()
+		}
+	}
+	for _, h := range session.StopHandles {
+		h()
+	}
+	session.conn.Close()
+}
@@ -0,0 +1,526 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+//rtp解包后得到的完整音视频帧
+type AVFrame struct {
+	Type      RTPType
+	Codec     string
+	Timestamp time.Duration //相对解包器开始时的时间
+	KeyFrame  bool
+	//视频帧的nalu列表，不包含起始码
+	NALUs [][]byte
+	//音频帧数据，aac为不含adts头的raw数据
+	Payload []byte
+}
+
+//rtp时间戳扩展，处理32位回绕
+type rtpClock struct {
+	started   bool
+	last      uint32
+	extended  int64
+	base      int64
+	offset    time.Duration
+	clockRate int
+	//推流端最近一次SR中ntp与rtp时间戳的对应关系
+	srReceived bool
+	srNTP      time.Time
+	srRTP      uint32
+}
+
+func (clock *rtpClock) rate() int64 {
+	if clock.clockRate <= 0 {
+		return 90000
+	}
+	return int64(clock.clockRate)
+}
+
+func (clock *rtpClock) toDuration(ts uint32, startAt time.Time) time.Duration {
+	if !clock.started {
+		clock.started = true
+		clock.last = ts
+		clock.extended = int64(ts)
+		clock.base = clock.extended
+		//不同轨道的rtp时间戳起点不同，以首包到达时间对齐音视频
+		clock.offset = time.Since(startAt)
+	} else {
+		clock.extended += int64(int32(ts - clock.last))
+		clock.last = ts
+	}
+	return clock.offset + time.Duration((clock.extended-clock.base)*int64(time.Second)/clock.rate())
+}
+
+//根据最近一次的时间戳换算，不修改时钟状态
+func (clock *rtpClock) peekDuration(ts uint32) time.Duration {
+	extended := clock.extended + int64(int32(ts-clock.last))
+	return clock.offset + time.Duration((extended-clock.base)*int64(time.Second)/clock.rate())
+}
+
+//推流rtp时间戳与服务器时间的映射，由pusher统一维护
+//后加入的消费者(gop缓存回放)也能得到与直播一致的音视频时间
+type RTPTimeline struct {
+	lock    sync.RWMutex
+	startAt time.Time
+	video   rtpClock
+	audio   rtpClock
+}
+
+func NewRTPTimeline(sdpRaw string) *RTPTimeline {
+	timeline := &RTPTimeline{
+		startAt: time.Now(),
+	}
+	sdpMap := ParseSDP(sdpRaw)
+	if info, ok := sdpMap["video"]; ok {
+		timeline.video.clockRate = info.TimeScale
+	}
+	if info, ok := sdpMap["audio"]; ok {
+		timeline.audio.clockRate = info.TimeScale
+	}
+	return timeline
+}
+
+func (timeline *RTPTimeline) Update(pack *RTPPack) {
+	var clock *rtpClock
+	switch pack.Type {
+	case RTP_TYPE_VIDEO:
+		clock = &timeline.video
+	case RTP_TYPE_AUDIO:
+		clock = &timeline.audio
+	case RTP_TYPE_VIDEOCONTROL, RTP_TYPE_AUDIOCONTROL:
+		timeline.updateSenderReport(pack)
+		return
+	default:
+		return
+	}
+	rtp := ParseRTP(pack.Buffer.Bytes())
+	if rtp == nil {
+		return
+	}
+	timeline.lock.Lock()
+	clock.toDuration(uint32(rtp.Timestamp), timeline.startAt)
+	timeline.lock.Unlock()
+}
+
+//推流源重连后rtp时间戳及SR重新开始，以重连后首包到达时间接续原时间线
+func (timeline *RTPTimeline) Rebase() {
+	timeline.lock.Lock()
+	timeline.video = rtpClock{clockRate: timeline.video.clockRate}
+	timeline.audio = rtpClock{clockRate: timeline.audio.clockRate}
+	timeline.lock.Unlock()
+}
+
+//消费推流端的SR
+func (timeline *RTPTimeline) updateSenderReport(pack *RTPPack) {
+	clock := &timeline.audio
+	if pack.Type == RTP_TYPE_VIDEOCONTROL {
+		clock = &timeline.video
+	}
+	for _, packet := range parseRTCP(pack.Buffer.Bytes()) {
+		info, _ := packet.reports()
+		if info == nil {
+			continue
+		}
+		timeline.lock.Lock()
+		clock.srReceived = true
+		clock.srNTP = fromNTPTimestamp(info.NTPTime)
+		clock.srRTP = info.RTPTimestamp
+		timeline.lock.Unlock()
+	}
+}
+
+//rtp时间戳对应的ntp时间，优先使用推流端SR，其次使用首包到达时间
+func (timeline *RTPTimeline) NTPTime(rtpType RTPType, ts uint32) time.Time {
+	timeline.lock.RLock()
+	defer timeline.lock.RUnlock()
+	clock, other := &timeline.audio, &timeline.video
+	if rtpType == RTP_TYPE_VIDEO {
+		clock, other = &timeline.video, &timeline.audio
+	}
+	//音视频须使用同一种映射，否则会破坏同步关系
+	if clock.srReceived && (other.srReceived || !other.started) {
+		return clock.srNTP.Add(time.Duration(int64(int32(ts-clock.srRTP)) * int64(time.Second) / clock.rate()))
+	}
+	if !clock.started {
+		return time.Now()
+	}
+	return timeline.startAt.Add(clock.peekDuration(ts))
+}
+
+func (timeline *RTPTimeline) Duration(rtpType RTPType, ts uint32) (duration time.Duration, ok bool) {
+	timeline.lock.RLock()
+	defer timeline.lock.RUnlock()
+	clock := &timeline.audio
+	if rtpType == RTP_TYPE_VIDEO {
+		clock = &timeline.video
+	}
+	if !clock.started {
+		return 0, false
+	}
+	return clock.peekDuration(ts), true
+}
+
+//将推流rtp包还原为h264/h265/aac等音视频帧
+type RTPDepacketizer struct {
+	VCodec string
+	ACodec string
+	VPS    []byte
+	SPS    []byte
+	PPS    []byte
+	//aac AudioSpecificConfig
+	AudioConfig []byte
+	AudioRate   int
+	//音频通道数
+	AudioChannels int
+	OnFrame       func(frame *AVFrame)
+	//不为nil时使用推流统一的时间线
+	Timeline *RTPTimeline
+
+	startAt     time.Time
+	sizeLength  int
+	indexLength int
+
+	vClock     rtpClock
+	aClock     rtpClock
+	vTimestamp uint32
+	vNALUs     [][]byte
+	vFU        []byte
+	vLastSN    int
+}
+
+func NewRTPDepacketizer(sdpRaw string, onFrame func(frame *AVFrame)) *RTPDepacketizer {
+	depacketizer := &RTPDepacketizer{
+		OnFrame:       onFrame,
+		startAt:       time.Now(),
+		sizeLength:    13,
+		indexLength:   3,
+		AudioChannels: 1,
+		vLastSN:       -1,
+	}
+	sdpMap := ParseSDP(sdpRaw)
+	if info, ok := sdpMap["video"]; ok {
+		depacketizer.VCodec = info.Codec
+		depacketizer.vClock.clockRate = info.TimeScale
+		switch info.Codec {
+		case "h264":
+			for _, nalu := range info.SpropParameterSets {
+				if len(nalu) == 0 {
+					continue
+				}
+				switch nalu[0] & 0x1f {
+				case 7:
+					depacketizer.SPS = nalu
+				case 8:
+					depacketizer.PPS = nalu
+				}
+			}
+		case "h265":
+			depacketizer.VPS = info.SpropVPS
+			depacketizer.SPS = info.SpropSPS
+			depacketizer.PPS = info.SpropPPS
+		}
+	}
+	if info, ok := sdpMap["audio"]; ok {
+		depacketizer.ACodec = info.Codec
+		depacketizer.AudioRate = info.TimeScale
+		depacketizer.aClock.clockRate = info.TimeScale
+		if info.Channels > 0 {
+			depacketizer.AudioChannels = info.Channels
+		}
+		depacketizer.AudioConfig = info.Config
+		if info.SizeLength > 0 {
+			depacketizer.sizeLength = info.SizeLength
+		}
+		if info.IndexLength > 0 {
+			depacketizer.indexLength = info.IndexLength
+		}
+	}
+	return depacketizer
+}
+
+func (depacketizer *RTPDepacketizer) duration(rtpType RTPType, ts uint32) time.Duration {
+	if depacketizer.Timeline != nil {
+		if duration, ok := depacketizer.Timeline.Duration(rtpType, ts); ok {
+			return duration
+		}
+	}
+	if rtpType == RTP_TYPE_VIDEO {
+		return depacketizer.vClock.toDuration(ts, depacketizer.startAt)
+	}
+	return depacketizer.aClock.toDuration(ts, depacketizer.startAt)
+}
+
+func (depacketizer *RTPDepacketizer) HasVideo() bool {
+	return depacketizer.VCodec == "h264" || depacketizer.VCodec == "h265"
+}
+
+func (depacketizer *RTPDepacketizer) HasAudio() bool {
+	return depacketizer.ACodec != ""
+}
+
+func (depacketizer *RTPDepacketizer) WriteRTP(pack *RTPPack) {
+	if pack == nil {
+		return
+	}
+	switch pack.Type {
+	case RTP_TYPE_VIDEO:
+		if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil {
+			depacketizer.writeVideo(rtp)
+		}
+	case RTP_TYPE_AUDIO:
+		if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil {
+			depacketizer.writeAudio(rtp)
+		}
+	}
+}
+
+func (depacketizer *RTPDepacketizer) writeVideo(rtp *RTPInfo) {
+	ts := uint32(rtp.Timestamp)
+	if len(depacketizer.vNALUs) > 0 && ts != depacketizer.vTimestamp {
+		depacketizer.flushVideo()
+	}
+	depacketizer.vTimestamp = ts
+	if depacketizer.vLastSN >= 0 && uint16(depacketizer.vLastSN+1) != uint16(rtp.SequenceNumber) {
+		//丢包时丢弃未完成的分片
+		depacketizer.vFU = nil
+	}
+	depacketizer.vLastSN = rtp.SequenceNumber
+	switch depacketizer.VCodec {
+	case "h264":
+		depacketizer.depacketizeH264(rtp.Payload)
+	case "h265":
+		depacketizer.depacketizeH265(rtp.Payload)
+	default:
+		return
+	}
+	if rtp.Marker {
+		depacketizer.flushVideo()
+	}
+}
+
+func (depacketizer *RTPDepacketizer) depacketizeH264(payload []byte) {
+	naluType := payload[0] & 0x1f
+	switch {
+	case naluType >= 1 && naluType <= 23:
+		depacketizer.appendNALU(payload)
+	case naluType == 24: //STAP-A
+		for off := 1; off+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[off:]))
+			off += 2
+			if size == 0 || off+size > len(payload) {
+				return
+			}
+			depacketizer.appendNALU(payload[off : off+size])
+			off += size
+		}
+	case naluType == 28: //FU-A
+		if len(payload) < 3 {
+			return
+		}
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			depacketizer.vFU = append([]byte{payload[0]&0xe0 | fuHeader&0x1f}, payload[2:]...)
+		} else if depacketizer.vFU != nil {
+			depacketizer.vFU = append(depacketizer.vFU, payload[2:]...)
+		}
+		if fuHeader&0x40 != 0 && depacketizer.vFU != nil {
+			depacketizer.vNALUs = append(depacketizer.vNALUs, depacketizer.vFU)
+			depacketizer.vFU = nil
+		}
+	}
+}
+
+func (depacketizer *RTPDepacketizer) depacketizeH265(payload []byte) {
+	if len(payload) < 3 {
+		return
+	}
+	naluType := (payload[0] >> 1) & 0x3f
+	switch naluType {
+	case 48: //Aggregation Packets
+		for off := 2; off+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[off:]))
+			off += 2
+			if size == 0 || off+size > len(payload) {
+				return
+			}
+			depacketizer.appendNALU(payload[off : off+size])
+			off += size
+		}
+	case 49: //Fragmentation Units
+		fuHeader := payload[2]
+		if fuHeader&0x80 != 0 {
+			depacketizer.vFU = append([]byte{payload[0]&0x81 | (fuHeader&0x3f)<<1, payload[1]}, payload[3:]...)
+		} else if depacketizer.vFU != nil {
+			depacketizer.vFU = append(depacketizer.vFU, payload[3:]...)
+		}
+		if fuHeader&0x40 != 0 && depacketizer.vFU != nil {
+			depacketizer.vNALUs = append(depacketizer.vNALUs, depacketizer.vFU)
+			depacketizer.vFU = nil
+		}
+	case 50: //PACI Packets
+	default:
+		depacketizer.appendNALU(payload)
+	}
+}
+
+func (depacketizer *RTPDepacketizer) appendNALU(nalu []byte) {
+	buf := make([]byte, len(nalu))
+	copy(buf, nalu)
+	depacketizer.vNALUs = append(depacketizer.vNALUs, buf)
+}
+
+func (depacketizer *RTPDepacketizer) flushVideo() {
+	nalus := depacketizer.vNALUs
+	depacketizer.vNALUs = nil
+	if len(nalus) == 0 {
+		return
+	}
+	frame := &AVFrame{
+		Type:      RTP_TYPE_VIDEO,
+		Codec:     depacketizer.VCodec,
+		Timestamp: depacketizer.duration(RTP_TYPE_VIDEO, depacketizer.vTimestamp),
+	}
+	hasParams := false
+	for _, nalu := range nalus {
+		if depacketizer.VCodec == "h264" {
+			switch nalu[0] & 0x1f {
+			case 5:
+				frame.KeyFrame = true
+			case 7:
+				depacketizer.SPS = nalu
+				hasParams = true
+			case 8:
+				depacketizer.PPS = nalu
+			case 9: //AUD
+				continue
+			}
+		} else {
+			switch t := (nalu[0] >> 1) & 0x3f; {
+			case t >= 16 && t <= 21:
+				frame.KeyFrame = true
+			case t == 32:
+				depacketizer.VPS = nalu
+				hasParams = true
+			case t == 33:
+				depacketizer.SPS = nalu
+			case t == 34:
+				depacketizer.PPS = nalu
+			case t == 35: //AUD
+				continue
+			}
+		}
+		frame.NALUs = append(frame.NALUs, nalu)
+	}
+	if len(frame.NALUs) == 0 {
+		return
+	}
+	//关键帧前补充参数集，保证每个关键帧都可独立解码
+	if frame.KeyFrame && !hasParams {
+		frame.NALUs = append(depacketizer.ParameterSets(), frame.NALUs...)
+	}
+	if depacketizer.OnFrame != nil {
+		depacketizer.OnFrame(frame)
+	}
+}
+
+//视频参数集(vps)/sps/pps
+func (depacketizer *RTPDepacketizer) ParameterSets() (nalus [][]byte) {
+	if depacketizer.VCodec == "h265" && len(depacketizer.VPS) > 0 {
+		nalus = append(nalus, depacketizer.VPS)
+	}
+	if len(depacketizer.SPS) > 0 {
+		nalus = append(nalus, depacketizer.SPS)
+	}
+	if len(depacketizer.PPS) > 0 {
+		nalus = append(nalus, depacketizer.PPS)
+	}
+	return
+}
+
+func (depacketizer *RTPDepacketizer) writeAudio(rtp *RTPInfo) {
+	ts := uint32(rtp.Timestamp)
+	switch depacketizer.ACodec {
+	case "aac":
+		//https://tools.ietf.org/html/rfc3640#section-3.2
+		payload := rtp.Payload
+		if len(payload) < 2 {
+			return
+		}
+		headersBits := int(binary.BigEndian.Uint16(payload))
+		headersLen := (headersBits + 7) / 8
+		if 2+headersLen > len(payload) {
+			return
+		}
+		headerBits := depacketizer.sizeLength + depacketizer.indexLength
+		if headerBits <= 0 {
+			return
+		}
+		headers := payload[2 : 2+headersLen]
+		data := payload[2+headersLen:]
+		count := headersBits / headerBits
+		for i := 0; i < count; i++ {
+			size := readBits(headers, i*headerBits, depacketizer.sizeLength)
+			if size <= 0 || size > len(data) {
+				return
+			}
+			frame := &AVFrame{
+				Type:      RTP_TYPE_AUDIO,
+				Codec:     depacketizer.ACodec,
+				Timestamp: depacketizer.duration(RTP_TYPE_AUDIO, ts+uint32(i*1024)),
+				KeyFrame:  true,
+				Payload:   append([]byte{}, data[:size]...),
+			}
+			data = data[size:]
+			if depacketizer.OnFrame != nil {
+				depacketizer.OnFrame(frame)
+			}
+		}
+	default:
+		frame := &AVFrame{
+			Type:      RTP_TYPE_AUDIO,
+			Codec:     depacketizer.ACodec,
+			Timestamp: depacketizer.duration(RTP_TYPE_AUDIO, ts),
+			KeyFrame:  true,
+			Payload:   append([]byte{}, rtp.Payload...),
+		}
+		if depacketizer.OnFrame != nil {
+			depacketizer.OnFrame(frame)
+		}
+	}
+}
+
+//按位读取大端数据
+func readBits(buf []byte, offset int, count int) int {
+	value := 0
+	for i := 0; i < count; i++ {
+		pos := offset + i
+		if pos/8 >= len(buf) {
+			return -1
+		}
+		value = value<<1 | int(buf[pos/8]>>(7-uint(pos%8))&1)
+	}
+	return value
+}
+
+//统一不同来源的编码名称
+func normalizeCodecName(codec string) string {
+	switch strings.ToUpper(codec) {
+	case "H264":
+		return "h264"
+	case "H265", "HEVC":
+		return "h265"
+	case "MPEG4-GENERIC", "AAC":
+		return "aac"
+	case "PCMA":
+		return "pcma"
+	case "PCMU":
+		return "pcmu"
+	case "OPUS":
+		return "opus"
+	}
+	return strings.ToLower(codec)
+}
@@ -0,0 +1,148 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+)
+
+const RTP_MAX_PAYLOAD_SIZE = 1400
+
+//将音视频帧封装为rtp包，用于rtmp等非rtsp推流转换
+type RTPPacketizer struct {
+	Type        RTPType
+	PayloadType byte
+	SSRC        uint32
+	seq         uint16
+}
+
+func NewRTPPacketizer(rtpType RTPType, payloadType byte) *RTPPacketizer {
+	return &RTPPacketizer{
+		Type:        rtpType,
+		PayloadType: payloadType,
+		SSRC:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+	}
+}
+
+func (packetizer *RTPPacketizer) packet(ts uint32, marker bool, payload ...[]byte) *RTPPack {
+	header := make([]byte, 12)
+	header[0] = 0x80
+	header[1] = packetizer.PayloadType & 0x7f
+	if marker {
+		header[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(header[2:], packetizer.seq)
+	binary.BigEndian.PutUint32(header[4:], ts)
+	binary.BigEndian.PutUint32(header[8:], packetizer.SSRC)
+	packetizer.seq++
+	buf := bytes.NewBuffer(header)
+	for _, p := range payload {
+		buf.Write(p)
+	}
+	return &RTPPack{Type: packetizer.Type, Buffer: buf}
+}
+
+//rfc6184, 参数集合并为STAP-A，大于mtu的nalu使用FU-A分片
+func (packetizer *RTPPacketizer) PacketizeH264(nalus [][]byte, ts uint32) (packs []*RTPPack) {
+	var params [][]byte
+	var others [][]byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case 7, 8:
+			params = append(params, nalu)
+		case 9:
+		default:
+			others = append(others, nalu)
+		}
+	}
+	if len(params) > 1 {
+		stap := []byte{params[0][0]&0xe0 | 24}
+		for _, nalu := range params {
+			stap = append(stap, byte(len(nalu)>>8), byte(len(nalu)))
+			stap = append(stap, nalu...)
+		}
+		packs = append(packs, packetizer.packet(ts, len(others) == 0, stap))
+	} else if len(params) == 1 {
+		others = append(params, others...)
+	}
+	for i, nalu := range others {
+		last := i == len(others)-1
+		if len(nalu) <= RTP_MAX_PAYLOAD_SIZE {
+			packs = append(packs, packetizer.packet(ts, last, nalu))
+			continue
+		}
+		indicator := nalu[0]&0xe0 | 28
+		nalType := nalu[0] & 0x1f
+		data := nalu[1:]
+		for start := true; len(data) > 0; start = false {
+			size := len(data)
+			if size > RTP_MAX_PAYLOAD_SIZE-2 {
+				size = RTP_MAX_PAYLOAD_SIZE - 2
+			}
+			header := nalType
+			if start {
+				header |= 0x80
+			}
+			end := size == len(data)
+			if end {
+				header |= 0x40
+			}
+			packs = append(packs, packetizer.packet(ts, last && end, []byte{indicator, header}, data[:size]))
+			data = data[size:]
+		}
+	}
+	return
+}
+
+//rfc7798, 大于mtu的nalu使用FU分片
+func (packetizer *RTPPacketizer) PacketizeH265(nalus [][]byte, ts uint32) (packs []*RTPPack) {
+	var frames [][]byte
+	for _, nalu := range nalus {
+		if len(nalu) < 2 || (nalu[0]>>1)&0x3f == 35 {
+			continue
+		}
+		frames = append(frames, nalu)
+	}
+	for i, nalu := range frames {
+		last := i == len(frames)-1
+		if len(nalu) <= RTP_MAX_PAYLOAD_SIZE {
+			packs = append(packs, packetizer.packet(ts, last, nalu))
+			continue
+		}
+		payloadHeader := []byte{nalu[0]&0x81 | 49<<1, nalu[1]}
+		nalType := (nalu[0] >> 1) & 0x3f
+		data := nalu[2:]
+		for start := true; len(data) > 0; start = false {
+			size := len(data)
+			if size > RTP_MAX_PAYLOAD_SIZE-3 {
+				size = RTP_MAX_PAYLOAD_SIZE - 3
+			}
+			header := nalType
+			if start {
+				header |= 0x80
+			}
+			end := size == len(data)
+			if end {
+				header |= 0x40
+			}
+			packs = append(packs, packetizer.packet(ts, last && end, payloadHeader, []byte{header}, data[:size]))
+			data = data[size:]
+		}
+	}
+	return
+}
+
+//rfc3640 AAC-hbr, 每个包一个access unit
+func (packetizer *RTPPacketizer) PacketizeAAC(frame []byte, ts uint32) []*RTPPack {
+	auHeader := []byte{0x00, 0x10, byte(len(frame) >> 5), byte(len(frame)<<3) & 0xf8}
+	return []*RTPPack{packetizer.packet(ts, true, auHeader, frame)}
+}
+
+//g711等无需额外封装的音频
+func (packetizer *RTPPacketizer) PacketizeRaw(payload []byte, ts uint32) []*RTPPack {
+	return []*RTPPack{packetizer.packet(ts, true, payload)}
+}
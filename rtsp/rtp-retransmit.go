@@ -0,0 +1,66 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+//rfc4585 Generic NACK
+const RTCP_FMT_GENERIC_NACK = 1
+
+//推流端最近的视频rtp包，按序号索引，用于响应拉流端的NACK
+type rtpRetransmitBuffer struct {
+	lock    sync.RWMutex
+	packets []*RTPPack
+}
+
+func newRTPRetransmitBuffer(size int) *rtpRetransmitBuffer {
+	return &rtpRetransmitBuffer{
+		packets: make([]*RTPPack, size),
+	}
+}
+
+func (buffer *rtpRetransmitBuffer) Push(pack *RTPPack) {
+	data := pack.Buffer.Bytes()
+	if len(data) < RTP_FIXED_HEADER_LENGTH {
+		return
+	}
+	seq := binary.BigEndian.Uint16(data[2:])
+	buffer.lock.Lock()
+	buffer.packets[int(seq)%len(buffer.packets)] = pack
+	buffer.lock.Unlock()
+}
+
+//取出指定ssrc及序号的包，已被覆盖时返回nil
+func (buffer *rtpRetransmitBuffer) Get(ssrc uint32, seq uint16) *RTPPack {
+	buffer.lock.RLock()
+	pack := buffer.packets[int(seq)%len(buffer.packets)]
+	buffer.lock.RUnlock()
+	if pack == nil {
+		return nil
+	}
+	data := pack.Buffer.Bytes()
+	if binary.BigEndian.Uint16(data[2:]) != seq || binary.BigEndian.Uint32(data[8:]) != ssrc {
+		return nil
+	}
+	return pack
+}
+
+//解析NACK请求的序号，每个FCI为PID及其后16个包的丢失位图
+func parseGenericNACK(packet *rtcpPacket) (ssrc uint32, seqs []uint16) {
+	if packet.Type != RTCP_TYPE_RTPFB || packet.Count != RTCP_FMT_GENERIC_NACK || len(packet.Payload) < 4 {
+		return
+	}
+	ssrc = binary.BigEndian.Uint32(packet.Payload)
+	for fci := packet.Payload[4:]; len(fci) >= 4; fci = fci[4:] {
+		pid := binary.BigEndian.Uint16(fci)
+		blp := binary.BigEndian.Uint16(fci[2:])
+		seqs = append(seqs, pid)
+		for i := uint16(0); i < 16; i++ {
+			if blp&(1<<i) != 0 {
+				seqs = append(seqs, pid+i+1)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package rtsp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseGenericNACK(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ssrc uint32
+		seqs []uint16
+	}{
+		{
+			name: "pid and bitmap",
+			data: []byte{0x81, RTCP_TYPE_RTPFB, 0, 3, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0, 10, 0x80, 0x01},
+			ssrc: 0x1234,
+			seqs: []uint16{10, 11, 26},
+		},
+		{
+			name: "sequence wraps",
+			data: []byte{0x81, RTCP_TYPE_RTPFB, 0, 3, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0xff, 0xff, 0, 0x01},
+			ssrc: 0x1234,
+			seqs: []uint16{0xffff, 0},
+		},
+		{
+			name: "two fci",
+			data: []byte{0x81, RTCP_TYPE_RTPFB, 0, 4, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0, 1, 0, 0, 0, 5, 0, 0},
+			ssrc: 0x1234,
+			seqs: []uint16{1, 5},
+		},
+		{
+			name: "without fci",
+			data: []byte{0x81, RTCP_TYPE_RTPFB, 0, 2, 0, 0, 0, 1, 0, 0, 0x12, 0x34},
+			ssrc: 0x1234,
+		},
+		{
+			name: "without media ssrc",
+			data: []byte{0x81, RTCP_TYPE_RTPFB, 0, 1, 0, 0, 0, 1},
+		},
+		{
+			name: "not generic nack",
+			data: []byte{0x83, RTCP_TYPE_RTPFB, 0, 3, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0, 10, 0, 0},
+		},
+		{
+			name: "pli",
+			data: []byte{0x81, RTCP_TYPE_PSFB, 0, 2, 0, 0, 0, 1, 0, 0, 0x12, 0x34},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := parseRTCP(test.data)
+			if len(packets) != 1 {
+				t.Fatalf("packets = %d", len(packets))
+			}
+			ssrc, seqs := parseGenericNACK(packets[0])
+			if ssrc != test.ssrc || !reflect.DeepEqual(seqs, test.seqs) {
+				t.Fatalf("ssrc = %x seqs = %v, want %x %v", ssrc, seqs, test.ssrc, test.seqs)
+			}
+		})
+	}
+}
+
+func TestRTPRetransmitBuffer(t *testing.T) {
+	buffer := newRTPRetransmitBuffer(4)
+	for seq := uint16(0); seq < 6; seq++ {
+		buffer.Push(&RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(testRTPPacket(0x1234, seq))})
+	}
+	//过短的包不缓存
+	buffer.Push(&RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer([]byte{0x80, 96})})
+	tests := []struct {
+		ssrc  uint32
+		seq   uint16
+		found bool
+	}{
+		{0x1234, 5, true},
+		{0x1234, 2, true},
+		{0x1234, 1, false},
+		{0x5678, 5, false},
+		{0x1234, 9, false},
+	}
+	for _, test := range tests {
+		if pack := buffer.Get(test.ssrc, test.seq); (pack != nil) != test.found {
+			t.Fatalf("ssrc %x seq %d found = %v", test.ssrc, test.seq, pack != nil)
+		}
+	}
+}
+
+func FuzzParseGenericNACK(f *testing.F) {
+	f.Add([]byte{0x81, RTCP_TYPE_RTPFB, 0, 3, 0, 0, 0, 1, 0, 0, 0x12, 0x34, 0, 10, 0x80, 0x01})
+	f.Add([]byte{0x81, RTCP_TYPE_RTPFB, 0, 1, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := newRTPRetransmitBuffer(16)
+		buffer.Push(&RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(testRTPPacket(0x1234, 10))})
+		for _, packet := range parseRTCP(data) {
+			ssrc, seqs := parseGenericNACK(packet)
+			//每个FCI最多17个序号
+			if len(seqs) > len(packet.Payload)/4*17 {
+				t.Fatalf("seqs = %d for payload %d", len(seqs), len(packet.Payload))
+			}
+			for _, seq := range seqs {
+				buffer.Get(ssrc, seq)
+			}
+		}
+	})
+}
@@ -3,6 +3,8 @@ package rtsp
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,6 +13,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strings"
 )
 
 type AuthorizationType string
@@ -20,13 +23,12 @@ const (
 	DIGEST AuthorizationType = "Digest"
 )
 
+const (
+	AUTH_REALM = "EasyDarwin"
+)
+
 var (
-	REALM_REX           *regexp.Regexp = regexp.MustCompile(`realm="(.*?)"`)
-	NONCE_REX           *regexp.Regexp = regexp.MustCompile(`nonce="(.*?)"`)
-	USERNAME_REX        *regexp.Regexp = regexp.MustCompile(`username="(.*?)"`)
-	RESPONSE_REX        *regexp.Regexp = regexp.MustCompile(`response="(.*?)"`)
-	URI_REX             *regexp.Regexp = regexp.MustCompile(`uri="(.*?)"`)
-	BASIC_REX           *regexp.Regexp = regexp.MustCompile(`Basic(\s+)([\w=]+)`)
+	BASIC_REX           *regexp.Regexp = regexp.MustCompile(`Basic(\s+)([\w+/=]+)`)
 	USERNAME_PASSWD_REX *regexp.Regexp = regexp.MustCompile(`[:]`)
 )
 
@@ -38,6 +40,10 @@ type AuthorizationInfo struct {
 	Nonce         string            `json:"nonce"`
 	Uri           string            `json:"uri"`
 	Response      string            `json:"response"`
+	Algorithm     string            `json:"algorithm"`
+	Qop           string            `json:"qop"`
+	Nc            string            `json:"nc"`
+	Cnonce        string            `json:"cnonce"`
 	RequestMethod string            `json:"requestMethod"`
 	SessionType   string            `json:"sessionType"`
 }
@@ -45,9 +51,11 @@ type AuthorizationInfo struct {
 type AuthError struct {
 	authLine string
 	err      string
+	stale    bool
 }
 
-func DecodeAuthorizationInfo(authLine string, serverNonce string, requestMethod string, sessionType SessionType) (authInfo *AuthorizationInfo, err error) {
+//digest认证要求realm为AUTH_REALM、uri与请求的uri一致，且必须带qop=auth
+func DecodeAuthorizationInfo(authLine string, requestMethod string, requestURI string, sessionType SessionType) (authInfo *AuthorizationInfo, err error) {
 	server := GetServer()
 	authInfo = &AuthorizationInfo{
 		AuthType:      server.authorizationType,
@@ -59,6 +67,10 @@ func DecodeAuthorizationInfo(authLine string, serverNonce string, requestMethod
 	}
 	if server.authorizationType == BASIC {
 		baseMatch := BASIC_REX.FindStringSubmatch(authLine)
+		if len(baseMatch) != 3 {
+			authError.err = "not basic authorization"
+			return nil, authError
+		}
 		authByte, decErr := base64.StdEncoding.DecodeString(baseMatch[2])
 		if decErr != nil {
 			authError.err = decErr.Error()
@@ -73,46 +85,55 @@ func DecodeAuthorizationInfo(authLine string, serverNonce string, requestMethod
 		authInfo.Password = split[1]
 		return authInfo, nil
 	} else if server.authorizationType == DIGEST {
-		result1 := REALM_REX.FindStringSubmatch(authLine)
-		if len(result1) == 2 {
-			authInfo.Realm = result1[1]
-		} else {
-			authError.err = "no realm found"
+		challenges := parseAuthChallenges([]string{authLine})
+		if len(challenges) == 0 || challenges[0].Scheme != "digest" {
+			authError.err = "not digest authorization"
 			return nil, authError
 		}
-		result1 = NONCE_REX.FindStringSubmatch(authLine)
-		if len(result1) == 2 {
-			authInfo.Nonce = result1[1]
-		} else {
-			authError.err = "no nonce found"
+		params := challenges[0].Params
+		for _, item := range []struct {
+			name  string
+			value *string
+		}{
+			{"realm", &authInfo.Realm},
+			{"nonce", &authInfo.Nonce},
+			{"username", &authInfo.Username},
+			{"response", &authInfo.Response},
+			{"uri", &authInfo.Uri},
+		} {
+			if *item.value = params[item.name]; *item.value == "" {
+				authError.err = item.name + " not found"
+				return nil, authError
+			}
+		}
+		if authInfo.Realm != AUTH_REALM {
+			authError.err = "realm not match: " + authInfo.Realm
 			return nil, authError
 		}
-		if serverNonce != authInfo.Nonce {
-			authError.err = "server nonce not same as client nonce"
+		//防止截获的其他地址的认证信息被用于当前请求
+		if authInfo.Uri != requestURI {
+			authError.err = "uri not match: " + authInfo.Uri
 			return nil, authError
 		}
-
-		result1 = USERNAME_REX.FindStringSubmatch(authLine)
-		if len(result1) == 2 {
-			authInfo.Username = result1[1]
-		} else {
-			authError.err = "username not found"
+		authInfo.Algorithm = challenges[0].algorithm()
+		if authInfo.Algorithm != "MD5" && authInfo.Algorithm != "SHA-256" {
+			authError.err = "not support algorithm: " + authInfo.Algorithm
 			return nil, authError
 		}
-
-		result1 = RESPONSE_REX.FindStringSubmatch(authLine)
-		if len(result1) == 2 {
-			authInfo.Response = result1[1]
-		} else {
-			authError.err = "response not found"
+		//不带qop的响应无法通过nc防止重放，不再支持
+		authInfo.Qop = strings.ToLower(params["qop"])
+		if authInfo.Qop != "auth" {
+			authError.err = "not support qop: " + authInfo.Qop
 			return nil, authError
 		}
-
-		result1 = URI_REX.FindStringSubmatch(authLine)
-		if len(result1) == 2 {
-			authInfo.Uri = result1[1]
-		} else {
-			authError.err = "uri not found"
+		authInfo.Nc, authInfo.Cnonce = params["nc"], params["cnonce"]
+		if authInfo.Nc == "" || authInfo.Cnonce == "" {
+			authError.err = "nc or cnonce not found"
+			return nil, authError
+		}
+		if stale, nonceErr := server.digestNonces.Check(authInfo.Nonce, authInfo.Nc); nonceErr != nil {
+			authError.err = nonceErr.Error()
+			authError.stale = stale
 			return nil, authError
 		}
 		return authInfo, nil
@@ -122,6 +143,25 @@ func DecodeAuthorizationInfo(authLine string, serverNonce string, requestMethod
 	}
 }
 
+//Digest response，qop为空时兼容RFC 2069: H(H(A1):nonce:H(A2))
+func digestResponse(algorithm string, username string, realm string, password string, method string, uri string, nonce string, nc string, cnonce string, qop string) string {
+	h := func(s string) string {
+		if strings.HasPrefix(algorithm, "SHA-256") {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+		}
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	ha1 := h(fmt.Sprintf("%s:%s:%s", username, realm, password))
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(fmt.Sprintf("%s:%s:%s", ha1, nonce, cnonce))
+	}
+	ha2 := h(fmt.Sprintf("%s:%s", method, uri))
+	if qop != "" {
+		return h(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, nc, cnonce, qop, ha2))
+	}
+	return h(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+}
+
 func (authInfo *AuthorizationInfo) CheckAuthLocal() error {
 	var user models.User
 	err := db.SQLite.Where("Username = ?", authInfo.Username).First(&user).Error
@@ -133,17 +173,51 @@ func (authInfo *AuthorizationInfo) CheckAuthLocal() error {
 			return fmt.Errorf("CheckAuth error : password not equal")
 		}
 	} else {
-		//response = MD5(MD5(username:realm:password):nonce:MD5(method:uri))
-		md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", authInfo.Username, authInfo.Realm, user.Password))))
-		md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", authInfo.RequestMethod, authInfo.Uri))))
-		myResponse := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", md5UserRealmPwd, authInfo.Nonce, md5MethodURL))))
-		if myResponse != authInfo.Response {
+		myResponse := digestResponse(authInfo.Algorithm, authInfo.Username, authInfo.Realm, user.Password, authInfo.RequestMethod, authInfo.Uri,
+			authInfo.Nonce, authInfo.Nc, authInfo.Cnonce, authInfo.Qop)
+		if subtle.ConstantTimeCompare([]byte(myResponse), []byte(strings.ToLower(authInfo.Response))) != 1 {
 			return fmt.Errorf("CheckAuth error : response not equal")
 		}
 	}
 	return nil
 }
 
+//rtsp及http拉流共用的身份认证，stale为true表示digest nonce已过期，客户端可直接使用新nonce重试
+func (server *Server) CheckAuthorization(authLine string, requestMethod string, requestURI string, sessionType SessionType) (stale bool, err error) {
+	info, err := DecodeAuthorizationInfo(authLine, requestMethod, requestURI, sessionType)
+	if err != nil {
+		if authErr, ok := err.(*AuthError); ok {
+			stale = authErr.stale
+		}
+		return
+	}
+	if server.localAuthorizationEnable {
+		err = info.CheckAuthLocal()
+	} else {
+		err = info.CheckAuthHttpRemote()
+	}
+	if err == nil && info.AuthType == DIGEST {
+		err = server.digestNonces.Use(info.Nonce, info.Nc)
+	}
+	return
+}
+
+//401响应的WWW-Authenticate，digest同时提供SHA-256及MD5，使用同一个nonce
+func (server *Server) AuthenticateHeaders(stale bool) []string {
+	if server.authorizationType == BASIC {
+		return []string{fmt.Sprintf(`Basic realm="%s"`, AUTH_REALM)}
+	}
+	nonce := server.digestNonces.New()
+	staleParam := ""
+	if stale {
+		staleParam = ", stale=true"
+	}
+	return []string{
+		fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth", algorithm=SHA-256%s`, AUTH_REALM, nonce, staleParam),
+		fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth", algorithm=MD5%s`, AUTH_REALM, nonce, staleParam),
+	}
+}
+
 func (authInfo *AuthorizationInfo) CheckAuthHttpRemote() error {
 	authInfoByte, _ := json.Marshal(authInfo)
 	//{
@@ -154,6 +228,10 @@ func (authInfo *AuthorizationInfo) CheckAuthHttpRemote() error {
 	//    "nonce": "8fd7c44874480bd643d970149224da11",
 	//    "uri": "rtsp://192.168.1.76:554/live/123456",
 	//    "response": "ca29ba3297f50b32425e46e23723ef7b",
+	//    "algorithm": "MD5",
+	//    "qop": "auth",
+	//    "nc": "00000001",
+	//    "cnonce": "0a4f113b",
 	//    "requestMethod": "Play"
 	//}
 	response, err := http.Post(GetServer().remoteHttpAuthorizationUrl, "application/json", bytes.NewReader(authInfoByte))
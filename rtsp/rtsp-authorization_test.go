@@ -0,0 +1,196 @@
+package rtsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/gin-gonic/gin"
+)
+
+const testAuthURI = "rtsp://127.0.0.1:554/live/test"
+
+//使用本地digest认证的server，用户admin/admin
+func newTestDigestServer(t *testing.T) *Server {
+	newTestRecordDB(t)
+	db.SQLite.AutoMigrate(models.User{})
+	if err := db.SQLite.Create(&models.User{Username: "admin", Password: "admin"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	server := GetServer()
+	authorizationType, localAuthorizationEnable, digestNonces := server.authorizationType, server.localAuthorizationEnable, server.digestNonces
+	server.authorizationType = DIGEST
+	server.localAuthorizationEnable = true
+	server.digestNonces = newDigestNonceStore(time.Minute)
+	t.Cleanup(func() {
+		server.authorizationType, server.localAuthorizationEnable, server.digestNonces = authorizationType, localAuthorizationEnable, digestNonces
+	})
+	return server
+}
+
+//按服务端返回的challenge计算Authorization
+func testDigestAuthorization(server *Server, uri string, nc int) string {
+	challenge := parseAuthChallenges(server.AuthenticateHeaders(false))[0]
+	return challenge.digestAuthorization("admin", "admin", "DESCRIBE", uri, nc, "0a4f113b")
+}
+
+func TestCheckAuthorizationDigest(t *testing.T) {
+	server := newTestDigestServer(t)
+	nonce := parseAuthChallenges(server.AuthenticateHeaders(false))[0].Params["nonce"]
+	line := func(format string) string {
+		return strings.Replace(format, "NONCE", nonce, -1)
+	}
+	valid := testDigestAuthorization(server, testAuthURI, 1)
+	tests := []struct {
+		name    string
+		line    string
+		uri     string
+		wantErr string
+	}{
+		{"valid", valid, testAuthURI, ""},
+		{"nc replayed", valid, testAuthURI, "nc replayed"},
+		{"uri not match", testDigestAuthorization(server, testAuthURI, 1), "rtsp://127.0.0.1:554/live/other", "uri not match"},
+		{"realm not match", line(`Digest username="admin", realm="other", nonce="NONCE", uri="` + testAuthURI + `", response="x", qop=auth, nc=00000002, cnonce="a"`), testAuthURI, "realm not match"},
+		{"without qop", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x"`), testAuthURI, "not support qop"},
+		{"qop auth-int", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x", qop=auth-int, nc=00000002, cnonce="a"`), testAuthURI, "not support qop"},
+		{"without nc", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x", qop=auth, cnonce="a"`), testAuthURI, "nc or cnonce not found"},
+		{"without cnonce", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x", qop=auth, nc=00000002`), testAuthURI, "nc or cnonce not found"},
+		{"nc zero", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x", qop=auth, nc=00000000, cnonce="a"`), testAuthURI, "nc invalid"},
+		{"unknown nonce", `Digest username="admin", realm="EasyDarwin", nonce="abc", uri="` + testAuthURI + `", response="x", qop=auth, nc=00000001, cnonce="a"`, testAuthURI, "nonce not found"},
+		{"sess algorithm", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x", algorithm=MD5-sess, qop=auth, nc=00000002, cnonce="a"`), testAuthURI, "not support algorithm"},
+		{"wrong response", line(`Digest username="admin", realm="EasyDarwin", nonce="NONCE", uri="` + testAuthURI + `", response="x", qop=auth, nc=00000002, cnonce="a"`), testAuthURI, "response not equal"},
+		{"basic", "Basic YWRtaW46YWRtaW4=", testAuthURI, "not digest authorization"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := server.CheckAuthorization(test.line, "DESCRIBE", test.uri, SESSEION_TYPE_PLAYER)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckAuthorizationStale(t *testing.T) {
+	server := newTestDigestServer(t)
+	authorization := testDigestAuthorization(server, testAuthURI, 1)
+	for _, item := range server.digestNonces.nonces {
+		item.createAt = item.createAt.Add(-2 * time.Minute)
+	}
+	stale, err := server.CheckAuthorization(authorization, "DESCRIBE", testAuthURI, SESSEION_TYPE_PLAYER)
+	if err == nil || !stale {
+		t.Fatalf("stale = %v error = %v", stale, err)
+	}
+}
+
+func TestHttpStreamAuthorizationRequired(t *testing.T) {
+	server := newTestDigestServer(t)
+	var hooks int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hooks, 1)
+		w.Write([]byte("0"))
+	}))
+	defer hook.Close()
+	onPlay := server.onPlay
+	server.onPlay = []string{hook.URL}
+	defer func() {
+		server.onPlay = onPlay
+	}()
+	for _, target := range []string{"/flv/live/test.flv", "/live/test.m3u8"} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest("GET", target, nil)
+		MediaStreamGinHandler{}.BeforeProcessMediaStream(c)
+		if !c.IsAborted() || recorder.Code != 401 || len(recorder.Header()["Www-Authenticate"]) != 2 {
+			t.Fatalf("%s status = %d header = %v", target, recorder.Code, recorder.Header())
+		}
+		if n := atomic.LoadInt32(&hooks); n != 0 {
+			t.Fatalf("%s on_play hook called %d times", target, n)
+		}
+	}
+}
+
+func TestDigestNonceStoreNC(t *testing.T) {
+	store := newDigestNonceStore(time.Minute)
+	nonce := store.New()
+	for _, nc := range []string{"00000002", "00000001", "00000050"} {
+		if err := store.Use(nonce, nc); err != nil {
+			t.Fatalf("use nc %s error = %v", nc, err)
+		}
+	}
+	tests := []struct {
+		nc   string
+		want error
+	}{
+		{"00000001", ErrDigestNcReplayed},
+		{"00000050", ErrDigestNcReplayed},
+		{"00000020", nil},
+		{"00000010", ErrDigestNcReplayed},
+		{"", ErrDigestNcInvalid},
+		{"zz", ErrDigestNcInvalid},
+		{"00000000", ErrDigestNcInvalid},
+	}
+	for _, test := range tests {
+		if _, err := store.Check(nonce, test.nc); err != test.want {
+			t.Fatalf("check nc %q error = %v, want %v", test.nc, err, test.want)
+		}
+	}
+}
+
+func TestDigestNonceStoreBound(t *testing.T) {
+	store := newDigestNonceStore(time.Minute)
+	first := store.New()
+	for i := 0; i < DIGEST_NONCE_MAX_COUNT+10; i++ {
+		store.New()
+	}
+	if len(store.nonces) != DIGEST_NONCE_MAX_COUNT || len(store.order) != DIGEST_NONCE_MAX_COUNT {
+		t.Fatalf("nonces = %d order = %d", len(store.nonces), len(store.order))
+	}
+	if _, err := store.Check(first, "00000001"); err != ErrDigestNonceNotFound {
+		t.Fatalf("oldest nonce error = %v", err)
+	}
+	//超过两个有效期的nonce在签发新nonce时删除
+	for _, item := range store.nonces {
+		item.createAt = item.createAt.Add(-3 * time.Minute)
+	}
+	last := store.New()
+	if len(store.nonces) != 1 || store.nonces[last] == nil {
+		t.Fatalf("nonces = %d", len(store.nonces))
+	}
+}
+
+func FuzzDecodeAuthorizationInfo(f *testing.F) {
+	store := newDigestNonceStore(time.Minute)
+	nonce := store.New()
+	challenge := authChallenge{Scheme: "digest", Params: map[string]string{"realm": AUTH_REALM, "nonce": nonce, "qop": "auth", "algorithm": "SHA-256"}}
+	f.Add(challenge.digestAuthorization("admin", "admin", "DESCRIBE", testAuthURI, 1, "0a4f113b"))
+	f.Add(`Digest username="admin", realm="EasyDarwin", nonce="` + nonce + `", uri="` + testAuthURI + `", response="x", qop=auth, nc=ffffffff, cnonce="a"`)
+	f.Add(`Digest username="a\"b", realm="EasyDarwin", nonce="` + nonce + `", uri=` + testAuthURI + `, response=x, qop=AUTH, nc=1, cnonce=a, Basic realm="x"`)
+	f.Add("Basic YWRtaW46YWRtaW4=")
+	server := GetServer()
+	f.Fuzz(func(t *testing.T, authLine string) {
+		authorizationType, digestNonces := server.authorizationType, server.digestNonces
+		server.authorizationType, server.digestNonces = DIGEST, store
+		defer func() {
+			server.authorizationType, server.digestNonces = authorizationType, digestNonces
+		}()
+		info, err := DecodeAuthorizationInfo(authLine, "DESCRIBE", testAuthURI, SESSEION_TYPE_PLAYER)
+		if err != nil {
+			return
+		}
+		if info.Realm != AUTH_REALM || info.Uri != testAuthURI || info.Qop != "auth" || info.Nc == "" || info.Cnonce == "" {
+			t.Fatalf("info = %+v", info)
+		}
+	})
+}
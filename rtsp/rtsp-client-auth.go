@@ -0,0 +1,233 @@
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//WWW-Authenticate中的一个challenge，scheme及参数名均为小写
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+//解析WWW-Authenticate，同一个头中可能有多个challenge，如: Digest realm="a", nonce="b", Basic realm="a"
+func parseAuthChallenges(values []string) (challenges []authChallenge) {
+	for _, s := range values {
+		var current *authChallenge
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			i := strings.IndexAny(s, " \t,=")
+			if i < 0 {
+				i = len(s)
+			}
+			token := s[:i]
+			s = strings.TrimLeft(s[i:], " \t")
+			if !strings.HasPrefix(s, "=") {
+				challenges = append(challenges, authChallenge{Scheme: strings.ToLower(token), Params: make(map[string]string)})
+				current = &challenges[len(challenges)-1]
+				continue
+			}
+			var value string
+			value, s = readAuthParamValue(strings.TrimLeft(s[1:], " \t"))
+			if current != nil {
+				current.Params[strings.ToLower(token)] = value
+			}
+		}
+	}
+	return
+}
+
+//读取token或quoted-string，返回值及剩余部分
+func readAuthParamValue(s string) (value string, rest string) {
+	if !strings.HasPrefix(s, "\"") {
+		i := strings.IndexAny(s, " \t,")
+		if i < 0 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+	builder := strings.Builder{}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				builder.WriteByte(s[i])
+			}
+		case '"':
+			return builder.String(), s[i+1:]
+		default:
+			builder.WriteByte(s[i])
+		}
+	}
+	return builder.String(), ""
+}
+
+func (challenge *authChallenge) algorithm() string {
+	algorithm := strings.ToUpper(challenge.Params["algorithm"])
+	if algorithm == "" {
+		return "MD5"
+	}
+	return algorithm
+}
+
+func (challenge *authChallenge) supported() bool {
+	switch challenge.Scheme {
+	case "basic":
+		return true
+	case "digest":
+		switch challenge.algorithm() {
+		case "MD5", "MD5-SESS", "SHA-256", "SHA-256-SESS":
+			return true
+		}
+	}
+	return false
+}
+
+//按Digest SHA-256、Digest MD5、Basic的顺序选择
+func selectAuthChallenge(challenges []authChallenge) *authChallenge {
+	rank := func(challenge *authChallenge) int {
+		if !challenge.supported() {
+			return 0
+		}
+		if challenge.Scheme == "basic" {
+			return 1
+		}
+		if strings.HasPrefix(challenge.algorithm(), "SHA-256") {
+			return 3
+		}
+		return 2
+	}
+	var selected *authChallenge
+	for i := range challenges {
+		if rank(&challenges[i]) > 0 && (selected == nil || rank(&challenges[i]) > rank(selected)) {
+			selected = &challenges[i]
+		}
+	}
+	return selected
+}
+
+//qop同时支持auth及auth-int时使用auth
+func (challenge *authChallenge) qop() string {
+	for _, qop := range strings.Split(challenge.Params["qop"], ",") {
+		if strings.TrimSpace(strings.ToLower(qop)) == "auth" {
+			return "auth"
+		}
+	}
+	return ""
+}
+
+//计算请求的Authorization头，nc为使用同一nonce的请求序号，从1开始
+func (challenge *authChallenge) authorization(username string, password string, method string, uri string, nc int) string {
+	if challenge.Scheme == "basic" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	cnonce := ""
+	if challenge.qop() != "" || strings.HasSuffix(challenge.algorithm(), "-SESS") {
+		b := make([]byte, 16)
+		rand.Read(b)
+		cnonce = hex.EncodeToString(b)
+	}
+	return challenge.digestAuthorization(username, password, method, uri, nc, cnonce)
+}
+
+//cnonce为空表示不使用qop且不是-sess算法
+func (challenge *authChallenge) digestAuthorization(username string, password string, method string, uri string, nc int, cnonce string) string {
+	realm, nonce := challenge.Params["realm"], challenge.Params["nonce"]
+	qop := challenge.qop()
+	ncValue := fmt.Sprintf("%08x", nc)
+	response := digestResponse(challenge.algorithm(), username, realm, password, method, uri, nonce, ncValue, cnonce, qop)
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", username, realm, nonce, uri, response))
+	if _, ok := challenge.Params["algorithm"]; ok {
+		builder.WriteString(fmt.Sprintf(", algorithm=%s", challenge.Params["algorithm"]))
+	}
+	if opaque, ok := challenge.Params["opaque"]; ok {
+		builder.WriteString(fmt.Sprintf(", opaque=\"%s\"", opaque))
+	}
+	if qop != "" {
+		builder.WriteString(fmt.Sprintf(", qop=%s, nc=%s", qop, ncValue))
+	}
+	//-sess算法没有qop时服务端同样需要cnonce计算HA1
+	if cnonce != "" {
+		builder.WriteString(fmt.Sprintf(", cnonce=\"%s\"", cnonce))
+	}
+	return builder.String()
+}
+
+//单独设置的用户名密码优先于地址中的
+func (client *RTSPClient) credentials() (username string, password string) {
+	if client.Username != "" {
+		return client.Username, client.Password
+	}
+	if l, err := url.Parse(client.URL); err == nil && l.User != nil {
+		username = l.User.Username()
+		password, _ = l.User.Password()
+	}
+	return
+}
+
+//根据401响应选择认证方式，之后的请求都会带上Authorization
+func (client *RTSPClient) checkAuth(resp *Response) error {
+	var values []string
+	for k, v := range resp.Header {
+		if !strings.EqualFold(k, "WWW-Authenticate") {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			values = append(values, v)
+		case []string:
+			values = append(values, v...)
+		}
+	}
+	challenge := selectAuthChallenge(parseAuthChallenges(values))
+	if challenge == nil {
+		return fmt.Errorf("auth error:unsupported challenge %v", values)
+	}
+	if username, _ := client.credentials(); username == "" {
+		return fmt.Errorf("auth error:no username")
+	}
+	client.auth = challenge
+	client.authNC = 0
+	return nil
+}
+
+func (client *RTSPClient) authorization(method string, uri string) string {
+	if client.auth == nil {
+		return ""
+	}
+	client.authNC++
+	username, password := client.credentials()
+	return client.auth.authorization(username, password, method, uri, client.authNC)
+}
+
+//不含用户名密码的源地址，用于请求行
+func (client *RTSPClient) requestURL() string {
+	l, err := url.Parse(client.URL)
+	if err != nil {
+		return client.URL
+	}
+	l.User = nil
+	return l.String()
+}
+
+//隐藏地址中的密码，用于日志及接口输出
+func redactURL(rawURL string) string {
+	l, err := url.Parse(rawURL)
+	if err != nil || l.User == nil {
+		return rawURL
+	}
+	if _, ok := l.User.Password(); ok {
+		l.User = url.UserPassword(l.User.Username(), "xxxxx")
+	}
+	return l.String()
+}
@@ -0,0 +1,140 @@
+package rtsp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//rfc7616 3.9.1
+var rfc7616Challenges = []string{
+	`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+	`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=MD5, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+}
+
+func TestDigestAuthorizationRFC7616(t *testing.T) {
+	challenges := parseAuthChallenges(rfc7616Challenges)
+	if len(challenges) != 2 {
+		t.Fatalf("challenges = %+v", challenges)
+	}
+	if selected := selectAuthChallenge(challenges); selected != &challenges[0] {
+		t.Fatalf("selected = %+v", selected)
+	}
+	tests := []struct {
+		challenge authChallenge
+		response  string
+	}{
+		{challenges[0], "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+		{challenges[1], "8ca523f5e9506fed4657c9700eebdbec"},
+	}
+	for _, test := range tests {
+		t.Run(test.challenge.algorithm(), func(t *testing.T) {
+			authorization := test.challenge.digestAuthorization("Mufasa", "Circle of Life", "GET", "/dir/index.html", 1, "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+			for _, want := range []string{
+				`response="` + test.response + `"`,
+				`qop=auth, nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"`,
+				`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+				`algorithm=` + test.challenge.algorithm(),
+			} {
+				if !strings.Contains(authorization, want) {
+					t.Fatalf("authorization = %s, want %s", authorization, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestAuthorizationSessWithoutQop(t *testing.T) {
+	challenge := parseAuthChallenges([]string{`Digest realm="EasyDarwin", nonce="abc", algorithm=MD5-sess`})[0]
+	authorization := challenge.authorization("admin", "admin", "DESCRIBE", "rtsp://127.0.0.1/test", 1)
+	if strings.Contains(authorization, "qop=") || strings.Contains(authorization, "nc=") {
+		t.Fatalf("authorization = %s", authorization)
+	}
+	params := parseAuthChallenges([]string{authorization})[0].Params
+	if params["cnonce"] == "" {
+		t.Fatalf("authorization without cnonce: %s", authorization)
+	}
+	//服务端按收到的cnonce计算的结果与客户端一致
+	if response := digestResponse("MD5-SESS", "admin", "EasyDarwin", "admin", "DESCRIBE", "rtsp://127.0.0.1/test", "abc", "", params["cnonce"], ""); response != params["response"] {
+		t.Fatalf("response = %s, want %s", params["response"], response)
+	}
+}
+
+func TestParseAuthChallenges(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []authChallenge
+	}{
+		{
+			name:   "multiple challenges",
+			values: []string{`Digest realm="a", nonce="b", Basic realm="a"`},
+			want: []authChallenge{
+				{Scheme: "digest", Params: map[string]string{"realm": "a", "nonce": "b"}},
+				{Scheme: "basic", Params: map[string]string{"realm": "a"}},
+			},
+		},
+		{
+			name:   "quoted escape",
+			values: []string{`Digest REALM="a\"b,c" , Nonce=xyz`},
+			want:   []authChallenge{{Scheme: "digest", Params: map[string]string{"realm": `a"b,c`, "nonce": "xyz"}}},
+		},
+		{
+			name:   "unterminated quote",
+			values: []string{`Basic realm="abc`},
+			want:   []authChallenge{{Scheme: "basic", Params: map[string]string{"realm": "abc"}}},
+		},
+		{
+			name:   "param without scheme",
+			values: []string{`realm="a"`, `Basic`},
+			want:   []authChallenge{{Scheme: "basic", Params: map[string]string{}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if challenges := parseAuthChallenges(test.values); !reflect.DeepEqual(challenges, test.want) {
+				t.Fatalf("challenges = %+v", challenges)
+			}
+		})
+	}
+}
+
+func TestSelectAuthChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`Basic realm="a", Digest realm="a", nonce="b"`, "digest MD5"},
+		{`Digest realm="a", nonce="b", algorithm=SHA-256-sess, Basic realm="a"`, "digest SHA-256-SESS"},
+		{`Digest realm="a", nonce="b", algorithm=SHA-512-256, Basic realm="a"`, "basic MD5"},
+		{`Negotiate abc, NTLM`, ""},
+	}
+	for _, test := range tests {
+		selected := selectAuthChallenge(parseAuthChallenges([]string{test.header}))
+		got := ""
+		if selected != nil {
+			got = selected.Scheme + " " + selected.algorithm()
+		}
+		if got != test.want {
+			t.Fatalf("%s selected = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func FuzzParseAuthChallenges(f *testing.F) {
+	for _, value := range rfc7616Challenges {
+		f.Add(value)
+	}
+	f.Add(`Digest realm="a\"b", nonce=b, algorithm=MD5-sess, Basic realm="a`)
+	f.Add(`Basic realm="EasyDarwin"`)
+	f.Fuzz(func(t *testing.T, value string) {
+		challenge := selectAuthChallenge(parseAuthChallenges([]string{value}))
+		if challenge == nil {
+			return
+		}
+		authorization := challenge.authorization("admin", "admin", "DESCRIBE", "rtsp://127.0.0.1/test", 1)
+		if !strings.HasPrefix(authorization, "Basic ") && !strings.HasPrefix(authorization, "Digest ") {
+			t.Fatalf("authorization = %s", authorization)
+		}
+	})
+}
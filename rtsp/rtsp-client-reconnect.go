@@ -0,0 +1,102 @@
+package rtsp
+
+import (
+	"math/rand"
+	"time"
+)
+
+//第attempt次重连前的等待时间，指数退避并加入随机抖动，避免大量摄像头同时断线后同时重连
+func (server *Server) pullReconnectDelay(attempt int) time.Duration {
+	delay := server.pullReconnectMinDelay
+	for i := 1; i < attempt && delay < server.pullReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > server.pullReconnectMaxDelay {
+		delay = server.pullReconnectMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	//在[delay/2, delay]之间随机
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+//使用相同的地址及参数创建新的client，ID不变，pusher对外保持同一路流
+func (client *RTSPClient) clone() (next *RTSPClient, err error) {
+	next, err = NewRTSPClient(client.Server, client.URL, client.OptionIntervalMillis, client.Agent)
+	if err != nil {
+		return
+	}
+	next.ID = client.ID
+	next.SessionLogger = client.SessionLogger
+	next.CustomPath = client.CustomPath
+	next.TransType = client.TransType
+	next.Username = client.Username
+	next.Password = client.Password
+	next.StartAt = client.StartAt
+	next.InBytes = client.InBytes
+	next.OutBytes = client.OutBytes
+	next.SDPRaw = client.SDPRaw
+	next.timeout = client.timeout
+	next.multicastInfo = client.multicastInfo
+	next.Reconnect = client.Reconnect
+	next.Reconnecting = client.Reconnecting
+	next.ReconnectCount = client.ReconnectCount
+	next.reconnectAttempt = client.reconnectAttempt
+	next.LastError = client.LastError
+	next.RTPHandles = client.RTPHandles
+	next.StopHandles, client.StopHandles = client.StopHandles, nil
+	next.RebindHandles = client.RebindHandles
+	return
+}
+
+//断线后保留pusher及播放者，按退避时间重新拉流
+//每次重连前先通过RebindHandles把新client交给pusher，新连接的包都使用重连后的时间线
+//重连期间对pusher调用Stop会结束重连并触发StopHandles
+func (client *RTSPClient) reconnect() {
+	server := client.Server
+	client.close()
+	client.Reconnecting = true
+	//稳定拉流超过最大退避时间后，重新从最小退避时间开始
+	if time.Since(client.connectedAt) > server.pullReconnectMaxDelay {
+		client.reconnectAttempt = 0
+	}
+	current := client
+	for !current.Stoped {
+		if server.pullReconnectMaxTimes > 0 && current.reconnectAttempt >= server.pullReconnectMaxTimes {
+			current.logger.Printf("%v reconnect failed %d times, last error:%s", current, current.reconnectAttempt, current.LastError)
+			current.Stop()
+			return
+		}
+		current.reconnectAttempt++
+		delay := server.pullReconnectDelay(current.reconnectAttempt)
+		current.logger.Printf("%v reconnect after %v, attempt:%d, last error:%s", current, delay, current.reconnectAttempt, current.LastError)
+		select {
+		case <-current.stopCh:
+			return
+		case <-time.After(delay):
+		}
+		current.ReconnectCount++
+		next, err := current.clone()
+		if err != nil {
+			current.LastError = err.Error()
+			continue
+		}
+		for _, h := range next.RebindHandles {
+			h(next)
+		}
+		current.Stop()
+		current = next
+		if err = current.Start(current.timeout); err != nil {
+			current.close()
+			continue
+		}
+		if current.Stoped {
+			current.close()
+			return
+		}
+		current.Reconnecting = false
+		current.logger.Printf("%v reconnect success, attempt:%d", current, current.reconnectAttempt)
+		return
+	}
+}
@@ -0,0 +1,132 @@
+package rtsp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPullReconnectDelay(t *testing.T) {
+	server := &Server{pullReconnectMinDelay: time.Second, pullReconnectMaxDelay: 8 * time.Second}
+	//指数增长，达到最大值后不再增长
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, delay := range want {
+		for j := 0; j < 100; j++ {
+			if got := server.pullReconnectDelay(i + 1); got < delay/2 || got > delay {
+				t.Fatalf("attempt %d delay = %v, want [%v, %v]", i+1, got, delay/2, delay)
+			}
+		}
+	}
+	if got := server.pullReconnectDelay(1000); got > server.pullReconnectMaxDelay {
+		t.Fatalf("delay = %v", got)
+	}
+	server.pullReconnectMinDelay = 0
+	if got := server.pullReconnectDelay(3); got != 0 {
+		t.Fatalf("delay = %v", got)
+	}
+}
+
+type testReconnectAttempt struct {
+	client  *RTSPClient
+	attempt int
+	count   int
+}
+
+//从测试server拉流的client，重连时通过attempts通知
+func newTestReconnectClient(t *testing.T, server *Server, path string) (*RTSPClient, chan testReconnectAttempt, chan struct{}) {
+	client, err := NewRTSPClient(server, "rtsp://"+server.testAddr()+path, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Reconnect = true
+	attempts := make(chan testReconnectAttempt, 100)
+	stopped := make(chan struct{})
+	client.RebindHandles = append(client.RebindHandles, func(next *RTSPClient) {
+		attempts <- testReconnectAttempt{next, next.reconnectAttempt, next.ReconnectCount}
+	})
+	client.StopHandles = append(client.StopHandles, func() {
+		close(stopped)
+	})
+	if err = client.Start(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return client, attempts, stopped
+}
+
+func waitTestPlayers(t *testing.T, pusher *Pusher, n int) {
+	for i := 0; i < 200 && len(pusher.GetPlayers()) != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if players := pusher.GetPlayers(); len(players) != n {
+		t.Fatalf("players = %d, want %d", len(players), n)
+	}
+}
+
+//源断开期间按次数退避，恢复后继续推送，稳定拉流超过最大退避时间后重新计数
+func TestRTSPClientReconnect(t *testing.T) {
+	server := startTestServer(t)
+	hold, minDelay, maxDelay, maxTimes := server.streamNotExistHoldMillisecond, server.pullReconnectMinDelay, server.pullReconnectMaxDelay, server.pullReconnectMaxTimes
+	server.streamNotExistHoldMillisecond = 0
+	server.pullReconnectMinDelay, server.pullReconnectMaxDelay, server.pullReconnectMaxTimes = 20*time.Millisecond, 80*time.Millisecond, 0
+	defer func() {
+		server.streamNotExistHoldMillisecond = hold
+		server.pullReconnectMinDelay, server.pullReconnectMaxDelay, server.pullReconnectMaxTimes = minDelay, maxDelay, maxTimes
+	}()
+	source := newTestPusher(t, server, "/live/reconnect")
+	if !server.AddPusher(source) {
+		t.Fatal("add pusher failed")
+	}
+	client, attempts, stopped := newTestReconnectClient(t, server, "/live/reconnect")
+	defer func() {
+		select {
+		case <-stopped:
+		default:
+			client.Stop()
+		}
+	}()
+	waitTestPlayers(t, source, 1)
+	count := 0
+	readAttempt := func() testReconnectAttempt {
+		select {
+		case attempt := <-attempts:
+			client, count = attempt.client, attempt.count
+			return attempt
+		case <-time.After(5 * time.Second):
+			t.Fatal("reconnect not attempted")
+		}
+		return testReconnectAttempt{}
+	}
+	source.Stop()
+	for i := 1; i <= 3; i++ {
+		if attempt := readAttempt(); attempt.attempt != i || attempt.count != i {
+			t.Fatalf("attempt = %d count = %d, want %d", attempt.attempt, attempt.count, i)
+		}
+	}
+	source = newTestPusher(t, server, "/live/reconnect")
+	if !server.AddPusher(source) {
+		t.Fatal("add pusher failed")
+	}
+	waitTestPlayers(t, source, 1)
+	//排空恢复前的重连
+	for len(attempts) > 0 {
+		readAttempt()
+	}
+	last := count
+	//达到最大重连次数后停止
+	server.pullReconnectMaxTimes = 3
+	time.Sleep(2 * server.pullReconnectMaxDelay)
+	source.Stop()
+	if attempt := readAttempt(); attempt.attempt != 1 || attempt.count != last+1 {
+		t.Fatalf("attempt = %d count = %d, want 1 %d", attempt.attempt, attempt.count, last+1)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not stopped after max reconnect times")
+	}
+	for len(attempts) > 0 {
+		readAttempt()
+	}
+	if client.reconnectAttempt != 3 || client.LastError == "" {
+		t.Fatalf("attempt = %d last error = %s", client.reconnectAttempt, client.LastError)
+	}
+}
@@ -3,7 +3,6 @@ package rtsp
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,7 +10,6 @@ import (
 	"net"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -54,8 +52,12 @@ type RTSPClient struct {
 	debugLogEnable bool
 	lastRtpSN      uint16
 
-	Agent    string
-	authLine string
+	Agent string
+	//单独设置的用户名密码，为空时使用URL中的
+	Username string
+	Password string
+	auth     *authChallenge
+	authNC   int
 
 	//tcp channels
 	aRTPChannel        int
@@ -63,13 +65,26 @@ type RTSPClient struct {
 	vRTPChannel        int
 	vRTPControlChannel int
 
+	//断线后是否自动重连，默认为pull_reconnect_enable配置
+	Reconnect      bool
+	Reconnecting   bool
+	ReconnectCount int
+	LastError      string
+	//连续重连失败次数，用于计算退避时间
+	reconnectAttempt int
+	connectedAt      time.Time
+	timeout          time.Duration
+	stopCh           chan struct{}
+
 	UDPServer   *UDPServer
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
+	//重连成功后以新的client调用，由pusher通过RebindClient接管
+	RebindHandles []func(*RTSPClient)
 }
 
 func (client *RTSPClient) String() string {
-	return fmt.Sprintf("client[%s]", client.URL)
+	return fmt.Sprintf("client[%s]", redactURL(client.URL))
 }
 
 func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent string) (client *RTSPClient, err error) {
@@ -93,6 +108,8 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent
 		Agent:                agent,
 		debugLogEnable:       GetServer().debugLogEnable,
 		multicastBoardTimes:  -1,
+		Reconnect:            server.pullReconnectEnable,
+		stopCh:               make(chan struct{}),
 	}
 	client.logger = log.New(os.Stdout, fmt.Sprintf("[%s]", client.ID), log.LstdFlags|log.Lshortfile)
 	if !utils.Debug {
@@ -100,7 +117,7 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent
 	}
 	multicastInfo := &MulticastCommunicateInfo{
 		SDPRaw:          client.SDPRaw,
-		SourceUrl:       client.URL,
+		SourceUrl:       redactURL(client.URL),
 		Path:            client.Path,
 		SourceSessionId: client.ID,
 	}
@@ -108,81 +125,6 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent
 	return
 }
 
-func DigestAuth(authLine string, method string, URL string) (string, error) {
-	l, err := url.Parse(URL)
-	if err != nil {
-		return "", fmt.Errorf("Url parse error:%v,%v", URL, err)
-	}
-	realm := ""
-	nonce := ""
-	realmRex := regexp.MustCompile(`realm="(.*?)"`)
-	result1 := realmRex.FindStringSubmatch(authLine)
-
-	nonceRex := regexp.MustCompile(`nonce="(.*?)"`)
-	result2 := nonceRex.FindStringSubmatch(authLine)
-
-	if len(result1) == 2 {
-		realm = result1[1]
-	} else {
-		return "", fmt.Errorf("auth error : no realm found")
-	}
-	if len(result2) == 2 {
-		nonce = result2[1]
-	} else {
-		return "", fmt.Errorf("auth error : no nonce found")
-	}
-	// response= md5(md5(username:realm:password):nonce:md5(public_method:url));
-	username := l.User.Username()
-	password, _ := l.User.Password()
-	l.User = nil
-	if l.Port() == "" {
-		l.Host = fmt.Sprintf("%s:%s", l.Host, "554")
-	}
-	md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, password))))
-	md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", method, l.String()))))
-
-	response := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", md5UserRealmPwd, nonce, md5MethodURL))))
-	Authorization := fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", username, realm, nonce, l.String(), response)
-	return Authorization, nil
-}
-
-func (client *RTSPClient) checkAuth(method string, resp *Response) (string, error) {
-	if resp.StatusCode == 401 {
-
-		// need auth.
-		AuthHeaders := resp.Header["WWW-Authenticate"]
-		auths, ok := AuthHeaders.([]string)
-
-		if ok {
-			for _, authLine := range auths {
-
-				if strings.IndexAny(authLine, "Digest") == 0 {
-					// 					realm="HipcamRealServer",
-					// nonce="3b27a446bfa49b0c48c3edb83139543d"
-					client.authLine = authLine
-					return DigestAuth(authLine, method, client.URL)
-				} else if strings.IndexAny(authLine, "Basic") == 0 {
-					// not support yet
-					// TODO..
-				}
-
-			}
-			return "", fmt.Errorf("auth error")
-		} else {
-			authLine, _ := AuthHeaders.(string)
-			if strings.IndexAny(authLine, "Digest") == 0 {
-				client.authLine = authLine
-				return DigestAuth(authLine, method, client.URL)
-			} else if strings.IndexAny(authLine, "Basic") == 0 {
-				// not support yet
-				// TODO..
-				return "", fmt.Errorf("not support Basic auth yet")
-			}
-		}
-	}
-	return "", nil
-}
-
 func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	defer func() {
 		if err != nil {
@@ -195,7 +137,7 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	if err != nil {
 		return err
 	}
-	if strings.ToLower(l.Scheme) != "rtsp" {
+	if scheme := strings.ToLower(l.Scheme); scheme != "rtsp" && scheme != "rtsps" {
 		err = fmt.Errorf("RTSP url is invalid")
 		return err
 	}
@@ -205,9 +147,9 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	}
 	port := l.Port()
 	if len(port) == 0 {
-		port = "554"
+		port = defaultRTSPPort(l.Scheme)
 	}
-	conn, err := net.DialTimeout("tcp", l.Hostname()+":"+port, timeout)
+	conn, err := dialRTSP(l.Scheme, net.JoinHostPort(l.Hostname(), port), timeout)
 	if err != nil {
 		// handle error
 		return err
@@ -227,21 +169,7 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	// An OPTIONS request returns the request types the server will accept.
 	resp, err := client.Request("OPTIONS", headers)
 	if err != nil {
-		if resp != nil {
-			Authorization, _ := client.checkAuth("OPTIONS", resp)
-			if len(Authorization) > 0 {
-				headers := make(map[string]string)
-				headers["Require"] = "implicit-play"
-				headers["Authorization"] = Authorization
-				// An OPTIONS request returns the request types the server will accept.
-				resp, err = client.Request("OPTIONS", headers)
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
 
 	// A DESCRIBE request includes an RTSP URL (rtsp://...), and the type of reply data that can be handled. This reply includes the presentation description,
@@ -251,27 +179,19 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 	headers["Accept"] = "application/sdp"
 	resp, err = client.Request("DESCRIBE", headers)
 	if err != nil {
-		if resp != nil {
-			authorization, _ := client.checkAuth("DESCRIBE", resp)
-			if len(authorization) > 0 {
-				headers := make(map[string]string)
-				headers["Authorization"] = authorization
-				headers["Accept"] = "application/sdp"
-				resp, err = client.Request("DESCRIBE", headers)
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
 	_sdp, err := sdp.ParseString(resp.Body)
 	if err != nil {
 		return err
 	}
 	client.Sdp = _sdp
-	client.SDPRaw = resp.Body
+	//摄像头sdp带srtp密钥时udp使用RTP/SAVP，转发时去掉密钥
+	srtpKeys, err := parseSDPSRTPKeys(resp.Body)
+	if err != nil {
+		client.logger.Printf("parse srtp keys error:%v", err)
+	}
+	client.SDPRaw = plainSDP(resp.Body)
 	session := ""
 	for _, media := range _sdp.Media {
 		switch media.Type {
@@ -279,10 +199,10 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 			client.VControl = media.Attributes.Get("control")
 			client.VCodec = media.Format[0].Name
 			var _url = ""
-			if strings.Index(strings.ToLower(client.VControl), "rtsp://") == 0 {
+			if isAbsoluteRTSPURL(client.VControl) {
 				_url = client.VControl
 			} else {
-				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.VControl, "/")
+				_url = strings.TrimRight(client.requestURL(), "/") + "/" + strings.TrimLeft(client.VControl, "/")
 			}
 			headers = make(map[string]string)
 			if client.TransType == TRANS_TYPE_TCP {
@@ -291,13 +211,20 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 				if client.UDPServer == nil {
 					client.UDPServer = &UDPServer{RTSPClient: client}
 				}
+				profile := "RTP/AVP/UDP"
+				if key, ok := srtpKeys["video"]; ok && isSAVPTransport(media.Proto) {
+					if client.UDPServer.vSRTP, err = newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:]); err != nil {
+						return err
+					}
+					profile = "RTP/SAVP"
+				}
 				//RTP/AVP;unicast;client_port=64864-64865
 				err = client.UDPServer.SetupVideo()
 				if err != nil {
 					client.logger.Printf("Setup video err.%v", err)
 					return err
 				}
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", client.UDPServer.VPort, client.UDPServer.VControlPort)
+				headers["Transport"] = fmt.Sprintf("%s;unicast;client_port=%d-%d", profile, client.UDPServer.VPort, client.UDPServer.VControlPort)
 				client.Conn.timeout = 0 //	UDP ignore timeout
 			}
 			if session != "" {
@@ -313,10 +240,10 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 			client.AControl = media.Attributes.Get("control")
 			client.ACodec = media.Format[0].Name
 			var _url = ""
-			if strings.Index(strings.ToLower(client.AControl), "rtsp://") == 0 {
+			if isAbsoluteRTSPURL(client.AControl) {
 				_url = client.AControl
 			} else {
-				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.AControl, "/")
+				_url = strings.TrimRight(client.requestURL(), "/") + "/" + strings.TrimLeft(client.AControl, "/")
 			}
 			headers = make(map[string]string)
 			if client.TransType == TRANS_TYPE_TCP {
@@ -325,12 +252,19 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 				if client.UDPServer == nil {
 					client.UDPServer = &UDPServer{RTSPClient: client}
 				}
+				profile := "RTP/AVP/UDP"
+				if key, ok := srtpKeys["audio"]; ok && isSAVPTransport(media.Proto) {
+					if client.UDPServer.aSRTP, err = newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:]); err != nil {
+						return err
+					}
+					profile = "RTP/SAVP"
+				}
 				err = client.UDPServer.SetupAudio()
 				if err != nil {
 					client.logger.Printf("Setup audio err.%v", err)
 					return err
 				}
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", client.UDPServer.APort, client.UDPServer.AControlPort)
+				headers["Transport"] = fmt.Sprintf("%s;unicast;client_port=%d-%d", profile, client.UDPServer.APort, client.UDPServer.AControlPort)
 				client.Conn.timeout = 0 //	UDP ignore timeout
 			}
 			if session != "" {
@@ -356,9 +290,24 @@ func (client *RTSPClient) requestStream(timeout time.Duration) (err error) {
 }
 
 func (client *RTSPClient) startStream() {
+	err := client.readStream()
+	if client.Stoped {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("stream closed")
+	}
+	client.LastError = err.Error()
+	if !client.Reconnect {
+		client.Stop()
+		return
+	}
+	client.reconnect()
+}
+
+func (client *RTSPClient) readStream() error {
 	startTime := time.Now()
 	loggerTime := time.Now().Add(-10 * time.Second)
-	defer client.Stop()
 	for !client.Stoped {
 		if client.OptionIntervalMillis > 0 {
 			if time.Since(startTime) > time.Duration(client.OptionIntervalMillis)*time.Millisecond {
@@ -376,7 +325,7 @@ func (client *RTSPClient) startStream() {
 			if !client.Stoped {
 				client.logger.Printf("client.connRW.ReadByte err:%v", err)
 			}
-			return
+			return err
 		}
 		switch b {
 		case 0x24: // rtp
@@ -388,7 +337,7 @@ func (client *RTSPClient) startStream() {
 				if !client.Stoped {
 					client.logger.Printf("io.ReadFull err:%v", err)
 				}
-				return
+				return err
 			}
 			channel := int(header[1])
 			length := binary.BigEndian.Uint16(header[2:])
@@ -398,7 +347,7 @@ func (client *RTSPClient) startStream() {
 				if !client.Stoped {
 					client.logger.Printf("io.ReadFull err:%v", err)
 				}
-				return
+				return err
 			}
 			//ch <- append(header, content...)
 			rtpBuf := bytes.NewBuffer(content)
@@ -461,7 +410,7 @@ func (client *RTSPClient) startStream() {
 					if !client.Stoped {
 						client.logger.Printf("client.connRW.ReadLine err:%v", err)
 					}
-					return
+					return err
 				}
 				if len(line) == 0 {
 					if contentLen != 0 {
@@ -471,7 +420,7 @@ func (client *RTSPClient) startStream() {
 							if !client.Stoped {
 								err = fmt.Errorf("Read content err.ContentLength:%d", contentLen)
 							}
-							return
+							return err
 						}
 						builder.Write(content)
 					}
@@ -491,12 +440,13 @@ func (client *RTSPClient) startStream() {
 						if !client.Stoped {
 							client.logger.Printf("strconv.Atoi err:%v, str:%v", err, splits[1])
 						}
-						return
+						return err
 					}
 				}
 			}
 		}
 	}
+	return nil
 }
 
 func (client *RTSPClient) Start(timeout time.Duration) (err error) {
@@ -504,19 +454,23 @@ func (client *RTSPClient) Start(timeout time.Duration) (err error) {
 		timeoutMillis := GetServer().rtspTimeoutMillisecond
 		timeout = time.Duration(timeoutMillis) * time.Millisecond
 	}
+	client.timeout = timeout
 	err = client.requestStream(timeout)
 	if err != nil {
+		client.LastError = err.Error()
 		return
 	}
-	if client.AControl != "" {
+	client.connectedAt = time.Now()
+	//重连时沿用已分配的组播地址
+	if client.AControl != "" && client.multicastInfo.AudioRtpMultiAddress == "" {
 		client.multicastInfo.AudioRtpMultiAddress, client.multicastInfo.AudioRtpPort = RandomMulticastAddress()
 		client.multicastInfo.CtlAudioRtpMultiAddress, client.multicastInfo.CtlAudioRtpPort = RandomMulticastAddress()
 	}
-	if client.VControl != "" {
+	if client.VControl != "" && client.multicastInfo.VideoRtpMultiAddress == "" {
 		client.multicastInfo.VideoRtpMultiAddress, client.multicastInfo.VideoRtpPort = RandomMulticastAddress()
 		client.multicastInfo.CtlVideoRtpMultiAddress, client.multicastInfo.CtlVideoRtpPort = RandomMulticastAddress()
 	}
-	if client.Server.EnableAudioHttpStream {
+	if client.Server.EnableAudioHttpStream && client.multicastInfo.AudioMulticastAddress == "" {
 		client.multicastInfo.AudioMulticastAddress, client.multicastInfo.AudioStreamPort = RandomMulticastAddress()
 	}
 	//if client.Server.EnableVideoHttpStream {
@@ -531,9 +485,15 @@ func (client *RTSPClient) Stop() {
 		return
 	}
 	client.Stoped = true
+	close(client.stopCh)
 	for _, h := range client.StopHandles {
 		h()
 	}
+	client.close()
+}
+
+//只关闭连接，不触发StopHandles
+func (client *RTSPClient) close() {
 	if client.Conn != nil {
 		client.connRW.Flush()
 		client.Conn.Close()
@@ -546,15 +506,23 @@ func (client *RTSPClient) Stop() {
 }
 
 func (client *RTSPClient) RequestWithPath(method string, path string, headers map[string]string, needResp bool) (resp *Response, err error) {
+	resp, err = client.requestWithPath(method, path, headers, needResp)
+	//未认证或nonce过期(stale)时按新的challenge重试一次
+	if resp != nil && resp.StatusCode == 401 {
+		if e := client.checkAuth(resp); e != nil {
+			return resp, e
+		}
+		resp, err = client.requestWithPath(method, path, headers, needResp)
+	}
+	return
+}
+
+func (client *RTSPClient) requestWithPath(method string, path string, headers map[string]string, needResp bool) (resp *Response, err error) {
 	logger := client.logger
 	headers["User-Agent"] = client.Agent
-	if len(headers["Authorization"]) == 0 {
-		if len(client.authLine) != 0 {
-			Authorization, _ := DigestAuth(client.authLine, method, client.URL)
-			if len(Authorization) > 0 {
-				headers["Authorization"] = Authorization
-			}
-		}
+	authorization := client.authorization(method, path)
+	if authorization != "" {
+		headers["Authorization"] = authorization
 	}
 	if len(client.Session) > 0 {
 		headers["Session"] = client.Session
@@ -569,7 +537,11 @@ func (client *RTSPClient) RequestWithPath(method string, path string, headers ma
 	}
 	builder.WriteString(fmt.Sprintf("\r\n"))
 	s := builder.String()
-	logger.Printf("[OUT]>>>\n%s", s)
+	if strings.HasPrefix(authorization, "Basic ") {
+		logger.Printf("[OUT]>>>\n%s", strings.Replace(s, authorization, "Basic xxxxx", 1))
+	} else {
+		logger.Printf("[OUT]>>>\n%s", s)
+	}
 	_, err = client.connRW.WriteString(s)
 	if err != nil {
 		return
@@ -632,7 +604,8 @@ func (client *RTSPClient) RequestWithPath(method string, path string, headers ma
 			status = splits[2]
 		}
 		lineCount++
-		splits := strings.Split(s, ":")
+		//值中可能包含':'，如WWW-Authenticate的realm及Content-Base
+		splits := strings.SplitN(s, ":", 2)
 		if len(splits) == 2 {
 			if val, ok := respHeader[splits[0]]; ok {
 				if slice, ok2 := val.([]string); ok2 {
@@ -675,23 +648,11 @@ func (client *RTSPClient) RequestWithPath(method string, path string, headers ma
 }
 
 func (client *RTSPClient) Request(method string, headers map[string]string) (*Response, error) {
-	l, err := url.Parse(client.URL)
-	if err != nil {
-		return nil, fmt.Errorf("Url parse error:%v", err)
-	}
-	l.User = nil
-	return client.RequestWithPath(method, l.String(), headers, true)
+	return client.RequestWithPath(method, client.requestURL(), headers, true)
 }
 
 func (client *RTSPClient) RequestNoResp(method string, headers map[string]string) (err error) {
-	var (
-		l *url.URL
-	)
-	if l, err = url.Parse(client.URL); err != nil {
-		return fmt.Errorf("Url parse error:%v", err)
-	}
-	l.User = nil
-	if _, err = client.RequestWithPath(method, l.String(), headers, false); err != nil {
+	if _, err = client.RequestWithPath(method, client.requestURL(), headers, false); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,119 @@
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//记录已使用nc的窗口大小，允许并发请求的nc乱序到达
+	DIGEST_NC_WINDOW = 64
+	//最多保存的nonce数量，未认证的请求也会签发nonce，超过后丢弃最早签发的
+	DIGEST_NONCE_MAX_COUNT = 10000
+)
+
+var (
+	ErrDigestNonceNotFound = errors.New("nonce not found")
+	ErrDigestNonceExpired  = errors.New("nonce expired")
+	ErrDigestNcInvalid     = errors.New("nc invalid")
+	ErrDigestNcReplayed    = errors.New("nc replayed")
+)
+
+type digestNonce struct {
+	createAt time.Time
+	maxNC    uint64
+	ncWindow uint64 //第i位表示maxNC-i是否已使用
+}
+
+//服务端签发的Digest nonce，超过有效期后要求客户端使用新nonce(stale=true)，并通过nc防止重放
+type digestNonceStore struct {
+	lock   sync.Mutex
+	expire time.Duration
+	nonces map[string]*digestNonce
+	order  []string //按签发时间排序
+}
+
+func newDigestNonceStore(expire time.Duration) *digestNonceStore {
+	if expire <= 0 {
+		expire = 300 * time.Second
+	}
+	return &digestNonceStore{
+		expire: expire,
+		nonces: make(map[string]*digestNonce),
+	}
+}
+
+func (store *digestNonceStore) New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	now := time.Now()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	//过期的nonce再保留一个有效期，用于返回stale=true
+	for len(store.order) > 0 {
+		oldest := store.order[0]
+		if len(store.nonces) < DIGEST_NONCE_MAX_COUNT && now.Sub(store.nonces[oldest].createAt) <= 2*store.expire {
+			break
+		}
+		delete(store.nonces, oldest)
+		store.order = store.order[1:]
+	}
+	store.nonces[nonce] = &digestNonce{createAt: now}
+	store.order = append(store.order, nonce)
+	return nonce
+}
+
+//检查nonce是否有效、nc是否已使用，stale表示nonce已过期
+func (store *digestNonceStore) Check(nonce string, nc string) (stale bool, err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.check(nonce, nc, false)
+}
+
+//认证通过后记录nc，同一nonce的nc不能再次使用
+func (store *digestNonceStore) Use(nonce string, nc string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	_, err := store.check(nonce, nc, true)
+	return err
+}
+
+func (store *digestNonceStore) check(nonce string, nc string, use bool) (stale bool, err error) {
+	item := store.nonces[nonce]
+	if item == nil {
+		return false, ErrDigestNonceNotFound
+	}
+	if time.Since(item.createAt) > store.expire {
+		return true, ErrDigestNonceExpired
+	}
+	count, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || count == 0 {
+		return false, ErrDigestNcInvalid
+	}
+	switch {
+	case count > item.maxNC:
+		if use {
+			if shift := count - item.maxNC; shift >= DIGEST_NC_WINDOW {
+				item.ncWindow = 0
+			} else {
+				item.ncWindow <<= shift
+			}
+			item.ncWindow |= 1
+			item.maxNC = count
+		}
+	case item.maxNC-count >= DIGEST_NC_WINDOW:
+		return false, ErrDigestNcReplayed
+	case item.ncWindow&(1<<(item.maxNC-count)) != 0:
+		return false, ErrDigestNcReplayed
+	default:
+		if use {
+			item.ncWindow |= 1 << (item.maxNC - count)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,312 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RTSP_HTTP_TUNNEL_CONTENT_TYPE = "application/x-rtsp-tunnelled"
+	//GET连接建立后等待POST连接的时间
+	RTSP_HTTP_TUNNEL_POST_TIMEOUT = 10 * time.Second
+)
+
+//已预读过数据的连接
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+type rtspHTTPTunnelPost struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+//rtsp over http隧道(Apple QuickTime方式)，GET连接下行rtsp响应及interleaved rtp，POST连接上行base64编码的rtsp请求
+//对Session表现为一个普通连接
+type rtspHTTPTunnel struct {
+	cookie       string
+	get          net.Conn
+	posts        chan *rtspHTTPTunnelPost
+	post         *rtspHTTPTunnelPost
+	postLock     sync.Mutex
+	readDeadline time.Time
+	//已解码未读取的数据
+	pending []byte
+	//不足4个字符的base64数据
+	quantum   []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRTSPHTTPTunnel(cookie string, get net.Conn) *rtspHTTPTunnel {
+	return &rtspHTTPTunnel{
+		cookie:  cookie,
+		get:     get,
+		posts:   make(chan *rtspHTTPTunnelPost, 1),
+		quantum: make([]byte, 0, 4),
+		closed:  make(chan struct{}),
+	}
+}
+
+//客户端可能关闭POST连接后以相同cookie重新发起
+func (tunnel *rtspHTTPTunnel) addPost(post *rtspHTTPTunnelPost) bool {
+	select {
+	case tunnel.posts <- post:
+		return true
+	case <-tunnel.closed:
+		return false
+	}
+}
+
+func (tunnel *rtspHTTPTunnel) currentPost() *rtspHTTPTunnelPost {
+	tunnel.postLock.Lock()
+	defer tunnel.postLock.Unlock()
+	return tunnel.post
+}
+
+func (tunnel *rtspHTTPTunnel) setPost(post *rtspHTTPTunnelPost) {
+	tunnel.postLock.Lock()
+	defer tunnel.postLock.Unlock()
+	if tunnel.post != nil {
+		tunnel.post.conn.Close()
+	}
+	tunnel.post = post
+	if post != nil {
+		post.conn.SetReadDeadline(tunnel.readDeadline)
+	}
+}
+
+func (tunnel *rtspHTTPTunnel) waitPost(timeout time.Duration) bool {
+	select {
+	case post := <-tunnel.posts:
+		tunnel.setPost(post)
+		return true
+	case <-time.After(timeout):
+	case <-tunnel.closed:
+	}
+	return false
+}
+
+//每个请求可能单独做base64编码，中间会出现'='，按4字符分组解码
+func (tunnel *rtspHTTPTunnel) decode(data []byte) error {
+	out := make([]byte, 3)
+	for _, c := range data {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '+', c == '/', c == '=':
+			tunnel.quantum = append(tunnel.quantum, c)
+		default:
+			continue
+		}
+		if len(tunnel.quantum) < 4 {
+			continue
+		}
+		n, err := base64.StdEncoding.Decode(out, tunnel.quantum)
+		tunnel.quantum = tunnel.quantum[:0]
+		if err != nil {
+			return err
+		}
+		tunnel.pending = append(tunnel.pending, out[:n]...)
+	}
+	return nil
+}
+
+func (tunnel *rtspHTTPTunnel) Read(b []byte) (n int, err error) {
+	buf := make([]byte, 4096)
+	for len(tunnel.pending) == 0 {
+		post := tunnel.currentPost()
+		if post == nil {
+			if !tunnel.waitPost(RTSP_HTTP_TUNNEL_POST_TIMEOUT) {
+				return 0, io.EOF
+			}
+			continue
+		}
+		n, err = post.reader.Read(buf)
+		if decodeErr := tunnel.decode(buf[:n]); decodeErr != nil {
+			return 0, decodeErr
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return 0, err
+			}
+			tunnel.setPost(nil)
+		}
+	}
+	n = copy(b, tunnel.pending)
+	tunnel.pending = tunnel.pending[n:]
+	return n, nil
+}
+
+func (tunnel *rtspHTTPTunnel) Write(b []byte) (int, error) {
+	return tunnel.get.Write(b)
+}
+
+func (tunnel *rtspHTTPTunnel) Close() error {
+	tunnel.closeOnce.Do(func() {
+		close(tunnel.closed)
+		tunnel.setPost(nil)
+	})
+	return tunnel.get.Close()
+}
+
+func (tunnel *rtspHTTPTunnel) LocalAddr() net.Addr {
+	return tunnel.get.LocalAddr()
+}
+
+func (tunnel *rtspHTTPTunnel) RemoteAddr() net.Addr {
+	return tunnel.get.RemoteAddr()
+}
+
+func (tunnel *rtspHTTPTunnel) SetDeadline(t time.Time) error {
+	tunnel.SetReadDeadline(t)
+	return tunnel.SetWriteDeadline(t)
+}
+
+func (tunnel *rtspHTTPTunnel) SetReadDeadline(t time.Time) error {
+	tunnel.postLock.Lock()
+	defer tunnel.postLock.Unlock()
+	tunnel.readDeadline = t
+	if tunnel.post != nil {
+		return tunnel.post.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (tunnel *rtspHTTPTunnel) SetWriteDeadline(t time.Time) error {
+	return tunnel.get.SetWriteDeadline(t)
+}
+
+//rtsp与http隧道共用监听端口，根据首个请求区分
+func (server *Server) handleConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	if server.httpTunnelEnable {
+		if server.rtspTimeoutMillisecond > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(server.rtspTimeoutMillisecond) * time.Millisecond))
+		}
+		head, err := reader.Peek(4)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if method := string(head); method == "GET " || method == "POST" {
+			server.handleHTTPTunnel(conn, reader)
+			return
+		}
+	}
+	session := NewSession(server, &bufferedConn{conn, reader})
+	session.Start()
+}
+
+func (server *Server) handleHTTPTunnel(conn net.Conn, reader *bufio.Reader) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		server.logger.Printf("rtsp http tunnel read request error, %v", err)
+		conn.Close()
+		return
+	}
+	server.serveHTTPTunnel(conn, reader, req)
+}
+
+//GET连接在隧道结束前不返回
+func (server *Server) serveHTTPTunnel(conn net.Conn, reader *bufio.Reader, req *http.Request) {
+	logger := server.logger
+	var err error
+	cookie := req.Header.Get("x-sessioncookie")
+	if cookie == "" {
+		fmt.Fprintf(conn, "HTTP/1.0 400 Bad Request\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		tunnel := newRTSPHTTPTunnel(cookie, conn)
+		server.httpTunnelsLock.Lock()
+		if _, ok := server.httpTunnels[cookie]; ok {
+			server.httpTunnelsLock.Unlock()
+			fmt.Fprintf(conn, "HTTP/1.0 409 Conflict\r\nConnection: close\r\n\r\n")
+			conn.Close()
+			return
+		}
+		server.httpTunnels[cookie] = tunnel
+		server.httpTunnelsLock.Unlock()
+		defer func() {
+			server.httpTunnelsLock.Lock()
+			delete(server.httpTunnels, cookie)
+			server.httpTunnelsLock.Unlock()
+		}()
+		conn.SetReadDeadline(time.Time{})
+		if _, err = fmt.Fprintf(conn, "HTTP/1.0 200 OK\r\nServer: EasyDarwin\r\nConnection: close\r\nCache-Control: no-store\r\nPragma: no-cache\r\nContent-Type: %s\r\n\r\n", RTSP_HTTP_TUNNEL_CONTENT_TYPE); err != nil {
+			conn.Close()
+			return
+		}
+		if !tunnel.waitPost(RTSP_HTTP_TUNNEL_POST_TIMEOUT) {
+			logger.Printf("rtsp http tunnel[%s] wait post timeout", cookie)
+			tunnel.Close()
+			return
+		}
+		logger.Printf("rtsp http tunnel[%s] established from %v", cookie, conn.RemoteAddr())
+		session := NewSession(server, tunnel)
+		session.Start()
+	case http.MethodPost:
+		server.httpTunnelsLock.Lock()
+		tunnel := server.httpTunnels[cookie]
+		server.httpTunnelsLock.Unlock()
+		//POST连接不需要响应
+		if tunnel == nil || !tunnel.addPost(&rtspHTTPTunnelPost{conn, reader}) {
+			conn.Close()
+		}
+	default:
+		fmt.Fprintf(conn, "HTTP/1.0 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		conn.Close()
+	}
+}
+
+//http端口上的rtsp over http隧道，代理环境下rtsp端口不可达时使用
+type RTSPHTTPTunnelGinHandler struct {
+}
+
+//GET需Accept、POST需Content-Type为application/x-rtsp-tunnelled，且带x-sessioncookie
+func isRTSPHTTPTunnelRequest(req *http.Request) bool {
+	if req.Header.Get("x-sessioncookie") == "" {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return strings.Contains(req.Header.Get("Accept"), RTSP_HTTP_TUNNEL_CONTENT_TYPE)
+	case http.MethodPost:
+		return strings.HasPrefix(req.Header.Get("Content-Type"), RTSP_HTTP_TUNNEL_CONTENT_TYPE)
+	}
+	return false
+}
+
+//作为中间件注册在静态文件之前，非隧道请求交给后续处理
+func (handler RTSPHTTPTunnelGinHandler) ProcessTunnel(c *gin.Context) {
+	server := GetServer()
+	if !server.httpTunnelEnable || !isRTSPHTTPTunnelRequest(c.Request) {
+		c.Next()
+		return
+	}
+	c.Abort()
+	conn, rw, err := c.Writer.Hijack()
+	if err != nil {
+		server.logger.Printf("rtsp http tunnel hijack error, %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	//取消http server设置的超时，POST的body由隧道继续读取
+	conn.SetDeadline(time.Time{})
+	server.serveHTTPTunnel(conn, rw.Reader, c.Request)
+}
@@ -0,0 +1,119 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//GET下行、POST上行base64编码的OPTIONS及DESCRIBE，响应从GET连接返回
+func testRTSPHTTPTunnel(t *testing.T, addr string, path string) {
+	cookie := "tunnel" + path[strings.LastIndex(path, "/")+1:]
+	get, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer get.Close()
+	get.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(get, "GET %s HTTP/1.0\r\nx-sessioncookie: %s\r\nAccept: application/x-rtsp-tunnelled\r\n\r\n", path, cookie)
+	reader := bufio.NewReader(get)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != RTSP_HTTP_TUNNEL_CONTENT_TYPE {
+		t.Fatalf("get response = %d %v", response.StatusCode, response.Header)
+	}
+	post, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer post.Close()
+	fmt.Fprintf(post, "POST %s HTTP/1.0\r\nx-sessioncookie: %s\r\nContent-Type: application/x-rtsp-tunnelled\r\nContent-Length: 32767\r\n\r\n", path, cookie)
+	url := "rtsp://" + addr + path
+	//每个请求单独编码，并拆成多次发送
+	options := base64.StdEncoding.EncodeToString([]byte("OPTIONS " + url + " RTSP/1.0\r\nCSeq: 1\r\n\r\n"))
+	post.Write([]byte(options[:5]))
+	time.Sleep(10 * time.Millisecond)
+	post.Write([]byte(options[5:]))
+	status, header, _ := readTestRTSPResponse(t, reader)
+	if status != "RTSP/1.0 200 OK" || header["cseq"] != "1" || !strings.Contains(header["public"], "DESCRIBE") {
+		t.Fatalf("options response = %s %v", status, header)
+	}
+	post.Write([]byte(base64.StdEncoding.EncodeToString([]byte("DESCRIBE " + url + " RTSP/1.0\r\nCSeq: 2\r\nAccept: application/sdp\r\n\r\n"))))
+	status, header, body := readTestRTSPResponse(t, reader)
+	if status != "RTSP/1.0 200 OK" || header["cseq"] != "2" || !strings.Contains(body, "H264/90000") {
+		t.Fatalf("describe response = %s %v %s", status, header, body)
+	}
+}
+
+func TestRTSPHTTPTunnel(t *testing.T) {
+	server := startTestServer(t)
+	if !server.AddPusher(newTestPusher(t, server, "/live/tunnel")) {
+		t.Fatal("add pusher failed")
+	}
+	testRTSPHTTPTunnel(t, server.testAddr(), "/live/tunnel")
+}
+
+func TestRTSPHTTPTunnelOnHTTPPort(t *testing.T) {
+	server := startTestServer(t)
+	if !server.AddPusher(newTestPusher(t, server, "/live/httptunnel")) {
+		t.Fatal("add pusher failed")
+	}
+	router := gin.New()
+	router.Use(RTSPHTTPTunnelGinHandler{}.ProcessTunnel)
+	router.GET("/live/*path", func(c *gin.Context) {
+		c.String(http.StatusOK, "static")
+	})
+	httpServer := httptest.NewServer(router)
+	defer httpServer.Close()
+	addr := strings.TrimPrefix(httpServer.URL, "http://")
+	testRTSPHTTPTunnel(t, addr, "/live/httptunnel")
+	//普通http请求交给后续路由
+	response, err := http.Get(httpServer.URL + "/live/httptunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if data, _ := ioutil.ReadAll(response.Body); string(data) != "static" {
+		t.Fatalf("body = %s", data)
+	}
+}
+
+func TestRTSPHTTPTunnelDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []string
+		want string
+	}{
+		{"whole", []string{base64.StdEncoding.EncodeToString([]byte("OPTIONS"))}, "OPTIONS"},
+		{"split quantum", []string{"T1BU", "SU9O", "Uw", "=="}, "OPTIONS"},
+		{"padding between requests", []string{base64.StdEncoding.EncodeToString([]byte("a")), base64.StdEncoding.EncodeToString([]byte("bc"))}, "abc"},
+		{"line breaks", []string{"T1BU\r\nSU9O\r\nUw==\r\n"}, "OPTIONS"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tunnel := newRTSPHTTPTunnel("test", nil)
+			for _, data := range test.data {
+				if err := tunnel.decode([]byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(tunnel.pending) != test.want {
+				t.Fatalf("pending = %q", tunnel.pending)
+			}
+		})
+	}
+	if err := newRTSPHTTPTunnel("test", nil).decode([]byte("=abc")); err == nil {
+		t.Fatal("expected decode error")
+	}
+}
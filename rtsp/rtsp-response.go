@@ -33,6 +33,13 @@ func NewResponse(statusCode int, status, cSeq, sid, body string) *Response {
 func (r *Response) String() string {
 	str := fmt.Sprintf("%s %d %s\r\n", r.Version, r.StatusCode, r.Status)
 	for key, value := range r.Header {
+		//同名的多个头，如多个WWW-Authenticate
+		if values, ok := value.([]string); ok {
+			for _, v := range values {
+				str += fmt.Sprintf("%s: %s\r\n", key, v)
+			}
+			continue
+		}
 		str += fmt.Sprintf("%s: %s\r\n", key, value)
 	}
 	str += "\r\n"
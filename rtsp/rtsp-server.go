@@ -6,13 +6,14 @@ import (
 	"log"
 	"net"
 	"os"
-	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
 	"github.com/bruce-qin/EasyGoLib/utils"
 )
 
@@ -20,6 +21,17 @@ type Server struct {
 	SessionLogger
 	TCPListener                   *net.TCPListener
 	TCPPort                       int
+	TLSListener                   *net.TCPListener
+	EnableRTSPS                   bool
+	RTSPSPort                     int
+	rtspsCertFile                 string
+	rtspsKeyFile                  string
+	rtspsInsecureSkipVerify       bool
+	rtspsClientCAFile             string
+	httpTunnelEnable              bool
+	httpTunnels                   map[string]*rtspHTTPTunnel // x-sessioncookie <-> tunnel
+	httpTunnelsLock               sync.Mutex
+	srtpEnable                    bool
 	Stoped                        bool
 	pushers                       map[string]*Pusher // Path <-> Pusher
 	pushersLock                   sync.RWMutex
@@ -29,24 +41,55 @@ type Server struct {
 	rtpMaxUdpPort                 uint16
 	networkBuffer                 int
 	localRecord                   byte
+	saveStreamToLocal             bool
+	recordDirReady                bool //录像目录可用时才能录像
 	ffmpeg                        string
 	m3u8DirPath                   string
-	tsDurationSecond              int
+	recordSegmentDuration         time.Duration
+	recordPrerollDuration         time.Duration
+	recordPostrollDuration        time.Duration
+	recordThumbnailInterval       time.Duration
+	recordRetention               []RecordRetentionPolicy
+	recordHighWaterPercent        float64
+	recordJanitorInterval         time.Duration
+	recordJanitor                 *RecordJanitor
+	snapshotDecoder               SnapshotDecoder
+	snapshotCacheDuration         time.Duration
+	snapshots                     sync.Map // Path <-> *snapshotItem
 	gopCacheEnable                bool
+	nackBufferSize                int
 	debugLogEnable                bool
 	playerQueueLimit              int
 	dropPacketWhenPaused          bool
 	rtspTimeoutMillisecond        int
+	pullReconnectEnable           bool
+	pullReconnectMinDelay         time.Duration
+	pullReconnectMaxDelay         time.Duration
+	pullReconnectMaxTimes         int
+	pullOnDemandLinger            time.Duration
+	streamSupervisor              *StreamSupervisor
 	streamNotExistHoldMillisecond time.Duration
 	localAuthorizationEnable      bool
 	remoteHttpAuthorizationEnable bool
 	remoteHttpAuthorizationUrl    string
 	authorizationType             AuthorizationType
+	digestNonces                  *digestNonceStore
 	EnableAudioHttpStream         bool
 	HttpAudioStreamPort           uint16
 	EnableVideoHttpStream         bool
 	HttpVideoStreamPort           uint16
 	NginxRtmpHlsMapDir            string
+	hlsEnable                     bool
+	hlsSegmentDuration            time.Duration
+	hlsSegmentCount               int
+	llHlsEnable                   bool
+	llHlsPartDuration             time.Duration
+	EnableRTMP                    bool
+	RTMPPort                      int
+	EnableWebRTC                  bool
+	WebRTCPort                    int
+	webrtcCandidateIP             string
+	webrtcServer                  *WebRTCServer
 	closeOld                      bool
 	svcDiscoverMultiAddr          string
 	svcDiscoverMultiPort          uint16
@@ -99,7 +142,7 @@ var Instance *Server = func() (server *Server) {
 	localRecord := rtspFile.Key("save_stream_to_local").MustUint(0)
 	ffmpeg := rtspFile.Key("ffmpeg_path").MustString("ffmpeg")
 	m3u8_dir_path := rtspFile.Key("m3u8_dir_path").MustString("")
-	ts_duration_second := rtspFile.Key("ts_duration_second").MustInt(6)
+	recordSegmentSecond := rtspFile.Key("record_segment_second").MustInt(300)
 	infName := rtspFile.Key("multicast_svc_bind_inf").MustString("")
 	var multicastBindInf *net.Interface = nil
 	if infName != "" {
@@ -191,6 +234,15 @@ var Instance *Server = func() (server *Server) {
 		SessionLogger:                 logger,
 		Stoped:                        true,
 		TCPPort:                       rtspFile.Key("port").MustInt(554),
+		EnableRTSPS:                   rtspFile.Key("enable_rtsps").MustBool(false),
+		RTSPSPort:                     rtspFile.Key("rtsps_port").MustInt(322),
+		rtspsCertFile:                 rtspFile.Key("rtsps_cert_file").MustString(""),
+		rtspsKeyFile:                  rtspFile.Key("rtsps_key_file").MustString(""),
+		rtspsInsecureSkipVerify:       rtspFile.Key("rtsps_insecure_skip_verify").MustBool(false),
+		rtspsClientCAFile:             rtspFile.Key("rtsps_client_ca_file").MustString(""),
+		httpTunnelEnable:              rtspFile.Key("enable_rtsp_http_tunnel").MustBool(true),
+		httpTunnels:                   make(map[string]*rtspHTTPTunnel),
+		srtpEnable:                    rtspFile.Key("enable_srtp").MustBool(false),
 		pushers:                       make(map[string]*Pusher),
 		addPusherCh:                   make(chan *Pusher),
 		removePusherCh:                make(chan *Pusher),
@@ -200,17 +252,32 @@ var Instance *Server = func() (server *Server) {
 		localRecord:                   byte(localRecord),
 		ffmpeg:                        ffmpeg,
 		m3u8DirPath:                   m3u8_dir_path,
-		tsDurationSecond:              ts_duration_second,
+		recordSegmentDuration:         time.Duration(recordSegmentSecond) * time.Second,
+		recordPrerollDuration:         time.Duration(rtspFile.Key("record_preroll_second").MustInt(0)) * time.Second,
+		recordPostrollDuration:        time.Duration(rtspFile.Key("record_postroll_second").MustInt(30)) * time.Second,
+		recordThumbnailInterval:       time.Duration(rtspFile.Key("record_thumbnail_second").MustInt(0)) * time.Second,
+		recordRetention:               loadRecordRetentionPolicies(logger),
+		recordHighWaterPercent:        rtspFile.Key("record_disk_high_water_percent").MustFloat64(0),
+		recordJanitorInterval:         time.Duration(rtspFile.Key("record_janitor_interval_second").MustInt(60)) * time.Second,
+		snapshotDecoder:               &FFmpegSnapshotDecoder{FFmpeg: ffmpeg},
+		snapshotCacheDuration:         time.Duration(rtspFile.Key("snapshot_cache_second").MustInt(5)) * time.Second,
 		gopCacheEnable:                rtspFile.Key("gop_cache_enable").MustBool(true),
+		nackBufferSize:                rtspFile.Key("nack_buffer_size").MustInt(1024),
 		debugLogEnable:                rtspFile.Key("debug_log_enable").MustBool(false),
 		playerQueueLimit:              rtspFile.Key("player_queue_limit").MustInt(0),
 		dropPacketWhenPaused:          rtspFile.Key("drop_packet_when_paused").MustBool(false),
 		rtspTimeoutMillisecond:        rtspFile.Key("timeout").MustInt(0),
+		pullReconnectEnable:           rtspFile.Key("pull_reconnect_enable").MustBool(true),
+		pullReconnectMinDelay:         time.Duration(rtspFile.Key("pull_reconnect_min_millisecond").MustInt(1000)) * time.Millisecond,
+		pullReconnectMaxDelay:         time.Duration(rtspFile.Key("pull_reconnect_max_millisecond").MustInt(30000)) * time.Millisecond,
+		pullReconnectMaxTimes:         rtspFile.Key("pull_reconnect_max_times").MustInt(0),
+		pullOnDemandLinger:            time.Duration(rtspFile.Key("pull_on_demand_linger_second").MustInt(30)) * time.Second,
 		streamNotExistHoldMillisecond: time.Duration(rtspFile.Key("stream_notexist_wait_second").MustInt(10)) * time.Second,
 		localAuthorizationEnable:      rtspFile.Key("local_authorization_enable").MustBool(false),
 		remoteHttpAuthorizationEnable: rtspFile.Key("remote_http_authorization_enable").MustBool(false),
 		remoteHttpAuthorizationUrl:    rtspFile.Key("remote_http_authorization_url").Value(),
 		authorizationType:             AuthorizationType(rtspFile.Key("authorization_type").Value()),
+		digestNonces:                  newDigestNonceStore(time.Duration(rtspFile.Key("digest_nonce_expire_second").MustInt(300)) * time.Second),
 		closeOld:                      rtspFile.Key("close_old").MustBool(false),
 		svcDiscoverMultiAddr:          rtspFile.Key("svc_discover_multiaddr").MustString("239.12.12.12"),
 		svcDiscoverMultiPort:          uint16(rtspFile.Key("svc_discover_multiport").MustUint(1212)),
@@ -222,6 +289,16 @@ var Instance *Server = func() (server *Server) {
 		EnableVideoHttpStream:         rtspFile.Key("enable_http_video_stream").MustBool(false),
 		HttpVideoStreamPort:           uint16(rtspFile.Key("http_video_stream_port").MustUint(8099)),
 		NginxRtmpHlsMapDir:            rtspFile.Key("nginx_rtmp_hls_dir_map").MustString("record"),
+		hlsEnable:                     rtspFile.Key("hls_enable").MustBool(false),
+		hlsSegmentDuration:            time.Duration(rtspFile.Key("hls_segment_second").MustInt(2)) * time.Second,
+		hlsSegmentCount:               rtspFile.Key("hls_segment_count").MustInt(6),
+		llHlsEnable:                   rtspFile.Key("ll_hls_enable").MustBool(false),
+		llHlsPartDuration:             time.Duration(rtspFile.Key("ll_hls_part_millisecond").MustInt(500)) * time.Millisecond,
+		EnableRTMP:                    rtspFile.Key("enable_rtmp").MustBool(false),
+		RTMPPort:                      rtspFile.Key("rtmp_port").MustInt(1935),
+		EnableWebRTC:                  rtspFile.Key("enable_webrtc").MustBool(false),
+		WebRTCPort:                    rtspFile.Key("webrtc_udp_port").MustInt(8189),
+		webrtcCandidateIP:             rtspFile.Key("webrtc_candidate_ip").MustString(""),
 		allPushCmd:                    allCmds,
 		pushCmdDirMap:                 pushCmdMap,
 		otherPushCmd:                  otherCmds,
@@ -231,6 +308,7 @@ var Instance *Server = func() (server *Server) {
 		onPublish:                     onPublish,
 		onTeardown:                    onTeardown,
 	}
+	server.streamSupervisor = NewStreamSupervisor(server)
 	if !server.localAuthorizationEnable && server.remoteHttpAuthorizationEnable && server.remoteHttpAuthorizationUrl == "" {
 		logger.logger.Panicf("server configed remoteHttpAuthorizationEnable, but not set remoteHttpAuthorizationUrl")
 	}
@@ -269,59 +347,40 @@ func (server *Server) Start() (err error) {
 		return
 	}
 
-	localRecord := server.localRecord             //utils.Conf().Section("rtsp").Key("save_stream_to_local").MustInt(0)
-	ffmpeg := server.ffmpeg                       //utils.Conf().Section("rtsp").Key("ffmpeg_path").MustString("")
-	m3u8_dir_path := server.m3u8DirPath           //utils.Conf().Section("rtsp").Key("m3u8_dir_path").MustString("")
-	ts_duration_second := server.tsDurationSecond //utils.Conf().Section("rtsp").Key("ts_duration_second").MustInt(6)
-	SaveStreamToLocal := false
-	if (len(ffmpeg) > 0) && localRecord > 0 && len(m3u8_dir_path) > 0 {
-		err = utils.EnsureDir(m3u8_dir_path)
+	//进程内录像，不再依赖ffmpeg
+	server.recordDirReady = false
+	server.saveStreamToLocal = false
+	if len(server.m3u8DirPath) > 0 {
+		err = utils.EnsureDir(server.m3u8DirPath)
 		if err != nil {
-			logger.Printf("Create m3u8_dir_path[%s] err:%v.", m3u8_dir_path, err)
+			logger.Printf("Create m3u8_dir_path[%s] err:%v.", server.m3u8DirPath, err)
 		} else {
-			SaveStreamToLocal = true
+			server.recordDirReady = true
+			server.saveStreamToLocal = server.localRecord > 0
+			if server.saveStreamToLocal {
+				logger.Printf("Prepare to save stream to local[%s]....", server.m3u8DirPath)
+			}
 		}
 	}
-	go func() { // save to local.
-		pusher2ffmpegMap := make(map[*Pusher]*CmdRepeatBag)
+	if len(server.m3u8DirPath) > 0 && (len(server.recordRetention) > 0 || server.recordHighWaterPercent > 0) {
+		server.recordJanitor = NewRecordJanitor(server)
+		server.recordJanitor.Start()
+	}
+	go func() {
 		pusher2CmdMap := make(map[*Pusher]*hashset.Set)
 		regx, _ := regexp.Compile("[ ]+")
-		if SaveStreamToLocal {
-			logger.Printf("Prepare to save stream to local....")
-			defer logger.Printf("End save stream to local....")
-		}
 		var pusher *Pusher
 		addChnOk := true
 		removeChnOk := true
 		for addChnOk || removeChnOk {
 			select {
 			case pusher, addChnOk = <-server.addPusherCh:
-				if SaveStreamToLocal {
-					if addChnOk {
-						dir := path.Join(m3u8_dir_path, pusher.Path(), time.Now().Format("20060102"))
-						err := utils.EnsureDir(dir)
-						if err != nil {
-							logger.Printf("EnsureDir:[%s] err:%v.", dir, err)
-							continue
-						}
-						m3u8path := path.Join(dir, fmt.Sprintf("out.m3u8"))
-						port := pusher.Server().TCPPort
-						rtsp := fmt.Sprintf("rtsp://localhost:%d%s", port, pusher.Path())
-						paramStr := utils.Conf().Section("rtsp").Key(pusher.Path()).MustString("-c:v copy -c:a aac")
-						params := []string{"-fflags", "genpts", "-rtsp_transport", "tcp", "-i", rtsp, "-hls_time", strconv.Itoa(ts_duration_second), "-hls_list_size", "0", m3u8path}
-						if paramStr != "default" {
-							paramsOfThisPath := strings.Split(paramStr, " ")
-							params = append(params[:6], append(paramsOfThisPath, params[6:]...)...)
-						}
-						bag := NewCmdRepeatBag(ffmpeg, params, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.Session.ID)
-						pusher2ffmpegMap[pusher] = bag
-						bag.Run(func() {
-							delete(pusher2ffmpegMap, pusher)
-						})
-						logger.Printf("add ffmpeg [%v] to pull stream from pusher[%v]", bag.Cmd, pusher)
-					} else {
-						logger.Printf("addPusherChan closed")
-					}
+				if !addChnOk {
+					logger.Printf("addPusherChan closed")
+					continue
+				}
+				if server.RecordEnabled(pusher.Path()) {
+					pusher.StartRecord()
 				}
 				if pusher.MulticastClient == nil {
 					cmdSet := hashset.New()
@@ -342,7 +401,7 @@ func (server *Server) Start() (err error) {
 								parameters = append(parameters, parameter)
 							}
 						}
-						bag := NewCmdRepeatBag(server.ffmpeg, parameters, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.Session.ID)
+						bag := NewCmdRepeatBag(server.ffmpeg, parameters, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.ID())
 						cmdSet.Add(bag)
 						bag.Run(func() {
 							cmdSet.Remove(bag)
@@ -360,7 +419,7 @@ func (server *Server) Start() (err error) {
 									parameters = append(parameters, parameter)
 								}
 							}
-							bag := NewCmdRepeatBag(server.ffmpeg, parameters, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.Session.ID)
+							bag := NewCmdRepeatBag(server.ffmpeg, parameters, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.ID())
 							cmdSet.Add(bag)
 							bag.Run(func() {
 								cmdSet.Remove(bag)
@@ -378,7 +437,7 @@ func (server *Server) Start() (err error) {
 									parameters = append(parameters, parameter)
 								}
 							}
-							bag := NewCmdRepeatBag(server.ffmpeg, parameters, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.Session.ID)
+							bag := NewCmdRepeatBag(server.ffmpeg, parameters, server.cmdErrorRepeatTime, server.logger, pusher.Path(), pusher.ID())
 							cmdSet.Add(bag)
 							bag.Run(func() {
 								cmdSet.Remove(bag)
@@ -391,22 +450,11 @@ func (server *Server) Start() (err error) {
 					}
 				}
 			case pusher, removeChnOk = <-server.removePusherCh:
-				if SaveStreamToLocal {
-					if removeChnOk {
-						if bag := pusher2ffmpegMap[pusher]; bag != nil {
-							bag.PushOver4Kill()
-							delete(pusher2ffmpegMap, pusher)
-							logger.Printf("delete ffmpeg from pull stream from pusher[%v]", pusher)
-						}
-					} else {
-						for _, bag := range pusher2ffmpegMap {
-							bag.PusherTerminated = true
-							err2 := bag.Cmd.Process.Kill()
-							logger.Printf("kill  process error:%v", err2)
-						}
-						pusher2ffmpegMap = make(map[*Pusher]*CmdRepeatBag)
-						logger.Printf("removePusherChan closed")
-					}
+				if !removeChnOk {
+					logger.Printf("removePusherChan closed")
+				}
+				if pusher != nil {
+					pusher.StopRecord()
 				}
 				if pusher != nil && pusher.MulticastClient == nil {
 					if bags := pusher2CmdMap[pusher]; bags != nil {
@@ -424,6 +472,11 @@ func (server *Server) Start() (err error) {
 	server.Stoped = false
 	server.TCPListener = listener
 	logger.Println("rtsp server start on", server.TCPPort)
+	if server.EnableRTSPS {
+		if err = server.startRTSPS(); err != nil {
+			logger.Printf("rtsps server start error, %v", err)
+		}
+	}
 	networkBuffer := server.networkBuffer
 	for !server.Stoped {
 		var (
@@ -441,8 +494,7 @@ func (server *Server) Start() (err error) {
 				logger.Printf("rtsp server conn set write buffer error, %v", err)
 			}
 		}
-		session := NewSession(server, conn)
-		go session.Start()
+		go server.handleConn(conn)
 	}
 	return
 }
@@ -451,10 +503,18 @@ func (server *Server) Stop() {
 	logger := server.logger
 	logger.Println("rtsp server stop on", server.TCPPort)
 	server.Stoped = true
+	if server.recordJanitor != nil {
+		server.recordJanitor.Stop()
+		server.recordJanitor = nil
+	}
 	if server.TCPListener != nil {
 		server.TCPListener.Close()
 		server.TCPListener = nil
 	}
+	if server.TLSListener != nil {
+		server.TLSListener.Close()
+		server.TLSListener = nil
+	}
 	server.pushersLock.Lock()
 	server.pushers = make(map[string]*Pusher)
 	server.pushersLock.Unlock()
@@ -465,15 +525,19 @@ func (server *Server) Stop() {
 
 func (server *Server) AddPusher(pusher *Pusher) bool {
 	logger := server.logger
+	if isPlaybackPath(pusher.Path()) {
+		logger.Printf("%v reject, path prefix[%s] is reserved for record playback", pusher, PLAYBACK_PATH_PREFIX)
+		return false
+	}
 	added := false
 	server.pushersLock.Lock()
 	_, ok := server.pushers[pusher.Path()]
 	if !ok {
+		//先初始化完成再加入推流列表，避免播放端拿到未初始化的pusher
+		server.initPusher(pusher)
 		server.pushers[pusher.Path()] = pusher
 		logger.Printf("%v start, now pusher size[%d]", pusher, len(server.pushers))
 		added = true
-	} else {
-		added = false
 	}
 	server.pushersLock.Unlock()
 	if added {
@@ -495,6 +559,20 @@ func (server *Server) AddPusher(pusher *Pusher) bool {
 	return added
 }
 
+func (server *Server) initPusher(pusher *Pusher) {
+	pusher.timeline = NewRTPTimeline(pusher.SDPRaw())
+	if server.nackBufferSize > 0 {
+		pusher.retransmitBuffer = newRTPRetransmitBuffer(server.nackBufferSize)
+	}
+	if server.EnableVideoHttpStream && server.hlsEnable {
+		pusher.hlsMuxer = NewHLSMuxer(pusher)
+		pusher.AddRTPSink("hls", pusher.hlsMuxer.WriteRTP)
+	}
+	if server.recordDirReady && server.recordPrerollDuration > 0 {
+		pusher.preroll = newRTPPrerollBuffer(server.recordPrerollDuration)
+	}
+}
+
 func (server *Server) TryAttachToPusher(session *Session) (int, *Pusher) {
 	server.pushersLock.Lock()
 	attached := 0
@@ -523,6 +601,11 @@ func (server *Server) RemovePusher(pusher *Pusher) {
 	}
 	server.pushersLock.Unlock()
 	if removed {
+		if pusher.hlsMuxer != nil {
+			pusher.RemoveRTPSink("hls")
+			pusher.hlsMuxer.Close()
+		}
+		server.snapshots.Delete(pusher.Path())
 		server.removePusherCh <- pusher
 	}
 }
@@ -545,6 +628,69 @@ func (server *Server) GetPushers() (pushers map[string]*Pusher) {
 	return
 }
 
+//推流路径是否录像，单路流的录像开关优先于全局save_stream_to_local
+func (server *Server) RecordEnabled(path string) bool {
+	if !server.recordDirReady {
+		return false
+	}
+	var setting models.RecordSetting
+	if db.SQLite.Where("stream_path = ?", path).First(&setting).RecordNotFound() {
+		return server.saveStreamToLocal
+	}
+	return setting.Enabled
+}
+
+//保存单路流的录像开关，流在线时立即开始或停止录像
+func (server *Server) SetRecordEnabled(path string, enabled bool) error {
+	if !server.recordDirReady {
+		return fmt.Errorf("m3u8_dir_path not available")
+	}
+	if err := db.SQLite.Save(&models.RecordSetting{StreamPath: path, Enabled: enabled}).Error; err != nil {
+		return err
+	}
+	if pusher := server.GetPusher(path); pusher != nil {
+		if enabled {
+			pusher.StartRecord()
+		} else {
+			pusher.StopRecord()
+		}
+	}
+	return nil
+}
+
+//事件触发录像，postRoll为0时使用配置的record_postroll_second
+func (server *Server) TriggerRecord(path string, postRoll time.Duration) error {
+	if !server.recordDirReady {
+		return fmt.Errorf("m3u8_dir_path not available")
+	}
+	pusher := server.GetPusher(path)
+	if pusher == nil {
+		return fmt.Errorf("pusher[%s] not found", path)
+	}
+	if postRoll <= 0 {
+		postRoll = server.recordPostrollDuration
+	}
+	if !pusher.TriggerRecord(postRoll) {
+		return fmt.Errorf("pusher[%s] not found", path)
+	}
+	return nil
+}
+
+//录像清理策略及已回收空间，未开启清理时返回nil
+func (server *Server) GetRecordJanitorInfo() *RecordJanitorInfo {
+	janitor := server.recordJanitor
+	if janitor == nil {
+		return nil
+	}
+	info := janitor.Info()
+	return &info
+}
+
+//models.Stream配置的拉流管理
+func (server *Server) StreamSupervisor() *StreamSupervisor {
+	return server.streamSupervisor
+}
+
 func (server *Server) GetPusherSize() (size int) {
 	server.pushersLock.RLock()
 	size = len(server.pushers)
@@ -0,0 +1,214 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/jinzhu/gorm"
+)
+
+//h264视频及pcma音频
+const testPusherSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=test\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=Z2QAH6zZQFAFuhAAAAMAEAAAAwPI8YMZYA==,aOvjyyLA\r\n" +
+	"a=control:streamid=0\r\n" +
+	"m=audio 0 RTP/AVP 8\r\n" +
+	"a=rtpmap:8 PCMA/8000\r\n" +
+	"a=control:streamid=1\r\n"
+
+var testServerOnce sync.Once
+
+//在随机端口启动全局server，所有测试共用，测试进程结束前不停止
+//server使用进程内的内存数据库，单个测试可以再替换为自己的数据库
+func startTestServer(t *testing.T) *Server {
+	server := GetServer()
+	testServerOnce.Do(func() {
+		sqlite, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlite.DB().SetMaxOpenConns(1)
+		sqlite.AutoMigrate(models.User{}, models.Stream{}, models.Record{}, models.RecordSetting{}, models.Thumbnail{})
+		db.SQLite = sqlite
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.TCPPort = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if server.m3u8DirPath, err = ioutil.TempDir("", "easydarwin"); err != nil {
+			t.Fatal(err)
+		}
+		go server.Start()
+		for i := 0; i < 100; i++ {
+			if conn, err := net.Dial("tcp", server.testAddr()); err == nil {
+				conn.Close()
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("rtsp server not started")
+	})
+	return server
+}
+
+func (server *Server) testAddr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(server.TCPPort))
+}
+
+//读取一个rtsp响应，header名称转为小写
+func readTestRTSPResponse(t *testing.T, reader *bufio.Reader) (status string, header map[string]string, body string) {
+	header = make(map[string]string)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = strings.TrimSpace(line)
+	for {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			header[strings.ToLower(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	var length int
+	fmt.Sscanf(header["content-length"], "%d", &length)
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	return status, header, string(buf)
+}
+
+//使用rtmp会话的推流，测试结束时停止
+func newTestPusher(t *testing.T, server *Server, path string) *Pusher {
+	conn, other := net.Pipe()
+	session := NewRTMPSession(server, conn)
+	session.Type = SESSION_TYPE_PUSHER
+	session.Path = path
+	session.URL = "rtmp://127.0.0.1" + path
+	session.SDPRaw = testPusherSDP
+	session.VCodec, session.VControl = "H264", "streamid=0"
+	session.ACodec, session.AControl = "PCMA", "streamid=1"
+	pusher := NewRTMPPusher(session)
+	session.Pusher = pusher
+	t.Cleanup(func() {
+		session.Stop()
+		other.Close()
+	})
+	return pusher
+}
+
+func TestAddPusherInitializedBeforePublish(t *testing.T) {
+	server := startTestServer(t)
+	enableVideoHttpStream, hlsEnable := server.EnableVideoHttpStream, server.hlsEnable
+	server.EnableVideoHttpStream, server.hlsEnable = true, true
+	defer func() {
+		server.EnableVideoHttpStream, server.hlsEnable = enableVideoHttpStream, hlsEnable
+	}()
+	for i := 0; i < 50; i++ {
+		path := "/live/init" + strconv.Itoa(i)
+		//发现pusher时立即检查，之后AddPusher可能已经完成初始化
+		initialized := make(chan bool)
+		go func() {
+			for {
+				if pusher := server.GetPusher(path); pusher != nil {
+					initialized <- pusher.timeline != nil && pusher.retransmitBuffer != nil && pusher.hlsMuxer != nil
+					return
+				}
+			}
+		}()
+		if !server.AddPusher(newTestPusher(t, server, path)) {
+			t.Fatal("add pusher failed")
+		}
+		if !<-initialized {
+			t.Fatalf("pusher %s published before initialized", path)
+		}
+	}
+}
+
+func TestSetRecordEnabled(t *testing.T) {
+	server := startTestServer(t)
+	newTestRecordDB(t)
+	db.SQLite.AutoMigrate(models.RecordSetting{})
+	saveStreamToLocal := server.saveStreamToLocal
+	server.saveStreamToLocal = true
+	defer func() {
+		server.saveStreamToLocal = saveStreamToLocal
+	}()
+	waitRecording := func(pusher *Pusher, recording bool) {
+		for i := 0; i < 100 && pusher.Recording() != recording; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if pusher.Recording() != recording {
+			t.Fatalf("%s recording = %v", pusher.Path(), !recording)
+		}
+	}
+	//没有单路开关时使用全局配置
+	pusher := newTestPusher(t, server, "/live/recordset")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	waitRecording(pusher, true)
+	if err := server.SetRecordEnabled("/live/recordset", false); err != nil {
+		t.Fatal(err)
+	}
+	if pusher.Recording() || server.RecordEnabled("/live/recordset") {
+		t.Fatal("record not stopped")
+	}
+	if err := server.SetRecordEnabled("/live/recordset", true); err != nil {
+		t.Fatal(err)
+	}
+	if !pusher.Recording() {
+		t.Fatal("record not started")
+	}
+	//保存的开关在之后推流时生效
+	server.saveStreamToLocal = false
+	if err := server.SetRecordEnabled("/live/recordnext", true); err != nil {
+		t.Fatal(err)
+	}
+	var setting models.RecordSetting
+	if err := db.SQLite.Where("stream_path = ?", "/live/recordnext").First(&setting).Error; err != nil || !setting.Enabled {
+		t.Fatalf("setting = %+v err = %v", setting, err)
+	}
+	next := newTestPusher(t, server, "/live/recordnext")
+	if !server.AddPusher(next) {
+		t.Fatal("add pusher failed")
+	}
+	waitRecording(next, true)
+	if server.RecordEnabled("/live/recordother") {
+		t.Fatal("record enabled without setting")
+	}
+	//录像目录不可用
+	recordDirReady := server.recordDirReady
+	server.recordDirReady = false
+	defer func() {
+		server.recordDirReady = recordDirReady
+	}()
+	if err := server.SetRecordEnabled("/live/recordset", false); err == nil {
+		t.Fatal("expected error")
+	}
+	if server.RecordEnabled("/live/recordnext") {
+		t.Fatal("record enabled without record dir")
+	}
+}
@@ -3,7 +3,6 @@ package rtsp
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -72,6 +71,8 @@ type TransType int
 const (
 	TRANS_TYPE_TCP TransType = iota
 	TRANS_TYPE_UDP
+	TRANS_TYPE_RTMP
+	TRANS_TYPE_WEBRTC
 )
 
 func (tt TransType) String() string {
@@ -80,6 +81,10 @@ func (tt TransType) String() string {
 		return "TCP"
 	case TRANS_TYPE_UDP:
 		return "UDP"
+	case TRANS_TYPE_RTMP:
+		return "RTMP"
+	case TRANS_TYPE_WEBRTC:
+		return "WebRTC"
 	}
 	return "unknow"
 }
@@ -103,7 +108,6 @@ type Session struct {
 	localAuthorizationEnable      bool
 	remoteHttpAuthorizationEnable bool
 	authorizationType             AuthorizationType
-	nonce                         string
 	closeOld                      bool
 	debugLogEnable                bool
 
@@ -112,6 +116,13 @@ type Session struct {
 	ACodec   string
 	VCodec   string
 
+	//rtsps连接，只有rtsps上才下发srtp密钥
+	secure bool
+	//每个媒体的srtp master key及master salt
+	srtpKeys map[string][]byte
+	//按密钥缓存的srtp上下文
+	srtpContexts map[string]*srtpContext
+
 	// stats info
 	InBytes  int
 	OutBytes int
@@ -132,6 +143,7 @@ type Session struct {
 
 	Pusher      *Pusher
 	Player      *Player
+	playback    *recordPlayback
 	UDPClient   *UDPClient
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
@@ -166,6 +178,7 @@ func NewSession(server *Server, conn net.Conn) *Session {
 		aRTPChannel:                   -1,
 		aRTPControlChannel:            -1,
 		closeOld:                      server.closeOld,
+		secure:                        isTLSConn(conn),
 		rtpPackHandelChan:             make(chan *RTPPack, 10),
 		requestHandelChan:             make(chan *Request, 1),
 	}
@@ -357,6 +370,12 @@ func (session *Session) handleRequest(req *Request) {
 			//开始拉流，开始推流
 			switch session.Type {
 			case SESSEION_TYPE_PLAYER:
+				if session.playback != nil {
+					if res.StatusCode == 200 {
+						session.playback.Start()
+					}
+					break
+				}
 				if session.Pusher.HasPlayer(session.Player) {
 					session.Player.Pause(false)
 				} else {
@@ -380,7 +399,7 @@ func (session *Session) handleRequest(req *Request) {
 	if req.Method != "OPTIONS" {
 		if session.localAuthorizationEnable || session.remoteHttpAuthorizationEnable {
 			authLine := req.Header["Authorization"]
-			authFailed := true
+			authFailed, stale := true, false
 			if authLine != "" {
 				sessionType := session.Type
 				if sessionType == 0 {
@@ -394,33 +413,17 @@ func (session *Session) handleRequest(req *Request) {
 						return
 					}
 				}
-				info, err := DecodeAuthorizationInfo(authLine, session.nonce, req.Method, sessionType)
-				if err != nil {
+				var err error
+				if stale, err = session.Server.CheckAuthorization(authLine, req.Method, req.URL, sessionType); err != nil {
 					logger.Printf("%v", err)
-				} else if session.localAuthorizationEnable {
-					if err = info.CheckAuthLocal(); err != nil {
-						logger.Printf("%v", err)
-					} else {
-						authFailed = false
-					}
-				} else if session.remoteHttpAuthorizationEnable {
-					if err = info.CheckAuthHttpRemote(); err != nil {
-						logger.Printf("%v", err)
-					} else {
-						authFailed = false
-					}
+				} else {
+					authFailed = false
 				}
 			}
 			if authFailed {
 				res.StatusCode = 401
 				res.Status = "Unauthorized"
-				if session.Server.authorizationType == "Basic" {
-					res.Header["WWW-Authenticate"] = `Basic realm="EasyDarwin"`
-				} else {
-					nonce := fmt.Sprintf("%x", md5.Sum([]byte(shortid.MustGenerate())))
-					session.nonce = nonce
-					res.Header["WWW-Authenticate"] = fmt.Sprintf(`Digest realm="EasyDarwin", nonce="%s", algorithm="MD5"`, nonce)
-				}
+				res.Header["WWW-Authenticate"] = session.Server.AuthenticateHeaders(stale)
 				return
 			}
 		}
@@ -439,7 +442,13 @@ func (session *Session) handleRequest(req *Request) {
 			res.Status = "Invalid URL"
 			return
 		}
-		if continueProcess := NewWebHookInfo(ON_PUBLISH, session.ID, SESSION_TYPE_PUSHER, TRANS_TYPE_TCP, req.URL, surl.Path, req.Body, session.Conn.RemoteAddr().String()).ExecuteWebHookNotify(); !continueProcess {
+		keys, err := parseSDPSRTPKeys(req.Body)
+		if err != nil {
+			logger.Printf("parse srtp keys error:%v", err)
+		}
+		session.srtpKeys = keys
+		sdpRaw := plainSDP(req.Body)
+		if continueProcess := NewWebHookInfo(ON_PUBLISH, session.ID, SESSION_TYPE_PUSHER, TRANS_TYPE_TCP, req.URL, surl.Path, sdpRaw, session.Conn.RemoteAddr().String()).ExecuteWebHookNotify(); !continueProcess {
 			res.StatusCode = 500
 			res.Status = "Server not allowed you push stream"
 			return
@@ -447,8 +456,8 @@ func (session *Session) handleRequest(req *Request) {
 
 		session.Path = surl.Path
 
-		session.SDPRaw = req.Body
-		session.SDPMap = ParseSDP(req.Body)
+		session.SDPRaw = sdpRaw
+		session.SDPMap = ParseSDP(sdpRaw)
 		sdp, ok := session.SDPMap["audio"]
 		if ok {
 			session.AControl = sdp.Control
@@ -519,7 +528,15 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		session.Path = url.Path
+		if isPlaybackPath(session.Path) {
+			session.describePlayback(req, res)
+			return
+		}
 		pusher := session.Server.pushers[session.Path]
+		if pusher == nil {
+			//按需拉流的配置立即开始拉流
+			pusher = session.Server.StreamSupervisor().Demand(session.Path)
+		}
 		if pusher == nil {
 			waitExist := false
 			if session.Server.streamNotExistHoldMillisecond != 0 {
@@ -548,7 +565,12 @@ func (session *Session) handleRequest(req *Request) {
 		session.VCodec = pusher.VCodec()
 		session.Conn.timeout = 0
 		session.logger = log.New(os.Stdout, fmt.Sprintf("[player:%s, pusher:%s, path: %s]", session.ID, pusher.ID(), session.Path), log.LstdFlags|log.Lshortfile)
-		res.SetBody(session.Pusher.SDPRaw())
+		sdpRaw := session.Pusher.SDPRaw()
+		if session.Server.srtpEnable && session.secure {
+			session.srtpKeys = map[string][]byte{"audio": newSRTPKey(), "video": newSRTPKey()}
+			sdpRaw = srtpSDP(sdpRaw, session.srtpKeys)
+		}
+		res.SetBody(sdpRaw)
 	case "SETUP":
 		ts := req.Header["Transport"]
 		// control字段可能是`stream=1`字样，也可能是rtsp://...字样。即control可能是url的path，也可能是整个url
@@ -565,19 +587,19 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		if setupUrl.Port() == "" {
-			setupUrl.Host = fmt.Sprintf("%s:554", setupUrl.Host)
+			setupUrl.Host = fmt.Sprintf("%s:%s", setupUrl.Host, defaultRTSPPort(setupUrl.Scheme))
 		}
 		setupPath := setupUrl.String()
 
 		// error status. SETUP without ANNOUNCE or DESCRIBE.
-		if session.Pusher == nil {
+		if session.Pusher == nil && session.playback == nil {
 			res.StatusCode = 500
 			res.Status = "Error Status"
 			return
 		}
 		//setupPath = setupPath[strings.LastIndex(setupPath, "/")+1:]
 		vPath := ""
-		if strings.Index(strings.ToLower(session.VControl), "rtsp://") == 0 {
+		if isAbsoluteRTSPURL(session.VControl) {
 			vControlUrl, err := url.Parse(session.VControl)
 			if err != nil {
 				res.StatusCode = 500
@@ -585,7 +607,7 @@ func (session *Session) handleRequest(req *Request) {
 				return
 			}
 			if vControlUrl.Port() == "" {
-				vControlUrl.Host = fmt.Sprintf("%s:554", vControlUrl.Host)
+				vControlUrl.Host = fmt.Sprintf("%s:%s", vControlUrl.Host, defaultRTSPPort(vControlUrl.Scheme))
 			}
 			vPath = vControlUrl.String()
 		} else {
@@ -593,7 +615,7 @@ func (session *Session) handleRequest(req *Request) {
 		}
 
 		aPath := ""
-		if strings.Index(strings.ToLower(session.AControl), "rtsp://") == 0 {
+		if isAbsoluteRTSPURL(session.AControl) {
 			aControlUrl, err := url.Parse(session.AControl)
 			if err != nil {
 				res.StatusCode = 500
@@ -601,7 +623,7 @@ func (session *Session) handleRequest(req *Request) {
 				return
 			}
 			if aControlUrl.Port() == "" {
-				aControlUrl.Host = fmt.Sprintf("%s:554", aControlUrl.Host)
+				aControlUrl.Host = fmt.Sprintf("%s:%s", aControlUrl.Host, defaultRTSPPort(aControlUrl.Scheme))
 			}
 			aPath = aControlUrl.String()
 		} else {
@@ -612,6 +634,12 @@ func (session *Session) handleRequest(req *Request) {
 		mudp := regexp.MustCompile("client_port=(\\d+)(-(\\d+))?")
 
 		if tcpMatchs := mtcp.FindStringSubmatch(ts); tcpMatchs != nil {
+			//interleaved时rtp已在rtsp连接中，不支持srtp
+			if isSAVPTransport(ts) {
+				res.StatusCode = 461
+				res.Status = "Unsupported Transport"
+				return
+			}
 			session.TransType = TRANS_TYPE_TCP
 			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
 				session.aRTPChannel, _ = strconv.Atoi(tcpMatchs[1])
@@ -630,9 +658,7 @@ func (session *Session) handleRequest(req *Request) {
 			// no need for tcp timeout.
 			session.Conn.timeout = 0
 			if session.Type == SESSEION_TYPE_PLAYER && session.UDPClient == nil {
-				session.UDPClient = &UDPClient{
-					Session: session,
-				}
+				session.UDPClient = NewUDPClient(session)
 			}
 			if session.Type == SESSION_TYPE_PUSHER && session.Pusher.UDPServer == nil {
 				session.Pusher.UDPServer = &UDPServer{
@@ -644,58 +670,62 @@ func (session *Session) handleRequest(req *Request) {
 				if session.Type == SESSEION_TYPE_PLAYER {
 					session.UDPClient.APort, _ = strconv.Atoi(udpMatchs[1])
 					session.UDPClient.AControlPort, _ = strconv.Atoi(udpMatchs[3])
+					if session.UDPClient.aSRTP, err = session.transportSRTPContext(ts, "audio"); err != nil {
+						res.StatusCode = 461
+						res.Status = "Unsupported Transport"
+						return
+					}
 					if err := session.UDPClient.SetupAudio(); err != nil {
 						res.StatusCode = 500
 						res.Status = fmt.Sprintf("udp client setup audio error, %v", err)
 						return
 					}
+					//拉流端向server_port发送RR
+					ts = appendServerPort(ts, udpMatchs[0], udpLocalPort(session.UDPClient.AConn), udpLocalPort(session.UDPClient.AControlConn))
 				}
 				if session.Type == SESSION_TYPE_PUSHER {
+					if session.Pusher.UDPServer.aSRTP, err = session.transportSRTPContext(ts, "audio"); err != nil {
+						res.StatusCode = 461
+						res.Status = "Unsupported Transport"
+						return
+					}
 					if err := session.Pusher.UDPServer.SetupAudio(); err != nil {
 						res.StatusCode = 500
 						res.Status = fmt.Sprintf("udp server setup audio error, %v", err)
 						return
 					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.APort, session.Pusher.UDPServer.AControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+					ts = appendServerPort(ts, udpMatchs[0], session.Pusher.UDPServer.APort, session.Pusher.UDPServer.AControlPort)
 				}
 			} else if setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath) {
 				if session.Type == SESSEION_TYPE_PLAYER {
 					session.UDPClient.VPort, _ = strconv.Atoi(udpMatchs[1])
 					session.UDPClient.VControlPort, _ = strconv.Atoi(udpMatchs[3])
+					if session.UDPClient.vSRTP, err = session.transportSRTPContext(ts, "video"); err != nil {
+						res.StatusCode = 461
+						res.Status = "Unsupported Transport"
+						return
+					}
 					if err := session.UDPClient.SetupVideo(); err != nil {
 						res.StatusCode = 500
 						res.Status = fmt.Sprintf("udp client setup video error, %v", err)
 						return
 					}
+					//拉流端向server_port发送RR
+					ts = appendServerPort(ts, udpMatchs[0], udpLocalPort(session.UDPClient.VConn), udpLocalPort(session.UDPClient.VControlConn))
 				}
 
 				if session.Type == SESSION_TYPE_PUSHER {
+					if session.Pusher.UDPServer.vSRTP, err = session.transportSRTPContext(ts, "video"); err != nil {
+						res.StatusCode = 461
+						res.Status = "Unsupported Transport"
+						return
+					}
 					if err := session.Pusher.UDPServer.SetupVideo(); err != nil {
 						res.StatusCode = 500
 						res.Status = fmt.Sprintf("udp server setup video error, %v", err)
 						return
 					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.VPort, session.Pusher.UDPServer.VControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+					ts = appendServerPort(ts, udpMatchs[0], session.Pusher.UDPServer.VPort, session.Pusher.UDPServer.VControlPort)
 				}
 			} else {
 				logger.Printf("SETUP [UDP] got UnKown control:%s", setupPath)
@@ -705,6 +735,10 @@ func (session *Session) handleRequest(req *Request) {
 	case "PLAY":
 		//开始拉流
 		// error status. PLAY without ANNOUNCE or DESCRIBE.
+		if session.playback != nil {
+			session.playPlayback(req, res)
+			return
+		}
 		if session.Pusher == nil {
 			res.StatusCode = 500
 			res.Status = "Error Status"
@@ -720,6 +754,10 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 	case "PAUSE":
+		if session.playback != nil {
+			session.playback.Pause()
+			return
+		}
 		if session.Player == nil {
 			res.StatusCode = 500
 			res.Status = "Error Status"
@@ -729,6 +767,95 @@ func (session *Session) handleRequest(req *Request) {
 	}
 }
 
+//录像回放，DESCRIBE rtsp://host/playback/{path}?start=..&end=..
+func (session *Session) describePlayback(req *Request, res *Response) {
+	playback, err := newRecordPlayback(session, req.URL)
+	if err != nil {
+		session.logger.Printf("open playback[%s] error:%v", req.URL, err)
+		switch err {
+		case ErrRecordNotFound:
+			res.StatusCode = 404
+			res.Status = "NOT FOUND"
+		case errInvalidRange:
+			res.StatusCode = 400
+			res.Status = "Bad Request"
+		default:
+			res.StatusCode = 500
+			res.Status = fmt.Sprintf("Open Playback Error, %v", err)
+		}
+		return
+	}
+	session.playback = playback
+	session.StopHandles = append(session.StopHandles, playback.Close)
+	session.AControl = playback.AControl
+	session.VControl = playback.VControl
+	session.ACodec = playback.ACodec
+	session.VCodec = playback.VCodec
+	session.Conn.timeout = 0
+	session.logger = log.New(os.Stdout, fmt.Sprintf("[player:%s, playback: %s]", session.ID, session.Path), log.LstdFlags|log.Lshortfile)
+	playback.logger = session.logger
+	sdpRaw := playback.SDPRaw
+	if session.Server.srtpEnable && session.secure {
+		session.srtpKeys = map[string][]byte{"audio": newSRTPKey(), "video": newSRTPKey()}
+		sdpRaw = srtpSDP(sdpRaw, session.srtpKeys)
+	}
+	res.SetBody(sdpRaw)
+}
+
+func (session *Session) playPlayback(req *Request, res *Response) {
+	rangeValue, rtpInfo, scale, err := session.playback.Play(req.Header["Range"], req.Header["Scale"])
+	switch err {
+	case nil:
+	case errInvalidRange:
+		res.StatusCode = 457
+		res.Status = "Invalid Range"
+		return
+	case errInvalidScale:
+		res.StatusCode = 400
+		res.Status = "Bad Request"
+		return
+	default:
+		res.StatusCode = 404
+		res.Status = "NOT FOUND"
+		return
+	}
+	res.Header["Range"] = rangeValue
+	res.Header["Scale"] = scale
+	res.Header["RTP-Info"] = rtpInfo
+}
+
+//拉流端SETUP时是否建立了rtcp通道
+func (session *Session) hasRTCPChannel(rtpType RTPType) bool {
+	if session.TransType == TRANS_TYPE_UDP {
+		if session.UDPClient == nil {
+			return false
+		}
+		if rtpType == RTP_TYPE_AUDIOCONTROL {
+			return session.UDPClient.AControlConn != nil
+		}
+		return session.UDPClient.VControlConn != nil
+	}
+	if rtpType == RTP_TYPE_AUDIOCONTROL {
+		return session.aRTPControlChannel >= 0 && session.aRTPControlChannel != session.aRTPChannel
+	}
+	return session.vRTPControlChannel >= 0 && session.vRTPControlChannel != session.vRTPChannel
+}
+
+//在Transport的client_port之后追加server_port
+func appendServerPort(transport string, clientPort string, rtpPort int, rtcpPort int) string {
+	tss := strings.Split(transport, ";")
+	idx := -1
+	for i, val := range tss {
+		if val == clientPort {
+			idx = i
+		}
+	}
+	tail := append([]string{}, tss[idx+1:]...)
+	tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", rtpPort, rtcpPort))
+	tss = append(tss, tail...)
+	return strings.Join(tss, ";")
+}
+
 func (session *Session) SendRTP(pack *RTPPack) (err error) {
 	if pack == nil {
 		err = fmt.Errorf("player send rtp got nil pack")
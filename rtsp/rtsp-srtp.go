@@ -0,0 +1,299 @@
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	SRTP_CRYPTO_SUITE      = "AES_CM_128_HMAC_SHA1_80"
+	SRTP_MASTER_KEY_LENGTH = 16
+	//master key + master salt
+	SRTP_KEY_MATERIAL_LENGTH = 30
+
+	mikeyPayloadLast    = 0
+	mikeyPayloadKEMAC   = 1
+	mikeyPayloadT       = 5
+	mikeyPayloadSP      = 10
+	mikeyPayloadRAND    = 11
+	mikeyHeaderLength   = 10
+	mikeyCSMapLength    = 9
+	mikeyKeyTypeTGKSalt = 1
+	mikeyKeyTypeTEKSalt = 3
+)
+
+//rfc4568 a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:<base64 key||salt>[|lifetime][|mki:len]
+func parseSDPCrypto(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid crypto attribute:%s", value)
+	}
+	if !strings.EqualFold(fields[1], SRTP_CRYPTO_SUITE) {
+		return nil, fmt.Errorf("unsupported crypto suite:%s", fields[1])
+	}
+	params := strings.TrimPrefix(fields[2], "inline:")
+	if params == fields[2] {
+		return nil, fmt.Errorf("unsupported key method:%s", fields[2])
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.SplitN(params, "|", 2)[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != SRTP_KEY_MATERIAL_LENGTH {
+		return nil, fmt.Errorf("invalid srtp key length %d", len(key))
+	}
+	return key, nil
+}
+
+func sdpCrypto(key []byte) string {
+	return fmt.Sprintf("1 %s inline:%s", SRTP_CRYPTO_SUITE, base64.StdEncoding.EncodeToString(key))
+}
+
+//rfc3830/rfc4567 a=key-mgmt:mikey <base64>，只支持NULL加密的KEMAC(依赖rtsps保护)
+//与live555一致，key data及salt直接作为srtp master key及master salt
+func parseMIKEY(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "mikey") {
+		return nil, fmt.Errorf("unsupported key-mgmt:%s", value)
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < mikeyHeaderLength || data[0] != 1 {
+		return nil, fmt.Errorf("invalid mikey header")
+	}
+	next := data[2]
+	offset := mikeyHeaderLength + int(data[8])*mikeyCSMapLength
+	for next != mikeyPayloadLast {
+		if offset+2 > len(data) {
+			return nil, fmt.Errorf("mikey payload truncated")
+		}
+		payload := next
+		next = data[offset]
+		switch payload {
+		case mikeyPayloadT:
+			offset += 2 + 8
+		case mikeyPayloadRAND:
+			offset += 2 + int(data[offset+1])
+		case mikeyPayloadSP:
+			if offset+5 > len(data) {
+				return nil, fmt.Errorf("mikey payload truncated")
+			}
+			offset += 5 + int(binary.BigEndian.Uint16(data[offset+3:]))
+		case mikeyPayloadKEMAC:
+			if offset+4 > len(data) {
+				return nil, fmt.Errorf("mikey payload truncated")
+			}
+			if data[offset+1] != 0 {
+				return nil, fmt.Errorf("unsupported mikey kemac encryption %d", data[offset+1])
+			}
+			length := int(binary.BigEndian.Uint16(data[offset+2:]))
+			if offset+4+length > len(data) {
+				return nil, fmt.Errorf("mikey payload truncated")
+			}
+			return parseMIKEYKeyData(data[offset+4 : offset+4+length])
+		default:
+			return nil, fmt.Errorf("unsupported mikey payload %d", payload)
+		}
+	}
+	return nil, fmt.Errorf("mikey key data not found")
+}
+
+//key data子载荷：next payload(8) type(4)|kv(4) key len(16) key [salt len(16) salt]
+func parseMIKEYKeyData(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("mikey key data truncated")
+	}
+	keyType := data[1] >> 4
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if 4+length > len(data) {
+		return nil, fmt.Errorf("mikey key data truncated")
+	}
+	key := append([]byte{}, data[4:4+length]...)
+	if keyType == mikeyKeyTypeTGKSalt || keyType == mikeyKeyTypeTEKSalt {
+		offset := 4 + length
+		if offset+2 > len(data) {
+			return nil, fmt.Errorf("mikey salt truncated")
+		}
+		saltLength := int(binary.BigEndian.Uint16(data[offset:]))
+		if offset+2+saltLength > len(data) {
+			return nil, fmt.Errorf("mikey salt truncated")
+		}
+		key = append(key, data[offset+2:offset+2+saltLength]...)
+	}
+	if len(key) != SRTP_KEY_MATERIAL_LENGTH {
+		return nil, fmt.Errorf("invalid srtp key length %d", len(key))
+	}
+	return key, nil
+}
+
+//生成NULL加密的MIKEY消息：HDR, T, RAND, SP, KEMAC
+func newMIKEY(key []byte) string {
+	csb := make([]byte, 4)
+	rand.Read(csb)
+	msg := []byte{1, 0, mikeyPayloadT, 0}
+	msg = append(msg, csb...)
+	//一个srtp crypto session，ssrc及roc为0表示任意
+	msg = append(msg, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	ntp := make([]byte, 8)
+	binary.BigEndian.PutUint64(ntp, toNTPTimestamp(time.Now()))
+	msg = append(msg, mikeyPayloadRAND, 0)
+	msg = append(msg, ntp...)
+	random := make([]byte, 16)
+	rand.Read(random)
+	msg = append(msg, mikeyPayloadSP, byte(len(random)))
+	msg = append(msg, random...)
+	//AES-CM, 16字节加密密钥, HMAC-SHA1, 20字节认证密钥, 14字节salt, srtp/srtcp加密, srtp认证, 10字节认证标签
+	policy := []byte{0, 1, 1, 1, 1, 16, 2, 1, 1, 3, 1, 20, 4, 1, 14, 7, 1, 1, 8, 1, 1, 10, 1, 1, 11, 1, 10}
+	msg = append(msg, mikeyPayloadKEMAC, 0, 0, byte(len(policy)>>8), byte(len(policy)))
+	msg = append(msg, policy...)
+	keyData := []byte{mikeyPayloadLast, mikeyKeyTypeTGKSalt << 4, 0, SRTP_MASTER_KEY_LENGTH}
+	keyData = append(keyData, key[:SRTP_MASTER_KEY_LENGTH]...)
+	keyData = append(keyData, 0, byte(len(key)-SRTP_MASTER_KEY_LENGTH))
+	keyData = append(keyData, key[SRTP_MASTER_KEY_LENGTH:]...)
+	msg = append(msg, mikeyPayloadLast, 0, byte(len(keyData)>>8), byte(len(keyData)))
+	msg = append(msg, keyData...)
+	//MAC算法NULL
+	msg = append(msg, 0)
+	return "mikey " + base64.StdEncoding.EncodeToString(msg)
+}
+
+func toNTPTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+func newSRTPKey() []byte {
+	key := make([]byte, SRTP_KEY_MATERIAL_LENGTH)
+	rand.Read(key)
+	return key
+}
+
+//读取sdp中每个媒体的srtp密钥，媒体级a=crypto优先，其次媒体级及会话级a=key-mgmt
+func parseSDPSRTPKeys(sdpRaw string) (keys map[string][]byte, err error) {
+	keys = make(map[string][]byte)
+	var (
+		media      string
+		sessionKey []byte
+		fromCrypto = make(map[string]bool)
+	)
+	for _, line := range strings.Split(sdpRaw, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			media = strings.SplitN(line[2:], " ", 2)[0]
+			if media != "audio" && media != "video" {
+				media = "-"
+			} else if sessionKey != nil {
+				keys[media] = sessionKey
+			}
+		case strings.HasPrefix(line, "a=crypto:"):
+			if media == "" || media == "-" {
+				continue
+			}
+			key, e := parseSDPCrypto(line[len("a=crypto:"):])
+			if e != nil {
+				err = e
+				continue
+			}
+			keys[media] = key
+			fromCrypto[media] = true
+		case strings.HasPrefix(line, "a=key-mgmt:"):
+			key, e := parseMIKEY(line[len("a=key-mgmt:"):])
+			if e != nil {
+				err = e
+				continue
+			}
+			if media == "" {
+				sessionKey = key
+			} else if media != "-" && !fromCrypto[media] {
+				keys[media] = key
+			}
+		}
+	}
+	if len(keys) > 0 {
+		err = nil
+	}
+	return
+}
+
+//去掉sdp中的密钥，转发给拉流端及webhook时不能泄露推流端密钥
+func plainSDP(sdpRaw string) string {
+	if !strings.Contains(sdpRaw, "a=crypto:") && !strings.Contains(sdpRaw, "a=key-mgmt:") && !strings.Contains(sdpRaw, "RTP/SAVP") {
+		return sdpRaw
+	}
+	lines := strings.Split(strings.TrimRight(sdpRaw, "\r\n"), "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "a=crypto:") || strings.HasPrefix(line, "a=key-mgmt:") {
+			continue
+		}
+		if strings.HasPrefix(line, "m=") {
+			line = strings.Replace(line, " RTP/SAVP", " RTP/AVP", 1)
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+//为拉流端生成带密钥的sdp，密钥属性追加在每个媒体描述末尾
+func srtpSDP(sdpRaw string, keys map[string][]byte) string {
+	lines := strings.Split(strings.TrimRight(plainSDP(sdpRaw), "\r\n"), "\r\n")
+	out := make([]string, 0, len(lines)+4)
+	var key []byte
+	flush := func() {
+		if key != nil {
+			out = append(out, "a=crypto:"+sdpCrypto(key), "a=key-mgmt:"+newMIKEY(key))
+			key = nil
+		}
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			flush()
+			if k, ok := keys[strings.SplitN(line[2:], " ", 2)[0]]; ok {
+				key = k
+				line = strings.Replace(line, " RTP/AVP", " RTP/SAVP", 1)
+			}
+		}
+		out = append(out, line)
+	}
+	flush()
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+//SETUP请求的传输协议是否为RTP/SAVP
+func isSAVPTransport(transport string) bool {
+	return strings.Contains(strings.ToUpper(transport), "RTP/SAVP")
+}
+
+//RTP/SAVP传输时根据sdp中协商的密钥创建srtp上下文，RTP/AVP返回nil
+//相同密钥的媒体及收发两个方向共用一个上下文，roc及重放状态按ssrc区分
+func (session *Session) transportSRTPContext(transport string, media string) (*srtpContext, error) {
+	if !isSAVPTransport(transport) {
+		return nil, nil
+	}
+	key, ok := session.srtpKeys[media]
+	if !ok {
+		session.logger.Printf("SETUP RTP/SAVP without %s srtp key", media)
+		return nil, fmt.Errorf("no srtp key for %s", media)
+	}
+	if ctx, ok := session.srtpContexts[string(key)]; ok {
+		return ctx, nil
+	}
+	ctx, err := newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:])
+	if err != nil {
+		return nil, err
+	}
+	if session.srtpContexts == nil {
+		session.srtpContexts = make(map[string]*srtpContext)
+	}
+	session.srtpContexts[string(key)] = ctx
+	return ctx, nil
+}
@@ -0,0 +1,126 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseSDPCrypto(t *testing.T) {
+	key := newSRTPKey()
+	encoded := base64.StdEncoding.EncodeToString(key)
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"sdes", sdpCrypto(key), false},
+		{"lifetime and mki", "1 AES_CM_128_HMAC_SHA1_80 inline:" + encoded + "|2^20|1:4", false},
+		{"unsupported suite", "1 AES_CM_128_HMAC_SHA1_32 inline:" + encoded, true},
+		{"without inline", "1 AES_CM_128_HMAC_SHA1_80 " + encoded, true},
+		{"short key", "1 AES_CM_128_HMAC_SHA1_80 inline:" + base64.StdEncoding.EncodeToString(key[:16]), true},
+		{"bad base64", "1 AES_CM_128_HMAC_SHA1_80 inline:***", true},
+		{"missing fields", "1 AES_CM_128_HMAC_SHA1_80", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := parseSDPCrypto(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && !bytes.Equal(out, key) {
+				t.Fatalf("key = %x, want %x", out, key)
+			}
+		})
+	}
+}
+
+func TestParseMIKEY(t *testing.T) {
+	key := newSRTPKey()
+	out, err := parseMIKEY(newMIKEY(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, key) {
+		t.Fatalf("key = %x, want %x", out, key)
+	}
+	data, _ := base64.StdEncoding.DecodeString(strings.Fields(newMIKEY(key))[1])
+	encode := func(data []byte) string {
+		return "mikey " + base64.StdEncoding.EncodeToString(data)
+	}
+	kemacEncrypted := append([]byte{}, data...)
+	//HDR(10) + CS map(9) + T(10) + RAND(18) + SP(5+27)
+	kemacEncrypted[10+9+10+18+32+1] = 1
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"not mikey", "foo " + base64.StdEncoding.EncodeToString(data)},
+		{"bad base64", "mikey ***"},
+		{"short header", encode(data[:9])},
+		{"bad version", encode(append([]byte{2}, data[1:]...))},
+		{"truncated", encode(data[:len(data)-20])},
+		{"cs map out of range", encode(append(append([]byte{}, data[:8]...), 0xff, 0))},
+		{"encrypted kemac", encode(kemacEncrypted)},
+		{"unsupported payload", encode(append([]byte{1, 0, 99}, data[3:]...))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseMIKEY(test.value); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParseSDPSRTPKeys(t *testing.T) {
+	videoKey, audioKey, sessionKey := newSRTPKey(), newSRTPKey(), newSRTPKey()
+	sdp := strings.Join([]string{
+		"v=0",
+		"a=key-mgmt:" + newMIKEY(sessionKey),
+		"m=video 0 RTP/SAVP 96",
+		"a=crypto:" + sdpCrypto(videoKey),
+		"a=key-mgmt:" + newMIKEY(audioKey),
+		"m=audio 0 RTP/SAVP 97",
+		"m=application 0 RTP/SAVP 98",
+		"a=crypto:" + sdpCrypto(audioKey),
+	}, "\r\n")
+	keys, err := parseSDPSRTPKeys(sdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys["video"], videoKey) || !bytes.Equal(keys["audio"], sessionKey) || len(keys) != 2 {
+		t.Fatalf("keys = %x", keys)
+	}
+	if plain := plainSDP(sdp); strings.Contains(plain, "a=crypto") || strings.Contains(plain, "key-mgmt") || strings.Contains(plain, "SAVP") {
+		t.Fatalf("plain sdp = %s", plain)
+	}
+}
+
+func FuzzParseMIKEY(f *testing.F) {
+	data, _ := base64.StdEncoding.DecodeString(strings.Fields(newMIKEY(newSRTPKey()))[1])
+	f.Add(data)
+	f.Add(data[:20])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		key, err := parseMIKEY("mikey " + base64.StdEncoding.EncodeToString(data))
+		if err == nil && len(key) != SRTP_KEY_MATERIAL_LENGTH {
+			t.Fatalf("key length %d", len(key))
+		}
+	})
+}
+
+func FuzzParseSDPSRTPKeys(f *testing.F) {
+	key := newSRTPKey()
+	f.Add("m=video 0 RTP/SAVP 96\r\na=crypto:" + sdpCrypto(key) + "\r\na=key-mgmt:" + newMIKEY(key) + "\r\n")
+	f.Add("a=key-mgmt:mikey AQA=\r\nm=audio 0 RTP/SAVP 0\r\n")
+	f.Fuzz(func(t *testing.T, sdp string) {
+		keys, _ := parseSDPSRTPKeys(sdp)
+		for _, key := range keys {
+			if len(key) != SRTP_KEY_MATERIAL_LENGTH {
+				t.Fatalf("key length %d", len(key))
+			}
+		}
+		srtpSDP(sdp, keys)
+	})
+}
@@ -0,0 +1,123 @@
+package rtsp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	RTSP_DEFAULT_PORT  = "554"
+	RTSPS_DEFAULT_PORT = "322"
+)
+
+//rtsps默认端口322
+func defaultRTSPPort(scheme string) string {
+	if strings.ToLower(scheme) == "rtsps" {
+		return RTSPS_DEFAULT_PORT
+	}
+	return RTSP_DEFAULT_PORT
+}
+
+//control字段是否为完整的rtsp/rtsps地址
+func isAbsoluteRTSPURL(control string) bool {
+	control = strings.ToLower(control)
+	return strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://")
+}
+
+//rtsps监听，tls握手后与rtsp相同处理
+func (server *Server) startRTSPS() (err error) {
+	logger := server.logger
+	cert, err := tls.LoadX509KeyPair(server.rtspsCertFile, server.rtspsKeyFile)
+	if err != nil {
+		return fmt.Errorf("load rtsps certificate error, %v", err)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", server.RTSPSPort))
+	if err != nil {
+		return
+	}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	server.TLSListener = listener
+	logger.Println("rtsps server start on", server.RTSPSPort)
+	go func() {
+		networkBuffer := server.networkBuffer
+		for !server.Stoped {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				if server.Stoped {
+					break
+				}
+				logger.Println(err)
+				continue
+			}
+			if err = conn.SetReadBuffer(networkBuffer); err != nil {
+				logger.Printf("rtsps server conn set read buffer error, %v", err)
+			}
+			if err = conn.SetWriteBuffer(networkBuffer); err != nil {
+				logger.Printf("rtsps server conn set write buffer error, %v", err)
+			}
+			go server.handleConn(tls.Server(conn, config))
+		}
+		logger.Println("rtsps server end")
+	}()
+	return
+}
+
+//拉取rtsps摄像头时的tls配置，摄像头多为自签名证书，可配置ca或跳过校验
+func (server *Server) rtspsClientConfig(serverName string) (config *tls.Config, err error) {
+	config = &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: server.rtspsInsecureSkipVerify,
+	}
+	if server.rtspsClientCAFile != "" {
+		pem, err := ioutil.ReadFile(server.rtspsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", server.rtspsClientCAFile)
+		}
+		config.RootCAs = pool
+	}
+	return
+}
+
+//连接是否经过tls，包括rtsps上的http隧道
+func isTLSConn(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return true
+	case *bufferedConn:
+		return isTLSConn(c.Conn)
+	case *rtspHTTPTunnel:
+		return isTLSConn(c.get)
+	}
+	return false
+}
+
+func dialRTSP(scheme string, host string, timeout time.Duration) (conn net.Conn, err error) {
+	if strings.ToLower(scheme) != "rtsps" {
+		return net.DialTimeout("tcp", host, timeout)
+	}
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return
+	}
+	config, err := GetServer().rtspsClientConfig(hostname)
+	if err != nil {
+		return
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", host, config)
+}
@@ -0,0 +1,138 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+//ca及其签发的127.0.0.1证书，写入pem文件
+func newTestCertificateFiles(t *testing.T, dir string, name string) (caFile, certFile, keyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, certFile, keyFile = path.Join(dir, name+"-ca.pem"), path.Join(dir, name+".pem"), path.Join(dir, name+"-key.pem")
+	for file, block := range map[string]*pem.Block{
+		caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err = ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestRTSPS(t *testing.T) {
+	server := startTestServer(t)
+	dir, err := ioutil.TempDir("", "rtsps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile := newTestCertificateFiles(t, dir, "server")
+	otherCAFile, _, _ := newTestCertificateFiles(t, dir, "other")
+	emptyFile := path.Join(dir, "empty.pem")
+	ioutil.WriteFile(emptyFile, []byte("empty"), 0600)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RTSPSPort = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server.rtspsCertFile, server.rtspsKeyFile = certFile, keyFile
+	if err = server.startRTSPS(); err != nil {
+		t.Fatal(err)
+	}
+	clientCAFile, insecureSkipVerify := server.rtspsClientCAFile, server.rtspsInsecureSkipVerify
+	defer func() {
+		server.rtspsClientCAFile, server.rtspsInsecureSkipVerify = clientCAFile, insecureSkipVerify
+	}()
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(server.RTSPSPort))
+	tests := []struct {
+		name               string
+		caFile             string
+		insecureSkipVerify bool
+		wantErr            string
+	}{
+		{"trusted ca", caFile, false, ""},
+		//对端证书不是配置的ca签发
+		{"untrusted ca", otherCAFile, false, "certificate signed by unknown authority"},
+		{"skip verify", otherCAFile, true, ""},
+		{"invalid ca file", emptyFile, false, "no certificate found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.rtspsClientCAFile, server.rtspsInsecureSkipVerify = test.caFile, test.insecureSkipVerify
+			conn, err := dialRTSP("rtsps", addr, 5*time.Second)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if !isTLSConn(conn) {
+				t.Fatal("not tls conn")
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "OPTIONS rtsps://%s/live/test RTSP/1.0\r\nCSeq: 1\r\n\r\n", addr)
+			status, header, _ := readTestRTSPResponse(t, bufio.NewReader(conn))
+			if status != "RTSP/1.0 200 OK" || header["cseq"] != "1" {
+				t.Fatalf("options response = %s %v", status, header)
+			}
+		})
+	}
+}
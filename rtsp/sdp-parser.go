@@ -15,7 +15,11 @@ type SDPInfo struct {
 	Rtpmap             int
 	Config             []byte
 	SpropParameterSets [][]byte
+	SpropVPS           []byte
+	SpropSPS           []byte
+	SpropPPS           []byte
 	PayloadType        int
+	Channels           int
 	SizeLength         int
 	IndexLength        int
 }
@@ -59,13 +63,12 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 						keyval = strings.Split(field, "/")
 						if len(keyval) >= 2 {
 							key := keyval[0]
-							switch key {
-							case "MPEG4-GENERIC":
-								info.Codec = "aac"
-							case "H264":
-								info.Codec = "h264"
-							case "H265":
-								info.Codec = "h265"
+							switch strings.ToUpper(key) {
+							case "MPEG4-GENERIC", "H264", "H265", "PCMA", "PCMU", "OPUS":
+								info.Codec = normalizeCodecName(key)
+								if len(keyval) >= 3 {
+									info.Channels, _ = strconv.Atoi(keyval[2])
+								}
 							}
 							if i, err := strconv.Atoi(keyval[1]); err == nil {
 								info.TimeScale = i
@@ -91,6 +94,12 @@ func ParseSDP(sdpRaw string) map[string]*SDPInfo {
 											val, _ := base64.StdEncoding.DecodeString(field)
 											info.SpropParameterSets = append(info.SpropParameterSets, val)
 										}
+									case "sprop-vps":
+										info.SpropVPS, _ = base64.StdEncoding.DecodeString(val)
+									case "sprop-sps":
+										info.SpropSPS, _ = base64.StdEncoding.DecodeString(val)
+									case "sprop-pps":
+										info.SpropPPS, _ = base64.StdEncoding.DecodeString(val)
 									}
 								}
 							}
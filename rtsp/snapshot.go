@@ -0,0 +1,120 @@
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//ffmpeg解码单帧的超时时间
+	SNAPSHOT_DECODE_TIMEOUT = 10 * time.Second
+)
+
+var (
+	ErrPusherNotFound     = errors.New("pusher not found")
+	ErrKeyFrameNotFound   = errors.New("key frame not found")
+	ErrSnapshotNotSupport = errors.New("snapshot only support h264/h265")
+)
+
+//将带参数集的annexb关键帧解码为jpeg，可通过Server.SetSnapshotDecoder替换
+type SnapshotDecoder interface {
+	DecodeJPEG(codec string, frame []byte) ([]byte, error)
+}
+
+//使用ffmpeg进程解码
+type FFmpegSnapshotDecoder struct {
+	FFmpeg string
+}
+
+func (decoder *FFmpegSnapshotDecoder) DecodeJPEG(codec string, frame []byte) ([]byte, error) {
+	format := "h264"
+	if codec == "h265" {
+		format = "hevc"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SNAPSHOT_DECODE_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, decoder.FFmpeg, "-hide_banner", "-loglevel", "error", "-f", format, "-i", "pipe:0",
+		"-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(frame)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg decode error:%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg decode error:no output %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+type snapshotItem struct {
+	lock   sync.Mutex
+	id     string
+	jpeg   []byte
+	expire time.Time
+}
+
+//gop缓存中最新的关键帧，annexb格式并包含参数集
+func (pusher *Pusher) KeyFrame() (codec string, frame []byte, err error) {
+	codec = strings.ToLower(pusher.VCodec())
+	if codec != "h264" && codec != "h265" {
+		return codec, nil, ErrSnapshotNotSupport
+	}
+	var keyFrame *AVFrame
+	depacketizer := NewRTPDepacketizer(pusher.SDPRaw(), func(frame *AVFrame) {
+		if keyFrame == nil && frame.KeyFrame {
+			keyFrame = frame
+		}
+	})
+	packs := pusher.gopCache[:]
+	for _, pack := range packs {
+		depacketizer.WriteRTP(pack)
+		if keyFrame != nil {
+			break
+		}
+	}
+	if keyFrame == nil {
+		return codec, nil, ErrKeyFrameNotFound
+	}
+	for _, nalu := range keyFrame.NALUs {
+		frame = append(frame, 0, 0, 0, 1)
+		frame = append(frame, nalu...)
+	}
+	return codec, frame, nil
+}
+
+func (server *Server) SetSnapshotDecoder(decoder SnapshotDecoder) {
+	server.snapshotDecoder = decoder
+}
+
+//推流的jpeg截图，缓存snapshot_cache_second秒，同一路流同时只解码一次
+func (server *Server) Snapshot(path string) ([]byte, error) {
+	pusher := server.GetPusher(path)
+	if pusher == nil {
+		return nil, ErrPusherNotFound
+	}
+	value, _ := server.snapshots.LoadOrStore(path, &snapshotItem{})
+	item := value.(*snapshotItem)
+	item.lock.Lock()
+	defer item.lock.Unlock()
+	if item.id == pusher.ID() && time.Now().Before(item.expire) {
+		return item.jpeg, nil
+	}
+	codec, frame, err := pusher.KeyFrame()
+	if err != nil {
+		return nil, err
+	}
+	jpeg, err := server.snapshotDecoder.DecodeJPEG(codec, frame)
+	if err != nil {
+		return nil, err
+	}
+	item.id, item.jpeg, item.expire = pusher.ID(), jpeg, time.Now().Add(server.snapshotCacheDuration)
+	return jpeg, nil
+}
@@ -0,0 +1,97 @@
+package rtsp
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSnapshotDecoder struct {
+	lock   sync.Mutex
+	frames [][]byte
+	err    error
+}
+
+func (decoder *testSnapshotDecoder) DecodeJPEG(codec string, frame []byte) ([]byte, error) {
+	decoder.lock.Lock()
+	defer decoder.lock.Unlock()
+	decoder.frames = append(decoder.frames, frame)
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+	//解码耗时，并发请求应等待同一次解码
+	time.Sleep(10 * time.Millisecond)
+	return []byte(codec + "jpeg"), nil
+}
+
+func (decoder *testSnapshotDecoder) Decodes() int {
+	decoder.lock.Lock()
+	defer decoder.lock.Unlock()
+	return len(decoder.frames)
+}
+
+func TestSnapshot(t *testing.T) {
+	server := startTestServer(t)
+	decoder := &testSnapshotDecoder{}
+	snapshotDecoder, cacheDuration := server.snapshotDecoder, server.snapshotCacheDuration
+	server.SetSnapshotDecoder(decoder)
+	server.snapshotCacheDuration = 100 * time.Millisecond
+	defer func() {
+		server.snapshotDecoder, server.snapshotCacheDuration = snapshotDecoder, cacheDuration
+	}()
+	if _, err := server.Snapshot("/live/none"); err != ErrPusherNotFound {
+		t.Fatalf("err = %v", err)
+	}
+	pusher := newTestPusher(t, server, "/live/snapshot")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	if _, err := server.Snapshot("/live/snapshot"); err != ErrKeyFrameNotFound {
+		t.Fatalf("err = %v", err)
+	}
+	pusher.QueueRTP(newTestH264Pack(1, 0, []byte{0x65, 0x88, 0x80}))
+	pusher.QueueRTP(newTestH264Pack(2, 3600, []byte{0x41, 0x9a}))
+	for i := 0; i < 100 && len(pusher.queue) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if jpeg, err := server.Snapshot("/live/snapshot"); err != nil || string(jpeg) != "h264jpeg" {
+				t.Errorf("jpeg = %s err = %v", jpeg, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if decodes := decoder.Decodes(); decodes != 1 {
+		t.Fatalf("decodes = %d", decodes)
+	}
+	//annexb关键帧，参数集在前
+	frame := decoder.frames[0]
+	if !bytes.HasPrefix(frame, []byte{0, 0, 0, 1, 0x67}) || !bytes.Contains(frame, []byte{0, 0, 0, 1, 0x68}) || !bytes.HasSuffix(frame, []byte{0, 0, 0, 1, 0x65, 0x88, 0x80}) {
+		t.Fatalf("frame = %x", frame)
+	}
+	//缓存过期后重新解码，解码失败不缓存
+	time.Sleep(150 * time.Millisecond)
+	decoder.err = errors.New("decode error")
+	for i := 0; i < 2; i++ {
+		if _, err := server.Snapshot("/live/snapshot"); err != decoder.err {
+			t.Fatalf("err = %v", err)
+		}
+	}
+	if decodes := decoder.Decodes(); decodes != 3 {
+		t.Fatalf("decodes = %d", decodes)
+	}
+}
+
+func TestFFmpegSnapshotDecoderError(t *testing.T) {
+	decoder := &FFmpegSnapshotDecoder{FFmpeg: "/nonexistent/ffmpeg"}
+	if jpeg, err := decoder.DecodeJPEG("h264", []byte{0, 0, 0, 1, 0x65}); err == nil {
+		t.Fatalf("jpeg = %x", jpeg)
+	}
+}
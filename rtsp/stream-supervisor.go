@@ -0,0 +1,514 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/teris-io/shortid"
+)
+
+type StreamState string
+
+const (
+	STREAM_STATE_CONNECTING StreamState = "connecting"
+	STREAM_STATE_LIVE       StreamState = "live"
+	STREAM_STATE_BACKOFF    StreamState = "backoff"
+	STREAM_STATE_FAILED     StreamState = "failed"
+	//按需拉流等待播放请求
+	STREAM_STATE_IDLE StreamState = "idle"
+)
+
+var ErrStreamNotFound = errors.New("stream not found")
+
+//拉流源的当前状态，用于/api/v1/streams
+type StreamInfo struct {
+	ID                string      `json:"id"`
+	URL               string      `json:"url"`
+	CustomPath        string      `json:"customPath"`
+	Username          string      `json:"username"`
+	Path              string      `json:"path"`
+	TransType         string      `json:"transType"`
+	IdleTimeout       int         `json:"idleTimeout"`
+	HeartbeatInterval int         `json:"heartbeatInterval"`
+	OnDemand          bool        `json:"onDemand"`
+	State             StreamState `json:"state"`
+	ReconnectCount    int         `json:"reconnectCount"`
+	LastError         string      `json:"lastError"`
+	Onlines           int         `json:"onlines"`
+}
+
+func parseStreamTransType(transType string) TransType {
+	if strings.ToLower(transType) == "udp" {
+		return TRANS_TYPE_UDP
+	}
+	return TRANS_TYPE_TCP
+}
+
+//管理models.Stream中配置的拉流，每路一个goroutine负责连接、断线退避重试，api增删时立即生效
+type StreamSupervisor struct {
+	server  *Server
+	agent   string
+	lock    sync.RWMutex
+	sources map[string]*streamSource // URL <-> source
+}
+
+func NewStreamSupervisor(server *Server) *StreamSupervisor {
+	return &StreamSupervisor{
+		server:  server,
+		sources: make(map[string]*streamSource),
+	}
+}
+
+//加载数据库中的拉流配置并开始拉流
+func (supervisor *StreamSupervisor) Start(agent string) (err error) {
+	supervisor.agent = agent
+	var streams []models.Stream
+	if err = db.SQLite.Find(&streams).Error; err != nil {
+		return
+	}
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	for _, stream := range streams {
+		if _, ok := supervisor.sources[stream.URL]; ok {
+			continue
+		}
+		source := newStreamSource(supervisor, stream)
+		supervisor.sources[stream.URL] = source
+		go source.run(nil, nil)
+	}
+	return
+}
+
+func (supervisor *StreamSupervisor) Stop() {
+	supervisor.lock.Lock()
+	sources := supervisor.sources
+	supervisor.sources = make(map[string]*streamSource)
+	supervisor.lock.Unlock()
+	for _, source := range sources {
+		source.stopAndWait()
+	}
+}
+
+//新增或修改拉流，正在拉流的旧配置先停止再替换；首次连接成功后才保存配置，失败时返回错误且不保存；按需拉流直接保存
+func (supervisor *StreamSupervisor) Add(stream models.Stream) (info StreamInfo, err error) {
+	if stream.CustomPath != "" && !strings.HasPrefix(stream.CustomPath, "/") {
+		stream.CustomPath = "/" + stream.CustomPath
+	}
+	stream.TransType = parseStreamTransType(stream.TransType).String()
+	source := newStreamSource(supervisor, stream)
+	if isPlaybackPath(source.path()) {
+		return info, fmt.Errorf("path %s is reserved for record playback", source.path())
+	}
+	supervisor.lock.Lock()
+	old := supervisor.sources[stream.URL]
+	delete(supervisor.sources, stream.URL)
+	supervisor.lock.Unlock()
+	//等待旧的拉流退出，释放占用的path
+	if old != nil {
+		old.stopAndWait()
+	}
+	var (
+		pusher *Pusher
+		done   chan struct{}
+	)
+	//按需拉流在播放时才连接
+	if !stream.OnDemand {
+		if pusher, done, err = source.connect(); err != nil {
+			supervisor.restore(old)
+			return
+		}
+	}
+	supervisor.lock.Lock()
+	if _, ok := supervisor.sources[stream.URL]; ok {
+		supervisor.lock.Unlock()
+		if pusher != nil {
+			pusher.Stop()
+		}
+		return info, fmt.Errorf("stream %s already exists", redactURL(stream.URL))
+	}
+	if db.SQLite.Where(&models.Stream{URL: stream.URL}).First(&models.Stream{}).RecordNotFound() {
+		err = db.SQLite.Create(&stream).Error
+	} else {
+		err = db.SQLite.Save(&stream).Error
+	}
+	if err != nil {
+		supervisor.lock.Unlock()
+		if pusher != nil {
+			pusher.Stop()
+		}
+		supervisor.restore(old)
+		return
+	}
+	supervisor.sources[stream.URL] = source
+	supervisor.lock.Unlock()
+	go source.run(pusher, done)
+	return source.Info(), nil
+}
+
+//新配置未生效时按原来的配置重新拉流
+func (supervisor *StreamSupervisor) restore(old *streamSource) {
+	if old == nil {
+		return
+	}
+	supervisor.lock.Lock()
+	defer supervisor.lock.Unlock()
+	if _, ok := supervisor.sources[old.stream.URL]; ok {
+		return
+	}
+	source := newStreamSource(supervisor, old.stream)
+	source.id = old.id
+	supervisor.sources[old.stream.URL] = source
+	go source.run(nil, nil)
+}
+
+//停止拉流并删除配置
+func (supervisor *StreamSupervisor) Remove(id string) (info StreamInfo, err error) {
+	supervisor.lock.Lock()
+	var source *streamSource
+	for url, v := range supervisor.sources {
+		if v.id == id {
+			source = v
+			delete(supervisor.sources, url)
+			break
+		}
+	}
+	supervisor.lock.Unlock()
+	if source == nil {
+		return info, ErrStreamNotFound
+	}
+	info = source.Info()
+	source.stopAndWait()
+	err = db.SQLite.Delete(models.Stream{URL: source.stream.URL}).Error
+	return
+}
+
+//播放请求的path对应按需拉流配置时立即拉流，等待连接完成后返回pusher，否则返回nil
+func (supervisor *StreamSupervisor) Demand(path string) *Pusher {
+	var source *streamSource
+	supervisor.lock.RLock()
+	for _, v := range supervisor.sources {
+		if v.stream.OnDemand && v.path() == path {
+			source = v
+			break
+		}
+	}
+	supervisor.lock.RUnlock()
+	if source == nil {
+		return nil
+	}
+	<-source.demand()
+	return source.currentPusher()
+}
+
+func (supervisor *StreamSupervisor) Streams() (infos []StreamInfo) {
+	supervisor.lock.RLock()
+	defer supervisor.lock.RUnlock()
+	infos = make([]StreamInfo, 0, len(supervisor.sources))
+	for _, source := range supervisor.sources {
+		infos = append(infos, source.Info())
+	}
+	return
+}
+
+type streamSource struct {
+	supervisor *StreamSupervisor
+	id         string
+	stream     models.Stream
+	stopCh     chan struct{}
+	exitCh     chan struct{} //run退出后关闭
+	demandCh   chan struct{}
+
+	lock           sync.RWMutex
+	stopped        bool
+	waiters        []chan struct{} //等待按需拉流连接结果的播放请求
+	state          StreamState
+	pusher         *Pusher
+	reconnectCount int
+	lastError      string
+}
+
+func newStreamSource(supervisor *StreamSupervisor, stream models.Stream) *streamSource {
+	source := &streamSource{
+		supervisor: supervisor,
+		id:         shortid.MustGenerate(),
+		stream:     stream,
+		stopCh:     make(chan struct{}),
+		exitCh:     make(chan struct{}),
+		demandCh:   make(chan struct{}, 1),
+		state:      STREAM_STATE_CONNECTING,
+	}
+	if stream.OnDemand {
+		source.state = STREAM_STATE_IDLE
+	}
+	return source
+}
+
+func (source *streamSource) path() string {
+	if source.stream.CustomPath != "" {
+		return source.stream.CustomPath
+	}
+	if l, err := url.Parse(source.stream.URL); err == nil {
+		return l.Path
+	}
+	return ""
+}
+
+func (source *streamSource) currentPusher() *Pusher {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	return source.pusher
+}
+
+func (source *streamSource) setState(state StreamState, err error) {
+	source.lock.Lock()
+	source.state = state
+	if err != nil {
+		source.lastError = err.Error()
+	}
+	source.lock.Unlock()
+}
+
+func (source *streamSource) Info() StreamInfo {
+	source.lock.RLock()
+	info := StreamInfo{
+		ID:                source.id,
+		URL:               redactURL(source.stream.URL),
+		CustomPath:        source.stream.CustomPath,
+		Username:          source.stream.Username,
+		TransType:         source.stream.TransType,
+		IdleTimeout:       source.stream.IdleTimeout,
+		HeartbeatInterval: source.stream.HeartbeatInterval,
+		OnDemand:          source.stream.OnDemand,
+		State:             source.state,
+		ReconnectCount:    source.reconnectCount,
+		LastError:         source.lastError,
+	}
+	pusher := source.pusher
+	source.lock.RUnlock()
+	if pusher != nil {
+		info.Path = pusher.Path()
+		info.Onlines = pusher.OnlineSize()
+		//拉流断线后由RTSPClient自行重连
+		reconnecting, count, lastError := pusher.ReconnectInfo()
+		if reconnecting {
+			info.State = STREAM_STATE_BACKOFF
+		}
+		info.ReconnectCount += count
+		if lastError != "" {
+			info.LastError = lastError
+		}
+	} else {
+		info.Path = source.path()
+	}
+	return info
+}
+
+//连接源地址并加入推流列表，done在推流结束(重连失败或被移除)时关闭
+func (source *streamSource) connect() (pusher *Pusher, done chan struct{}, err error) {
+	server := source.supervisor.server
+	client, err := NewRTSPClient(server, source.stream.URL, int64(source.stream.HeartbeatInterval)*1000, source.supervisor.agent)
+	if err != nil {
+		return
+	}
+	//重连后pusher仍使用同一ID
+	client.ID = source.id
+	client.logger.SetPrefix(fmt.Sprintf("[%s]", client.ID))
+	client.CustomPath = source.stream.CustomPath
+	client.Username = source.stream.Username
+	client.Password = source.stream.Password
+	client.TransType = parseStreamTransType(source.stream.TransType)
+	pusher = NewClientPusher(client)
+	if server.GetPusher(pusher.Path()) != nil {
+		return nil, nil, fmt.Errorf("path %s already exists", pusher.Path())
+	}
+	done = make(chan struct{})
+	client.StopHandles = append(client.StopHandles, func() {
+		close(done)
+	})
+	if err = client.Start(time.Duration(source.stream.IdleTimeout) * time.Second); err != nil {
+		client.Stop()
+		return nil, nil, err
+	}
+	if !server.AddPusher(pusher) {
+		client.Stop()
+		return nil, nil, fmt.Errorf("path %s already exists", pusher.Path())
+	}
+	source.lock.Lock()
+	source.pusher = pusher
+	source.state = STREAM_STATE_LIVE
+	source.lock.Unlock()
+	return
+}
+
+//pusher为nil时先连接，之后等待推流结束并按退避时间重连，直到stop或连续失败超过重连次数
+func (source *streamSource) run(pusher *Pusher, done chan struct{}) {
+	defer close(source.exitCh)
+	if source.stream.OnDemand {
+		source.runOnDemand()
+		return
+	}
+	server := source.supervisor.server
+	attempt := 0
+	for {
+		if pusher == nil {
+			source.setState(STREAM_STATE_CONNECTING, nil)
+			var err error
+			if pusher, done, err = source.connect(); err != nil {
+				attempt++
+				if server.pullReconnectMaxTimes > 0 && attempt >= server.pullReconnectMaxTimes {
+					log.Printf("pull stream[%s] failed %d times, last error:%v", redactURL(source.stream.URL), attempt, err)
+					source.setState(STREAM_STATE_FAILED, err)
+					return
+				}
+				source.setState(STREAM_STATE_BACKOFF, err)
+				select {
+				case <-source.stopCh:
+					return
+				case <-time.After(server.pullReconnectDelay(attempt)):
+				}
+				source.lock.Lock()
+				source.reconnectCount++
+				source.lock.Unlock()
+				continue
+			}
+		}
+		select {
+		case <-source.stopCh:
+			pusher.Stop()
+			return
+		case <-done:
+		}
+		//RTSPClient重连失败、未开启重连或被移除
+		client := source.pusherEnded(pusher)
+		attempt = client.reconnectAttempt
+		pusher, done = nil, nil
+		if server.pullReconnectMaxTimes > 0 && attempt >= server.pullReconnectMaxTimes {
+			log.Printf("pull stream[%s] failed %d times, last error:%s", redactURL(source.stream.URL), attempt, client.LastError)
+			source.setState(STREAM_STATE_FAILED, nil)
+			return
+		}
+		source.setState(STREAM_STATE_BACKOFF, nil)
+		select {
+		case <-source.stopCh:
+			return
+		case <-time.After(server.pullReconnectDelay(attempt + 1)):
+		}
+		attempt++
+		source.lock.Lock()
+		source.reconnectCount++
+		source.lock.Unlock()
+	}
+}
+
+//按需拉流：空闲时等待播放请求，最后一个播放者离开pull_on_demand_linger_second后停止拉流
+//正在录像时不停止
+func (source *streamSource) runOnDemand() {
+	server := source.supervisor.server
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		source.setState(STREAM_STATE_IDLE, nil)
+		select {
+		case <-source.stopCh:
+			return
+		case <-source.demandCh:
+		}
+		source.setState(STREAM_STATE_CONNECTING, nil)
+		pusher, done, err := source.connect()
+		//连接期间的播放请求已经得到结果
+		select {
+		case <-source.demandCh:
+		default:
+		}
+		source.notifyWaiters()
+		if err != nil {
+			log.Printf("pull stream[%s] on demand err:%v", redactURL(source.stream.URL), err)
+			source.setState(STREAM_STATE_IDLE, err)
+			continue
+		}
+		var idleSince time.Time
+	live:
+		for {
+			select {
+			case <-source.stopCh:
+				pusher.Stop()
+				return
+			case <-done:
+				break live
+			case <-ticker.C:
+				if pusher.OnlineSize() > 0 || pusher.Recording() {
+					idleSince = time.Time{}
+				} else if idleSince.IsZero() {
+					idleSince = time.Now()
+				} else if time.Since(idleSince) >= server.pullOnDemandLinger {
+					log.Printf("pull stream[%s] on demand has no player for %v, stop", redactURL(source.stream.URL), server.pullOnDemandLinger)
+					pusher.Stop()
+					break live
+				}
+			}
+		}
+		source.pusherEnded(pusher)
+	}
+}
+
+//推流结束后累计重连次数及错误
+func (source *streamSource) pusherEnded(pusher *Pusher) (client *RTSPClient) {
+	client = pusher.RTSPClient
+	source.lock.Lock()
+	source.pusher = nil
+	source.reconnectCount += client.ReconnectCount
+	source.lastError = client.LastError
+	source.lock.Unlock()
+	return
+}
+
+//返回的channel在本次按需拉流连接结束(成功或失败)后关闭
+func (source *streamSource) demand() <-chan struct{} {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	wait := make(chan struct{})
+	if source.pusher != nil || source.stopped {
+		close(wait)
+		return wait
+	}
+	source.waiters = append(source.waiters, wait)
+	select {
+	case source.demandCh <- struct{}{}:
+	default:
+	}
+	return wait
+}
+
+func (source *streamSource) notifyWaiters() {
+	source.lock.Lock()
+	for _, wait := range source.waiters {
+		close(wait)
+	}
+	source.waiters = nil
+	source.lock.Unlock()
+}
+
+func (source *streamSource) stop() {
+	source.lock.Lock()
+	if source.stopped {
+		source.lock.Unlock()
+		return
+	}
+	source.stopped = true
+	close(source.stopCh)
+	source.lock.Unlock()
+	source.notifyWaiters()
+}
+
+//停止并等待run退出，此时pusher已从推流列表中移除
+func (source *streamSource) stopAndWait() {
+	source.stop()
+	<-source.exitCh
+}
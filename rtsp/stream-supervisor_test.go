@@ -0,0 +1,165 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+)
+
+//内存数据库，测试结束后恢复
+func newTestStreamDB(t *testing.T) {
+	newTestRecordDB(t)
+	db.SQLite.AutoMigrate(models.Stream{})
+}
+
+func TestStreamSupervisorAdd(t *testing.T) {
+	newTestStreamDB(t)
+	supervisor := NewStreamSupervisor(GetServer())
+	defer supervisor.Stop()
+	url := "rtsp://127.0.0.1:1/live/test"
+	first, err := supervisor.Add(models.Stream{URL: url, CustomPath: "test", OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Path != "/test" || first.State != STREAM_STATE_IDLE {
+		t.Fatalf("info = %+v", first)
+	}
+	old := supervisor.sources[url]
+	//相同地址再次添加时替换原来的拉流
+	second, err := supervisor.Add(models.Stream{URL: url, CustomPath: "/test2", OnDemand: true, TransType: "udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID == first.ID || second.Path != "/test2" {
+		t.Fatalf("info = %+v", second)
+	}
+	select {
+	case <-old.exitCh:
+	default:
+		t.Fatal("old source is still running")
+	}
+	if streams := supervisor.Streams(); len(streams) != 1 || streams[0].ID != second.ID {
+		t.Fatalf("streams = %+v", streams)
+	}
+	var saved []models.Stream
+	if err = db.SQLite.Find(&saved).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].CustomPath != "/test2" || saved[0].TransType != "UDP" {
+		t.Fatalf("saved = %+v", saved)
+	}
+	//新配置连接失败时恢复原来的拉流
+	if _, err = supervisor.Add(models.Stream{URL: url, IdleTimeout: 1}); err == nil {
+		t.Fatal("expected connect error")
+	}
+	if streams := supervisor.Streams(); len(streams) != 1 || streams[0].ID != second.ID || !streams[0].OnDemand {
+		t.Fatalf("streams = %+v", streams)
+	}
+	if _, err = supervisor.Remove(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SQLite.Find(&saved).Error; err != nil || len(saved) != 0 {
+		t.Fatalf("saved = %+v err = %v", saved, err)
+	}
+}
+
+func TestStreamSupervisorAddPlaybackPath(t *testing.T) {
+	newTestStreamDB(t)
+	supervisor := NewStreamSupervisor(GetServer())
+	defer supervisor.Stop()
+	tests := []models.Stream{
+		{URL: "rtsp://127.0.0.1:1/live/test", CustomPath: "/playback/test", OnDemand: true},
+		{URL: "rtsp://127.0.0.1:1/playback/test", OnDemand: true},
+	}
+	for _, stream := range tests {
+		if _, err := supervisor.Add(stream); err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Fatalf("add %+v error = %v", stream, err)
+		}
+	}
+	var count int
+	if db.SQLite.Model(&models.Stream{}).Count(&count); count != 0 || len(supervisor.Streams()) != 0 {
+		t.Fatalf("count = %d streams = %+v", count, supervisor.Streams())
+	}
+}
+
+//按需拉流在DESCRIBE时开始，最后一个播放者离开并超过linger时长后停止
+func TestStreamSupervisorOnDemand(t *testing.T) {
+	server := startTestServer(t)
+	newTestStreamDB(t)
+	hold, linger := server.streamNotExistHoldMillisecond, server.pullOnDemandLinger
+	server.streamNotExistHoldMillisecond, server.pullOnDemandLinger = 0, 500*time.Millisecond
+	defer func() {
+		server.streamNotExistHoldMillisecond, server.pullOnDemandLinger = hold, linger
+	}()
+	source := newTestPusher(t, server, "/live/demandsource")
+	if !server.AddPusher(source) {
+		t.Fatal("add pusher failed")
+	}
+	supervisor := server.StreamSupervisor()
+	info, err := supervisor.Add(models.Stream{URL: "rtsp://" + server.testAddr() + "/live/demandsource", CustomPath: "/live/demand", OnDemand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Remove(info.ID)
+	streamState := func() StreamState {
+		for _, stream := range supervisor.Streams() {
+			if stream.ID == info.ID {
+				return stream.State
+			}
+		}
+		return ""
+	}
+	time.Sleep(50 * time.Millisecond)
+	if streamState() != STREAM_STATE_IDLE || server.GetPusher("/live/demand") != nil || len(source.GetPlayers()) != 0 {
+		t.Fatalf("state = %s before play", streamState())
+	}
+	conn, err := net.Dial("tcp", server.testAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	url := "rtsp://" + server.testAddr() + "/live/demand"
+	fmt.Fprintf(conn, "DESCRIBE %s RTSP/1.0\r\nCSeq: 1\r\nAccept: application/sdp\r\n\r\n", url)
+	if status, _, body := readTestRTSPResponse(t, reader); status != "RTSP/1.0 200 OK" || !strings.Contains(body, "H264/90000") {
+		t.Fatalf("describe response = %s %s", status, body)
+	}
+	if streamState() != STREAM_STATE_LIVE || len(source.GetPlayers()) != 1 {
+		t.Fatalf("state = %s after describe", streamState())
+	}
+	fmt.Fprintf(conn, "SETUP %s/streamid=0 RTSP/1.0\r\nCSeq: 2\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n", url)
+	status, header, _ := readTestRTSPResponse(t, reader)
+	if status != "RTSP/1.0 200 OK" {
+		t.Fatalf("setup response = %s %v", status, header)
+	}
+	fmt.Fprintf(conn, "PLAY %s RTSP/1.0\r\nCSeq: 3\r\nSession: %s\r\n\r\n", url, strings.Split(header["session"], ";")[0])
+	if status, header, _ = readTestRTSPResponse(t, reader); status != "RTSP/1.0 200 OK" {
+		t.Fatalf("play response = %s %v", status, header)
+	}
+	pusher := server.GetPusher("/live/demand")
+	if pusher == nil {
+		t.Fatal("on demand pusher not found")
+	}
+	waitTestPlayers(t, pusher, 1)
+	//有播放者时超过linger时长也不停止
+	time.Sleep(2*time.Second + server.pullOnDemandLinger)
+	if streamState() != STREAM_STATE_LIVE || server.GetPusher("/live/demand") != pusher {
+		t.Fatalf("state = %s while playing", streamState())
+	}
+	conn.Close()
+	waitTestPlayers(t, pusher, 0)
+	for i := 0; i < 400 && streamState() != STREAM_STATE_IDLE; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if streamState() != STREAM_STATE_IDLE || server.GetPusher("/live/demand") != nil {
+		t.Fatalf("state = %s after last player left", streamState())
+	}
+	waitTestPlayers(t, source, 0)
+}
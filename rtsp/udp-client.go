@@ -1,9 +1,12 @@
 package rtsp
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type UDPClient struct {
@@ -17,15 +20,33 @@ type UDPClient struct {
 	VConn        *net.UDPConn
 	VControlPort int
 	VControlConn *net.UDPConn
+	//RTP/SAVP时用于加密，拉流端发来的srtcp也用同一上下文解密
+	aSRTP *srtpContext
+	vSRTP *srtpContext
 
-	Stoped bool
+	//拉流端发来的rtcp字节数，在udp读取协程中更新
+	RTCPInBytes int64
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func NewUDPClient(session *Session) *UDPClient {
+	return &UDPClient{
+		Session: session,
+		stopCh:  make(chan struct{}),
+	}
 }
 
 func (s *UDPClient) Stop() {
-	if s.Stoped {
+	stoped := true
+	s.stopOnce.Do(func() {
+		stoped = false
+		close(s.stopCh)
+	})
+	if stoped {
 		return
 	}
-	s.Stoped = true
 	if s.AConn != nil {
 		s.AConn.Close()
 		s.AConn = nil
@@ -87,6 +108,7 @@ func (c *UDPClient) SetupAudio() (err error) {
 	if err = c.AControlConn.SetWriteBuffer(networkBuffer); err != nil {
 		logger.Printf("udp client audio control conn set write buffer error, %v", err)
 	}
+	go c.readRTCP(c.AControlConn, RTP_TYPE_AUDIOCONTROL, c.aSRTP)
 	return
 }
 
@@ -132,24 +154,71 @@ func (c *UDPClient) SetupVideo() (err error) {
 	if err = c.VControlConn.SetWriteBuffer(networkBuffer); err != nil {
 		logger.Printf("udp client video control conn set write buffer error, %v", err)
 	}
+	go c.readRTCP(c.VControlConn, RTP_TYPE_VIDEOCONTROL, c.vSRTP)
 	return
 }
 
+//接收拉流端发往server_port的rtcp，与tcp方式收到的rtcp一样交给会话的rtp处理协程
+func (c *UDPClient) readRTCP(conn *net.UDPConn, rtpType RTPType, srtp *srtpContext) {
+	buf := make([]byte, UDP_BUF_SIZE)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.stopCh:
+				return
+			default:
+				//rtcp端口不可达时会收到icmp错误，忽略
+				continue
+			}
+		}
+		data := make([]byte, n)
+		copy(data, buf)
+		if srtp != nil {
+			if data, err = srtp.UnprotectRTCP(data); err != nil {
+				continue
+			}
+		}
+		atomic.AddInt64(&c.RTCPInBytes, int64(n))
+		pack := &RTPPack{
+			Type:   rtpType,
+			Buffer: bytes.NewBuffer(data),
+		}
+		select {
+		case c.Session.rtpPackHandelChan <- pack:
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func udpLocalPort(conn *net.UDPConn) int {
+	if conn == nil {
+		return 0
+	}
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
 func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
 	if pack == nil {
 		err = fmt.Errorf("udp client send rtp got nil pack")
 		return
 	}
-	var conn *net.UDPConn
+	var (
+		conn *net.UDPConn
+		srtp *srtpContext
+	)
 	switch pack.Type {
-	case RTP_TYPE_AUDIO:
-		conn = c.AConn
-	case RTP_TYPE_AUDIOCONTROL:
-		conn = c.AControlConn
-	case RTP_TYPE_VIDEO:
-		conn = c.VConn
-	case RTP_TYPE_VIDEOCONTROL:
-		conn = c.VControlConn
+	case RTP_TYPE_AUDIO, RTP_TYPE_AUDIOCONTROL:
+		conn, srtp = c.AConn, c.aSRTP
+		if pack.Type == RTP_TYPE_AUDIOCONTROL {
+			conn = c.AControlConn
+		}
+	case RTP_TYPE_VIDEO, RTP_TYPE_VIDEOCONTROL:
+		conn, srtp = c.VConn, c.vSRTP
+		if pack.Type == RTP_TYPE_VIDEOCONTROL {
+			conn = c.VControlConn
+		}
 	default:
 		err = fmt.Errorf("udp client send rtp got unkown pack type[%v]", pack.Type)
 		return
@@ -158,8 +227,20 @@ func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
 		err = fmt.Errorf("udp client send rtp pack type[%v] failed, conn not found", pack.Type)
 		return
 	}
+	data := pack.Buffer.Bytes()
+	if srtp != nil {
+		if pack.Type == RTP_TYPE_AUDIOCONTROL || pack.Type == RTP_TYPE_VIDEOCONTROL {
+			data, err = srtp.ProtectRTCP(data)
+		} else {
+			data, err = srtp.ProtectRTP(data)
+		}
+		if err != nil {
+			err = fmt.Errorf("udp client protect rtp error, %v", err)
+			return
+		}
+	}
 	var n int
-	if n, err = conn.Write(pack.Buffer.Bytes()); err != nil {
+	if n, err = conn.Write(data); err != nil {
 		err = fmt.Errorf("udp client write bytes error, %v", err)
 		return
 	}
@@ -0,0 +1,143 @@
+package rtsp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestUDPClient(t *testing.T) (client *UDPClient, conn *net.UDPConn, remote *net.UDPConn) {
+	local, other := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		other.Close()
+	})
+	client = NewUDPClient(NewSession(GetServer(), local))
+	var err error
+	if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	client.AControlConn = conn
+	if remote, err = net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Stop()
+		remote.Close()
+	})
+	return
+}
+
+func TestUDPClientReadRTCP(t *testing.T) {
+	client, conn, remote := newTestUDPClient(t)
+	key := newSRTPKey()
+	ctx, err := newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	player, err := newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		client.readRTCP(conn, RTP_TYPE_AUDIOCONTROL, ctx)
+		close(done)
+	}()
+	rr := []byte{0x80, RTCP_TYPE_RR, 0, 1, 0, 0, 0x56, 0x78}
+	protected, err := player.ProtectRTCP(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//服务端自己发出的sr被反射回来
+	reflected, err := ctx.ProtectRTCP(newSenderReport(0x1234, &rtcpSenderInfo{NTPTime: 1 << 32}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{reflected, protected, protected, []byte("garbage")} {
+		if _, err = remote.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//rtcp交给会话的rtp处理协程，只有一个有效包
+	select {
+	case pack := <-client.Session.rtpPackHandelChan:
+		if pack.Type != RTP_TYPE_AUDIOCONTROL || !bytes.Equal(pack.Buffer.Bytes(), rr) {
+			t.Fatalf("pack = %v %x", pack.Type, pack.Buffer.Bytes())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rtcp not received")
+	}
+	select {
+	case pack := <-client.Session.rtpPackHandelChan:
+		t.Fatalf("unexpected pack %x", pack.Buffer.Bytes())
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := atomic.LoadInt64(&client.RTCPInBytes); n != int64(len(protected)) {
+		t.Fatalf("rtcp in bytes = %d", n)
+	}
+	client.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("read rtcp not stopped")
+	}
+}
+
+//会话rtp处理协程已退出时，读取协程不能阻塞在发送上
+func TestUDPClientStopWhileHandlerBlocked(t *testing.T) {
+	client, conn, remote := newTestUDPClient(t)
+	done := make(chan struct{})
+	go func() {
+		client.readRTCP(conn, RTP_TYPE_VIDEOCONTROL, nil)
+		close(done)
+	}()
+	rr := []byte{0x80, RTCP_TYPE_RR, 0, 1, 0, 0, 0x56, 0x78}
+	for i := 0; i < cap(client.Session.rtpPackHandelChan)+5; i++ {
+		remote.Write(rr)
+	}
+	for atomic.LoadInt64(&client.RTCPInBytes) <= int64(cap(client.Session.rtpPackHandelChan)*len(rr)) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Stop()
+	client.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("read rtcp not stopped")
+	}
+}
+
+func TestTransportSRTPContextByKey(t *testing.T) {
+	shared, other := newSRTPKey(), newSRTPKey()
+	tests := []struct {
+		name   string
+		keys   map[string][]byte
+		shared bool
+	}{
+		{"session key", map[string][]byte{"audio": shared, "video": shared}, true},
+		{"media keys", map[string][]byte{"audio": shared, "video": other}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := NewSession(GetServer(), &net.TCPConn{})
+			session.srtpKeys = test.keys
+			audio, err := session.transportSRTPContext("RTP/SAVP;unicast", "audio")
+			if err != nil {
+				t.Fatal(err)
+			}
+			video, err := session.transportSRTPContext("RTP/SAVP;unicast", "video")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := session.transportSRTPContext("RTP/SAVP;unicast", "audio"); again != audio {
+				t.Fatal("audio context not reused")
+			}
+			if (audio == video) != test.shared {
+				t.Fatalf("shared = %v", audio == video)
+			}
+		})
+	}
+}
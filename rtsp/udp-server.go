@@ -23,6 +23,9 @@ type UDPServer struct {
 	VConn        *net.UDPConn
 	VControlPort int
 	VControlConn *net.UDPConn
+	//RTP/SAVP时用于解密
+	aSRTP *srtpContext
+	vSRTP *srtpContext
 
 	Stoped bool
 }
@@ -56,6 +59,26 @@ func (s *UDPServer) HandleRTP(pack *RTPPack) {
 	panic(fmt.Errorf("session and RTSPClient both nil"))
 }
 
+//RTP/SAVP时解密，校验失败返回nil
+func (s *UDPServer) unprotect(ctx *srtpContext, data []byte, rtcp bool) []byte {
+	if ctx == nil {
+		return data
+	}
+	var (
+		out []byte
+		err error
+	)
+	if rtcp {
+		out, err = ctx.UnprotectRTCP(data)
+	} else {
+		out, err = ctx.UnprotectRTP(data)
+	}
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
 func (s *UDPServer) Logger() *log.Logger {
 	if s.Session != nil {
 		return s.Session.logger
@@ -132,6 +155,9 @@ func (s *UDPServer) SetupAudio() (err error) {
 				rtpBytes := make([]byte, n)
 				s.AddInputBytes(n)
 				copy(rtpBytes, bufUDP)
+				if rtpBytes = s.unprotect(s.aSRTP, rtpBytes, false); rtpBytes == nil {
+					continue
+				}
 				pack := &RTPPack{
 					Type:   RTP_TYPE_AUDIO,
 					Buffer: bytes.NewBuffer(rtpBytes),
@@ -177,6 +203,9 @@ func (s *UDPServer) SetupAudio() (err error) {
 				rtpBytes := make([]byte, n)
 				s.AddInputBytes(n)
 				copy(rtpBytes, bufUDP)
+				if rtpBytes = s.unprotect(s.aSRTP, rtpBytes, true); rtpBytes == nil {
+					continue
+				}
 				pack := &RTPPack{
 					Type:   RTP_TYPE_AUDIOCONTROL,
 					Buffer: bytes.NewBuffer(rtpBytes),
@@ -234,6 +263,9 @@ func (s *UDPServer) SetupVideo() (err error) {
 				rtpBytes := make([]byte, n)
 				s.AddInputBytes(n)
 				copy(rtpBytes, bufUDP)
+				if rtpBytes = s.unprotect(s.vSRTP, rtpBytes, false); rtpBytes == nil {
+					continue
+				}
 				pack := &RTPPack{
 					Type:   RTP_TYPE_VIDEO,
 					Buffer: bytes.NewBuffer(rtpBytes),
@@ -280,6 +312,9 @@ func (s *UDPServer) SetupVideo() (err error) {
 				rtpBytes := make([]byte, n)
 				s.AddInputBytes(n)
 				copy(rtpBytes, bufUDP)
+				if rtpBytes = s.unprotect(s.vSRTP, rtpBytes, true); rtpBytes == nil {
+					continue
+				}
 				pack := &RTPPack{
 					Type:   RTP_TYPE_VIDEOCONTROL,
 					Buffer: bytes.NewBuffer(rtpBytes),
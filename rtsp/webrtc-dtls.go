@@ -0,0 +1,809 @@
+package rtsp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	DTLS_CONTENT_CHANGE_CIPHER_SPEC = 20
+	DTLS_CONTENT_ALERT              = 21
+	DTLS_CONTENT_HANDSHAKE          = 22
+	DTLS_CONTENT_APPLICATION_DATA   = 23
+
+	DTLS_HANDSHAKE_CLIENT_HELLO        = 1
+	DTLS_HANDSHAKE_SERVER_HELLO        = 2
+	DTLS_HANDSHAKE_CERTIFICATE         = 11
+	DTLS_HANDSHAKE_SERVER_KEY_EXCHANGE = 12
+	DTLS_HANDSHAKE_CERTIFICATE_REQUEST = 13
+	DTLS_HANDSHAKE_SERVER_HELLO_DONE   = 14
+	DTLS_HANDSHAKE_CERTIFICATE_VERIFY  = 15
+	DTLS_HANDSHAKE_CLIENT_KEY_EXCHANGE = 16
+	DTLS_HANDSHAKE_FINISHED            = 20
+
+	DTLS_RECORD_HEADER_LENGTH    = 13
+	DTLS_HANDSHAKE_HEADER_LENGTH = 12
+
+	//TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	DTLS_CIPHER_SUITE = 0xc02b
+	//SRTP_AES128_CM_HMAC_SHA1_80
+	DTLS_SRTP_PROFILE = 0x0001
+
+	DTLS_EXT_SUPPORTED_GROUPS         = 10
+	DTLS_EXT_EC_POINT_FORMATS         = 11
+	DTLS_EXT_USE_SRTP                 = 14
+	DTLS_EXT_EXTENDED_MASTER_SECRET   = 23
+	DTLS_EXT_RENEGOTIATION_INFO       = 0xff01
+	DTLS_ALERT_CLOSE_NOTIFY           = 0
+	DTLS_ALERT_HANDSHAKE_FAILURE      = 40
+	DTLS_ALERT_BAD_CERTIFICATE        = 42
+	DTLS_ALERT_LEVEL_FATAL            = 2
+	DTLS_SRTP_KEYING_MATERIAL_LENGTH  = 2 * (16 + 14)
+	DTLS_HANDSHAKE_RETRANSMIT_TIMEOUT = time.Second
+)
+
+var dtlsVersion = []byte{0xfe, 0xfd}
+
+//自签名证书，sdp中通过a=fingerprint告知对端
+type dtlsCertificate struct {
+	der         []byte
+	key         *ecdsa.PrivateKey
+	Fingerprint string
+}
+
+func newDTLSCertificate() (cert *dtlsCertificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "EasyDarwin"},
+		NotBefore:    time.Now().Add(-24 * time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(der)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02X", b)
+	}
+	return &dtlsCertificate{der: der, key: key, Fingerprint: strings.Join(hexes, ":")}, nil
+}
+
+//对端sdp中的a=fingerprint，用于校验对端dtls证书
+type dtlsFingerprint struct {
+	Algorithm string
+	Value     []byte
+}
+
+//解析a=fingerprint的值，如: sha-256 AB:CD:...
+func parseDTLSFingerprint(value string) (fingerprint *dtlsFingerprint, err error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid fingerprint:%s", value)
+	}
+	fingerprint = &dtlsFingerprint{Algorithm: strings.ToLower(fields[0])}
+	if fingerprint.hash() == 0 {
+		return nil, fmt.Errorf("unsupported fingerprint algorithm:%s", fields[0])
+	}
+	if fingerprint.Value, err = hex.DecodeString(strings.ReplaceAll(fields[1], ":", "")); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint:%s", value)
+	}
+	if len(fingerprint.Value) != fingerprint.hash().Size() {
+		return nil, fmt.Errorf("invalid fingerprint length:%s", value)
+	}
+	return
+}
+
+func (fingerprint *dtlsFingerprint) hash() crypto.Hash {
+	switch fingerprint.Algorithm {
+	case "sha-1":
+		return crypto.SHA1
+	case "sha-224":
+		return crypto.SHA224
+	case "sha-256":
+		return crypto.SHA256
+	case "sha-384":
+		return crypto.SHA384
+	case "sha-512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+//证书的摘要是否与fingerprint一致
+func (fingerprint *dtlsFingerprint) Match(der []byte) bool {
+	var sum []byte
+	switch fingerprint.hash() {
+	case crypto.SHA1:
+		v := sha1.Sum(der)
+		sum = v[:]
+	case crypto.SHA224:
+		v := sha256.Sum224(der)
+		sum = v[:]
+	case crypto.SHA256:
+		v := sha256.Sum256(der)
+		sum = v[:]
+	case crypto.SHA384:
+		v := sha512.Sum384(der)
+		sum = v[:]
+	case crypto.SHA512:
+		v := sha512.Sum512(der)
+		sum = v[:]
+	default:
+		return false
+	}
+	return hmac.Equal(sum, fingerprint.Value)
+}
+
+type dtlsRecord struct {
+	ContentType byte
+	Epoch       uint16
+	Sequence    uint64
+	Payload     []byte
+}
+
+type dtlsHandshakeMessage struct {
+	Type     byte
+	Sequence uint16
+	Body     []byte
+}
+
+//握手消息分片重组
+type dtlsFragmentBuffer struct {
+	msgType  byte
+	body     []byte
+	received []bool
+	left     int
+}
+
+//dtls 1.2 服务端，仅支持webrtc需要的ECDHE-ECDSA-AES128-GCM-SHA256及use_srtp扩展
+//数据由调用方从共享的udp端口分发到in通道，握手完成后导出srtp密钥
+//要求对端提供证书，并与sdp中的a=fingerprint比对(rfc5763)，srtp密钥因此与信令中的对端绑定
+type dtlsConn struct {
+	cert              *dtlsCertificate
+	in                chan []byte
+	send              func([]byte) error
+	timeout           time.Duration
+	RemoteFingerprint *dtlsFingerprint
+	remoteCert        *x509.Certificate
+
+	clientRandom         []byte
+	serverRandom         []byte
+	masterSecret         []byte
+	extendedMasterSecret bool
+	ecdhKey              []byte
+	transcript           bytes.Buffer
+
+	writeEpoch    uint16
+	writeSequence uint64
+	msgSequence   uint16
+	readEpoch     uint16
+	nextReceive   uint16
+	fragments     map[uint16]*dtlsFragmentBuffer
+
+	clientAEAD cipher.AEAD
+	serverAEAD cipher.AEAD
+	clientIV   []byte
+	serverIV   []byte
+
+	//最近一次发送的flight，用于重传
+	lastFlight         []byte
+	HandshakeDone      bool
+	receivedHello      bool
+	receivedCert       bool
+	receivedKeyExc     bool
+	receivedCertVerify bool
+}
+
+func newDTLSConn(cert *dtlsCertificate, in chan []byte, send func([]byte) error, timeout time.Duration) *dtlsConn {
+	return &dtlsConn{
+		cert:      cert,
+		in:        in,
+		send:      send,
+		timeout:   timeout,
+		fragments: make(map[uint16]*dtlsFragmentBuffer),
+	}
+}
+
+func isDTLSPacket(data []byte) bool {
+	return len(data) >= DTLS_RECORD_HEADER_LENGTH && data[0] >= 20 && data[0] <= 63
+}
+
+func parseDTLSRecords(data []byte) (records []*dtlsRecord, err error) {
+	for len(data) > 0 {
+		if len(data) < DTLS_RECORD_HEADER_LENGTH {
+			return records, fmt.Errorf("dtls record header too short")
+		}
+		length := int(binary.BigEndian.Uint16(data[11:]))
+		if DTLS_RECORD_HEADER_LENGTH+length > len(data) {
+			return records, fmt.Errorf("dtls record length %d out of range", length)
+		}
+		sequence := uint64(binary.BigEndian.Uint16(data[5:]))<<32 | uint64(binary.BigEndian.Uint32(data[7:]))
+		records = append(records, &dtlsRecord{
+			ContentType: data[0],
+			Epoch:       binary.BigEndian.Uint16(data[3:]),
+			Sequence:    sequence,
+			Payload:     data[DTLS_RECORD_HEADER_LENGTH : DTLS_RECORD_HEADER_LENGTH+length],
+		})
+		data = data[DTLS_RECORD_HEADER_LENGTH+length:]
+	}
+	return
+}
+
+//tls1.2 PRF，基于HMAC-SHA256
+func dtlsPRF(secret []byte, label string, seed []byte, length int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	result := make([]byte, 0, length+sha256.Size)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		result = mac.Sum(result)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return result[:length]
+}
+
+func dtlsRecordNonce(epoch uint16, sequence uint64) []byte {
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, sequence)
+	binary.BigEndian.PutUint16(nonce, epoch)
+	return nonce
+}
+
+func dtlsAdditionalData(epoch uint16, sequence uint64, contentType byte, length int) []byte {
+	ad := make([]byte, 13)
+	copy(ad, dtlsRecordNonce(epoch, sequence))
+	ad[8] = contentType
+	copy(ad[9:], dtlsVersion)
+	binary.BigEndian.PutUint16(ad[11:], uint16(length))
+	return ad
+}
+
+func (conn *dtlsConn) encodeRecord(contentType byte, payload []byte) []byte {
+	epoch, sequence := conn.writeEpoch, conn.writeSequence
+	conn.writeSequence++
+	if epoch > 0 {
+		explicitNonce := dtlsRecordNonce(epoch, sequence)
+		nonce := append(append([]byte{}, conn.serverIV...), explicitNonce...)
+		payload = conn.serverAEAD.Seal(explicitNonce, nonce, payload, dtlsAdditionalData(epoch, sequence, contentType, len(payload)))
+	}
+	record := make([]byte, DTLS_RECORD_HEADER_LENGTH, DTLS_RECORD_HEADER_LENGTH+len(payload))
+	record[0] = contentType
+	copy(record[1:], dtlsVersion)
+	copy(record[3:], dtlsRecordNonce(epoch, sequence))
+	binary.BigEndian.PutUint16(record[11:], uint16(len(payload)))
+	return append(record, payload...)
+}
+
+func (conn *dtlsConn) decryptRecord(record *dtlsRecord) ([]byte, error) {
+	if record.Epoch == 0 {
+		return record.Payload, nil
+	}
+	if conn.clientAEAD == nil {
+		return nil, fmt.Errorf("dtls epoch %d record before change cipher spec", record.Epoch)
+	}
+	if len(record.Payload) < 8+conn.clientAEAD.Overhead() {
+		return nil, fmt.Errorf("dtls encrypted record too short")
+	}
+	nonce := append(append([]byte{}, conn.clientIV...), record.Payload[:8]...)
+	ciphertext := record.Payload[8:]
+	ad := dtlsAdditionalData(record.Epoch, record.Sequence, record.ContentType, len(ciphertext)-conn.clientAEAD.Overhead())
+	return conn.clientAEAD.Open(nil, nonce, ciphertext, ad)
+}
+
+//握手消息，同时计入transcript
+func (conn *dtlsConn) encodeHandshake(msgType byte, body []byte) []byte {
+	msg := make([]byte, DTLS_HANDSHAKE_HEADER_LENGTH, DTLS_HANDSHAKE_HEADER_LENGTH+len(body))
+	msg[0] = msgType
+	putUint24(msg[1:], len(body))
+	binary.BigEndian.PutUint16(msg[4:], conn.msgSequence)
+	putUint24(msg[9:], len(body))
+	conn.msgSequence++
+	msg = append(msg, body...)
+	conn.transcript.Write(msg)
+	return conn.encodeRecord(DTLS_CONTENT_HANDSHAKE, msg)
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func (conn *dtlsConn) sendAlert(level byte, description byte) {
+	_ = conn.send(conn.encodeRecord(DTLS_CONTENT_ALERT, []byte{level, description}))
+}
+
+func (conn *dtlsConn) sendFlight(flight []byte) error {
+	conn.lastFlight = flight
+	return conn.send(flight)
+}
+
+//取出完整的握手消息，按message_seq顺序返回
+func (conn *dtlsConn) reassemble(payload []byte) (messages []*dtlsHandshakeMessage, retransmit bool, err error) {
+	for len(payload) > 0 {
+		if len(payload) < DTLS_HANDSHAKE_HEADER_LENGTH {
+			return nil, false, fmt.Errorf("dtls handshake header too short")
+		}
+		msgType := payload[0]
+		length := uint24(payload[1:])
+		sequence := binary.BigEndian.Uint16(payload[4:])
+		fragmentOffset := uint24(payload[6:])
+		fragmentLength := uint24(payload[9:])
+		if DTLS_HANDSHAKE_HEADER_LENGTH+fragmentLength > len(payload) || fragmentOffset+fragmentLength > length {
+			return nil, false, fmt.Errorf("dtls handshake fragment out of range")
+		}
+		fragment := payload[DTLS_HANDSHAKE_HEADER_LENGTH : DTLS_HANDSHAKE_HEADER_LENGTH+fragmentLength]
+		payload = payload[DTLS_HANDSHAKE_HEADER_LENGTH+fragmentLength:]
+		if sequence < conn.nextReceive {
+			//对端重传，说明我们上一个flight丢失
+			retransmit = true
+			continue
+		}
+		buffer, ok := conn.fragments[sequence]
+		if !ok {
+			buffer = &dtlsFragmentBuffer{msgType: msgType, body: make([]byte, length), received: make([]bool, length), left: length}
+			conn.fragments[sequence] = buffer
+		}
+		if len(buffer.body) != length {
+			return nil, false, fmt.Errorf("dtls handshake fragment length mismatch")
+		}
+		copy(buffer.body[fragmentOffset:], fragment)
+		for i := fragmentOffset; i < fragmentOffset+fragmentLength; i++ {
+			if !buffer.received[i] {
+				buffer.received[i] = true
+				buffer.left--
+			}
+		}
+	}
+	for {
+		buffer, ok := conn.fragments[conn.nextReceive]
+		if !ok || buffer.left > 0 {
+			break
+		}
+		delete(conn.fragments, conn.nextReceive)
+		messages = append(messages, &dtlsHandshakeMessage{Type: buffer.msgType, Sequence: conn.nextReceive, Body: buffer.body})
+		conn.nextReceive++
+	}
+	return
+}
+
+func (conn *dtlsConn) writeTranscript(msg *dtlsHandshakeMessage) {
+	header := make([]byte, DTLS_HANDSHAKE_HEADER_LENGTH)
+	header[0] = msg.Type
+	putUint24(header[1:], len(msg.Body))
+	binary.BigEndian.PutUint16(header[4:], msg.Sequence)
+	putUint24(header[9:], len(msg.Body))
+	conn.transcript.Write(header)
+	conn.transcript.Write(msg.Body)
+}
+
+//握手，阻塞直到完成、超时或出错
+func (conn *dtlsConn) Handshake() (err error) {
+	deadline := time.After(conn.timeout)
+	retransmitTimer := time.NewTimer(DTLS_HANDSHAKE_RETRANSMIT_TIMEOUT)
+	defer retransmitTimer.Stop()
+	for !conn.HandshakeDone {
+		select {
+		case data, ok := <-conn.in:
+			if !ok {
+				return fmt.Errorf("dtls conn closed")
+			}
+			if !isDTLSPacket(data) {
+				continue
+			}
+			if err = conn.handlePacket(data); err != nil {
+				return
+			}
+		case <-retransmitTimer.C:
+			if conn.lastFlight != nil {
+				_ = conn.send(conn.lastFlight)
+			}
+			retransmitTimer.Reset(DTLS_HANDSHAKE_RETRANSMIT_TIMEOUT)
+		case <-deadline:
+			return fmt.Errorf("dtls handshake timeout")
+		}
+	}
+	return
+}
+
+//处理收到的dtls数据，握手完成后返回的closed表示对端关闭连接
+func (conn *dtlsConn) HandlePacket(data []byte) (closed bool, err error) {
+	err = conn.handlePacket(data)
+	return err == errDTLSClosed, err
+}
+
+var errDTLSClosed = fmt.Errorf("dtls close notify")
+
+func (conn *dtlsConn) handlePacket(data []byte) (err error) {
+	records, err := parseDTLSRecords(data)
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		switch record.ContentType {
+		case DTLS_CONTENT_CHANGE_CIPHER_SPEC:
+			if conn.receivedKeyExc {
+				conn.readEpoch = 1
+			}
+		case DTLS_CONTENT_ALERT:
+			payload, decryptErr := conn.decryptRecord(record)
+			if decryptErr != nil || len(payload) < 2 {
+				continue
+			}
+			if payload[1] == DTLS_ALERT_CLOSE_NOTIFY {
+				return errDTLSClosed
+			}
+			if payload[0] == DTLS_ALERT_LEVEL_FATAL {
+				return fmt.Errorf("dtls fatal alert %d", payload[1])
+			}
+		case DTLS_CONTENT_HANDSHAKE:
+			if record.Epoch != conn.readEpoch {
+				//握手完成后收到epoch 0的消息，对端没有收到Finished
+				if conn.HandshakeDone && conn.lastFlight != nil {
+					_ = conn.send(conn.lastFlight)
+				}
+				continue
+			}
+			payload, decryptErr := conn.decryptRecord(record)
+			if decryptErr != nil {
+				return decryptErr
+			}
+			messages, retransmit, reassembleErr := conn.reassemble(payload)
+			if reassembleErr != nil {
+				return reassembleErr
+			}
+			if retransmit && conn.lastFlight != nil {
+				_ = conn.send(conn.lastFlight)
+			}
+			for _, msg := range messages {
+				if err = conn.handleHandshake(msg); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+func (conn *dtlsConn) handleHandshake(msg *dtlsHandshakeMessage) (err error) {
+	switch msg.Type {
+	case DTLS_HANDSHAKE_CLIENT_HELLO:
+		if conn.receivedHello {
+			return
+		}
+		if err = conn.handleClientHello(msg); err != nil {
+			conn.sendAlert(DTLS_ALERT_LEVEL_FATAL, DTLS_ALERT_HANDSHAKE_FAILURE)
+		}
+		return
+	case DTLS_HANDSHAKE_CERTIFICATE:
+		if !conn.receivedHello || conn.receivedCert {
+			return fmt.Errorf("unexpected dtls client certificate")
+		}
+		if err = conn.handleClientCertificate(msg); err != nil {
+			conn.sendAlert(DTLS_ALERT_LEVEL_FATAL, DTLS_ALERT_BAD_CERTIFICATE)
+		}
+		return
+	case DTLS_HANDSHAKE_CLIENT_KEY_EXCHANGE:
+		if !conn.receivedCert || conn.receivedKeyExc {
+			return fmt.Errorf("unexpected dtls client key exchange")
+		}
+		return conn.handleClientKeyExchange(msg)
+	case DTLS_HANDSHAKE_CERTIFICATE_VERIFY:
+		if !conn.receivedKeyExc || conn.receivedCertVerify {
+			return fmt.Errorf("unexpected dtls certificate verify")
+		}
+		if err = conn.handleCertificateVerify(msg); err != nil {
+			conn.sendAlert(DTLS_ALERT_LEVEL_FATAL, DTLS_ALERT_BAD_CERTIFICATE)
+		}
+		return
+	case DTLS_HANDSHAKE_FINISHED:
+		if !conn.receivedCertVerify || conn.readEpoch != 1 {
+			return fmt.Errorf("unexpected dtls finished")
+		}
+		return conn.handleFinished(msg)
+	}
+	return fmt.Errorf("unsupported dtls handshake message %d", msg.Type)
+}
+
+func (conn *dtlsConn) handleClientHello(msg *dtlsHandshakeMessage) (err error) {
+	body := msg.Body
+	//client_version(2) random(32)
+	if len(body) < 35 {
+		return fmt.Errorf("dtls client hello too short")
+	}
+	conn.clientRandom = append([]byte{}, body[2:34]...)
+	offset := 34
+	readVector := func(lengthSize int) ([]byte, bool) {
+		if offset+lengthSize > len(body) {
+			return nil, false
+		}
+		length := 0
+		for i := 0; i < lengthSize; i++ {
+			length = length<<8 | int(body[offset+i])
+		}
+		offset += lengthSize
+		if offset+length > len(body) {
+			return nil, false
+		}
+		value := body[offset : offset+length]
+		offset += length
+		return value, true
+	}
+	var (
+		ok           bool
+		cipherSuites []byte
+		extensions   []byte
+	)
+	//session_id cookie cipher_suites compression_methods
+	if _, ok = readVector(1); !ok {
+		return fmt.Errorf("dtls client hello invalid session id")
+	}
+	if _, ok = readVector(1); !ok {
+		return fmt.Errorf("dtls client hello invalid cookie")
+	}
+	if cipherSuites, ok = readVector(2); !ok {
+		return fmt.Errorf("dtls client hello invalid cipher suites")
+	}
+	if _, ok = readVector(1); !ok {
+		return fmt.Errorf("dtls client hello invalid compression methods")
+	}
+	extensions, _ = readVector(2)
+	supportCipher := false
+	for i := 0; i+1 < len(cipherSuites); i += 2 {
+		if binary.BigEndian.Uint16(cipherSuites[i:]) == DTLS_CIPHER_SUITE {
+			supportCipher = true
+		}
+	}
+	if !supportCipher {
+		return fmt.Errorf("dtls client not support TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	}
+	supportSRTP, pointFormats := false, false
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+		if 4+extLen > len(extensions) {
+			break
+		}
+		extData := extensions[4 : 4+extLen]
+		extensions = extensions[4+extLen:]
+		switch extType {
+		case DTLS_EXT_USE_SRTP:
+			if len(extData) >= 2 {
+				profilesLen := int(binary.BigEndian.Uint16(extData))
+				for i := 2; i+1 < len(extData) && i < 2+profilesLen; i += 2 {
+					if binary.BigEndian.Uint16(extData[i:]) == DTLS_SRTP_PROFILE {
+						supportSRTP = true
+					}
+				}
+			}
+		case DTLS_EXT_EXTENDED_MASTER_SECRET:
+			conn.extendedMasterSecret = true
+		case DTLS_EXT_EC_POINT_FORMATS:
+			pointFormats = true
+		}
+	}
+	if !supportSRTP {
+		return fmt.Errorf("dtls client not support SRTP_AES128_CM_HMAC_SHA1_80")
+	}
+	conn.receivedHello = true
+	conn.writeTranscript(msg)
+	return conn.sendServerHelloFlight(pointFormats)
+}
+
+func (conn *dtlsConn) sendServerHelloFlight(pointFormats bool) (err error) {
+	conn.serverRandom = make([]byte, 32)
+	if _, err = rand.Read(conn.serverRandom); err != nil {
+		return
+	}
+	//ServerHello
+	extensions := []byte{}
+	addExtension := func(extType uint16, data []byte) {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header, extType)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+		extensions = append(append(extensions, header...), data...)
+	}
+	addExtension(DTLS_EXT_RENEGOTIATION_INFO, []byte{0})
+	if conn.extendedMasterSecret {
+		addExtension(DTLS_EXT_EXTENDED_MASTER_SECRET, nil)
+	}
+	if pointFormats {
+		addExtension(DTLS_EXT_EC_POINT_FORMATS, []byte{1, 0})
+	}
+	addExtension(DTLS_EXT_USE_SRTP, []byte{0, 2, byte(DTLS_SRTP_PROFILE >> 8), byte(DTLS_SRTP_PROFILE & 0xff), 0})
+	hello := append([]byte{}, dtlsVersion...)
+	hello = append(hello, conn.serverRandom...)
+	hello = append(hello, 0, byte(DTLS_CIPHER_SUITE>>8), byte(DTLS_CIPHER_SUITE&0xff), 0)
+	hello = append(hello, byte(len(extensions)>>8), byte(len(extensions)))
+	hello = append(hello, extensions...)
+	//Certificate
+	certificate := make([]byte, 6, 6+len(conn.cert.der))
+	putUint24(certificate, len(conn.cert.der)+3)
+	putUint24(certificate[3:], len(conn.cert.der))
+	certificate = append(certificate, conn.cert.der...)
+	//ServerKeyExchange secp256r1
+	curve := elliptic.P256()
+	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return
+	}
+	conn.ecdhKey = priv
+	publicKey := elliptic.Marshal(curve, x, y)
+	params := append([]byte{3, 0, 23, byte(len(publicKey))}, publicKey...)
+	digest := sha256.New()
+	digest.Write(conn.clientRandom)
+	digest.Write(conn.serverRandom)
+	digest.Write(params)
+	signature, err := ecdsa.SignASN1(rand.Reader, conn.cert.key, digest.Sum(nil))
+	if err != nil {
+		return
+	}
+	//ecdsa_secp256r1_sha256
+	keyExchange := append(params, 4, 3, byte(len(signature)>>8), byte(len(signature)))
+	keyExchange = append(keyExchange, signature...)
+
+	flight := conn.encodeHandshake(DTLS_HANDSHAKE_SERVER_HELLO, hello)
+	flight = append(flight, conn.encodeHandshake(DTLS_HANDSHAKE_CERTIFICATE, certificate)...)
+	flight = append(flight, conn.encodeHandshake(DTLS_HANDSHAKE_SERVER_KEY_EXCHANGE, keyExchange)...)
+	//CertificateRequest: ecdsa_sign、rsa_sign，ecdsa_secp256r1_sha256、rsa_pkcs1_sha256，不限制CA
+	certificateRequest := []byte{2, 64, 1, 0, 4, 4, 3, 4, 1, 0, 0}
+	flight = append(flight, conn.encodeHandshake(DTLS_HANDSHAKE_CERTIFICATE_REQUEST, certificateRequest)...)
+	flight = append(flight, conn.encodeHandshake(DTLS_HANDSHAKE_SERVER_HELLO_DONE, nil)...)
+	return conn.sendFlight(flight)
+}
+
+//对端证书必须与sdp中的fingerprint一致
+func (conn *dtlsConn) handleClientCertificate(msg *dtlsHandshakeMessage) (err error) {
+	body := msg.Body
+	if len(body) < 3 || uint24(body) != len(body)-3 {
+		return fmt.Errorf("dtls client certificate invalid length")
+	}
+	if len(body) < 6 || 6+uint24(body[3:]) > len(body) {
+		return fmt.Errorf("dtls client certificate empty")
+	}
+	der := body[6 : 6+uint24(body[3:])]
+	if conn.RemoteFingerprint == nil {
+		return fmt.Errorf("dtls remote fingerprint unknown")
+	}
+	if !conn.RemoteFingerprint.Match(der) {
+		return fmt.Errorf("dtls client certificate not match fingerprint")
+	}
+	if conn.remoteCert, err = x509.ParseCertificate(der); err != nil {
+		return fmt.Errorf("dtls client certificate parse error:%v", err)
+	}
+	conn.receivedCert = true
+	conn.writeTranscript(msg)
+	return
+}
+
+//校验对端对之前全部握手消息的签名，证明其持有证书私钥
+func (conn *dtlsConn) handleCertificateVerify(msg *dtlsHandshakeMessage) (err error) {
+	body := msg.Body
+	if len(body) < 4 || 4+int(binary.BigEndian.Uint16(body[2:])) != len(body) {
+		return fmt.Errorf("dtls certificate verify invalid length")
+	}
+	var algorithm x509.SignatureAlgorithm
+	switch binary.BigEndian.Uint16(body) {
+	case 0x0403:
+		algorithm = x509.ECDSAWithSHA256
+	case 0x0401:
+		algorithm = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("dtls certificate verify unsupported signature algorithm:%x", body[:2])
+	}
+	if err = conn.remoteCert.CheckSignature(algorithm, conn.transcript.Bytes(), body[4:]); err != nil {
+		return fmt.Errorf("dtls certificate verify failed:%v", err)
+	}
+	conn.receivedCertVerify = true
+	conn.writeTranscript(msg)
+	return
+}
+
+func (conn *dtlsConn) handleClientKeyExchange(msg *dtlsHandshakeMessage) (err error) {
+	if len(msg.Body) < 1 || int(msg.Body[0])+1 > len(msg.Body) {
+		return fmt.Errorf("dtls client key exchange too short")
+	}
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, msg.Body[1:1+int(msg.Body[0])])
+	if x == nil {
+		return fmt.Errorf("dtls client key exchange invalid public key")
+	}
+	sharedX, _ := curve.ScalarMult(x, y, conn.ecdhKey)
+	preMasterSecret := make([]byte, 32)
+	sharedBytes := sharedX.Bytes()
+	copy(preMasterSecret[32-len(sharedBytes):], sharedBytes)
+	conn.writeTranscript(msg)
+	if conn.extendedMasterSecret {
+		sessionHash := sha256.Sum256(conn.transcript.Bytes())
+		conn.masterSecret = dtlsPRF(preMasterSecret, "extended master secret", sessionHash[:], 48)
+	} else {
+		conn.masterSecret = dtlsPRF(preMasterSecret, "master secret", append(append([]byte{}, conn.clientRandom...), conn.serverRandom...), 48)
+	}
+	//client_write_key server_write_key client_write_IV server_write_IV
+	keyBlock := dtlsPRF(conn.masterSecret, "key expansion", append(append([]byte{}, conn.serverRandom...), conn.clientRandom...), 2*16+2*4)
+	if conn.clientAEAD, err = newGCM(keyBlock[:16]); err != nil {
+		return
+	}
+	if conn.serverAEAD, err = newGCM(keyBlock[16:32]); err != nil {
+		return
+	}
+	conn.clientIV = keyBlock[32:36]
+	conn.serverIV = keyBlock[36:40]
+	conn.receivedKeyExc = true
+	return
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (conn *dtlsConn) handleFinished(msg *dtlsHandshakeMessage) (err error) {
+	transcriptHash := sha256.Sum256(conn.transcript.Bytes())
+	expected := dtlsPRF(conn.masterSecret, "client finished", transcriptHash[:], 12)
+	if !hmac.Equal(expected, msg.Body) {
+		conn.sendAlert(DTLS_ALERT_LEVEL_FATAL, DTLS_ALERT_HANDSHAKE_FAILURE)
+		return fmt.Errorf("dtls client finished verify failed")
+	}
+	conn.writeTranscript(msg)
+	transcriptHash = sha256.Sum256(conn.transcript.Bytes())
+	flight := conn.encodeRecord(DTLS_CONTENT_CHANGE_CIPHER_SPEC, []byte{1})
+	conn.writeEpoch, conn.writeSequence = 1, 0
+	flight = append(flight, conn.encodeHandshake(DTLS_HANDSHAKE_FINISHED, dtlsPRF(conn.masterSecret, "server finished", transcriptHash[:], 12))...)
+	conn.HandshakeDone = true
+	return conn.sendFlight(flight)
+}
+
+//rfc5764 导出srtp密钥，返回本端(服务端)与对端的master key和master salt
+func (conn *dtlsConn) ExportSRTPKeys() (localKey, localSalt, remoteKey, remoteSalt []byte) {
+	material := dtlsPRF(conn.masterSecret, "EXTRACTOR-dtls_srtp", append(append([]byte{}, conn.clientRandom...), conn.serverRandom...), DTLS_SRTP_KEYING_MATERIAL_LENGTH)
+	remoteKey, localKey = material[0:16], material[16:32]
+	remoteSalt, localSalt = material[32:46], material[46:60]
+	return
+}
+
+func (conn *dtlsConn) Close() {
+	if conn.HandshakeDone {
+		conn.sendAlert(1, DTLS_ALERT_CLOSE_NOTIFY)
+	}
+}
@@ -0,0 +1,508 @@
+package rtsp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//tls1.2 PRF(SHA256)的公开测试向量
+func TestDTLSPRF(t *testing.T) {
+	secret, _ := hex.DecodeString("9bbe436ba940f017b17652849a71db35")
+	seed, _ := hex.DecodeString("a0ba9f936cda311827a6f796ffd5198c")
+	expected := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff70187347b66"
+	if out := hex.EncodeToString(dtlsPRF(secret, "test label", seed, 100)); out != expected {
+		t.Fatalf("prf = %s", out)
+	}
+}
+
+//读取时保存收到的数据，用于取出ServerHello中的server random
+type tlsRecordingConn struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (conn *tlsRecordingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.read.Write(p[:n])
+	return n, err
+}
+
+func newTestECDSACertificate(t testing.TB) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+//与crypto/tls的tls1.2握手结果比对master secret导出的srtp密钥(rfc5705/rfc5764)
+func TestDTLSExportSRTPKeysMatchesCryptoTLS(t *testing.T) {
+	der, key := newTestECDSACertificate(t)
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	var keyLog bytes.Buffer
+	recording := &tlsRecordingConn{Conn: clientConn}
+	client := tls.Client(recording, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		KeyLogWriter:       &keyLog,
+	})
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	//CLIENT_RANDOM <client random> <master secret>
+	fields := strings.Fields(keyLog.String())
+	if len(fields) != 3 || fields[0] != "CLIENT_RANDOM" {
+		t.Fatalf("key log = %q", keyLog.String())
+	}
+	clientRandom, _ := hex.DecodeString(fields[1])
+	masterSecret, _ := hex.DecodeString(fields[2])
+	//record header(5) handshake header(4) version(2) random(32)
+	read := recording.read.Bytes()
+	if len(read) < 43 || read[0] != 22 || read[5] != 2 {
+		t.Fatalf("server hello not found")
+	}
+	conn := &dtlsConn{masterSecret: masterSecret, clientRandom: clientRandom, serverRandom: read[11:43]}
+	localKey, localSalt, remoteKey, remoteSalt := conn.ExportSRTPKeys()
+	state := client.ConnectionState()
+	material, err := state.ExportKeyingMaterial("EXTRACTOR-dtls_srtp", nil, DTLS_SRTP_KEYING_MATERIAL_LENGTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := bytes.Join([][]byte{remoteKey, localKey, remoteSalt, localSalt}, nil)
+	if !bytes.Equal(exported, material) {
+		t.Fatalf("srtp keying material = %x, crypto/tls = %x", exported, material)
+	}
+}
+
+func TestParseDTLSFingerprint(t *testing.T) {
+	der, _ := newTestECDSACertificate(t)
+	sum := sha256.Sum256(der)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02X", b)
+	}
+	tests := []struct {
+		value   string
+		match   bool
+		wantErr bool
+	}{
+		{"sha-256 " + strings.Join(hexes, ":"), true, false},
+		{"SHA-256 " + strings.ToLower(strings.Join(hexes, ":")), true, false},
+		{"sha-256 " + strings.Repeat("00:", 31) + "00", false, false},
+		{"sha-1 " + strings.Repeat("00:", 19) + "00", false, false},
+		{"sha-256 " + strings.Repeat("00:", 19) + "00", false, true},
+		{"md5 " + strings.Repeat("00:", 15) + "00", false, true},
+		{"sha-256 zz", false, true},
+		{"sha-256", false, true},
+	}
+	for _, test := range tests {
+		fingerprint, err := parseDTLSFingerprint(test.value)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("%s error = %v", test.value, err)
+		}
+		if err == nil && fingerprint.Match(der) != test.match {
+			t.Fatalf("%s match = %v", test.value, !test.match)
+		}
+	}
+}
+
+//测试用dtls客户端，记录层及握手消息独立实现，只使用dtlsPRF(已与公开向量比对)
+type dtlsTestClient struct {
+	t       *testing.T
+	server  *dtlsConn
+	out     chan []byte
+	certDER []byte
+	certKey *ecdsa.PrivateKey
+
+	random       []byte
+	serverRandom []byte
+	serverCert   *x509.Certificate
+	serverKey    *ecdh.PublicKey
+	certRequest  bool
+	transcript   bytes.Buffer
+	msgSequence  uint16
+	epoch        uint16
+	sequence     uint64
+	masterSecret []byte
+	writeAEAD    cipher.AEAD
+	readAEAD     cipher.AEAD
+	writeIV      []byte
+	readIV       []byte
+}
+
+func newDTLSTestClient(t *testing.T) *dtlsTestClient {
+	cert, err := newDTLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &dtlsTestClient{t: t, out: make(chan []byte, 16), random: make([]byte, 32)}
+	rand.Read(client.random)
+	client.certDER, client.certKey = newTestECDSACertificate(t)
+	client.server = newDTLSConn(cert, make(chan []byte, 16), func(data []byte) error {
+		client.out <- append([]byte{}, data...)
+		return nil
+	}, 5*time.Second)
+	sum := sha256.Sum256(client.certDER)
+	client.server.RemoteFingerprint = &dtlsFingerprint{Algorithm: "sha-256", Value: sum[:]}
+	return client
+}
+
+func (client *dtlsTestClient) record(contentType byte, payload []byte) []byte {
+	header := make([]byte, 13)
+	header[0] = contentType
+	header[1], header[2] = 0xfe, 0xfd
+	seq := uint64(client.epoch)<<48 | client.sequence
+	binary.BigEndian.PutUint64(header[3:], seq)
+	client.sequence++
+	if client.epoch > 0 {
+		explicit := header[3:11]
+		ad := append(append([]byte{}, explicit...), contentType, 0xfe, 0xfd, byte(len(payload)>>8), byte(len(payload)))
+		nonce := append(append([]byte{}, client.writeIV...), explicit...)
+		payload = client.writeAEAD.Seal(append([]byte{}, explicit...), nonce, payload, ad)
+	}
+	binary.BigEndian.PutUint16(header[11:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func (client *dtlsTestClient) handshake(msgType byte, body []byte) []byte {
+	msg := []byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body)),
+		byte(client.msgSequence >> 8), byte(client.msgSequence), 0, 0, 0, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	client.msgSequence++
+	msg = append(msg, body...)
+	client.transcript.Write(msg)
+	return client.record(DTLS_CONTENT_HANDSHAKE, msg)
+}
+
+func (client *dtlsTestClient) clientHello() []byte {
+	body := append([]byte{0xfe, 0xfd}, client.random...)
+	body = append(body, 0, 0, 0, 2, 0xc0, 0x2b, 1, 0)
+	extensions := []byte{
+		0x00, 0x0a, 0x00, 0x04, 0x00, 0x02, 0x00, 0x17,
+		0x00, 0x0b, 0x00, 0x02, 0x01, 0x00,
+		0x00, 0x0e, 0x00, 0x05, 0x00, 0x02, 0x00, 0x01, 0x00,
+		0x00, 0x17, 0x00, 0x00,
+		0x00, 0x0d, 0x00, 0x04, 0x00, 0x02, 0x04, 0x03,
+	}
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	return client.handshake(DTLS_HANDSHAKE_CLIENT_HELLO, append(body, extensions...))
+}
+
+func (client *dtlsTestClient) read() []byte {
+	select {
+	case data := <-client.out:
+		return data
+	case <-time.After(5 * time.Second):
+		client.t.Fatal("dtls server response timeout")
+	}
+	return nil
+}
+
+//读取服务端的第一个flight并校验证书、ServerKeyExchange签名
+func (client *dtlsTestClient) readServerHelloFlight() {
+	t := client.t
+	data := client.read()
+	types := make([]byte, 0)
+	for len(data) >= 13 {
+		length := int(binary.BigEndian.Uint16(data[11:]))
+		if data[0] != DTLS_CONTENT_HANDSHAKE || 13+length > len(data) {
+			t.Fatalf("unexpected record %x", data[:13])
+		}
+		msg := data[13 : 13+length]
+		data = data[13+length:]
+		client.transcript.Write(msg)
+		msgType, body := msg[0], msg[12:]
+		types = append(types, msgType)
+		switch msgType {
+		case DTLS_HANDSHAKE_SERVER_HELLO:
+			client.serverRandom = append([]byte{}, body[2:34]...)
+			if suite := binary.BigEndian.Uint16(body[35:]); suite != DTLS_CIPHER_SUITE {
+				t.Fatalf("cipher suite = %x", suite)
+			}
+			if !bytes.Contains(body[38:], []byte{0x00, 0x0e, 0x00, 0x05, 0x00, 0x02, 0x00, 0x01, 0x00}) {
+				t.Fatal("server hello without use_srtp")
+			}
+		case DTLS_HANDSHAKE_CERTIFICATE:
+			cert, err := x509.ParseCertificate(body[6 : 6+uint24(body[3:])])
+			if err != nil {
+				t.Fatal(err)
+			}
+			fingerprint, _ := parseDTLSFingerprint("sha-256 " + client.server.cert.Fingerprint)
+			if !fingerprint.Match(cert.Raw) {
+				t.Fatal("server certificate not match fingerprint")
+			}
+			client.serverCert = cert
+		case DTLS_HANDSHAKE_SERVER_KEY_EXCHANGE:
+			params := body[:4+int(body[3])]
+			if params[0] != 3 || binary.BigEndian.Uint16(params[1:]) != 23 {
+				t.Fatalf("server key exchange params %x", params[:3])
+			}
+			signature := body[len(params)+4:]
+			digest := sha256.Sum256(bytes.Join([][]byte{client.random, client.serverRandom, params}, nil))
+			if !ecdsa.VerifyASN1(client.serverCert.PublicKey.(*ecdsa.PublicKey), digest[:], signature) {
+				t.Fatal("server key exchange signature verify failed")
+			}
+			key, err := ecdh.P256().NewPublicKey(params[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.serverKey = key
+		case DTLS_HANDSHAKE_CERTIFICATE_REQUEST:
+			client.certRequest = true
+		}
+	}
+	expected := []byte{DTLS_HANDSHAKE_SERVER_HELLO, DTLS_HANDSHAKE_CERTIFICATE, DTLS_HANDSHAKE_SERVER_KEY_EXCHANGE, DTLS_HANDSHAKE_CERTIFICATE_REQUEST, DTLS_HANDSHAKE_SERVER_HELLO_DONE}
+	if !bytes.Equal(types, expected) {
+		t.Fatalf("server flight = %v, want %v", types, expected)
+	}
+}
+
+func newTestGCM(t *testing.T, key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+type dtlsTestOptions struct {
+	skipCertificate bool
+	verifyKey       *ecdsa.PrivateKey
+	badFinished     bool
+}
+
+//Certificate、ClientKeyExchange、CertificateVerify、ChangeCipherSpec、Finished
+func (client *dtlsTestClient) clientFlight(options dtlsTestOptions) []byte {
+	t := client.t
+	var flight []byte
+	if !options.skipCertificate {
+		certificate := make([]byte, 6)
+		putUint24(certificate, len(client.certDER)+3)
+		putUint24(certificate[3:], len(client.certDER))
+		flight = append(flight, client.handshake(DTLS_HANDSHAKE_CERTIFICATE, append(certificate, client.certDER...))...)
+	}
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := priv.PublicKey().Bytes()
+	flight = append(flight, client.handshake(DTLS_HANDSHAKE_CLIENT_KEY_EXCHANGE, append([]byte{byte(len(public))}, public...))...)
+	preMasterSecret, err := priv.ECDH(client.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionHash := sha256.Sum256(client.transcript.Bytes())
+	client.masterSecret = dtlsPRF(preMasterSecret, "extended master secret", sessionHash[:], 48)
+	keyBlock := dtlsPRF(client.masterSecret, "key expansion", append(append([]byte{}, client.serverRandom...), client.random...), 40)
+	client.writeAEAD, client.readAEAD = newTestGCM(t, keyBlock[:16]), newTestGCM(t, keyBlock[16:32])
+	client.writeIV, client.readIV = keyBlock[32:36], keyBlock[36:40]
+	verifyKey := client.certKey
+	if options.verifyKey != nil {
+		verifyKey = options.verifyKey
+	}
+	digest := sha256.Sum256(client.transcript.Bytes())
+	signature, err := ecdsa.SignASN1(rand.Reader, verifyKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := append([]byte{4, 3, byte(len(signature) >> 8), byte(len(signature))}, signature...)
+	flight = append(flight, client.handshake(DTLS_HANDSHAKE_CERTIFICATE_VERIFY, verify)...)
+	flight = append(flight, client.record(DTLS_CONTENT_CHANGE_CIPHER_SPEC, []byte{1})...)
+	client.epoch, client.sequence = 1, 0
+	transcriptHash := sha256.Sum256(client.transcript.Bytes())
+	finished := dtlsPRF(client.masterSecret, "client finished", transcriptHash[:], 12)
+	if options.badFinished {
+		finished[0] ^= 0xff
+	}
+	return append(flight, client.handshake(DTLS_HANDSHAKE_FINISHED, finished)...)
+}
+
+//校验服务端的ChangeCipherSpec及加密的Finished
+func (client *dtlsTestClient) readServerFinished() {
+	t := client.t
+	data := client.read()
+	if len(data) < 14 || data[0] != DTLS_CONTENT_CHANGE_CIPHER_SPEC {
+		t.Fatalf("expected change cipher spec, got %x", data)
+	}
+	data = data[14:]
+	if len(data) < 13 || data[0] != DTLS_CONTENT_HANDSHAKE || binary.BigEndian.Uint16(data[3:]) != 1 {
+		t.Fatalf("expected encrypted finished, got %x", data)
+	}
+	payload := data[13:]
+	nonce := append(append([]byte{}, client.readIV...), payload[:8]...)
+	plainLength := len(payload) - 8 - client.readAEAD.Overhead()
+	ad := append(append([]byte{}, data[3:11]...), DTLS_CONTENT_HANDSHAKE, 0xfe, 0xfd, byte(plainLength>>8), byte(plainLength))
+	msg, err := client.readAEAD.Open(nil, nonce, payload[8:], ad)
+	if err != nil {
+		t.Fatalf("decrypt server finished error:%v", err)
+	}
+	transcriptHash := sha256.Sum256(client.transcript.Bytes())
+	expected := dtlsPRF(client.masterSecret, "server finished", transcriptHash[:], 12)
+	if msg[0] != DTLS_HANDSHAKE_FINISHED || !bytes.Equal(msg[12:], expected) {
+		t.Fatalf("server finished = %x, want %x", msg[12:], expected)
+	}
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	client := newDTLSTestClient(t)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.server.Handshake()
+	}()
+	hello := client.clientHello()
+	client.server.in <- hello
+	client.readServerHelloFlight()
+	if !client.certRequest {
+		t.Fatal("server did not request client certificate")
+	}
+	//ClientHello重传时服务端重发上一个flight
+	client.server.in <- hello
+	if retransmit := client.read(); !bytes.Equal(retransmit, client.server.lastFlight) {
+		t.Fatal("server flight not retransmitted")
+	}
+	client.server.in <- client.clientFlight(dtlsTestOptions{})
+	client.readServerFinished()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	//客户端导出的密钥与服务端对应
+	material := dtlsPRF(client.masterSecret, "EXTRACTOR-dtls_srtp", append(append([]byte{}, client.random...), client.serverRandom...), DTLS_SRTP_KEYING_MATERIAL_LENGTH)
+	localKey, localSalt, remoteKey, remoteSalt := client.server.ExportSRTPKeys()
+	if !bytes.Equal(material[:16], remoteKey) || !bytes.Equal(material[16:32], localKey) ||
+		!bytes.Equal(material[32:46], remoteSalt) || !bytes.Equal(material[46:60], localSalt) {
+		t.Fatal("srtp keys not match")
+	}
+	//握手完成后的close_notify
+	closed, _ := client.server.HandlePacket(client.record(DTLS_CONTENT_ALERT, []byte{1, DTLS_ALERT_CLOSE_NOTIFY}))
+	if !closed {
+		t.Fatal("close notify not handled")
+	}
+}
+
+func TestDTLSHandshakeFailure(t *testing.T) {
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name        string
+		fingerprint func(client *dtlsTestClient) *dtlsFingerprint
+		options     dtlsTestOptions
+		wantErr     string
+	}{
+		{
+			name: "fingerprint mismatch",
+			fingerprint: func(client *dtlsTestClient) *dtlsFingerprint {
+				return &dtlsFingerprint{Algorithm: "sha-256", Value: make([]byte, 32)}
+			},
+			wantErr: "not match fingerprint",
+		},
+		{
+			name: "fingerprint unknown",
+			fingerprint: func(client *dtlsTestClient) *dtlsFingerprint {
+				return nil
+			},
+			wantErr: "fingerprint unknown",
+		},
+		{
+			name:    "without client certificate",
+			options: dtlsTestOptions{skipCertificate: true},
+			wantErr: "unexpected dtls client key exchange",
+		},
+		{
+			name:    "certificate verify with other key",
+			options: dtlsTestOptions{verifyKey: otherKey},
+			wantErr: "certificate verify failed",
+		},
+		{
+			name:    "bad finished",
+			options: dtlsTestOptions{badFinished: true},
+			wantErr: "finished verify failed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newDTLSTestClient(t)
+			if test.fingerprint != nil {
+				client.server.RemoteFingerprint = test.fingerprint(client)
+			}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- client.server.Handshake()
+			}()
+			client.server.in <- client.clientHello()
+			client.readServerHelloFlight()
+			client.server.in <- client.clientFlight(test.options)
+			err := <-errCh
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+			if client.server.HandshakeDone {
+				t.Fatal("handshake done")
+			}
+		})
+	}
+}
+
+func FuzzDTLSHandlePacket(f *testing.F) {
+	cert, err := newDTLSCertificate()
+	if err != nil {
+		f.Fatal(err)
+	}
+	fingerprint := &dtlsFingerprint{Algorithm: "sha-256", Value: make([]byte, 32)}
+	seed := &dtlsTestClient{random: make([]byte, 32)}
+	f.Add(seed.clientHello())
+	//分片的ClientHello
+	hello := seed.clientHello()[13:]
+	fragment := append(append([]byte{}, hello[:12]...), hello[12:20]...)
+	putUint24(fragment[9:], 8)
+	f.Add(seed.record(DTLS_CONTENT_HANDSHAKE, fragment))
+	f.Add(seed.record(DTLS_CONTENT_CHANGE_CIPHER_SPEC, []byte{1}))
+	f.Add(seed.record(DTLS_CONTENT_ALERT, []byte{2, 40}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newDTLSConn(cert, nil, func([]byte) error { return nil }, time.Second)
+		conn.RemoteFingerprint = fingerprint
+		_ = conn.handlePacket(data)
+	})
+}
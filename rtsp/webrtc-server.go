@@ -0,0 +1,188 @@
+package rtsp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bruce-qin/EasyGoLib/utils"
+)
+
+//webrtc媒体服务，ice-lite模式，所有会话共用一个udp端口
+//stun请求根据username找到会话，之后按客户端地址分发dtls、srtp数据
+type WebRTCServer struct {
+	SessionLogger
+	Server       *Server
+	UDPConn      *net.UDPConn
+	UDPPort      int
+	CandidateIPs []string
+	Stoped       bool
+	certificate  *dtlsCertificate
+
+	sessions     map[string]*WebRTCSession // ID <-> session
+	ufragSession map[string]*WebRTCSession
+	addrSession  map[string]*WebRTCSession
+	sessionsLock sync.RWMutex
+}
+
+func NewWebRTCServer(server *Server) *WebRTCServer {
+	logger := SessionLogger{log.New(os.Stdout, "[WebRTCServer]", log.LstdFlags|log.Lshortfile)}
+	certificate, err := newDTLSCertificate()
+	if err != nil {
+		logger.logger.Printf("generate webrtc dtls certificate error:%v", err)
+		return nil
+	}
+	candidateIPs := make([]string, 0)
+	for _, ip := range strings.Split(server.webrtcCandidateIP, ";") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			candidateIPs = append(candidateIPs, ip)
+		}
+	}
+	if len(candidateIPs) == 0 {
+		candidateIPs = append(candidateIPs, utils.LocalIP())
+	}
+	rtcServer := &WebRTCServer{
+		SessionLogger: logger,
+		Server:        server,
+		UDPPort:       server.WebRTCPort,
+		CandidateIPs:  candidateIPs,
+		Stoped:        true,
+		certificate:   certificate,
+		sessions:      make(map[string]*WebRTCSession),
+		ufragSession:  make(map[string]*WebRTCSession),
+		addrSession:   make(map[string]*WebRTCSession),
+	}
+	server.webrtcServer = rtcServer
+	return rtcServer
+}
+
+func (rtcServer *WebRTCServer) Start() (err error) {
+	var (
+		logger = rtcServer.logger
+		addr   *net.UDPAddr
+		conn   *net.UDPConn
+	)
+	if addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", rtcServer.UDPPort)); err != nil {
+		return
+	}
+	if conn, err = net.ListenUDP("udp", addr); err != nil {
+		return
+	}
+	networkBuffer := rtcServer.Server.networkBuffer
+	if err = conn.SetReadBuffer(networkBuffer); err != nil {
+		logger.Printf("webrtc server conn set read buffer error, %v", err)
+	}
+	if err = conn.SetWriteBuffer(networkBuffer); err != nil {
+		logger.Printf("webrtc server conn set write buffer error, %v", err)
+	}
+	rtcServer.Stoped = false
+	rtcServer.UDPConn = conn
+	logger.Println("webrtc server start on", rtcServer.UDPPort)
+	buf := make([]byte, 2048)
+	for !rtcServer.Stoped {
+		n, remoteAddr, readErr := conn.ReadFromUDP(buf)
+		if readErr != nil {
+			if rtcServer.Stoped {
+				return nil
+			}
+			logger.Println(readErr)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if isSTUNPacket(data) {
+			rtcServer.handleSTUN(data, remoteAddr)
+			continue
+		}
+		rtcServer.sessionsLock.RLock()
+		session := rtcServer.addrSession[remoteAddr.String()]
+		rtcServer.sessionsLock.RUnlock()
+		if session != nil {
+			session.QueuePacket(data)
+		}
+	}
+	return
+}
+
+func (rtcServer *WebRTCServer) handleSTUN(data []byte, remoteAddr *net.UDPAddr) {
+	msg, err := parseSTUNMessage(data)
+	if err != nil || msg.Type != STUN_BINDING_REQUEST {
+		return
+	}
+	//username为 本端ufrag:对端ufrag
+	username := msg.Username()
+	localUfrag := username
+	if index := strings.Index(username, ":"); index >= 0 {
+		localUfrag = username[:index]
+	}
+	rtcServer.sessionsLock.RLock()
+	session := rtcServer.ufragSession[localUfrag]
+	rtcServer.sessionsLock.RUnlock()
+	if session == nil {
+		return
+	}
+	if !msg.CheckIntegrity(session.localPwd) {
+		rtcServer.WriteTo(newSTUNBindingError(msg, 401, "Unauthorized"), remoteAddr)
+		return
+	}
+	rtcServer.WriteTo(newSTUNBindingSuccess(msg, remoteAddr, session.localPwd), remoteAddr)
+	if session.SetRemoteAddr(remoteAddr) {
+		rtcServer.sessionsLock.Lock()
+		rtcServer.addrSession[remoteAddr.String()] = session
+		rtcServer.sessionsLock.Unlock()
+	}
+}
+
+func (rtcServer *WebRTCServer) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	conn := rtcServer.UDPConn
+	if conn == nil {
+		return 0, fmt.Errorf("webrtc server not started")
+	}
+	return conn.WriteToUDP(data, addr)
+}
+
+func (rtcServer *WebRTCServer) AddSession(session *WebRTCSession) {
+	rtcServer.sessionsLock.Lock()
+	rtcServer.sessions[session.ID] = session
+	rtcServer.ufragSession[session.localUfrag] = session
+	rtcServer.sessionsLock.Unlock()
+}
+
+func (rtcServer *WebRTCServer) GetSession(id string) *WebRTCSession {
+	rtcServer.sessionsLock.RLock()
+	defer rtcServer.sessionsLock.RUnlock()
+	return rtcServer.sessions[id]
+}
+
+func (rtcServer *WebRTCServer) RemoveSession(session *WebRTCSession) {
+	rtcServer.sessionsLock.Lock()
+	delete(rtcServer.sessions, session.ID)
+	delete(rtcServer.ufragSession, session.localUfrag)
+	for addr, s := range rtcServer.addrSession {
+		if s == session {
+			delete(rtcServer.addrSession, addr)
+		}
+	}
+	rtcServer.sessionsLock.Unlock()
+}
+
+func (rtcServer *WebRTCServer) Stop() {
+	rtcServer.logger.Println("webrtc server stop on", rtcServer.UDPPort)
+	rtcServer.Stoped = true
+	rtcServer.sessionsLock.RLock()
+	sessions := make([]*WebRTCSession, 0, len(rtcServer.sessions))
+	for _, session := range rtcServer.sessions {
+		sessions = append(sessions, session)
+	}
+	rtcServer.sessionsLock.RUnlock()
+	for _, session := range sessions {
+		session.Stop()
+	}
+	if rtcServer.UDPConn != nil {
+		rtcServer.UDPConn.Close()
+		rtcServer.UDPConn = nil
+	}
+}
@@ -0,0 +1,535 @@
+package rtsp
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bruce-qin/EasyGoLib/utils"
+	"github.com/pixelbender/go-sdp/sdp"
+	"github.com/teris-io/shortid"
+)
+
+const (
+	//浏览器每隔几秒发送一次stun consent检查，超过该时间未收到则认为断开
+	WEBRTC_SESSION_TIMEOUT = 30 * time.Second
+	//推流会话定时请求关键帧并告知浏览器可用带宽
+	WEBRTC_FEEDBACK_INTERVAL = 2 * time.Second
+	WEBRTC_REMB_BITRATE      = 4000000
+)
+
+//协商后的媒体轨道
+type webrtcTrack struct {
+	Kind        string
+	Mid         string
+	PayloadType byte
+	Codec       string
+	ClockRate   int
+	Channels    int
+	Params      []string
+	SSRC        uint32
+	seq         uint16
+	//推流端发来的ssrc
+	remoteSSRC uint32
+}
+
+//改写payload type、ssrc及序号，返回新的rtp包
+func (track *webrtcTrack) Rewrite(packet []byte) []byte {
+	out := make([]byte, len(packet))
+	copy(out, packet)
+	out[1] = out[1]&0x80 | track.PayloadType&0x7f
+	binary.BigEndian.PutUint16(out[2:], track.seq)
+	binary.BigEndian.PutUint32(out[8:], track.SSRC)
+	track.seq++
+	return out
+}
+
+//webrtc会话，一个whep/whip请求对应一个会话
+type WebRTCSession struct {
+	SessionLogger
+	ID         string
+	Server     *Server
+	rtcServer  *WebRTCServer
+	Type       SessionType
+	TransType  TransType
+	Path       string
+	URL        string
+	SDPRaw     string
+	ClientAddr string
+	Tracks     []*webrtcTrack
+	VCodec     string
+	ACodec     string
+	VControl   string
+	AControl   string
+	//whep/whip资源地址中的token，DELETE时校验，ID可以猜测不能用于鉴权
+	resourceToken string
+
+	localUfrag string
+	localPwd   string
+	remoteAddr *net.UDPAddr
+	lastSeen   time.Time
+	addrLock   sync.RWMutex
+
+	dtls       *dtlsConn
+	srtp       *srtpContext
+	remoteSRTP *srtpContext
+	rtcpSSRC   uint32
+	writeLock  sync.Mutex
+	connected  bool
+
+	// stats info
+	InBytes  int
+	OutBytes int
+	StartAt  time.Time
+
+	packets          chan []byte
+	Stoped           bool
+	stopLock         sync.Mutex
+	ConnectedHandles []func()
+	StopHandles      []func()
+	RTPHandles       []func(*RTPPack)
+}
+
+func (session *WebRTCSession) String() string {
+	return fmt.Sprintf("webrtc session[%v][%s][%s][%s]", session.Type, session.Path, session.ID, session.ClientAddr)
+}
+
+func NewWebRTCSession(rtcServer *WebRTCServer, id string, sessionType SessionType, path string, url string, clientAddr string) *WebRTCSession {
+	if id == "" {
+		id = shortid.MustGenerate()
+	}
+	session := &WebRTCSession{
+		ID:               id,
+		Server:           rtcServer.Server,
+		rtcServer:        rtcServer,
+		Type:             sessionType,
+		TransType:        TRANS_TYPE_WEBRTC,
+		Path:             path,
+		URL:              url,
+		ClientAddr:       clientAddr,
+		localUfrag:       randomICEString(8),
+		localPwd:         randomICEString(24),
+		resourceToken:    randomICEString(32),
+		rtcpSSRC:         rand.Uint32(),
+		StartAt:          time.Now(),
+		packets:          make(chan []byte, 256),
+		ConnectedHandles: make([]func(), 0),
+		StopHandles:      make([]func(), 0),
+		RTPHandles:       make([]func(*RTPPack), 0),
+	}
+	session.dtls = newDTLSConn(rtcServer.certificate, session.packets, session.writePacket, WEBRTC_SESSION_TIMEOUT)
+	session.logger = log.New(os.Stdout, fmt.Sprintf("[webrtc %v:%s, path: %s]", sessionType, session.ID, path), log.LstdFlags|log.Lshortfile)
+	if !utils.Debug {
+		session.logger.SetOutput(utils.GetLogWriter())
+	}
+	return session
+}
+
+//ice-pwd是stun MESSAGE-INTEGRITY的密钥，必须使用crypto/rand
+func randomICEString(length int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	buf := make([]byte, 0, length)
+	random := make([]byte, length)
+	for len(buf) < length {
+		if _, err := cryptorand.Read(random); err != nil {
+			panic(err)
+		}
+		for _, v := range random {
+			//丢弃248及以上的值，保证每个字符概率相同
+			if int(v) < 256/len(letters)*len(letters) && len(buf) < length {
+				buf = append(buf, letters[int(v)%len(letters)])
+			}
+		}
+	}
+	return string(buf)
+}
+
+func (session *WebRTCSession) ToWebHookInfo(actionType WebHookActionType) *WebHookInfo {
+	return NewWebHookInfo(actionType, session.ID, session.Type, session.TransType, session.URL, session.Path, session.SDPRaw, session.ClientAddr)
+}
+
+//根据offer生成answer，selectFormat返回nil表示拒绝该媒体
+func (session *WebRTCSession) Answer(offerRaw string, direction string, selectFormat func(media *sdp.Media) *sdp.Format) (answerRaw string, err error) {
+	offer, err := sdp.ParseString(offerRaw)
+	if err != nil {
+		return
+	}
+	session.SDPRaw = offerRaw
+	answer := &sdp.Session{
+		Origin:     &sdp.Origin{Username: "-", SessionID: time.Now().UnixNano(), SessionVersion: 2, Network: sdp.NetworkInternet, Type: sdp.TypeIPv4, Address: "127.0.0.1"},
+		Name:       "EasyDarwin",
+		Attributes: sdp.Attributes{sdp.NewAttrFlag("ice-lite")},
+	}
+	bundle := make([]string, 0)
+	for _, media := range offer.Media {
+		mid := media.Attributes.Get("mid")
+		answerMedia := &sdp.Media{
+			Type:       media.Type,
+			Port:       9,
+			Proto:      media.Proto,
+			Connection: []*sdp.Connection{{Network: sdp.NetworkInternet, Type: sdp.TypeIPv4, Address: "0.0.0.0"}},
+		}
+		var format *sdp.Format
+		if media.Type == "audio" || media.Type == "video" {
+			format = selectFormat(media)
+		}
+		if format == nil {
+			answerMedia.Port = 0
+			answerMedia.Mode = sdp.Inactive
+			answerMedia.FormatDescr = media.FormatDescr
+			if len(media.Format) > 0 {
+				answerMedia.Format = []*sdp.Format{{Payload: media.Format[0].Payload}}
+			}
+			answerMedia.Attributes = sdp.Attributes{sdp.NewAttr("mid", mid)}
+			answer.Media = append(answer.Media, answerMedia)
+			continue
+		}
+		//本端只作为dtls服务端
+		setup := media.Attributes.Get("setup")
+		if setup == "" {
+			setup = offer.Attributes.Get("setup")
+		}
+		if setup == "passive" {
+			return "", fmt.Errorf("offer dtls setup:passive not supported")
+		}
+		//bundle后所有媒体使用同一个dtls连接
+		if session.dtls.RemoteFingerprint == nil {
+			value := media.Attributes.Get("fingerprint")
+			if value == "" {
+				value = offer.Attributes.Get("fingerprint")
+			}
+			if value == "" {
+				return "", fmt.Errorf("offer without a=fingerprint")
+			}
+			if session.dtls.RemoteFingerprint, err = parseDTLSFingerprint(value); err != nil {
+				return "", err
+			}
+		}
+		track := &webrtcTrack{
+			Kind:        media.Type,
+			Mid:         mid,
+			PayloadType: format.Payload,
+			Codec:       normalizeCodecName(format.Name),
+			ClockRate:   format.ClockRate,
+			Channels:    format.Channels,
+			Params:      format.Params,
+			SSRC:        rand.Uint32(),
+			seq:         uint16(rand.Uint32()),
+		}
+		session.Tracks = append(session.Tracks, track)
+		answerMedia.Format = []*sdp.Format{{Payload: format.Payload, Name: format.Name, ClockRate: format.ClockRate, Channels: format.Channels, Params: format.Params}}
+		if direction == sdp.RecvOnly {
+			answerMedia.Format[0].Feedback = receiverFeedback(format.Feedback)
+		}
+		answerMedia.Mode = direction
+		answerMedia.Attributes = sdp.Attributes{
+			sdp.NewAttr("mid", mid),
+			sdp.NewAttr("ice-ufrag", session.localUfrag),
+			sdp.NewAttr("ice-pwd", session.localPwd),
+			sdp.NewAttr("fingerprint", "sha-256 "+session.rtcServer.certificate.Fingerprint),
+			sdp.NewAttr("setup", "passive"),
+			sdp.NewAttrFlag("rtcp-mux"),
+		}
+		if direction == sdp.SendOnly {
+			answerMedia.Attributes = append(answerMedia.Attributes,
+				sdp.NewAttr("msid", "EasyDarwin "+media.Type),
+				sdp.NewAttr("ssrc", fmt.Sprintf("%d cname:EasyDarwin", track.SSRC)))
+		}
+		for i, ip := range session.rtcServer.CandidateIPs {
+			answerMedia.Attributes = append(answerMedia.Attributes,
+				sdp.NewAttr("candidate", fmt.Sprintf("%d 1 udp %d %s %d typ host", i+1, 2130706431-i, ip, session.rtcServer.UDPPort)))
+		}
+		answerMedia.Attributes = append(answerMedia.Attributes, sdp.NewAttrFlag("end-of-candidates"))
+		answer.Media = append(answer.Media, answerMedia)
+		bundle = append(bundle, mid)
+	}
+	if len(session.Tracks) == 0 {
+		return "", fmt.Errorf("no supported media in offer")
+	}
+	answer.Attributes = append(answer.Attributes, sdp.NewAttr("group", "BUNDLE "+strings.Join(bundle, " ")))
+	return answer.String(), nil
+}
+
+//接收端只支持pli、fir及remb反馈
+func receiverFeedback(offered []string) []string {
+	feedback := make([]string, 0)
+	for _, fb := range offered {
+		switch fb {
+		case "nack pli", "ccm fir", "goog-remb":
+			feedback = append(feedback, fb)
+		}
+	}
+	return feedback
+}
+
+func (session *WebRTCSession) Track(kind string) *webrtcTrack {
+	for _, track := range session.Tracks {
+		if track.Kind == kind {
+			return track
+		}
+	}
+	return nil
+}
+
+//stun检查通过后更新对端地址，地址变化时返回true
+func (session *WebRTCSession) SetRemoteAddr(addr *net.UDPAddr) bool {
+	session.addrLock.Lock()
+	defer session.addrLock.Unlock()
+	session.lastSeen = time.Now()
+	if session.remoteAddr != nil && session.remoteAddr.String() == addr.String() {
+		return false
+	}
+	session.remoteAddr = addr
+	return true
+}
+
+func (session *WebRTCSession) RemoteAddr() (*net.UDPAddr, time.Time) {
+	session.addrLock.RLock()
+	defer session.addrLock.RUnlock()
+	return session.remoteAddr, session.lastSeen
+}
+
+func (session *WebRTCSession) writePacket(data []byte) error {
+	addr, _ := session.RemoteAddr()
+	if addr == nil {
+		return fmt.Errorf("webrtc remote address unknown")
+	}
+	_, err := session.rtcServer.WriteTo(data, addr)
+	return err
+}
+
+//加密后发送rtp包
+func (session *WebRTCSession) WriteRTP(packet []byte) error {
+	return session.writeProtected(packet, false)
+}
+
+//加密后发送rtcp包
+func (session *WebRTCSession) WriteRTCP(packet []byte) error {
+	return session.writeProtected(packet, true)
+}
+
+func (session *WebRTCSession) writeProtected(packet []byte, rtcp bool) (err error) {
+	if !session.connected || session.Stoped {
+		return
+	}
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	var out []byte
+	if rtcp {
+		out, err = session.srtp.ProtectRTCP(packet)
+	} else {
+		out, err = session.srtp.ProtectRTP(packet)
+	}
+	if err != nil {
+		return
+	}
+	if err = session.writePacket(out); err == nil {
+		session.OutBytes += len(out)
+	}
+	return
+}
+
+func (session *WebRTCSession) QueuePacket(data []byte) {
+	session.stopLock.Lock()
+	defer session.stopLock.Unlock()
+	if session.Stoped {
+		return
+	}
+	session.InBytes += len(data)
+	select {
+	case session.packets <- data:
+	default:
+	}
+}
+
+func (session *WebRTCSession) Start() {
+	defer session.Stop()
+	logger := session.logger
+	if err := session.dtls.Handshake(); err != nil {
+		logger.Printf("%v dtls handshake error:%v", session, err)
+		return
+	}
+	localKey, localSalt, remoteKey, remoteSalt := session.dtls.ExportSRTPKeys()
+	srtp, err := newSRTPContext(localKey, localSalt)
+	if err != nil {
+		logger.Printf("%v create srtp context error:%v", session, err)
+		return
+	}
+	remoteSRTP, err := newSRTPContext(remoteKey, remoteSalt)
+	if err != nil {
+		logger.Printf("%v create srtp context error:%v", session, err)
+		return
+	}
+	session.srtp = srtp
+	session.remoteSRTP = remoteSRTP
+	session.connected = true
+	logger.Printf("%v connected", session)
+	for _, h := range session.ConnectedHandles {
+		h()
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	feedbackTicker := time.NewTicker(WEBRTC_FEEDBACK_INTERVAL)
+	defer feedbackTicker.Stop()
+	for !session.Stoped {
+		select {
+		case data, ok := <-session.packets:
+			if !ok {
+				return
+			}
+			if isDTLSPacket(data) {
+				closed, err := session.dtls.HandlePacket(data)
+				if closed {
+					logger.Printf("%v closed by remote", session)
+					return
+				}
+				if err != nil {
+					logger.Printf("%v dtls error:%v", session, err)
+				}
+			} else if session.Type == SESSION_TYPE_PUSHER && isRTPPacket(data) {
+				session.handleRTP(data)
+			} else if session.Type == SESSION_TYPE_PUSHER {
+				session.handleRTCP(data)
+			}
+		case <-feedbackTicker.C:
+			if session.Type == SESSION_TYPE_PUSHER {
+				session.sendFeedback()
+			}
+		case <-ticker.C:
+			if _, lastSeen := session.RemoteAddr(); time.Since(lastSeen) > WEBRTC_SESSION_TIMEOUT {
+				logger.Printf("%v ice consent timeout", session)
+				return
+			}
+		}
+	}
+}
+
+//rfc5761 rtcp-mux时根据payload type区分rtp与rtcp
+func isRTPPacket(data []byte) bool {
+	return len(data) >= RTP_FIXED_HEADER_LENGTH && data[0]>>6 == 2 && (data[1] < 192 || data[1] > 223)
+}
+
+//解密推流端的rtp包并交给pusher
+func (session *WebRTCSession) handleRTP(data []byte) {
+	packet, err := session.remoteSRTP.UnprotectRTP(data)
+	if err != nil {
+		return
+	}
+	payloadType := packet[1] & 0x7f
+	for _, track := range session.Tracks {
+		if track.PayloadType != payloadType {
+			continue
+		}
+		track.remoteSSRC = binary.BigEndian.Uint32(packet[8:])
+		//丢弃带宽探测用的纯padding包
+		if ParseRTP(packet) == nil {
+			return
+		}
+		pack := &RTPPack{Type: RTP_TYPE_VIDEO, Buffer: bytes.NewBuffer(packet)}
+		if track.Kind == "audio" {
+			pack.Type = RTP_TYPE_AUDIO
+		}
+		for _, h := range session.RTPHandles {
+			h(pack)
+		}
+		return
+	}
+}
+
+//解密推流端的rtcp，按发送者ssrc区分音视频
+func (session *WebRTCSession) handleRTCP(data []byte) {
+	packet, err := session.remoteSRTP.UnprotectRTCP(data)
+	if err != nil {
+		return
+	}
+	ssrc := binary.BigEndian.Uint32(packet[4:])
+	for _, track := range session.Tracks {
+		if track.remoteSSRC == 0 || track.remoteSSRC != ssrc {
+			continue
+		}
+		pack := &RTPPack{Type: RTP_TYPE_VIDEOCONTROL, Buffer: bytes.NewBuffer(packet)}
+		if track.Kind == "audio" {
+			pack.Type = RTP_TYPE_AUDIOCONTROL
+		}
+		for _, h := range session.RTPHandles {
+			h(pack)
+		}
+		return
+	}
+}
+
+//发送空RR、PLI及REMB，浏览器默认不会周期性发送关键帧
+func (session *WebRTCSession) sendFeedback() {
+	packet := make([]byte, 8, 64)
+	packet[0], packet[1] = 0x80, 201
+	binary.BigEndian.PutUint16(packet[2:], 1)
+	binary.BigEndian.PutUint32(packet[4:], session.rtcpSSRC)
+	ssrcs := make([]uint32, 0)
+	for _, track := range session.Tracks {
+		if track.remoteSSRC == 0 {
+			continue
+		}
+		ssrcs = append(ssrcs, track.remoteSSRC)
+		if track.Kind == "video" {
+			pli := make([]byte, 12)
+			pli[0], pli[1] = 0x81, 206
+			binary.BigEndian.PutUint16(pli[2:], 2)
+			binary.BigEndian.PutUint32(pli[4:], session.rtcpSSRC)
+			binary.BigEndian.PutUint32(pli[8:], track.remoteSSRC)
+			packet = append(packet, pli...)
+		}
+	}
+	if len(ssrcs) == 0 {
+		return
+	}
+	//draft-alvestrand-rmcat-remb
+	mantissa, exp := uint32(WEBRTC_REMB_BITRATE), uint32(0)
+	for mantissa > 0x3ffff {
+		mantissa >>= 1
+		exp++
+	}
+	remb := make([]byte, 20, 20+4*len(ssrcs))
+	remb[0], remb[1] = 0x8f, 206
+	binary.BigEndian.PutUint16(remb[2:], uint16(4+len(ssrcs)))
+	binary.BigEndian.PutUint32(remb[4:], session.rtcpSSRC)
+	copy(remb[12:], "REMB")
+	binary.BigEndian.PutUint32(remb[16:], uint32(len(ssrcs))<<24|exp<<18|mantissa)
+	for _, ssrc := range ssrcs {
+		remb = append(remb, byte(ssrc>>24), byte(ssrc>>16), byte(ssrc>>8), byte(ssrc))
+	}
+	packet = append(packet, remb...)
+	if err := session.WriteRTCP(packet); err != nil {
+		session.logger.Printf("%v send rtcp error:%v", session, err)
+	}
+}
+
+func (session *WebRTCSession) Stop() {
+	session.stopLock.Lock()
+	if session.Stoped {
+		session.stopLock.Unlock()
+		return
+	}
+	session.Stoped = true
+	close(session.packets)
+	session.stopLock.Unlock()
+	if session.Type == SESSEION_TYPE_PLAYER {
+		go session.ToWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+	} else {
+		go session.ToWebHookInfo(ON_TEARDOWN).ExecuteWebHookNotify()
+	}
+	session.writeLock.Lock()
+	session.dtls.Close()
+	session.writeLock.Unlock()
+	session.rtcServer.RemoveSession(session)
+	for _, h := range session.StopHandles {
+		h()
+	}
+}
@@ -0,0 +1,338 @@
+package rtsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+const (
+	SRTP_AUTH_TAG_LENGTH  = 10
+	SRTCP_INDEX_LENGTH    = 4
+	RTCP_FIXED_HEADER_LEN = 8
+	//rfc3711 3.3.2 重放窗口最小为64
+	SRTP_REPLAY_WINDOW = 64
+
+	srtpLabelEncryption  = 0x00
+	srtpLabelAuth        = 0x01
+	srtpLabelSalt        = 0x02
+	srtcpLabelEncryption = 0x03
+	srtcpLabelAuth       = 0x04
+	srtcpLabelSalt       = 0x05
+)
+
+//单个ssrc的rollover counter
+type srtpStream struct {
+	started bool
+	roc     uint32
+	lastSeq uint16
+	replay  srtpReplayWindow
+}
+
+//rfc3711 3.3.2 记录最近SRTP_REPLAY_WINDOW个已收到的index，丢弃重复及过旧的包
+type srtpReplayWindow struct {
+	started  bool
+	maxIndex uint64
+	bitmap   uint64 //第i位表示maxIndex-i是否已收到
+}
+
+func (window *srtpReplayWindow) Check(index uint64) error {
+	if !window.started || index > window.maxIndex {
+		return nil
+	}
+	delta := window.maxIndex - index
+	if delta >= SRTP_REPLAY_WINDOW {
+		return fmt.Errorf("srtp index %d too old", index)
+	}
+	if window.bitmap&(1<<delta) != 0 {
+		return fmt.Errorf("srtp index %d replayed", index)
+	}
+	return nil
+}
+
+//认证通过后记录index
+func (window *srtpReplayWindow) Update(index uint64) {
+	if window.started && index <= window.maxIndex {
+		window.bitmap |= 1 << (window.maxIndex - index)
+		return
+	}
+	if shift := index - window.maxIndex; !window.started || shift >= SRTP_REPLAY_WINDOW {
+		window.bitmap = 0
+	} else {
+		window.bitmap <<= shift
+	}
+	window.bitmap |= 1
+	window.maxIndex = index
+	window.started = true
+}
+
+//rfc3711 AES_CM_128_HMAC_SHA1_80
+//同一密钥收发共用一个上下文时，roc及重放状态都按ssrc区分，需加锁
+type srtpContext struct {
+	lock    sync.Mutex
+	block   cipher.Block
+	salt    []byte
+	auth    hash.Hash
+	streams map[uint32]*srtpStream
+
+	rtcpBlock cipher.Block
+	rtcpSalt  []byte
+	rtcpAuth  hash.Hash
+	rtcpIndex uint32
+	//接收端每个ssrc的srtcp重放窗口
+	rtcpReplay map[uint32]*srtpReplayWindow
+	//本端发送过的ssrc，收到时丢弃，避免发出的包被反射回来
+	localSSRC map[uint32]bool
+}
+
+//rfc3711 4.3 由master key和master salt派生会话密钥
+func srtpDeriveKey(masterKey, masterSalt []byte, label byte, length int) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, masterSalt)
+	iv[7] ^= label
+	out := make([]byte, length)
+	cipher.NewCTR(block, iv).XORKeyStream(out, out)
+	return out, nil
+}
+
+//派生加密、认证、salt三组会话密钥
+func srtpSessionKeys(masterKey, masterSalt []byte, labelBase byte) (block cipher.Block, auth hash.Hash, salt []byte, err error) {
+	sessionKey, err := srtpDeriveKey(masterKey, masterSalt, labelBase, 16)
+	if err != nil {
+		return
+	}
+	sessionAuth, err := srtpDeriveKey(masterKey, masterSalt, labelBase+1, 20)
+	if err != nil {
+		return
+	}
+	if salt, err = srtpDeriveKey(masterKey, masterSalt, labelBase+2, 14); err != nil {
+		return
+	}
+	if block, err = aes.NewCipher(sessionKey); err != nil {
+		return
+	}
+	return block, hmac.New(sha1.New, sessionAuth), salt, nil
+}
+
+func newSRTPContext(masterKey, masterSalt []byte) (ctx *srtpContext, err error) {
+	ctx = &srtpContext{streams: make(map[uint32]*srtpStream), rtcpReplay: make(map[uint32]*srtpReplayWindow), localSSRC: make(map[uint32]bool)}
+	if ctx.block, ctx.auth, ctx.salt, err = srtpSessionKeys(masterKey, masterSalt, srtpLabelEncryption); err != nil {
+		return nil, err
+	}
+	if ctx.rtcpBlock, ctx.rtcpAuth, ctx.rtcpSalt, err = srtpSessionKeys(masterKey, masterSalt, srtcpLabelEncryption); err != nil {
+		return nil, err
+	}
+	return
+}
+
+//更新并返回发送包的roc
+func (ctx *srtpContext) rolloverCounter(ssrc uint32, seq uint16) uint32 {
+	stream, ok := ctx.streams[ssrc]
+	if !ok {
+		stream = &srtpStream{}
+		ctx.streams[ssrc] = stream
+	}
+	if !stream.started {
+		stream.started = true
+	} else if int16(seq-stream.lastSeq) < 0 {
+		//重传的旧包不更新状态
+		if seq > stream.lastSeq && stream.roc > 0 {
+			return stream.roc - 1
+		}
+		return stream.roc
+	} else if seq < stream.lastSeq {
+		stream.roc++
+	}
+	stream.lastSeq = seq
+	return stream.roc
+}
+
+//iv = salt*2^16 ^ ssrc*2^64 ^ index*2^16，srtp的index为roc<<16|seq，srtcp为31位包序号
+func srtpCounter(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:], ssrc)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= buf[i]
+	}
+	binary.BigEndian.PutUint64(buf[:], index<<16)
+	for i := 0; i < 8; i++ {
+		iv[8+i] ^= buf[i]
+	}
+	return iv
+}
+
+func (ctx *srtpContext) counter(ssrc uint32, roc uint32, seq uint16) []byte {
+	return srtpCounter(ctx.salt, ssrc, uint64(roc)<<16|uint64(seq))
+}
+
+func srtpAuthTag(auth hash.Hash, data []byte, trailer uint32) []byte {
+	auth.Reset()
+	auth.Write(data)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], trailer)
+	auth.Write(buf[:])
+	return auth.Sum(nil)[:SRTP_AUTH_TAG_LENGTH]
+}
+
+func (ctx *srtpContext) authTag(data []byte, roc uint32) []byte {
+	return srtpAuthTag(ctx.auth, data, roc)
+}
+
+//加密rtp包，返回新的缓冲区
+func (ctx *srtpContext) ProtectRTP(packet []byte) ([]byte, error) {
+	rtp := ParseRTP(packet)
+	if rtp == nil {
+		return nil, fmt.Errorf("invalid rtp packet")
+	}
+	ssrc, seq := uint32(rtp.SSRC), uint16(rtp.SequenceNumber)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.localSSRC[ssrc] = true
+	roc := ctx.rolloverCounter(ssrc, seq)
+	out := make([]byte, len(packet), len(packet)+SRTP_AUTH_TAG_LENGTH)
+	copy(out, packet[:rtp.PayloadOffset])
+	cipher.NewCTR(ctx.block, ctx.counter(ssrc, roc, seq)).XORKeyStream(out[rtp.PayloadOffset:], packet[rtp.PayloadOffset:])
+	return append(out, ctx.authTag(out, roc)...), nil
+}
+
+//rtp头部长度，padding在加密部分中，解密前不能用ParseRTP
+func rtpHeaderLength(packet []byte) int {
+	if len(packet) < RTP_FIXED_HEADER_LENGTH {
+		return -1
+	}
+	length := RTP_FIXED_HEADER_LENGTH + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < length+4 {
+			return -1
+		}
+		length += 4 + 4*int(binary.BigEndian.Uint16(packet[length+2:]))
+	}
+	if length > len(packet) {
+		return -1
+	}
+	return length
+}
+
+//rfc3711 附录A 根据收到的序号估计roc
+func (ctx *srtpContext) estimateRolloverCounter(ssrc uint32, seq uint16) (stream *srtpStream, roc uint32) {
+	stream, ok := ctx.streams[ssrc]
+	if !ok {
+		//认证通过后才保存
+		stream = &srtpStream{}
+	}
+	if !stream.started {
+		return stream, 0
+	}
+	roc = stream.roc
+	if stream.lastSeq < 0x8000 {
+		if int(seq)-int(stream.lastSeq) > 0x8000 && roc > 0 {
+			roc--
+		}
+	} else if int(stream.lastSeq)-0x8000 > int(seq) {
+		roc++
+	}
+	return
+}
+
+//校验并解密srtp包，返回新的缓冲区
+func (ctx *srtpContext) UnprotectRTP(packet []byte) ([]byte, error) {
+	if len(packet) < RTP_FIXED_HEADER_LENGTH+SRTP_AUTH_TAG_LENGTH {
+		return nil, fmt.Errorf("srtp packet too short")
+	}
+	authenticated := packet[:len(packet)-SRTP_AUTH_TAG_LENGTH]
+	ssrc, seq := binary.BigEndian.Uint32(packet[8:]), binary.BigEndian.Uint16(packet[2:])
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.localSSRC[ssrc] {
+		return nil, fmt.Errorf("srtp ssrc %d is local", ssrc)
+	}
+	stream, roc := ctx.estimateRolloverCounter(ssrc, seq)
+	index := uint64(roc)<<16 | uint64(seq)
+	if err := stream.replay.Check(index); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(ctx.authTag(authenticated, roc), packet[len(authenticated):]) {
+		return nil, fmt.Errorf("srtp auth failed")
+	}
+	headerLen := rtpHeaderLength(authenticated)
+	if headerLen < 0 {
+		return nil, fmt.Errorf("invalid rtp packet")
+	}
+	out := make([]byte, len(authenticated))
+	copy(out, authenticated[:headerLen])
+	cipher.NewCTR(ctx.block, ctx.counter(ssrc, roc, seq)).XORKeyStream(out[headerLen:], authenticated[headerLen:])
+	if !stream.started || roc > stream.roc || roc == stream.roc && seq > stream.lastSeq {
+		stream.started = true
+		stream.roc = roc
+		stream.lastSeq = seq
+	}
+	stream.replay.Update(index)
+	ctx.streams[ssrc] = stream
+	return out, nil
+}
+
+//加密rtcp包，末尾追加E标志与srtcp index
+func (ctx *srtpContext) ProtectRTCP(packet []byte) ([]byte, error) {
+	if len(packet) < RTCP_FIXED_HEADER_LEN {
+		return nil, fmt.Errorf("invalid rtcp packet")
+	}
+	ssrc := binary.BigEndian.Uint32(packet[4:])
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.localSSRC[ssrc] = true
+	index := ctx.rtcpIndex
+	ctx.rtcpIndex = (ctx.rtcpIndex + 1) & 0x7fffffff
+	out := make([]byte, len(packet), len(packet)+SRTCP_INDEX_LENGTH+SRTP_AUTH_TAG_LENGTH)
+	copy(out, packet[:RTCP_FIXED_HEADER_LEN])
+	cipher.NewCTR(ctx.rtcpBlock, srtpCounter(ctx.rtcpSalt, ssrc, uint64(index))).XORKeyStream(out[RTCP_FIXED_HEADER_LEN:], packet[RTCP_FIXED_HEADER_LEN:])
+	trailer := index | 0x80000000
+	tag := srtpAuthTag(ctx.rtcpAuth, out, trailer)
+	out = append(out, byte(trailer>>24), byte(trailer>>16), byte(trailer>>8), byte(trailer))
+	return append(out, tag...), nil
+}
+
+//校验并解密srtcp包
+func (ctx *srtpContext) UnprotectRTCP(packet []byte) ([]byte, error) {
+	if len(packet) < RTCP_FIXED_HEADER_LEN+SRTCP_INDEX_LENGTH+SRTP_AUTH_TAG_LENGTH {
+		return nil, fmt.Errorf("srtcp packet too short")
+	}
+	tagOffset := len(packet) - SRTP_AUTH_TAG_LENGTH
+	indexOffset := tagOffset - SRTCP_INDEX_LENGTH
+	trailer := binary.BigEndian.Uint32(packet[indexOffset:])
+	ssrc, index := binary.BigEndian.Uint32(packet[4:]), uint64(trailer&0x7fffffff)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.localSSRC[ssrc] {
+		return nil, fmt.Errorf("srtcp ssrc %d is local", ssrc)
+	}
+	replay, ok := ctx.rtcpReplay[ssrc]
+	if !ok {
+		replay = &srtpReplayWindow{}
+	}
+	if err := replay.Check(index); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(srtpAuthTag(ctx.rtcpAuth, packet[:indexOffset], trailer), packet[tagOffset:]) {
+		return nil, fmt.Errorf("srtcp auth failed")
+	}
+	//认证通过后才记录ssrc，避免伪造的包占用内存
+	ctx.rtcpReplay[ssrc] = replay
+	replay.Update(index)
+	out := make([]byte, indexOffset)
+	copy(out, packet[:indexOffset])
+	if trailer&0x80000000 != 0 {
+		cipher.NewCTR(ctx.rtcpBlock, srtpCounter(ctx.rtcpSalt, ssrc, index)).XORKeyStream(out[RTCP_FIXED_HEADER_LEN:], packet[RTCP_FIXED_HEADER_LEN:indexOffset])
+	}
+	return out, nil
+}
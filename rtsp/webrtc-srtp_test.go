@@ -0,0 +1,168 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+//rfc3711 附录B.2 密钥派生测试向量
+func TestSRTPDeriveKey(t *testing.T) {
+	masterKey, _ := hex.DecodeString("E1F97A0D3E018BE0D64FA32C06DE4139")
+	masterSalt, _ := hex.DecodeString("0EC675AD498AFEEBB6960B3AABE6")
+	tests := []struct {
+		label    byte
+		length   int
+		expected string
+	}{
+		{srtpLabelEncryption, 16, "C61E7A93744F39EE10734AFE3FF7A087"},
+		{srtpLabelSalt, 14, "30CBBC08863D8C85D49DB34A9AE1"},
+		{srtpLabelAuth, 20, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"},
+	}
+	for _, test := range tests {
+		key, err := srtpDeriveKey(masterKey, masterSalt, test.label, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := strings.ToUpper(hex.EncodeToString(key)); out != test.expected {
+			t.Fatalf("label %d key = %s, want %s", test.label, out, test.expected)
+		}
+	}
+}
+
+func newTestSRTPContexts(t testing.TB) (sender *srtpContext, receiver *srtpContext) {
+	key := newSRTPKey()
+	sender, err := newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func testRTPPacket(ssrc uint32, seq uint16) []byte {
+	packet := []byte{0x80, 96, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5}
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	return packet
+}
+
+func TestSRTPProtectUnprotect(t *testing.T) {
+	sender, receiver := newTestSRTPContexts(t)
+	//跨越序号回绕，验证roc估计
+	for _, seq := range []uint16{0xfffe, 0xffff, 0, 1} {
+		packet := testRTPPacket(1234, seq)
+		protected, err := sender.ProtectRTP(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(protected, packet[12:]) {
+			t.Fatal("payload not encrypted")
+		}
+		out, err := receiver.UnprotectRTP(protected)
+		if err != nil {
+			t.Fatalf("seq %d unprotect error:%v", seq, err)
+		}
+		if !bytes.Equal(out, packet) {
+			t.Fatalf("seq %d = %x, want %x", seq, out, packet)
+		}
+	}
+	//篡改的包认证失败，且不记录ssrc
+	protected, _ := sender.ProtectRTP(testRTPPacket(5678, 1))
+	protected[len(protected)-1] ^= 1
+	if _, err := receiver.UnprotectRTP(protected); err == nil {
+		t.Fatal("tampered packet accepted")
+	}
+	if _, ok := receiver.streams[5678]; ok {
+		t.Fatal("unauthenticated ssrc saved")
+	}
+}
+
+func TestSRTPReplay(t *testing.T) {
+	sender, receiver := newTestSRTPContexts(t)
+	packets := make(map[uint16][]byte)
+	for seq := uint16(1); seq <= 100; seq++ {
+		packets[seq], _ = sender.ProtectRTP(testRTPPacket(1234, seq))
+	}
+	tests := []struct {
+		name    string
+		seq     uint16
+		wantErr string
+	}{
+		{"first", 10, ""},
+		{"duplicate", 10, "replayed"},
+		{"newer", 80, ""},
+		{"reordered in window", 20, ""},
+		{"reordered duplicate", 20, "replayed"},
+		{"window edge", 17, ""},
+		{"too old", 16, "too old"},
+		{"newest duplicate", 80, "replayed"},
+		{"after newest", 81, ""},
+	}
+	for _, test := range tests {
+		_, err := receiver.UnprotectRTP(packets[test.seq])
+		if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Fatalf("%s: seq %d error = %v, want %q", test.name, test.seq, err, test.wantErr)
+		}
+	}
+}
+
+func TestSRTCPReplay(t *testing.T) {
+	sender, receiver := newTestSRTPContexts(t)
+	report := []byte{0x80, 200, 0, 6, 0, 0, 0x04, 0xd2, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24}
+	var packets [][]byte
+	for i := 0; i < 70; i++ {
+		protected, err := sender.ProtectRTCP(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, protected)
+	}
+	out, err := receiver.UnprotectRTCP(packets[0])
+	if err != nil || !bytes.Equal(out, report) {
+		t.Fatalf("unprotect = %x error %v", out, err)
+	}
+	if _, err = receiver.UnprotectRTCP(packets[0]); err == nil {
+		t.Fatal("replayed srtcp accepted")
+	}
+	if _, err = receiver.UnprotectRTCP(packets[69]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = receiver.UnprotectRTCP(packets[5]); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Fatalf("old srtcp error = %v", err)
+	}
+	if _, err = receiver.UnprotectRTCP(packets[6]); err != nil {
+		t.Fatal(err)
+	}
+	//伪造的ssrc不保存重放窗口
+	forged := append([]byte{}, packets[7]...)
+	forged[7] ^= 1
+	if _, err = receiver.UnprotectRTCP(forged); err == nil {
+		t.Fatal("forged srtcp accepted")
+	}
+	if len(receiver.rtcpReplay) != 1 {
+		t.Fatalf("replay windows = %d", len(receiver.rtcpReplay))
+	}
+}
+
+func FuzzSRTPUnprotect(f *testing.F) {
+	sender, _ := newTestSRTPContexts(f)
+	rtp, _ := sender.ProtectRTP(testRTPPacket(1234, 1))
+	rtcp, _ := sender.ProtectRTCP([]byte{0x80, 200, 0, 1, 0, 0, 0x04, 0xd2})
+	f.Add(rtp)
+	f.Add(rtcp)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, receiver := newTestSRTPContexts(t)
+		receiver.UnprotectRTP(data)
+		receiver.UnprotectRTCP(data)
+		//rtpHeaderLength用于解密前，不能越界
+		if length := rtpHeaderLength(data); length > len(data) {
+			t.Fatalf("header length %d > %d", length, len(data))
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package rtsp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	STUN_HEADER_LENGTH   = 20
+	STUN_MAGIC_COOKIE    = 0x2112A442
+	STUN_FINGERPRINT_XOR = 0x5354554e
+
+	STUN_BINDING_REQUEST = 0x0001
+	STUN_BINDING_SUCCESS = 0x0101
+	STUN_BINDING_ERROR   = 0x0111
+
+	STUN_ATTR_USERNAME           = 0x0006
+	STUN_ATTR_MESSAGE_INTEGRITY  = 0x0008
+	STUN_ATTR_ERROR_CODE         = 0x0009
+	STUN_ATTR_XOR_MAPPED_ADDRESS = 0x0020
+	STUN_ATTR_USE_CANDIDATE      = 0x0025
+	STUN_ATTR_FINGERPRINT        = 0x8028
+)
+
+//stun消息，只用于ice-lite的连通性检查
+type stunMessage struct {
+	Type          uint16
+	TransactionID []byte
+	Attributes    map[uint16][]byte
+	raw           []byte
+	//MESSAGE-INTEGRITY属性在消息中的偏移
+	integrityOffset int
+}
+
+//rfc5764 根据首字节区分同一端口上的stun、dtls、rtp/rtcp
+func isSTUNPacket(data []byte) bool {
+	return len(data) >= STUN_HEADER_LENGTH && data[0] < 2 && binary.BigEndian.Uint32(data[4:]) == STUN_MAGIC_COOKIE
+}
+
+func parseSTUNMessage(data []byte) (msg *stunMessage, err error) {
+	if !isSTUNPacket(data) {
+		return nil, fmt.Errorf("not a stun message")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if STUN_HEADER_LENGTH+length > len(data) {
+		return nil, fmt.Errorf("stun message length %d out of range", length)
+	}
+	msg = &stunMessage{
+		Type:            binary.BigEndian.Uint16(data),
+		TransactionID:   data[8:STUN_HEADER_LENGTH],
+		Attributes:      make(map[uint16][]byte),
+		raw:             data[:STUN_HEADER_LENGTH+length],
+		integrityOffset: -1,
+	}
+	offset := STUN_HEADER_LENGTH
+	for offset+4 <= len(msg.raw) {
+		attrType := binary.BigEndian.Uint16(msg.raw[offset:])
+		attrLen := int(binary.BigEndian.Uint16(msg.raw[offset+2:]))
+		if offset+4+attrLen > len(msg.raw) {
+			return nil, fmt.Errorf("stun attribute 0x%04x length %d out of range", attrType, attrLen)
+		}
+		if attrType == STUN_ATTR_MESSAGE_INTEGRITY {
+			msg.integrityOffset = offset
+		}
+		if _, ok := msg.Attributes[attrType]; !ok {
+			msg.Attributes[attrType] = msg.raw[offset+4 : offset+4+attrLen]
+		}
+		offset += 4 + (attrLen+3)/4*4
+	}
+	return
+}
+
+func (msg *stunMessage) Username() string {
+	return string(msg.Attributes[STUN_ATTR_USERNAME])
+}
+
+//校验MESSAGE-INTEGRITY，key为本端ice-pwd
+func (msg *stunMessage) CheckIntegrity(key string) bool {
+	value, ok := msg.Attributes[STUN_ATTR_MESSAGE_INTEGRITY]
+	if !ok || msg.integrityOffset < 0 || len(value) != sha1.Size {
+		return false
+	}
+	buf := make([]byte, msg.integrityOffset)
+	copy(buf, msg.raw[:msg.integrityOffset])
+	binary.BigEndian.PutUint16(buf[2:], uint16(msg.integrityOffset-STUN_HEADER_LENGTH+4+sha1.Size))
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write(buf)
+	return hmac.Equal(mac.Sum(nil), value)
+}
+
+type stunWriter struct {
+	buf []byte
+}
+
+func newSTUNWriter(msgType uint16, transactionID []byte) *stunWriter {
+	buf := make([]byte, STUN_HEADER_LENGTH, 128)
+	binary.BigEndian.PutUint16(buf, msgType)
+	binary.BigEndian.PutUint32(buf[4:], STUN_MAGIC_COOKIE)
+	copy(buf[8:], transactionID)
+	return &stunWriter{buf: buf}
+}
+
+func (writer *stunWriter) setLength(length int) {
+	binary.BigEndian.PutUint16(writer.buf[2:], uint16(length))
+}
+
+func (writer *stunWriter) AddAttribute(attrType uint16, value []byte) *stunWriter {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header, attrType)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	writer.buf = append(writer.buf, header...)
+	writer.buf = append(writer.buf, value...)
+	if pad := (4 - len(value)%4) % 4; pad > 0 {
+		writer.buf = append(writer.buf, make([]byte, pad)...)
+	}
+	writer.setLength(len(writer.buf) - STUN_HEADER_LENGTH)
+	return writer
+}
+
+func (writer *stunWriter) AddXORMappedAddress(addr *net.UDPAddr) *stunWriter {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(STUN_MAGIC_COOKIE>>16))
+	//ipv4与magic cookie异或，ipv6与magic cookie+transaction id异或
+	xorKey := writer.buf[4:STUN_HEADER_LENGTH]
+	for i := range ip {
+		value[4+i] = ip[i] ^ xorKey[i]
+	}
+	return writer.AddAttribute(STUN_ATTR_XOR_MAPPED_ADDRESS, value)
+}
+
+func (writer *stunWriter) AddMessageIntegrity(key string) *stunWriter {
+	writer.setLength(len(writer.buf) - STUN_HEADER_LENGTH + 4 + sha1.Size)
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write(writer.buf)
+	return writer.AddAttribute(STUN_ATTR_MESSAGE_INTEGRITY, mac.Sum(nil))
+}
+
+func (writer *stunWriter) AddFingerprint() *stunWriter {
+	writer.setLength(len(writer.buf) - STUN_HEADER_LENGTH + 8)
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, crc32.ChecksumIEEE(writer.buf)^STUN_FINGERPRINT_XOR)
+	return writer.AddAttribute(STUN_ATTR_FINGERPRINT, value)
+}
+
+func (writer *stunWriter) Bytes() []byte {
+	return writer.buf
+}
+
+//ice-lite只响应binding请求
+func newSTUNBindingSuccess(request *stunMessage, addr *net.UDPAddr, pwd string) []byte {
+	return newSTUNWriter(STUN_BINDING_SUCCESS, request.TransactionID).
+		AddXORMappedAddress(addr).
+		AddMessageIntegrity(pwd).
+		AddFingerprint().
+		Bytes()
+}
+
+func newSTUNBindingError(request *stunMessage, code int, reason string) []byte {
+	value := append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...)
+	return newSTUNWriter(STUN_BINDING_ERROR, request.TransactionID).
+		AddAttribute(STUN_ATTR_ERROR_CODE, value).
+		AddFingerprint().
+		Bytes()
+}
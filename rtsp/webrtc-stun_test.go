@@ -0,0 +1,101 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+)
+
+//rfc5769 2.1 Sample Request，密码为VOkJxbRl1RmTxUk/WvJxBt
+var stunSampleRequest, _ = hex.DecodeString(strings.Join([]string{
+	"000100582112a442b7e7a701bc34d686fa87dfae",
+	"802200105354554e207465737420636c69656e74",
+	"002400046e0001ff",
+	"80290008932ff9b151263b36",
+	"000600096576746a3a68367659202020",
+	"000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a2",
+	"80280004e57a3bcf",
+}, ""))
+
+func TestSTUNSampleRequest(t *testing.T) {
+	msg, err := parseSTUNMessage(stunSampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != STUN_BINDING_REQUEST || msg.Username() != "evtj:h6vY" {
+		t.Fatalf("type = %x username = %q", msg.Type, msg.Username())
+	}
+	if !msg.CheckIntegrity("VOkJxbRl1RmTxUk/WvJxBt") {
+		t.Fatal("message integrity check failed")
+	}
+	if msg.CheckIntegrity("VOkJxbRl1RmTxUk/WvJxBu") {
+		t.Fatal("message integrity check passed with wrong password")
+	}
+	fingerprintOffset := len(stunSampleRequest) - 8
+	crc := crc32.ChecksumIEEE(stunSampleRequest[:fingerprintOffset]) ^ STUN_FINGERPRINT_XOR
+	if crc != binary.BigEndian.Uint32(msg.Attributes[STUN_ATTR_FINGERPRINT]) {
+		t.Fatalf("fingerprint = %08x", crc)
+	}
+}
+
+func TestSTUNBindingSuccess(t *testing.T) {
+	request, _ := parseSTUNMessage(stunSampleRequest)
+	//rfc5769 2.2 192.0.2.1:32853
+	response := newSTUNBindingSuccess(request, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853}, "VOkJxbRl1RmTxUk/WvJxBt")
+	msg, err := parseSTUNMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != STUN_BINDING_SUCCESS || !bytes.Equal(msg.TransactionID, request.TransactionID) {
+		t.Fatalf("type = %x transaction id = %x", msg.Type, msg.TransactionID)
+	}
+	if address := hex.EncodeToString(msg.Attributes[STUN_ATTR_XOR_MAPPED_ADDRESS]); address != "0001a147e112a643" {
+		t.Fatalf("xor mapped address = %s", address)
+	}
+	if !msg.CheckIntegrity("VOkJxbRl1RmTxUk/WvJxBt") {
+		t.Fatal("message integrity check failed")
+	}
+	crc := crc32.ChecksumIEEE(response[:len(response)-8]) ^ STUN_FINGERPRINT_XOR
+	if crc != binary.BigEndian.Uint32(msg.Attributes[STUN_ATTR_FINGERPRINT]) {
+		t.Fatalf("fingerprint = %08x", crc)
+	}
+}
+
+func TestParseSTUNMessageError(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short", stunSampleRequest[:19]},
+		{"bad magic cookie", append([]byte{0, 1, 0, 0, 0x21, 0x12, 0xa4, 0x43}, make([]byte, 12)...)},
+		{"length out of range", stunSampleRequest[:len(stunSampleRequest)-4]},
+		{"attribute out of range", append(append([]byte{0, 1, 0, 8}, stunSampleRequest[4:20]...), 0, 6, 0, 9, 'a', 'b', 'c', 'd')},
+		{"rtp", []byte{0x80, 0x60, 0, 1, 0x21, 0x12, 0xa4, 0x42, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseSTUNMessage(test.data); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func FuzzSTUNParse(f *testing.F) {
+	f.Add(stunSampleRequest)
+	f.Add(newSTUNWriter(STUN_BINDING_REQUEST, make([]byte, 12)).AddAttribute(STUN_ATTR_USERNAME, []byte("a:b")).AddMessageIntegrity("pwd").Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := parseSTUNMessage(data)
+		if err != nil {
+			return
+		}
+		msg.Username()
+		msg.CheckIntegrity("pwd")
+		newSTUNBindingSuccess(msg, &net.UDPAddr{IP: net.IPv6loopback, Port: 1}, "pwd")
+		newSTUNBindingError(msg, 401, "Unauthorized")
+	})
+}
@@ -0,0 +1,275 @@
+package rtsp
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pixelbender/go-sdp/sdp"
+)
+
+const WHEP_URL_PREFIX = "/whep"
+
+//webrtc拉流端，转发h264及opus/g711的rtp包
+type WHEPPlayer struct {
+	*mediaPlayerBase
+	session       *WebRTCSession
+	video         *webrtcTrack
+	audio         *webrtcTrack
+	parameterSets [][]byte
+	videoStarted  bool
+	//最近一次发送sps/pps时的rtp时间戳
+	parameterSetTimestamp int
+}
+
+func NewWHEPPlayer(session *WebRTCSession, pusher *Pusher) *WHEPPlayer {
+	player := &WHEPPlayer{
+		mediaPlayerBase:       newMediaPlayerBase(session.ID, TRANS_TYPE_WEBRTC.String(), session.ClientAddr, pusher),
+		session:               session,
+		video:                 session.Track("video"),
+		audio:                 session.Track("audio"),
+		parameterSetTimestamp: -1,
+	}
+	if info, ok := ParseSDP(pusher.SDPRaw())["video"]; ok {
+		player.parameterSets = info.SpropParameterSets
+	}
+	player.StopHandles = append(player.StopHandles, func() {
+		go session.Stop()
+	})
+	session.ConnectedHandles = append(session.ConnectedHandles, func() {
+		go player.Start()
+	})
+	session.StopHandles = append(session.StopHandles, func() {
+		player.Stop()
+		pusher.RemoveMediaPlayer(player)
+	})
+	return player
+}
+
+//判断h264 rtp包是否为关键帧起始、是否包含sps/pps
+func h264PacketInfo(payload []byte) (keyFrame bool, parameterSet bool) {
+	if len(payload) < 1 {
+		return
+	}
+	switch payload[0] & 0x1f {
+	case 5:
+		keyFrame = true
+	case 7, 8:
+		parameterSet = true
+	case 24:
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				break
+			}
+			switch payload[offset] & 0x1f {
+			case 5:
+				keyFrame = true
+			case 7, 8:
+				parameterSet = true
+			}
+			offset += size
+		}
+	case 28:
+		keyFrame = len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	}
+	return
+}
+
+//sdp中的sps/pps打包为STAP-A，很多摄像头只在sdp中携带参数集，浏览器解码需要带内参数集
+func (player *WHEPPlayer) parameterSetPacket(header []byte) []byte {
+	packet := make([]byte, len(header), RTP_MAX_PAYLOAD_SIZE)
+	copy(packet, header)
+	packet[0] &= 0xdf
+	packet[1] &= 0x7f
+	packet = append(packet, 0x78)
+	for _, parameterSet := range player.parameterSets {
+		if len(parameterSet) == 0 {
+			continue
+		}
+		if len(packet)+2+len(parameterSet) > RTP_MAX_PAYLOAD_SIZE {
+			return nil
+		}
+		packet = append(packet, byte(len(parameterSet)>>8), byte(len(parameterSet)))
+		packet = append(packet, parameterSet...)
+	}
+	return packet
+}
+
+func (player *WHEPPlayer) writeRTP(track *webrtcTrack, packet []byte) error {
+	player.outBytes += len(packet)
+	return player.session.WriteRTP(track.Rewrite(packet))
+}
+
+func (player *WHEPPlayer) handleRTP(pack *RTPPack) error {
+	var track *webrtcTrack
+	switch pack.Type {
+	case RTP_TYPE_VIDEO:
+		track = player.video
+	case RTP_TYPE_AUDIO:
+		track = player.audio
+	}
+	if track == nil {
+		return nil
+	}
+	packet := pack.Buffer.Bytes()
+	rtp := ParseRTP(packet)
+	if rtp == nil {
+		return nil
+	}
+	if track == player.video {
+		keyFrame, parameterSet := h264PacketInfo(rtp.Payload)
+		if parameterSet {
+			player.parameterSetTimestamp = rtp.Timestamp
+		}
+		//从关键帧开始发送
+		if !player.videoStarted {
+			if !keyFrame && !parameterSet {
+				return nil
+			}
+			player.videoStarted = true
+		}
+		if keyFrame && player.parameterSetTimestamp != rtp.Timestamp && len(player.parameterSets) > 0 {
+			player.parameterSetTimestamp = rtp.Timestamp
+			if stapA := player.parameterSetPacket(packet[:rtp.PayloadOffset]); stapA != nil {
+				if err := player.writeRTP(track, stapA); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return player.writeRTP(track, packet)
+}
+
+func (player *WHEPPlayer) Start() {
+	player.pusher.AddMediaPlayer(player)
+	player.run(player.handleRTP)
+	player.Stop()
+}
+
+//从offer中选择与推流编码一致的格式
+func selectWHEPFormat(pusher *Pusher, media *sdp.Media) *sdp.Format {
+	switch media.Type {
+	case "video":
+		if normalizeCodecName(pusher.VCodec()) != "h264" {
+			return nil
+		}
+		for _, format := range media.Format {
+			if strings.EqualFold(format.Name, "H264") && strings.Contains(strings.Join(format.Params, ";"), "packetization-mode=1") {
+				return format
+			}
+		}
+	case "audio":
+		codec := normalizeCodecName(pusher.ACodec())
+		if codec != "opus" && codec != "pcma" && codec != "pcmu" {
+			return nil
+		}
+		for _, format := range media.Format {
+			if normalizeCodecName(format.Name) == codec {
+				return format
+			}
+		}
+	}
+	return nil
+}
+
+type WHEPGinHandler struct {
+}
+
+//whep拉流，POST sdp offer，返回answer
+// /whep/{path}
+func (handler WHEPGinHandler) ProcessOffer(c *gin.Context) {
+	server := GetServer()
+	rtcServer := server.webrtcServer
+	if rtcServer == nil || rtcServer.Stoped {
+		c.String(http.StatusServiceUnavailable, "webrtc not enabled")
+		return
+	}
+	if !strings.HasPrefix(c.ContentType(), "application/sdp") {
+		c.String(http.StatusUnsupportedMediaType, "content type must be application/sdp")
+		return
+	}
+	streamInfo := generateHttpStreamInfo(c)
+	//认证通过后才创建会话
+	if !checkHttpStreamAuthorization(c, streamInfo, SESSEION_TYPE_PLAYER) {
+		return
+	}
+	session := NewWebRTCSession(rtcServer, streamInfo.id, SESSEION_TYPE_PLAYER, streamInfo.rtspPath, streamInfo.fullPath, streamInfo.clientAdd)
+	if !session.ToWebHookInfo(ON_PLAY).ExecuteWebHookNotify() {
+		session.ToWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+		c.String(http.StatusForbidden, "server not allow pull stream:%s", session.Path)
+		return
+	}
+	pusher := server.GetPusher(session.Path)
+	if pusher == nil && server.streamNotExistHoldMillisecond != 0 {
+		end := time.Now().Add(server.streamNotExistHoldMillisecond)
+		for pusher == nil && time.Now().Before(end) {
+			time.Sleep(time.Duration(200) * time.Millisecond)
+			pusher = server.GetPusher(session.Path)
+		}
+	}
+	if pusher == nil {
+		session.ToWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+		c.String(http.StatusNotFound, "not found stream:%s", session.Path)
+		return
+	}
+	offer, err := c.GetRawData()
+	if err != nil {
+		session.ToWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+		c.String(http.StatusBadRequest, "%v", err)
+		return
+	}
+	answer, err := session.Answer(string(offer), sdp.SendOnly, func(media *sdp.Media) *sdp.Format {
+		return selectWHEPFormat(pusher, media)
+	})
+	if err != nil {
+		server.logger.Printf("%v negotiate error:%v, pusher sdp:%s", session, err, pusher.SDPRaw())
+		session.ToWebHookInfo(ON_STOP).ExecuteWebHookNotify()
+		c.String(http.StatusNotAcceptable, "%v", err)
+		return
+	}
+	NewWHEPPlayer(session, pusher)
+	rtcServer.AddSession(session)
+	go session.Start()
+	c.Header("Location", session.resourceURL(WHEP_URL_PREFIX))
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+//不支持trickle ice，候选地址已全部包含在answer中
+func (handler WHEPGinHandler) ProcessPatch(c *gin.Context) {
+	c.Status(http.StatusMethodNotAllowed)
+}
+
+//结束会话
+func (handler WHEPGinHandler) ProcessDelete(c *gin.Context) {
+	deleteWebRTCSession(c, SESSEION_TYPE_PLAYER)
+}
+
+//whep/whip资源地址，DELETE时需带上session及token
+func (session *WebRTCSession) resourceURL(prefix string) string {
+	return prefix + session.Path + "?session=" + url.QueryEscape(session.ID) + "&token=" + session.resourceToken
+}
+
+//DELETE whep/whip资源地址，需与创建会话时相同的身份认证，session参数需与路径匹配且token一致
+func deleteWebRTCSession(c *gin.Context, sessionType SessionType) {
+	rtcServer := GetServer().webrtcServer
+	if rtcServer == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !checkHttpStreamAuthorization(c, generateHttpStreamInfo(c), sessionType) {
+		return
+	}
+	session := rtcServer.GetSession(c.Query("session"))
+	if session == nil || session.Type != sessionType || session.Path != mediaStreamPath(c.Request.URL.Path) ||
+		subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(session.resourceToken)) != 1 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	session.Stop()
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,177 @@
+package rtsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bruce-qin/EasyDarwin/models"
+	"github.com/bruce-qin/EasyGoLib/db"
+	"github.com/gin-gonic/gin"
+)
+
+//不监听udp端口的webrtc服务，只用于信令测试
+func newTestWebRTCServer(t *testing.T) *WebRTCServer {
+	server := startTestServer(t)
+	old := server.webrtcServer
+	rtcServer := NewWebRTCServer(server)
+	if rtcServer == nil {
+		t.Fatal("create webrtc server failed")
+	}
+	rtcServer.Stoped = false
+	t.Cleanup(func() {
+		rtcServer.Stop()
+		server.webrtcServer = old
+	})
+	return rtcServer
+}
+
+//开启本地Basic认证，用户admin/admin
+func enableTestBasicAuth(t *testing.T, server *Server) {
+	var count int
+	db.SQLite.Model(models.User{}).Where("username = ?", "admin").Count(&count)
+	if count == 0 {
+		if err := db.SQLite.Create(&models.User{Username: "admin", Password: "admin"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	authorizationType, localAuthorizationEnable := server.authorizationType, server.localAuthorizationEnable
+	server.authorizationType, server.localAuthorizationEnable = BASIC, true
+	t.Cleanup(func() {
+		server.authorizationType, server.localAuthorizationEnable = authorizationType, localAuthorizationEnable
+	})
+}
+
+//浏览器生成的offer，direction为sendonly(whip)或recvonly(whep)
+func testWebRTCOffer(direction string) string {
+	fingerprint := strings.TrimSuffix(strings.Repeat("AB:", 32), ":")
+	return strings.Join([]string{
+		"v=0",
+		"o=- 4611731400430051336 2 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"a=group:BUNDLE 0 1",
+		"a=fingerprint:sha-256 " + fingerprint,
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111 8",
+		"c=IN IP4 0.0.0.0",
+		"a=mid:0",
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:abcdefghijklmnopqrstuvwx",
+		"a=setup:actpass",
+		"a=rtcp-mux",
+		"a=" + direction,
+		"a=rtpmap:111 opus/48000/2",
+		"a=rtpmap:8 PCMA/8000",
+		"m=video 9 UDP/TLS/RTP/SAVPF 102",
+		"c=IN IP4 0.0.0.0",
+		"a=mid:1",
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:abcdefghijklmnopqrstuvwx",
+		"a=setup:actpass",
+		"a=rtcp-mux",
+		"a=" + direction,
+		"a=rtpmap:102 H264/90000",
+		"a=rtcp-fb:102 nack pli",
+		"a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "\r\n") + "\r\n"
+}
+
+func newTestWebRTCRouter() *gin.Engine {
+	router := gin.New()
+	whep := WHEPGinHandler{}
+	router.POST(WHEP_URL_PREFIX+"/*path", whep.ProcessOffer)
+	router.DELETE(WHEP_URL_PREFIX+"/*path", whep.ProcessDelete)
+	whip := WHIPGinHandler{}
+	router.POST(WHIP_URL_PREFIX+"/*path", whip.ProcessOffer)
+	router.DELETE(WHIP_URL_PREFIX+"/*path", whip.ProcessDelete)
+	return router
+}
+
+func serveTestRequest(router http.Handler, method string, target string, body string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/sdp")
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestWHEPOfferAndDelete(t *testing.T) {
+	rtcServer := newTestWebRTCServer(t)
+	server := rtcServer.Server
+	pusher := newTestPusher(t, server, "/live/whep")
+	if !server.AddPusher(pusher) {
+		t.Fatal("add pusher failed")
+	}
+	router := newTestWebRTCRouter()
+	response := serveTestRequest(router, "POST", "/whep/live/whep", testWebRTCOffer("recvonly"), nil)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", response.Code, response.Body.String())
+	}
+	answer := response.Body.String()
+	if !strings.Contains(answer, "a=sendonly") || !strings.Contains(answer, "H264/90000") || !strings.Contains(answer, "PCMA/8000") {
+		t.Fatalf("answer = %s", answer)
+	}
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil || location.Path != "/whep/live/whep" {
+		t.Fatalf("location = %s", response.Header().Get("Location"))
+	}
+	session := rtcServer.GetSession(location.Query().Get("session"))
+	if session == nil || session.Type != SESSEION_TYPE_PLAYER || session.Track("video") == nil || session.Track("audio") == nil {
+		t.Fatalf("session = %v", session)
+	}
+	//只知道session id不能结束会话
+	for _, target := range []string{
+		"/whep/live/whep?session=" + session.ID,
+		"/whep/live/whep?session=" + session.ID + "&token=" + strings.Repeat("a", 32),
+		"/whep/live/other?" + location.RawQuery,
+		"/whip/live/whep?" + location.RawQuery,
+	} {
+		if response = serveTestRequest(router, "DELETE", target, "", nil); response.Code != http.StatusNotFound {
+			t.Fatalf("delete %s status = %d", target, response.Code)
+		}
+	}
+	if session.Stoped {
+		t.Fatal("session stopped without token")
+	}
+	if response = serveTestRequest(router, "DELETE", location.String(), "", nil); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d", response.Code)
+	}
+	if !session.Stoped || rtcServer.GetSession(session.ID) != nil {
+		t.Fatal("session not stopped")
+	}
+}
+
+func TestWHEPUnauthorized(t *testing.T) {
+	rtcServer := newTestWebRTCServer(t)
+	server := rtcServer.Server
+	if !server.AddPusher(newTestPusher(t, server, "/live/whepauth")) {
+		t.Fatal("add pusher failed")
+	}
+	enableTestBasicAuth(t, server)
+	router := newTestWebRTCRouter()
+	response := serveTestRequest(router, "POST", "/whep/live/whepauth", testWebRTCOffer("recvonly"), nil)
+	if response.Code != http.StatusUnauthorized || response.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("status = %d header = %v", response.Code, response.Header())
+	}
+	if len(rtcServer.sessions) != 0 {
+		t.Fatalf("sessions = %d", len(rtcServer.sessions))
+	}
+	auth := map[string]string{"Authorization": "Basic YWRtaW46YWRtaW4="}
+	response = serveTestRequest(router, "POST", "/whep/live/whepauth", testWebRTCOffer("recvonly"), auth)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", response.Code, response.Body.String())
+	}
+	//结束会话同样需要认证
+	location := response.Header().Get("Location")
+	if response = serveTestRequest(router, "DELETE", location, "", nil); response.Code != http.StatusUnauthorized {
+		t.Fatalf("delete without authorization status = %d", response.Code)
+	}
+	if response = serveTestRequest(router, "DELETE", location, "", auth); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d", response.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package rtsp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pixelbender/go-sdp/sdp"
+)
+
+const WHIP_URL_PREFIX = "/whip"
+
+//浏览器推流，视频只接收h264，音频优先opus
+func selectWHIPFormat(media *sdp.Media) *sdp.Format {
+	switch media.Type {
+	case "video":
+		for _, format := range media.Format {
+			if strings.EqualFold(format.Name, "H264") && strings.Contains(strings.Join(format.Params, ";"), "packetization-mode=1") {
+				return format
+			}
+		}
+	case "audio":
+		for _, codec := range []string{"opus", "pcma", "pcmu"} {
+			for _, format := range media.Format {
+				if normalizeCodecName(format.Name) == codec {
+					return format
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//根据协商结果生成pusher的sdp，拉流端按rtsp推流的方式处理
+func (session *WebRTCSession) pusherSDP() string {
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=EasyDarwin WHIP",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=tool:EasyDarwin",
+	}
+	if track := session.Track("video"); track != nil {
+		lines = append(lines,
+			fmt.Sprintf("m=video 0 RTP/AVP %d", track.PayloadType),
+			fmt.Sprintf("a=rtpmap:%d H264/%d", track.PayloadType, track.ClockRate))
+		if len(track.Params) > 0 {
+			lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", track.PayloadType, strings.Join(track.Params, ";")))
+		}
+		lines = append(lines, "a=control:streamid=0")
+		session.VCodec = track.Codec
+		session.VControl = "streamid=0"
+	}
+	if track := session.Track("audio"); track != nil {
+		rtpmap := fmt.Sprintf("a=rtpmap:%d %s/%d", track.PayloadType, strings.ToUpper(track.Codec), track.ClockRate)
+		if track.Codec == "opus" {
+			rtpmap = fmt.Sprintf("a=rtpmap:%d opus/%d/2", track.PayloadType, track.ClockRate)
+		}
+		lines = append(lines, fmt.Sprintf("m=audio 0 RTP/AVP %d", track.PayloadType), rtpmap)
+		if len(track.Params) > 0 {
+			lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", track.PayloadType, strings.Join(track.Params, ";")))
+		}
+		lines = append(lines, "a=control:streamid=1")
+		session.ACodec = track.Codec
+		session.AControl = "streamid=1"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+type WHIPGinHandler struct {
+}
+
+//whip推流，POST sdp offer，返回answer
+// /whip/{path}
+func (handler WHIPGinHandler) ProcessOffer(c *gin.Context) {
+	server := GetServer()
+	rtcServer := server.webrtcServer
+	if rtcServer == nil || rtcServer.Stoped {
+		c.String(http.StatusServiceUnavailable, "webrtc not enabled")
+		return
+	}
+	if !strings.HasPrefix(c.ContentType(), "application/sdp") {
+		c.String(http.StatusUnsupportedMediaType, "content type must be application/sdp")
+		return
+	}
+	streamInfo := generateHttpStreamInfo(c)
+	//认证通过后才创建会话
+	if !checkHttpStreamAuthorization(c, streamInfo, SESSION_TYPE_PUSHER) {
+		return
+	}
+	session := NewWebRTCSession(rtcServer, streamInfo.id, SESSION_TYPE_PUSHER, streamInfo.rtspPath, streamInfo.fullPath, streamInfo.clientAdd)
+	offer, err := c.GetRawData()
+	if err != nil {
+		c.String(http.StatusBadRequest, "%v", err)
+		return
+	}
+	session.SDPRaw = string(offer)
+	if !session.ToWebHookInfo(ON_PUBLISH).ExecuteWebHookNotify() {
+		c.String(http.StatusForbidden, "server not allowed you push stream:%s", session.Path)
+		return
+	}
+	if server.GetPusher(session.Path) != nil {
+		session.ToWebHookInfo(ON_TEARDOWN).ExecuteWebHookNotify()
+		c.String(http.StatusConflict, "stream already publishing:%s", session.Path)
+		return
+	}
+	answer, err := session.Answer(string(offer), sdp.RecvOnly, selectWHIPFormat)
+	if err != nil {
+		server.logger.Printf("%v negotiate error:%v", session, err)
+		session.ToWebHookInfo(ON_TEARDOWN).ExecuteWebHookNotify()
+		c.String(http.StatusNotAcceptable, "%v", err)
+		return
+	}
+	session.SDPRaw = session.pusherSDP()
+	session.logger.Printf("%v video codec[%s] audio codec[%s]", session, session.VCodec, session.ACodec)
+	pusher := NewWebRTCPusher(session)
+	if !server.AddPusher(pusher) {
+		session.logger.Printf("reject pusher.")
+		session.ToWebHookInfo(ON_TEARDOWN).ExecuteWebHookNotify()
+		c.String(http.StatusConflict, "stream already publishing:%s", session.Path)
+		return
+	}
+	rtcServer.AddSession(session)
+	go session.Start()
+	c.Header("Location", session.resourceURL(WHIP_URL_PREFIX))
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+//不支持trickle ice及ice restart
+func (handler WHIPGinHandler) ProcessPatch(c *gin.Context) {
+	c.Status(http.StatusMethodNotAllowed)
+}
+
+//停止推流
+func (handler WHIPGinHandler) ProcessDelete(c *gin.Context) {
+	deleteWebRTCSession(c, SESSION_TYPE_PUSHER)
+}
@@ -0,0 +1,140 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWHIPPublishAndDelete(t *testing.T) {
+	rtcServer := newTestWebRTCServer(t)
+	server := rtcServer.Server
+	router := newTestWebRTCRouter()
+	response := serveTestRequest(router, "POST", "/whip/live/whip", testWebRTCOffer("sendonly"), nil)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", response.Code, response.Body.String())
+	}
+	answer := response.Body.String()
+	if !strings.Contains(answer, "a=recvonly") || !strings.Contains(answer, "H264/90000") || !strings.Contains(answer, "opus/48000") {
+		t.Fatalf("answer = %s", answer)
+	}
+	pusher := server.GetPusher("/live/whip")
+	if pusher == nil || pusher.WebRTCSession == nil {
+		t.Fatal("pusher not added")
+	}
+	if sdp := pusher.SDPRaw(); !strings.Contains(sdp, "a=rtpmap:102 H264/90000") || !strings.Contains(sdp, "a=rtpmap:111 opus/48000/2") {
+		t.Fatalf("pusher sdp = %s", sdp)
+	}
+	//同一路径不能重复推流
+	if response := serveTestRequest(router, "POST", "/whip/live/whip", testWebRTCOffer("sendonly"), nil); response.Code != http.StatusConflict {
+		t.Fatalf("second publish status = %d", response.Code)
+	}
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := rtcServer.GetSession(location.Query().Get("session"))
+	if session == nil || session.Type != SESSION_TYPE_PUSHER {
+		t.Fatalf("session = %v", session)
+	}
+	if response := serveTestRequest(router, "DELETE", "/whip/live/whip?session="+session.ID, "", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("delete without token status = %d", response.Code)
+	}
+	if response := serveTestRequest(router, "DELETE", location.String(), "", nil); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d", response.Code)
+	}
+	if server.GetPusher("/live/whip") != nil || rtcServer.GetSession(session.ID) != nil {
+		t.Fatal("pusher not removed")
+	}
+}
+
+func TestWHIPForwardRTP(t *testing.T) {
+	rtcServer := newTestWebRTCServer(t)
+	router := newTestWebRTCRouter()
+	response := serveTestRequest(router, "POST", "/whip/live/whiprtp", testWebRTCOffer("sendonly"), nil)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", response.Code, response.Body.String())
+	}
+	location, _ := url.Parse(response.Header().Get("Location"))
+	session := rtcServer.GetSession(location.Query().Get("session"))
+	if session == nil {
+		t.Fatal("session not found")
+	}
+	defer session.Stop()
+	key := newSRTPKey()
+	sender, err := newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.remoteSRTP, err = newSRTPContext(key[:SRTP_MASTER_KEY_LENGTH], key[SRTP_MASTER_KEY_LENGTH:]); err != nil {
+		t.Fatal(err)
+	}
+	var packs []*RTPPack
+	session.RTPHandles = append(session.RTPHandles, func(pack *RTPPack) {
+		packs = append(packs, pack)
+	})
+	tests := []struct {
+		payloadType byte
+		ssrc        uint32
+		want        RTPType
+	}{
+		{102, 1111, RTP_TYPE_VIDEO},
+		{111, 2222, RTP_TYPE_AUDIO},
+		//未协商的负载类型丢弃
+		{96, 3333, -1},
+	}
+	for i, test := range tests {
+		packet := newTestH264Pack(uint16(i), 0, []byte{0x41, 0x9a}).Buffer.Bytes()
+		packet[1] = test.payloadType
+		binary.BigEndian.PutUint32(packet[8:], test.ssrc)
+		protected, err := sender.ProtectRTP(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packs = packs[:0]
+		session.handleRTP(protected)
+		if test.want < 0 {
+			if len(packs) != 0 {
+				t.Fatalf("payload type %d forwarded", test.payloadType)
+			}
+			continue
+		}
+		if len(packs) != 1 || packs[0].Type != test.want || packs[0].Buffer.Len() != len(packet) {
+			t.Fatalf("payload type %d packs = %v", test.payloadType, packs)
+		}
+	}
+	if session.Track("video").remoteSSRC != 1111 || session.Track("audio").remoteSSRC != 2222 {
+		t.Fatal("remote ssrc not recorded")
+	}
+}
+
+func TestWHIPUnauthorized(t *testing.T) {
+	rtcServer := newTestWebRTCServer(t)
+	server := rtcServer.Server
+	enableTestBasicAuth(t, server)
+	router := newTestWebRTCRouter()
+	response := serveTestRequest(router, "POST", "/whip/live/whipauth", testWebRTCOffer("sendonly"), nil)
+	if response.Code != http.StatusUnauthorized || response.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("status = %d header = %v", response.Code, response.Header())
+	}
+	if len(rtcServer.sessions) != 0 || server.GetPusher("/live/whipauth") != nil {
+		t.Fatal("session created without authorization")
+	}
+	auth := map[string]string{"Authorization": "Basic YWRtaW46YWRtaW4="}
+	response = serveTestRequest(router, "POST", "/whip/live/whipauth", testWebRTCOffer("sendonly"), auth)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", response.Code, response.Body.String())
+	}
+	location := response.Header().Get("Location")
+	if response = serveTestRequest(router, "DELETE", location, "", nil); response.Code != http.StatusUnauthorized {
+		t.Fatalf("delete without authorization status = %d", response.Code)
+	}
+	if response = serveTestRequest(router, "DELETE", location, "", auth); response.Code != http.StatusOK {
+		t.Fatalf("delete status = %d", response.Code)
+	}
+	if server.GetPusher("/live/whipauth") != nil {
+		t.Fatal("pusher not removed")
+	}
+}